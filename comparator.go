@@ -0,0 +1,105 @@
+package main
+
+import "bytes"
+
+/* Comparator defines order of keys in tree. Its name is recorded in 'Meta', so tree can't be opened with comparator other than the one it was created with. Keys for which 'Compare' returns 0 are the same key. */
+type Comparator interface {
+	Name() string
+	Compare(a []byte, b []byte) int
+}
+
+type caseInsensitiveComparator struct{}
+
+type numericComparator struct{}
+
+var (
+	/* CaseInsensitiveComparator orders keys bytewise with ASCII letters folded to lower case. */
+	CaseInsensitiveComparator Comparator = caseInsensitiveComparator{}
+
+	/* NumericComparator orders runs of decimal digits in keys by their values, so that "item2" is less than "item10". Other bytes are ordered bytewise. */
+	NumericComparator Comparator = numericComparator{}
+)
+
+func (caseInsensitiveComparator) Name() string {
+	return "case-insensitive"
+}
+
+func (caseInsensitiveComparator) Compare(a []byte, b []byte) int {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	for i := 0; i < n; i++ {
+		x, y := toLowerASCII(a[i]), toLowerASCII(b[i])
+		if x < y {
+			return -1
+		} else if x > y {
+			return 1
+		}
+	}
+	return len(a) - len(b)
+}
+
+func toLowerASCII(c byte) byte {
+	if (c >= 'A') && (c <= 'Z') {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+func (numericComparator) Name() string {
+	return "numeric"
+}
+
+func (numericComparator) Compare(a []byte, b []byte) int {
+	i, j := 0, 0
+	for (i < len(a)) && (j < len(b)) {
+		if (!isDigit(a[i])) || (!isDigit(b[j])) {
+			if a[i] != b[j] {
+				return int(a[i]) - int(b[j])
+			}
+			i++
+			j++
+			continue
+		}
+
+		/* NOTE(anton2920): leading zeroes are skipped, so longer run of significant digits is greater. */
+		for (i < len(a)-1) && (a[i] == '0') && (isDigit(a[i+1])) {
+			i++
+		}
+		for (j < len(b)-1) && (b[j] == '0') && (isDigit(b[j+1])) {
+			j++
+		}
+		si, sj := i, j
+		for (i < len(a)) && (isDigit(a[i])) {
+			i++
+		}
+		for (j < len(b)) && (isDigit(b[j])) {
+			j++
+		}
+		if i-si != j-sj {
+			return (i - si) - (j - sj)
+		}
+		if res := bytes.Compare(a[si:i], b[sj:j]); res != 0 {
+			return res
+		}
+	}
+	if res := (len(a) - i) - (len(b) - j); res != 0 {
+		return res
+	}
+
+	/* NOTE(anton2920): numbers which differ only in leading zeroes are different keys. */
+	return bytes.Compare(a, b)
+}
+
+func isDigit(c byte) bool {
+	return (c >= '0') && (c <= '9')
+}
+
+/* compare compares keys with tree's comparator. */
+func (t *Tree) compare(a []byte, b []byte) int {
+	if t.Comparator == nil {
+		return bytes.Compare(a, b)
+	}
+	return t.Comparator.Compare(a, b)
+}
@@ -0,0 +1,740 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/anton2920/gofa/errors"
+	"github.com/anton2920/gofa/trace"
+	"github.com/anton2920/gofa/util"
+)
+
+/* Database is a set of tables stored in one pager. Catalog maps names of tables to their trees. */
+type Database struct {
+	sync.Mutex
+	Pager
+
+	Catalog *Tree
+	Tables  map[string]*Table
+}
+
+/* SQLResult is a result of SQL statement. */
+type SQLResult struct {
+	/* Columns are names of columns of 'Rows' returned by SELECT and EXPLAIN. */
+	Columns []string
+	Rows    []Row
+
+	/* Affected is a number of rows inserted, updated or deleted by statement. */
+	Affected int
+}
+
+/* sqlRange is a range of rows which primary keys start with 'Prefix', followed by value between 'Lo' and 'Hi'. */
+type sqlRange struct {
+	Prefix []interface{}
+
+	Lo, Hi                   interface{}
+	LoInclusive, HiInclusive bool
+}
+
+/* DatabaseOpen opens database with catalog at 'index' or creates new one. */
+func DatabaseOpen(pager Pager, index int64) (*Database, error) {
+	defer trace.End(trace.Begin(""))
+
+	catalog, err := GetTreeAt(pager, index)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open catalog: %v", err)
+	}
+	return &Database{Pager: pager, Catalog: catalog, Tables: make(map[string]*Table)}, nil
+}
+
+/* CreateTable creates table 'name' with 'schema'. */
+func (db *Database) CreateTable(name string, schema Schema) (*Table, error) {
+	defer trace.End(trace.Begin(""))
+
+	db.Lock()
+	defer db.Unlock()
+
+	return db.createTable(name, schema)
+}
+
+func (db *Database) createTable(name string, schema Schema) (*Table, error) {
+	if ok, err := db.Catalog.Has([]byte(name)); err != nil {
+		return nil, fmt.Errorf("failed to find table in catalog: %v", err)
+	} else if ok {
+		return nil, fmt.Errorf("table %q already exists", name)
+	}
+
+	tree, err := GetTreeAt(db.Pager, -1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tree: %v", err)
+	}
+	table, err := CreateTable(tree, schema)
+	if err != nil {
+		return nil, err
+	}
+	var meta [8]byte
+	binary.LittleEndian.PutUint64(meta[:], uint64(tree.MetaIndex))
+	if err := db.Catalog.Set([]byte(name), meta[:]); err != nil {
+		return nil, fmt.Errorf("failed to add table to catalog: %v", err)
+	}
+
+	db.Tables[name] = table
+	return table, nil
+}
+
+/* Table returns table 'name', opening it if needed. */
+func (db *Database) Table(name string) (*Table, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	return db.table(name)
+}
+
+func (db *Database) table(name string) (*Table, error) {
+	if table, ok := db.Tables[name]; ok {
+		return table, nil
+	}
+
+	entry, err := db.Catalog.Get([]byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find table in catalog: %v", err)
+	} else if entry == nil {
+		return nil, fmt.Errorf("table %q does not exist", name)
+	}
+
+	tree, err := GetTreeAt(db.Pager, int64(binary.LittleEndian.Uint64(entry)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open tree of table %q: %v", name, err)
+	}
+	table, err := OpenTable(tree)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open table %q: %v", name, err)
+	}
+
+	db.Tables[name] = table
+	return table, nil
+}
+
+/* Exec parses and executes one SQL statement. Failed statement changes nothing, unless pager fails. */
+func (db *Database) Exec(query string) (*SQLResult, error) {
+	defer trace.End(trace.Begin(""))
+
+	stmt, err := ParseSQL(query)
+	if err != nil {
+		return nil, err
+	}
+
+	db.Lock()
+	defer db.Unlock()
+
+	switch stmt := stmt.(type) {
+	default:
+		panic("unknown statement")
+	case *SQLCreateTable:
+		if _, err := db.createTable(stmt.Table, stmt.Schema); err != nil {
+			return nil, err
+		}
+		return &SQLResult{}, nil
+	case *SQLCreateIndex:
+		table, err := db.table(stmt.Table)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := table.CreateColumnIndex(stmt.Column); err != nil {
+			return nil, err
+		}
+		return &SQLResult{}, nil
+	case *SQLInsert:
+		table, err := db.table(stmt.Table)
+		if err != nil {
+			return nil, err
+		}
+		return table.execInsert(stmt)
+	case *SQLSelect:
+		table, err := db.table(stmt.Table)
+		if err != nil {
+			return nil, err
+		}
+		return table.execSelect(stmt)
+	case *SQLUpdate:
+		table, err := db.table(stmt.Table)
+		if err != nil {
+			return nil, err
+		}
+		return table.execUpdate(stmt)
+	case *SQLDelete:
+		table, err := db.table(stmt.Table)
+		if err != nil {
+			return nil, err
+		}
+		return table.execDelete(stmt)
+	case *SQLExplain:
+		return db.explain(stmt)
+	}
+}
+
+func (db *Database) explain(stmt *SQLExplain) (*SQLResult, error) {
+	var name string
+	var where SQLExpr
+
+	switch stmt := stmt.Statement.(type) {
+	default:
+		panic("unknown statement")
+	case *SQLSelect:
+		name, where = stmt.Table, stmt.Where
+	case *SQLUpdate:
+		name, where = stmt.Table, stmt.Where
+	case *SQLDelete:
+		name, where = stmt.Table, stmt.Where
+	}
+
+	table, err := db.table(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := table.sqlCheck(where); err != nil {
+		return nil, err
+	}
+	plan, err := table.sqlPlan(where)
+	if err != nil {
+		return nil, err
+	}
+
+	return table.sqlExplain(name, &plan), nil
+}
+
+func (tb *Table) execInsert(stmt *SQLInsert) (*SQLResult, error) {
+	var result SQLResult
+
+	columns := make([]int, len(tb.Schema.Columns))
+	if stmt.Columns == nil {
+		for i := range columns {
+			columns[i] = i
+		}
+	} else {
+		columns = columns[:0]
+		for _, name := range stmt.Columns {
+			column, err := tb.sqlColumn(name)
+			if err != nil {
+				return nil, err
+			}
+			columns = append(columns, column)
+		}
+	}
+
+	rows := make([]Row, len(stmt.Values))
+	for j, values := range stmt.Values {
+		if len(values) != len(columns) {
+			return nil, fmt.Errorf("expected %d values, got %d", len(columns), len(values))
+		}
+
+		rows[j] = make(Row, len(tb.Schema.Columns))
+		for i, value := range values {
+			column := &tb.Schema.Columns[columns[i]]
+			value, err := sqlCoerce(column.Type, value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value of column %q: %v", column.Name, err)
+			}
+			rows[j][columns[i]] = value
+		}
+	}
+	if err := tb.putRows(rows, false); err != nil {
+		return nil, err
+	}
+	result.Affected = len(rows)
+
+	return &result, nil
+}
+
+func (tb *Table) execSelect(stmt *SQLSelect) (*SQLResult, error) {
+	var result SQLResult
+
+	columns := make([]int, len(tb.Schema.Columns))
+	if stmt.Columns == nil {
+		for i := range columns {
+			columns[i] = i
+		}
+	} else {
+		columns = columns[:0]
+		for _, name := range stmt.Columns {
+			column, err := tb.sqlColumn(name)
+			if err != nil {
+				return nil, err
+			}
+			columns = append(columns, column)
+		}
+	}
+	for _, i := range columns {
+		result.Columns = append(result.Columns, tb.Schema.Columns[i].Name)
+	}
+
+	for i, name := range stmt.OrderBy {
+		if (i >= len(tb.Schema.PrimaryKey)) || (name != tb.Schema.PrimaryKey[i]) {
+			return nil, errors.New("ORDER BY supports only columns of primary key in their order")
+		}
+	}
+	if err := tb.sqlCheck(stmt.Where); err != nil {
+		return nil, err
+	}
+
+	plan, err := tb.sqlPlan(stmt.Where)
+	if err != nil {
+		return nil, err
+	}
+
+	/* NOTE(anton2920): with DESC or rows read through index, limit applies after all rows are read and sorted. */
+	sorted := (plan.Index != nil) && (len(stmt.OrderBy) > 0)
+	var rows []Row
+	err = tb.sqlScanPlan(&plan, stmt.Where, func(row Row) bool {
+		if (!stmt.Desc) && (!sorted) && (stmt.Limit >= 0) && (int64(len(rows)) >= stmt.Limit) {
+			return false
+		}
+		rows = append(rows, row)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if sorted {
+		sort.SliceStable(rows, func(i, j int) bool {
+			for _, k := range tb.Key {
+				if res, _ := sqlCompare(rows[i][k], rows[j][k]); res != 0 {
+					return res < 0
+				}
+			}
+			return false
+		})
+	}
+	if stmt.Desc {
+		for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+			rows[i], rows[j] = rows[j], rows[i]
+		}
+	}
+	if (stmt.Limit >= 0) && (int64(len(rows)) > stmt.Limit) {
+		rows = rows[:stmt.Limit]
+	}
+
+	for _, row := range rows {
+		projected := make(Row, len(columns))
+		for i, column := range columns {
+			projected[i] = row[column]
+		}
+		result.Rows = append(result.Rows, projected)
+	}
+
+	return &result, nil
+}
+
+func (tb *Table) execUpdate(stmt *SQLUpdate) (*SQLResult, error) {
+	var result SQLResult
+
+	values := make(map[int]interface{})
+	for _, assignment := range stmt.Set {
+		i, err := tb.sqlColumn(assignment.Column)
+		if err != nil {
+			return nil, err
+		}
+		if tb.isKey(i) {
+			return nil, fmt.Errorf("primary key column %q can't be updated", assignment.Column)
+		}
+		if values[i], err = sqlCoerce(tb.Schema.Columns[i].Type, assignment.Value); err != nil {
+			return nil, fmt.Errorf("invalid value of column %q: %v", assignment.Column, err)
+		}
+	}
+	if err := tb.sqlCheck(stmt.Where); err != nil {
+		return nil, err
+	}
+
+	plan, err := tb.sqlPlan(stmt.Where)
+	if err != nil {
+		return nil, err
+	}
+
+	/* NOTE(anton2920): table can't be modified while it's scanned, so matching rows are collected first. */
+	var rows []Row
+	err = tb.sqlScanPlan(&plan, stmt.Where, func(row Row) bool {
+		rows = append(rows, row)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		for i, value := range values {
+			row[i] = value
+		}
+	}
+	if err := tb.putRows(rows, true); err != nil {
+		return nil, err
+	}
+	result.Affected = len(rows)
+
+	return &result, nil
+}
+
+func (tb *Table) execDelete(stmt *SQLDelete) (*SQLResult, error) {
+	var result SQLResult
+
+	if err := tb.sqlCheck(stmt.Where); err != nil {
+		return nil, err
+	}
+
+	plan, err := tb.sqlPlan(stmt.Where)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []Row
+	err = tb.sqlScanPlan(&plan, stmt.Where, func(row Row) bool {
+		rows = append(rows, row)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([][]byte, len(rows))
+	for i, row := range rows {
+		if keys[i], _, err = tb.encodeRow(row); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tb.deleteRows(keys); err != nil {
+		return nil, err
+	}
+	result.Affected = len(keys)
+
+	return &result, nil
+}
+
+func (tb *Table) sqlColumn(name string) (int, error) {
+	column := tb.Schema.Column(name)
+	if column == -1 {
+		return -1, fmt.Errorf("column %q does not exist", name)
+	}
+	return column, nil
+}
+
+/* sqlCheck returns error if 'expr' refers to columns which don't exist. */
+func (tb *Table) sqlCheck(expr SQLExpr) error {
+	switch expr := expr.(type) {
+	case SQLBinary:
+		if err := tb.sqlCheck(expr.Left); err != nil {
+			return err
+		}
+		return tb.sqlCheck(expr.Right)
+	case SQLNot:
+		return tb.sqlCheck(expr.X)
+	case SQLColumn:
+		_, err := tb.sqlColumn(expr.Name)
+		return err
+	}
+	return nil
+}
+
+/* sqlEval returns value of 'expr' for 'row'. NULL is unknown, as in SQL. */
+func (tb *Table) sqlEval(expr SQLExpr, row Row) (interface{}, error) {
+	switch expr := expr.(type) {
+	default:
+		panic("unknown expression")
+	case nil:
+		return true, nil
+	case SQLLiteral:
+		return expr.Value, nil
+	case SQLColumn:
+		return row[tb.Schema.Column(expr.Name)], nil
+	case SQLNot:
+		x, err := tb.sqlEval(expr.X, row)
+		if err != nil {
+			return nil, err
+		}
+		if x == nil {
+			return nil, nil
+		}
+		return x == false, nil
+	case SQLBinary:
+		left, err := tb.sqlEval(expr.Left, row)
+		if err != nil {
+			return nil, err
+		}
+		right, err := tb.sqlEval(expr.Right, row)
+		if err != nil {
+			return nil, err
+		}
+
+		switch expr.Op {
+		case "AND":
+			if (left == false) || (right == false) {
+				return false, nil
+			} else if (left == nil) || (right == nil) {
+				return nil, nil
+			}
+			return (left == true) && (right == true), nil
+		case "OR":
+			if (left == true) || (right == true) {
+				return true, nil
+			} else if (left == nil) || (right == nil) {
+				return nil, nil
+			}
+			return false, nil
+		}
+
+		if (left == nil) || (right == nil) {
+			return nil, nil
+		}
+		res, ok := sqlCompare(left, right)
+		if !ok {
+			return nil, fmt.Errorf("can't compare %T and %T", left, right)
+		}
+		switch expr.Op {
+		case "=":
+			return res == 0, nil
+		case "!=":
+			return res != 0, nil
+		case "<":
+			return res < 0, nil
+		case "<=":
+			return res <= 0, nil
+		case ">":
+			return res > 0, nil
+		default:
+			return res >= 0, nil
+		}
+	}
+}
+
+/* sqlRange returns range of rows which may match 'where'. */
+func (tb *Table) sqlRange(where SQLExpr) sqlRange {
+	var r sqlRange
+
+	conjuncts := sqlConjuncts(where)
+	for _, k := range tb.Key {
+		eq := sqlBounds(conjuncts, &tb.Schema.Columns[k], &r)
+		if eq == nil {
+			break
+		}
+		r.Prefix = append(r.Prefix, eq)
+		r.Lo, r.Hi = nil, nil
+	}
+
+	return r
+}
+
+/* sqlConjuncts returns comparisons joined with AND in 'where'. */
+func sqlConjuncts(where SQLExpr) []SQLBinary {
+	var conjuncts []SQLBinary
+
+	var collect func(SQLExpr)
+	collect = func(expr SQLExpr) {
+		if b, ok := expr.(SQLBinary); ok {
+			if b.Op == "AND" {
+				collect(b.Left)
+				collect(b.Right)
+			} else if b.Op != "OR" {
+				conjuncts = append(conjuncts, b)
+			}
+		}
+	}
+	collect(where)
+
+	return conjuncts
+}
+
+/* sqlBounds narrows bounds of 'r' by comparisons of 'column' in 'conjuncts'. It returns constant 'column' is equal to, if any. */
+func sqlBounds(conjuncts []SQLBinary, column *Column, r *sqlRange) interface{} {
+	var eq interface{}
+
+	for _, b := range conjuncts {
+		op, value, ok := sqlColumnComparison(b, column)
+		if (!ok) || (value == nil) {
+			continue
+		}
+
+		switch op {
+		case "=":
+			eq = value
+		case ">", ">=":
+			if res, _ := sqlCompare(value, r.Lo); (r.Lo == nil) || (res > 0) || ((res == 0) && (op == ">")) {
+				r.Lo, r.LoInclusive = value, op == ">="
+			}
+		case "<", "<=":
+			if res, _ := sqlCompare(value, r.Hi); (r.Hi == nil) || (res < 0) || ((res == 0) && (op == "<")) {
+				r.Hi, r.HiInclusive = value, op == "<="
+			}
+		}
+	}
+
+	return eq
+}
+
+/* sqlColumnComparison returns operator and constant of comparison of 'column' with constant. */
+func sqlColumnComparison(b SQLBinary, column *Column) (string, interface{}, bool) {
+	op := b.Op
+	c, ok1 := b.Left.(SQLColumn)
+	l, ok2 := b.Right.(SQLLiteral)
+	if (!ok1) || (!ok2) {
+		/* NOTE(anton2920): constant on the left is moved to the right, so operator is mirrored. */
+		c, ok1 = b.Right.(SQLColumn)
+		l, ok2 = b.Left.(SQLLiteral)
+		switch op {
+		case "<":
+			op = ">"
+		case "<=":
+			op = ">="
+		case ">":
+			op = "<"
+		case ">=":
+			op = "<="
+		}
+	}
+	if (!ok1) || (!ok2) || (c.Name != column.Name) {
+		return "", nil, false
+	}
+
+	value, err := sqlCoerce(column.Type, l.Value)
+	if err != nil {
+		return "", nil, false
+	}
+	return op, value, true
+}
+
+/* sqlScan calls 'fn' for rows in 'r' which match 'where', until it returns false. */
+func (tb *Table) sqlScan(r sqlRange, where SQLExpr, fn func(Row) bool) error {
+	start := r.Prefix
+	if r.Lo != nil {
+		start = append(start[:len(start):len(start)], r.Lo)
+	}
+	it, err := tb.ScanFrom(start...)
+	if err != nil {
+		return err
+	}
+
+	for it.Next() {
+		row := it.Row
+		for i, value := range r.Prefix {
+			if res, _ := sqlCompare(row[tb.Key[i]], value); res != 0 {
+				return nil
+			}
+		}
+		if r.Hi != nil {
+			if res, _ := sqlCompare(row[tb.Key[len(r.Prefix)]], r.Hi); (res > 0) || ((res == 0) && (!r.HiInclusive)) {
+				return nil
+			}
+		}
+
+		match, err := tb.sqlEval(where, row)
+		if err != nil {
+			return err
+		}
+		if (match == true) && (!fn(row)) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+/* sqlCoerce returns constant 'value' converted to type of column 'typ'. */
+func sqlCoerce(typ ColumnType, value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case int64:
+		switch typ {
+		case ColumnTypeUint:
+			if v < 0 {
+				return nil, fmt.Errorf("negative value %d for unsigned column", v)
+			}
+			return uint64(v), nil
+		case ColumnTypeFloat:
+			return float64(v), nil
+		}
+	case string:
+		if typ == ColumnTypeBytes {
+			return []byte(v), nil
+		}
+	}
+	return CheckValue(typ, value)
+}
+
+/* sqlCompare compares values. It returns false, if they can't be compared. */
+func sqlCompare(a interface{}, b interface{}) (int, bool) {
+	switch x := a.(type) {
+	case int64:
+		switch y := b.(type) {
+		case int64:
+			return util.Bool2Int(x > y) - util.Bool2Int(x < y), true
+		case uint64:
+			if x < 0 {
+				return -1, true
+			}
+			return util.Bool2Int(uint64(x) > y) - util.Bool2Int(uint64(x) < y), true
+		case float64:
+			return util.Bool2Int(float64(x) > y) - util.Bool2Int(float64(x) < y), true
+		}
+	case uint64:
+		switch y := b.(type) {
+		case uint64:
+			return util.Bool2Int(x > y) - util.Bool2Int(x < y), true
+		case int64, float64:
+			res, ok := sqlCompare(y, x)
+			return -res, ok
+		}
+	case float64:
+		switch y := b.(type) {
+		case float64:
+			return util.Bool2Int(x > y) - util.Bool2Int(x < y), true
+		case int64, uint64:
+			res, ok := sqlCompare(y, x)
+			return -res, ok
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), true
+		}
+	case []byte:
+		if y, ok := b.([]byte); ok {
+			return bytes.Compare(x, y), true
+		}
+	case bool:
+		if y, ok := b.(bool); ok {
+			return util.Bool2Int(x) - util.Bool2Int(y), true
+		}
+	}
+	return 0, false
+}
+
+/* String formats result as a table with one row per line. */
+func (r *SQLResult) String() string {
+	var buf strings.Builder
+
+	if r.Columns == nil {
+		fmt.Fprintf(&buf, "%d rows affected\n", r.Affected)
+		return buf.String()
+	}
+
+	buf.WriteString(strings.Join(r.Columns, " | "))
+	buf.WriteByte('\n')
+	for _, row := range r.Rows {
+		for i, value := range row {
+			if i > 0 {
+				buf.WriteString(" | ")
+			}
+			switch value := value.(type) {
+			case nil:
+				buf.WriteString("NULL")
+			case []byte:
+				fmt.Fprintf(&buf, "X'%X'", value)
+			default:
+				fmt.Fprint(&buf, value)
+			}
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.String()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+/* Entries of dedup tree are: | reference count (8 bytes) | value tagged with its type |. */
+
+/* dedupTree returns tree which maps hashes of shared values to their pages and reference counts, opening it if needed. */
+func (t *Tree) dedupTree() (*Tree, error) {
+	if t.Dedup == nil {
+		dedup, err := GetTreeAt(t.Pager, t.Meta.DedupMeta)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open dedup tree: %v", err)
+		}
+		t.Dedup = dedup
+	}
+	return t.Dedup, nil
+}
+
+/* findShared returns value with 'hash' and number of keys referencing it. */
+func (t *Tree) findShared(hash [ValueHashSize]byte) ([]byte, int64, error) {
+	dedup, err := t.dedupTree()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	entry, err := dedup.getRaw(hash[:])
+	if (err != nil) || (entry == nil) {
+		return nil, 0, err
+	}
+	entry = ValueGetFull(entry)
+
+	return entry[8:], int64(binary.LittleEndian.Uint64(entry)), nil
+}
+
+/* setShared records that value with 'hash' is referenced by 'refs' keys. Entry is removed when there are no references left. */
+func (t *Tree) setShared(hash [ValueHashSize]byte, v []byte, refs int64) error {
+	dedup, err := t.dedupTree()
+	if err != nil {
+		return err
+	}
+
+	if refs == 0 {
+		err = dedup.del(hash[:])
+	} else {
+		entry := make([]byte, 8+len(v))
+		binary.LittleEndian.PutUint64(entry, uint64(refs))
+		copy(entry[8:], v)
+		err = dedup.set(hash[:], entry, false)
+	}
+	if err == nil {
+		err = dedup.writeMeta()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update dedup tree: %v", err)
+	}
+	return nil
+}
+
+/* reuseShared adds reference to value with 'hash', if it's already stored. */
+func (t *Tree) reuseShared(hash [ValueHashSize]byte) (EncodedValue, bool, error) {
+	v, refs, err := t.findShared(hash)
+	if (err != nil) || (v == nil) {
+		return EncodedValue{}, false, err
+	}
+	if err := t.setShared(hash, v, refs+1); err != nil {
+		return EncodedValue{}, false, err
+	}
+	return EncodeShared(EncodeRaw(v), hash), true, nil
+}
+
+/* putShared records newly stored value 'v' with 'hash' referenced by one key. */
+func (t *Tree) putShared(hash [ValueHashSize]byte, v EncodedValue) (EncodedValue, error) {
+	if err := t.setShared(hash, v.Bytes(), 1); err != nil {
+		return EncodedValue{}, err
+	}
+	return EncodeShared(v, hash), nil
+}
+
+/* releaseShared removes reference to value 'v' with 'hash' and frees its pages, if it was the last one. */
+func (t *Tree) releaseShared(hash [ValueHashSize]byte, v []byte) error {
+	_, refs, err := t.findShared(hash)
+	if err != nil {
+		return err
+	}
+	if refs > 1 {
+		return t.setShared(hash, v, refs-1)
+	}
+
+	if err := t.setShared(hash, nil, 0); err != nil {
+		return err
+	}
+	return t.freeValue(v)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+/* Free is a page which is no longer used by tree. Free pages are linked into list starting at 'Meta.FreeList'. */
+type Free struct {
+	PageHeader
+
+	Next int64
+
+	_ [PageSize - PageHeaderSize - unsafe.Sizeof(int64(0))]byte
+}
+
+/* allocPage takes the first page from free list and returns its index. */
+func (t *Tree) allocPage() (int64, error) {
+	page := t.NewPage()
+
+	index := t.Meta.FreeList
+	if _, err := t.ReadPageAt(page, index); err != nil {
+		return -1, fmt.Errorf("failed to read free page: %v", err)
+	}
+	if page.Type() != PageTypeFree {
+		return -1, fmt.Errorf("page %d in free list has type %d", index, page.Type())
+	}
+
+	t.Meta.FreeList = page.Free().Next
+	t.MetaDirty = true
+
+	return index, nil
+}
+
+/* allocRun takes 'n' contiguous pages from the beginning of free list and returns index of the first one or -1, if list doesn't start with such run. Runs are put there when extents are freed. Runs of pages smaller than pager's must start at the first slot of page of pager. */
+func (t *Tree) allocRun(n int64) (int64, error) {
+	index := t.Meta.FreeList
+	if index == 0 {
+		return -1, nil
+	}
+	if n == 1 {
+		return t.allocPage()
+	}
+	if index%t.PageSlots() != 0 {
+		return -1, nil
+	}
+
+	pages := make([]Page, t.pagerPages(n))
+	if _, err := t.Pager.ReadPagesAt(pages, t.pagerIndex(index)); err == ErrPagesOutOfBounds {
+		return -1, nil
+	} else if err != nil {
+		return -1, fmt.Errorf("failed to read %d free pages: %v", n, err)
+	}
+
+	page := t.NewPage()
+	run := Pages2Bytes(pages)
+	for i := int64(0); i < n; i++ {
+		t.getRunPage(page, run, i)
+		if (page.Type() != PageTypeFree) || ((i < n-1) && (page.Free().Next != index+(i+1)*t.PageSpan())) {
+			return -1, nil
+		}
+	}
+
+	t.Meta.FreeList = page.Free().Next
+	t.MetaDirty = true
+
+	return index, nil
+}
+
+/* reserveRun returns index of the first of 'n' contiguous pages, which are taken from free list or appended to pager to be written later. Pages are appended without being written, if pager can do so. */
+func (t *Tree) reserveRun(n int64) (int64, error) {
+	index, err := t.allocRun(n)
+	if (err != nil) || (index != -1) {
+		return index, err
+	}
+
+	n = t.pagerPages(n)
+	if reserver, ok := t.Pager.(Reserver); ok {
+		index, err := reserver.ReservePages(n)
+		if err != nil {
+			return -1, err
+		}
+		return t.treeIndex(index), nil
+	}
+
+	pages := make([]Page, SetFromChunkPages)
+	first := int64(-1)
+	for n > 0 {
+		chunk := pages
+		if int64(len(chunk)) > n {
+			chunk = chunk[:n]
+		}
+		written, err := t.Pager.WritePagesAt(chunk, -1)
+		if err != nil {
+			return -1, fmt.Errorf("failed to append %d pages: %v", len(chunk), err)
+		}
+		if first == -1 {
+			first = written
+		}
+		n -= int64(len(chunk))
+	}
+	return t.treeIndex(first), nil
+}
+
+/* freePages puts 'n' pages starting at 'index' to free list. */
+func (t *Tree) freePages(index int64, n int64) error {
+	if err := t.putFree(index, n); err != nil {
+		return err
+	}
+	t.Freed++
+
+	last := index + (n-1)*t.PageSpan()
+	if int64(len(t.FreedAt)) <= last {
+		t.FreedAt = append(t.FreedAt, make([]int64, last+1-int64(len(t.FreedAt)))...)
+	}
+	for i := int64(0); i < n; i++ {
+		t.FreedAt[index+i*t.PageSpan()] = t.Freed
+	}
+
+	return nil
+}
+
+/* freedSince returns whether page 'index' was put to free list after 'Freed' was 'freed'. */
+func (t *Tree) freedSince(index int64, freed int64) bool {
+	return (index < int64(len(t.FreedAt))) && (t.FreedAt[index] > freed)
+}
+
+/* putFree is like 'freePages', but is also used for pages, which were never used. */
+func (t *Tree) putFree(index int64, n int64) error {
+	page := t.NewPage()
+	t.InitPage(page, PageTypeFree)
+
+	if n == 1 {
+		page.Free().Next = t.Meta.FreeList
+		if _, err := t.WritePageAt(page, index); err != nil {
+			return fmt.Errorf("failed to write free page: %v", err)
+		}
+	} else {
+		/* NOTE(anton2920): runs of pages belong to extents, which exist only in trees with wide headers, or fill whole pages of pager, so pages are written with one call. */
+		pages := make([]Page, t.pagerPages(n))
+		run := Pages2Bytes(pages)
+		for i := int64(0); i < n; i++ {
+			page.Free().Next = index + (i+1)*t.PageSpan()
+			if i == n-1 {
+				page.Free().Next = t.Meta.FreeList
+			}
+			t.putRunPage(run, i, page)
+		}
+		if _, err := t.Pager.WritePagesAt(pages, t.pagerIndex(index)); err != nil {
+			return fmt.Errorf("failed to write %d free pages: %v", n, err)
+		}
+	}
+
+	t.Meta.FreeList = index
+	t.MetaDirty = true
+
+	return nil
+}
+
+/* extentPages returns number of pages of tree in extent of 'length' bytes. Extents take whole pages of pager, so that they are read and written bypassing slots of smaller pages. */
+func (t *Tree) extentPages(length int64) int64 {
+	size := t.Meta.PageSize
+	if size < PageSize {
+		size = PageSize
+	}
+	return (length + size - 1) / size * (size / t.Meta.PageSize)
+}
+
+/* freeValue puts pages which hold parts of value tagged with its 'ValueType' to free list. */
+func (t *Tree) freeValue(v []byte) error {
+	page := t.NewPage()
+
+	switch ValueGetType(v) {
+	case ValueTypePartial:
+		next := ValueGetNext(v)
+		for next != 0 {
+			if _, err := t.ReadPageAt(page, next); err != nil {
+				return fmt.Errorf("failed to read overflow: %v", err)
+			}
+			index := next
+			next = page.Overflow().Next
+
+			if err := t.freePages(index, 1); err != nil {
+				return err
+			}
+		}
+	case ValueTypeExtent:
+		index, length := ValueGetExtent(v)
+		return t.freePages(index, t.extentPages(length))
+	case ValueTypeTTL:
+		_, v := ValueGetTTL(v)
+		return t.freeValue(v)
+	case ValueTypeShared:
+		hash, v := ValueGetShared(v)
+		return t.releaseShared(hash, v)
+	}
+
+	return nil
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/anton2920/gofa/trace"
+)
+
+/* IndexExtractor returns key of secondary index for 'value' or nil, if value is not indexed. */
+type IndexExtractor func(value []byte) []byte
+
+/* Index is a secondary index of 'Primary' tree. It's stored as separate tree in the same pager, which entries have keys | escaped index key | primary key | and empty values, see 'AppendKeyBytes'. Indexes are updated together with primary tree, while it's locked. */
+type Index struct {
+	*Tree
+
+	Name    string
+	Extract IndexExtractor
+	Primary *Tree
+}
+
+/* IndexIterator returns primary keys and values in order of their index keys. */
+type IndexIterator struct {
+	Index *Index
+	It    *TreeForwardIterator
+
+	IndexKeyBuffer   []byte
+	PrimaryKeyBuffer []byte
+	ValueBuffer      []byte
+}
+
+/* Entries of catalog tree are: | index of 'Meta' of index tree (8 bytes) |, keyed by index name. */
+
+/* catalogTree returns tree which maps names of indexes to their trees, opening or creating it if needed. */
+func (t *Tree) catalogTree() (*Tree, error) {
+	if t.Catalog == nil {
+		index := t.Meta.IndexCatalog
+		if index == 0 {
+			index = -1
+		}
+		catalog, err := GetTreeAt(t.Pager, index)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open index catalog: %v", err)
+		}
+		if t.Meta.IndexCatalog == 0 {
+			t.Meta.IndexCatalog = catalog.MetaIndex
+			t.MetaDirty = true
+		}
+		t.Catalog = catalog
+	}
+	return t.Catalog, nil
+}
+
+/* CreateIndex defines secondary index 'name' with keys returned by 'extract'. Index is created and filled with existing values the first time, later it's opened and 'extract' must return the same keys as before. Like 'MergeOperator', indexes must be defined every time tree is opened, modifications fail until all of them are. */
+func (t *Tree) CreateIndex(name string, extract IndexExtractor) (*Index, error) {
+	defer trace.End(trace.Begin(""))
+
+	t.Lock()
+	idx, err := t.createIndex(name, extract)
+	if err == nil {
+		err = t.writeMeta()
+	}
+	t.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return idx, t.sync()
+}
+
+func (t *Tree) createIndex(name string, extract IndexExtractor) (*Index, error) {
+	if t.Index(name) != nil {
+		return nil, fmt.Errorf("index %q is already defined", name)
+	}
+	catalog, err := t.catalogTree()
+	if err != nil {
+		return nil, err
+	}
+	entry, err := catalog.getRaw([]byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find index %q in catalog: %v", name, err)
+	}
+
+	idx := &Index{Name: name, Extract: extract, Primary: t}
+	if entry != nil {
+		if idx.Tree, err = GetTreeAt(t.Pager, int64(binary.LittleEndian.Uint64(ValueGetFull(entry)))); err != nil {
+			return nil, fmt.Errorf("failed to open index %q: %v", name, err)
+		}
+	} else {
+		if idx.Tree, err = GetTreeAt(t.Pager, -1); err != nil {
+			return nil, fmt.Errorf("failed to create index %q: %v", name, err)
+		}
+		if err := t.fillIndex(idx); err != nil {
+			return nil, fmt.Errorf("failed to fill index %q: %v", name, err)
+		}
+
+		var meta [8]byte
+		binary.LittleEndian.PutUint64(meta[:], uint64(idx.MetaIndex))
+		err = catalog.set([]byte(name), meta[:], false)
+		if err == nil {
+			err = catalog.writeMeta()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to add index %q to catalog: %v", name, err)
+		}
+	}
+
+	t.Indexes = append(t.Indexes, idx)
+	return idx, nil
+}
+
+/* fillIndex adds entries for all values already stored in tree to new index. */
+func (t *Tree) fillIndex(idx *Index) error {
+	page := t.NewPage()
+
+	it, err := t.Begin()
+	if err != nil {
+		return err
+	}
+	for it.Next() {
+		value, err := t.appendValue(nil, it.Value(), page)
+		if err != nil {
+			return fmt.Errorf("failed to read value: %v", err)
+		}
+		if key := idx.Extract(value); key != nil {
+			if err := idx.set(indexEntryKey(key, it.Key()), nil, false); err != nil {
+				return err
+			}
+		}
+	}
+	return idx.writeMeta()
+}
+
+/* Index returns secondary index 'name' or nil, if it's not defined. */
+func (t *Tree) Index(name string) *Index {
+	for _, idx := range t.Indexes {
+		if idx.Name == name {
+			return idx
+		}
+	}
+	return nil
+}
+
+func indexEntryKey(key []byte, primaryKey []byte) []byte {
+	return append(AppendKeyBytes(nil, key), primaryKey...)
+}
+
+/* indexChange is an entry of 'Index' to be removed and an entry to be added instead, nil means there's no such entry. */
+type indexChange struct {
+	Index    *Index
+	Old, New []byte
+}
+
+/* indexChanges returns changes of entries of all indexes for 'key', when 'old' value is replaced by 'value'. Values are tagged with their 'ValueType', nil means there's no value. 'plain' is 'value' without tag or nil, if it must be read from where 'value' points to. Expired values still have entries, so they are not checked for expiry. */
+func (t *Tree) indexChanges(key []byte, old []byte, value []byte, plain []byte) ([]indexChange, error) {
+	if len(t.Indexes) == 0 {
+		return nil, nil
+	}
+	page := t.NewPage()
+
+	oldValue, err := t.indexedValue(old, page)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read old value: %v", err)
+	}
+	newValue := plain
+	if (value != nil) && (plain == nil) {
+		if newValue, err = t.indexedValue(value, page); err != nil {
+			return nil, fmt.Errorf("failed to read new value: %v", err)
+		}
+	}
+
+	var changes []indexChange
+	for _, idx := range t.Indexes {
+		var oldKey, newKey []byte
+		if old != nil {
+			oldKey = idx.Extract(oldValue)
+		}
+		if value != nil {
+			newKey = idx.Extract(newValue)
+		}
+		if (oldKey != nil) && (newKey != nil) && (bytes.Equal(oldKey, newKey)) {
+			continue
+		}
+
+		change := indexChange{Index: idx}
+		if oldKey != nil {
+			change.Old = indexEntryKey(oldKey, key)
+		}
+		if newKey != nil {
+			change.New = indexEntryKey(newKey, key)
+		}
+		if (change.Old != nil) || (change.New != nil) {
+			changes = append(changes, change)
+		}
+	}
+
+	return changes, nil
+}
+
+/* updateIndexes applies 'changes' returned by 'indexChanges'. Each index is written on its own, so if one of them fails, indexes before it are already updated. */
+func (t *Tree) updateIndexes(changes []indexChange) error {
+	for _, change := range changes {
+		idx := change.Index
+		if change.Old != nil {
+			if err := idx.del(change.Old); err != nil {
+				return fmt.Errorf("failed to remove entry from index %q: %v", idx.Name, err)
+			}
+		}
+		if change.New != nil {
+			if err := idx.set(change.New, nil, false); err != nil {
+				return fmt.Errorf("failed to add entry to index %q: %v", idx.Name, err)
+			}
+		}
+		if err := idx.writeMeta(); err != nil {
+			return fmt.Errorf("failed to update index %q: %v", idx.Name, err)
+		}
+	}
+
+	return nil
+}
+
+/* checkIndexes returns error, if some of indexes in catalog are not defined, since their entries would not be updated. */
+func (t *Tree) checkIndexes() error {
+	if (t.Meta.IndexCatalog == 0) || (t.IndexesDefined) {
+		return nil
+	}
+
+	catalog, err := t.catalogTree()
+	if err != nil {
+		return err
+	}
+	it, err := catalog.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to read index catalog: %v", err)
+	}
+	for it.Next() {
+		if t.Index(string(it.Key())) == nil {
+			return fmt.Errorf("index %q must be defined with 'CreateIndex' before tree is modified", it.Key())
+		}
+	}
+
+	t.IndexesDefined = true
+	return nil
+}
+
+/* indexedValue returns copy of value tagged with its 'ValueType', including expired one. */
+func (t *Tree) indexedValue(v []byte, page *Page) ([]byte, error) {
+	if v == nil {
+		return nil, nil
+	}
+	if ValueGetType(v) == ValueTypeTTL {
+		_, v = ValueGetTTL(v)
+	}
+	return t.appendValue([]byte{}, v, page)
+}
+
+/* Seek returns iterator positioned right before the first entry with index key greater or equal to 'key'. Entries with equal index keys are ordered by primary keys. */
+func (idx *Index) Seek(key []byte) (*IndexIterator, error) {
+	defer trace.End(trace.Begin(""))
+
+	it, err := idx.Tree.Seek(AppendKeyBytes(nil, key))
+	if err != nil {
+		return nil, err
+	}
+	return &IndexIterator{Index: idx, It: it}, nil
+}
+
+/* Next moves iterator to the next entry. Entries which primary values have expired are skipped. */
+func (it *IndexIterator) Next() bool {
+	for it.It.Next() {
+		entry := it.It.Key()
+		if (len(entry) == 0) || (entry[0] != KeyTagBytes) {
+			return false
+		}
+
+		key, primaryKey, err := decodeKeyEscaped(entry[1:])
+		if err != nil {
+			return false
+		}
+		it.IndexKeyBuffer = append(it.IndexKeyBuffer[:0], key...)
+		it.PrimaryKeyBuffer = append(it.PrimaryKeyBuffer[:0], primaryKey...)
+
+		primary := it.Index.Primary
+		primary.RLock()
+		page := primary.getPage()
+		v, err := primary.findValue(page, primaryKey)
+		if (err == nil) && (v != nil) {
+			it.ValueBuffer, err = primary.appendValue(it.ValueBuffer[:0], v, page)
+		}
+		primary.putPage(page)
+		primary.RUnlock()
+		if err != nil {
+			return false
+		} else if v != nil {
+			return true
+		}
+	}
+	return false
+}
+
+/* upgradeIndexes upgrades catalog and trees of all indexes, including ones which are not defined. */
+func (t *Tree) upgradeIndexes() error {
+	catalog, err := t.catalogTree()
+	if err != nil {
+		return err
+	}
+	if err := catalog.Upgrade(); err != nil {
+		return fmt.Errorf("failed to upgrade catalog: %v", err)
+	}
+
+	it, err := catalog.Begin()
+	if err != nil {
+		return err
+	}
+	for it.Next() {
+		index, err := GetTreeAt(t.Pager, int64(binary.LittleEndian.Uint64(ValueGetFull(it.Value()))))
+		if err == nil {
+			err = index.Upgrade()
+		}
+		if err != nil {
+			return fmt.Errorf("failed to upgrade index %q: %v", it.Key(), err)
+		}
+	}
+	return nil
+}
+
+/* IndexKey returns index key of current entry. */
+func (it *IndexIterator) IndexKey() []byte {
+	return it.IndexKeyBuffer
+}
+
+/* Key returns primary key of current entry. */
+func (it *IndexIterator) Key() []byte {
+	return it.PrimaryKeyBuffer
+}
+
+/* Value returns primary value of current entry. */
+func (it *IndexIterator) Value() []byte {
+	return it.ValueBuffer
+}
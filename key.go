@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"unsafe"
+
+	"github.com/anton2920/gofa/errors"
+)
+
+/* Keys are encoded as sequences of elements, each starting with a tag, so that 'bytes.Compare' of encoded keys matches element-wise comparison of tuples. Elements of different types are ordered by their tags, so all unsigned integers sort after all signed ones, whatever their values are. Byte strings have 0x00 escaped as | 0x00 0xFF | and end with | 0x00 0x01 |, so that shorter strings sort first. Nested tuples end with 'KeyTagEnd'. Nil elements sort before all others. */
+const (
+	KeyTagEnd    = 0x00
+	KeyTagNull   = 0x01
+	KeyTagFalse  = 0x10
+	KeyTagTrue   = 0x11
+	KeyTagInt    = 0x20
+	KeyTagUint   = 0x21
+	KeyTagFloat  = 0x30
+	KeyTagBytes  = 0x40
+	KeyTagString = 0x41
+	KeyTagTuple  = 0x50
+)
+
+/* AppendKey appends encoding of tuple of 'elements' to 'buf'. Supported elements are nil, booleans, signed and unsigned integers, floats, strings, byte slices and nested tuples as '[]interface{}'. */
+func AppendKey(buf []byte, elements ...interface{}) ([]byte, error) {
+	for _, element := range elements {
+		switch e := element.(type) {
+		case nil:
+			buf = append(buf, KeyTagNull)
+		case bool:
+			buf = AppendKeyBool(buf, e)
+		case int:
+			buf = AppendKeyInt64(buf, int64(e))
+		case int8:
+			buf = AppendKeyInt64(buf, int64(e))
+		case int16:
+			buf = AppendKeyInt64(buf, int64(e))
+		case int32:
+			buf = AppendKeyInt64(buf, int64(e))
+		case int64:
+			buf = AppendKeyInt64(buf, e)
+		case uint:
+			buf = AppendKeyUint64(buf, uint64(e))
+		case uint8:
+			buf = AppendKeyUint64(buf, uint64(e))
+		case uint16:
+			buf = AppendKeyUint64(buf, uint64(e))
+		case uint32:
+			buf = AppendKeyUint64(buf, uint64(e))
+		case uint64:
+			buf = AppendKeyUint64(buf, e)
+		case float32:
+			buf = AppendKeyFloat64(buf, float64(e))
+		case float64:
+			buf = AppendKeyFloat64(buf, e)
+		case string:
+			buf = AppendKeyString(buf, e)
+		case []byte:
+			buf = AppendKeyBytes(buf, e)
+		case []interface{}:
+			var err error
+			buf = append(buf, KeyTagTuple)
+			if buf, err = AppendKey(buf, e...); err != nil {
+				return nil, err
+			}
+			buf = append(buf, KeyTagEnd)
+		default:
+			return nil, fmt.Errorf("unsupported key element of type %T", element)
+		}
+	}
+	return buf, nil
+}
+
+/* EncodeKey returns encoding of tuple of 'elements', see 'AppendKey'. */
+func EncodeKey(elements ...interface{}) ([]byte, error) {
+	return AppendKey(nil, elements...)
+}
+
+func AppendKeyBool(buf []byte, x bool) []byte {
+	if x {
+		return append(buf, KeyTagTrue)
+	}
+	return append(buf, KeyTagFalse)
+}
+
+/* AppendKeyInt64 appends 'x' in big-endian order with flipped sign bit, so that negative numbers sort before positive ones. */
+func AppendKeyInt64(buf []byte, x int64) []byte {
+	return appendKeyBits(buf, KeyTagInt, uint64(x)^(1<<63))
+}
+
+func AppendKeyUint64(buf []byte, x uint64) []byte {
+	return appendKeyBits(buf, KeyTagUint, x)
+}
+
+/* AppendKeyFloat64 appends bits of 'x' in big-endian order. Sign bit of positive numbers is flipped and all bits of negative numbers are flipped, so that they sort in reverse order of their magnitudes. -0 is stored as 0 and all NaNs as one NaN, which sorts after +Inf. */
+func AppendKeyFloat64(buf []byte, x float64) []byte {
+	if x == 0 {
+		x = 0
+	} else if math.IsNaN(x) {
+		x = math.NaN()
+	}
+	bits := math.Float64bits(x)
+	if bits&(1<<63) != 0 {
+		bits = ^bits
+	} else {
+		bits ^= 1 << 63
+	}
+	return appendKeyBits(buf, KeyTagFloat, bits)
+}
+
+func appendKeyBits(buf []byte, tag byte, bits uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], bits)
+	return append(append(buf, tag), b[:]...)
+}
+
+func AppendKeyString(buf []byte, x string) []byte {
+	return appendKeyEscaped(append(buf, KeyTagString), x)
+}
+
+func AppendKeyBytes(buf []byte, x []byte) []byte {
+	return appendKeyEscaped(append(buf, KeyTagBytes), *(*string)(unsafe.Pointer(&x)))
+}
+
+func appendKeyEscaped(buf []byte, x string) []byte {
+	for i := 0; i < len(x); i++ {
+		if x[i] == 0x00 {
+			buf = append(buf, 0x00, 0xFF)
+		} else {
+			buf = append(buf, x[i])
+		}
+	}
+	return append(buf, 0x00, 0x01)
+}
+
+/* DecodeKey returns elements of tuple encoded with 'AppendKey'. Integers are returned as 'int64' and 'uint64', floats as 'float64' and nested tuples as '[]interface{}'. */
+func DecodeKey(key []byte) ([]interface{}, error) {
+	elements, rest, err := decodeKey(key, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, errors.New("unexpected end of tuple in key")
+	}
+	return elements, nil
+}
+
+func decodeKey(key []byte, nested bool) ([]interface{}, []byte, error) {
+	elements := []interface{}{}
+
+	for len(key) > 0 {
+		tag := key[0]
+		key = key[1:]
+
+		switch tag {
+		case KeyTagEnd:
+			if !nested {
+				return nil, nil, errors.New("unexpected end of tuple in key")
+			}
+			return elements, key, nil
+		case KeyTagNull:
+			elements = append(elements, nil)
+		case KeyTagFalse, KeyTagTrue:
+			elements = append(elements, tag == KeyTagTrue)
+		case KeyTagInt, KeyTagUint, KeyTagFloat:
+			if len(key) < 8 {
+				return nil, nil, fmt.Errorf("key element with tag %#x is truncated", tag)
+			}
+			bits := binary.BigEndian.Uint64(key)
+			key = key[8:]
+
+			switch tag {
+			case KeyTagInt:
+				elements = append(elements, int64(bits^(1<<63)))
+			case KeyTagUint:
+				elements = append(elements, bits)
+			case KeyTagFloat:
+				if bits&(1<<63) != 0 {
+					bits ^= 1 << 63
+				} else {
+					bits = ^bits
+				}
+				elements = append(elements, math.Float64frombits(bits))
+			}
+		case KeyTagBytes, KeyTagString:
+			var x []byte
+			var err error
+
+			if x, key, err = decodeKeyEscaped(key); err != nil {
+				return nil, nil, err
+			}
+			if tag == KeyTagString {
+				elements = append(elements, string(x))
+			} else {
+				elements = append(elements, x)
+			}
+		case KeyTagTuple:
+			tuple, rest, err := decodeKey(key, true)
+			if err != nil {
+				return nil, nil, err
+			}
+			elements = append(elements, tuple)
+			key = rest
+		default:
+			return nil, nil, fmt.Errorf("unknown key element tag %#x", tag)
+		}
+	}
+
+	if nested {
+		return nil, nil, errors.New("nested tuple in key is not terminated")
+	}
+	return elements, key, nil
+}
+
+func decodeKeyEscaped(key []byte) ([]byte, []byte, error) {
+	x := []byte{}
+	for i := 0; i < len(key); i++ {
+		if key[i] != 0x00 {
+			x = append(x, key[i])
+			continue
+		}
+		if i+1 == len(key) {
+			break
+		}
+
+		switch key[i+1] {
+		case 0x01:
+			return x, key[i+2:], nil
+		case 0xFF:
+			x = append(x, 0x00)
+			i++
+		default:
+			return nil, nil, fmt.Errorf("unknown escape sequence 0x00 %#x in key", key[i+1])
+		}
+	}
+	return nil, nil, errors.New("byte string in key is not terminated")
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestKeyOrder(t *testing.T) {
+	/* NOTE(anton2920): each group is sorted in logical order. */
+	groups := [][][]interface{}{
+		{{false}, {true}},
+		{{int64(math.MinInt64)}, {-256}, {-1}, {0}, {1}, {255}, {256}, {int64(math.MaxInt64)}},
+		{{uint64(0)}, {uint64(1)}, {uint64(255)}, {uint64(256)}, {uint64(math.MaxUint64)}},
+		{{math.Inf(-1)}, {-math.MaxFloat64}, {-1.5}, {-math.SmallestNonzeroFloat64}, {0.0}, {math.SmallestNonzeroFloat64}, {1.5}, {math.MaxFloat64}, {math.Inf(1)}, {math.NaN()}},
+		{{""}, {"\x00"}, {"\x00\x00"}, {"\x00\x01"}, {"\x01"}, {"a"}, {"a\x00"}, {"a\x00b"}, {"ab"}, {"b"}, {"\xff"}},
+		{{[]byte{}}, {[]byte{0}}, {[]byte{0, 0xFF}}, {[]byte{1}}},
+		{{"a"}, {"a", -1}, {"a", 0}, {"a", 0, "x"}, {"a", 1}, {"a\x00", -1}, {"b", math.MinInt64}},
+		{{[]interface{}{}}, {[]interface{}{}, 0}, {[]interface{}{0}}, {[]interface{}{0}, "a"}, {[]interface{}{0, "a"}}, {[]interface{}{1}}},
+		{{nil}, {true}, {0}, {uint64(0)}, {0.0}, {[]byte{}}, {""}, {[]interface{}{}}},
+	}
+
+	for _, group := range groups {
+		var prev []byte
+		for i, elements := range group {
+			key, err := EncodeKey(elements...)
+			if err != nil {
+				t.Fatalf("Failed to encode key %v: %v", elements, err)
+			}
+			if (i > 0) && (bytes.Compare(prev, key) >= 0) {
+				t.Errorf("Expected key %v to sort after %v, got %x >= %x", elements, group[i-1], prev, key)
+			}
+			prev = key
+		}
+	}
+}
+
+func TestKeyDecode(t *testing.T) {
+	expected := []interface{}{nil, true, int64(-42), uint64(42), -0.5, "a\x00b", []byte{0, 0xFF, 0}, []interface{}{int64(1), []interface{}{"nested"}, []interface{}{}}, ""}
+
+	key, err := EncodeKey(expected...)
+	if err != nil {
+		t.Fatalf("Failed to encode key: %v", err)
+	}
+	got, err := DecodeKey(key)
+	if err != nil {
+		t.Fatalf("Failed to decode key: %v", err)
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+
+	for _, pair := range [...][2]float64{{math.Copysign(0, -1), 0}, {-math.NaN(), math.NaN()}, {math.Float64frombits(0x7FF0000000000001), math.NaN()}} {
+		x, err := EncodeKey(pair[0])
+		if err != nil {
+			t.Fatalf("Failed to encode key: %v", err)
+		}
+		y, err := EncodeKey(pair[1])
+		if err != nil {
+			t.Fatalf("Failed to encode key: %v", err)
+		}
+		if !bytes.Equal(x, y) {
+			t.Errorf("Expected %v to be encoded as %v, got %x and %x", pair[0], pair[1], x, y)
+		}
+	}
+
+	malformed := [][]byte{{KeyTagInt, 0x80}, {KeyTagString, 'a'}, {KeyTagString, 'a', 0x00}, {KeyTagBytes, 0x00, 0x02}, {KeyTagTuple, KeyTagTrue}, {KeyTagEnd}, {0xFF}}
+	for _, key := range malformed {
+		if _, err := DecodeKey(key); err == nil {
+			t.Errorf("Expected error for malformed key %x", key)
+		}
+	}
+	if _, err := EncodeKey(struct{}{}); err == nil {
+		t.Errorf("Expected error for unsupported element")
+	}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"bytes"
-	"encoding/binary"
 	"fmt"
 	"reflect"
 	"unsafe"
@@ -17,8 +16,8 @@ type Leaf struct {
 
 	Next int64
 
-	/* Data is structured as follows: | N*sizeof(uint16) bytes of keyOffsets | keys... | ...empty space... | ...values | N*sizeof(uint16) bytes of valueOffsets | */
-	Data [PageSize - PageHeaderSize - 1*unsafe.Sizeof(int64(0))]byte
+	/* data is structured as follows: | N*OffsetSize() bytes of keyOffsets | prefix | keys... | ...empty space... | ...values | N*OffsetSize() bytes of valueOffsets |, where prefix is common to all keys and is stored only once. Pages larger than 'PageSize' continue past the end of 'Leaf', see 'Data'. */
+	data [PageSize - PageHeaderSize - 1*unsafe.Sizeof(int64(0))]byte
 }
 
 func init() {
@@ -26,7 +25,7 @@ func init() {
 	page.Init(PageTypeLeaf)
 
 	leaf := page.Leaf()
-	debug.Printf("[leaf]: len(Leaf.Data) == %d\n", len(leaf.Data))
+	debug.Printf("[leaf]: len(Leaf.Data()) == %d\n", len(leaf.Data()))
 
 	leaf.InsertKeyValueAt([]byte{1, 2, 3, 4}, []byte{5, 6, 7, 8, 9, 10}, 0)
 	debug.Printf("[leaf]: %v\n", leaf)
@@ -44,68 +43,212 @@ func init() {
 	debug.Printf("[leaf]: %v\n", leaf)
 }
 
+/* Find returns position right before the first key which is not less than 'key', and whether that key is equal to 'key'. */
 func (l *Leaf) Find(key []byte) (int, bool) {
+	return l.find(key, nil, nil)
+}
+
+/* FindWithHints is like 'Find', but uses key hints stored in page. Hints must be up to date, see 'BuildHints'. */
+func (l *Leaf) FindWithHints(key []byte) (int, bool) {
+	return l.find(key, l.GetHints(), nil)
+}
+
+/* FindWithComparator is like 'Find', but orders keys with 'cmp'. Leaf must have no prefix. */
+func (l *Leaf) FindWithComparator(key []byte, cmp Comparator) (int, bool) {
+	return l.find(key, nil, cmp)
+}
+
+func (l *Leaf) find(key []byte, hints []byte, cmp Comparator) (int, bool) {
 	defer trace.End(trace.Begin(""))
 
 	if l.N == 0 {
 		return -1, false
-	} else if res := bytes.Compare(key, l.GetKeyAt(int(l.N)-1)); res >= 0 {
-		return int(l.N) - 1 - util.Bool2Int(res == 0), res == 0
 	}
 
-	for i := 0; i < int(l.N); i++ {
-		if res := bytes.Compare(key, l.GetKeyAt(i)); res <= 0 {
-			return i - 1, res == 0
+	prefix := l.GetPrefix()
+	if !bytes.HasPrefix(key, prefix) {
+		if bytes.Compare(key, prefix) < 0 {
+			return -1, false
 		}
+		return int(l.N) - 1, false
 	}
+	key = key[len(prefix):]
+	hint := KeyHint(key)
+
+	lo, hi := 0, int(l.N)
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+
+		res := CompareKeyHints(hint, hints, mid)
+		if cmp != nil {
+			res = cmp.Compare(key, l.GetKeyAt(mid))
+		} else if res == 0 {
+			res = bytes.Compare(key, l.GetKeyAt(mid))
+		}
+
+		switch {
+		case res == 0:
+			return mid - 1, true
+		case res < 0:
+			hi = mid
+		default:
+			lo = mid + 1
+		}
+	}
+
+	return lo - 1, false
+}
+
+/* GetHints returns key hints stored in free space after keys, or nil if there's not enough space for them. */
+func (l *Leaf) GetHints() []byte {
+	size := int(l.N) * KeyHintSize
+	if l.Head()+l.Tail()+size > l.DataSize() {
+		return nil
+	}
+	return l.Data()[l.Head() : l.Head()+size]
+}
+
+/* BuildHints stores key hints in free space of leaf. They are overwritten by any subsequent modification. */
+func (l *Leaf) BuildHints() {
+	if hints := l.GetHints(); hints != nil {
+		PutKeyHints(hints, int(l.N), l.GetKeyAt)
+	}
+}
 
-	return int(l.N) - 1, false
+func (l *Leaf) DataSize() int {
+	return l.Size() - int(unsafe.Offsetof(l.data)) - l.FooterSize()
+}
+
+/* Data returns 'DataSize' bytes of leaf after its header. */
+func (l *Leaf) Data() []byte {
+	return *(*[]byte)(unsafe.Pointer(&reflect.SliceHeader{Data: uintptr(unsafe.Pointer(&l.data[0])), Len: l.DataSize(), Cap: l.DataSize()}))
+}
+
+/* FindSplit returns number of entries which should stay in 'l' when it's split to put entry with 'key' and 'valueLength' at 'index'. Result is the closest to 'half' that leaves both pages within their size. If 'replace' is true, value of existing entry at 'index' is replaced. */
+func (l *Leaf) FindSplit(half int, index int, key []byte, valueLength int, replace bool) int {
+	prefix := l.GetPrefix()
+	common := CommonPrefixLength(key, prefix)
+	growth := len(prefix) - common
+
+	n := int(l.N) + util.Bool2Int(!replace)
+	sizes := make([]int, n+1)
+	for i := 0; i < n; i++ {
+		var size int
+
+		switch {
+		case i == index:
+			size = len(key) - common + valueLength
+		case (i > index) && (!replace):
+			_, keyLength := l.GetKeyOffsetAndLength(i - 1)
+			_, valueLength := l.GetValueOffsetAndLength(i - 1)
+			size = keyLength + growth + valueLength
+		default:
+			_, keyLength := l.GetKeyOffsetAndLength(i)
+			_, valueLength := l.GetValueOffsetAndLength(i)
+			size = keyLength + growth + valueLength
+		}
+		sizes[i+1] = sizes[i] + size
+	}
+
+	fits := func(count int, size int) bool {
+		return common+size+2*GetExtraOffset(0, count, l.OffsetSize()) <= l.DataSize()
+	}
+	for d := 0; d < n; d++ {
+		for _, s := range [...]int{half - d, half + d} {
+			if (s >= 1) && (s <= n-1) && fits(s, sizes[s]) && fits(n-s, sizes[n]-sizes[s]) {
+				return s
+			}
+		}
+	}
+	return half
 }
 
 func (l *Leaf) GetExtraOffset(count int) int {
-	return GetExtraOffset(int(l.N), count)
+	return GetExtraOffset(int(l.N), count, l.OffsetSize())
 }
 
 func (l *Leaf) GetFirstKeyOffset() int {
-	return GetExtraOffset(0, int(l.N))
+	return GetExtraOffset(0, int(l.N), l.OffsetSize())
 }
 
 func (l *Leaf) GetFirstValueOffset() int {
-	return len(l.Data) - GetExtraOffset(0, int(l.N))
+	return l.DataSize() - GetExtraOffset(0, int(l.N), l.OffsetSize())
+}
+
+/* GetPrefix returns bytes common to all keys in leaf. They are stored only once, right before the first key. */
+func (l *Leaf) GetPrefix() []byte {
+	offset, _ := l.GetKeyOffsetAndLength(0)
+	return l.Data()[l.GetFirstKeyOffset():offset]
+}
+
+/* SetPrefixLength re-encodes leaf, so that first 'length' bytes of its keys are stored only once. All keys must have these bytes in common. */
+func (l *Leaf) SetPrefixLength(length int) {
+	buffer := make([]byte, l.Size())
+
+	old := l.Page().Clone().Leaf()
+
+	/* NOTE(anton2920): prefix is immediately followed by the rest of the first key. */
+	offset, keyLength := old.GetKeyOffsetAndLength(0)
+	prefix := old.Data()[old.GetFirstKeyOffset() : offset+keyLength][:length]
+
+	l.Reset()
+	l.SetHead(copy(l.Data(), prefix))
+	for i := 0; i < int(old.N); i++ {
+		l.InsertKeyValueAt(old.AppendKeyAt(buffer[:0], i), old.GetValueAt(i), i)
+	}
 }
 
+/* Compact stores the longest prefix common to all keys only once. */
+func (l *Leaf) Compact() {
+	if l.N > 0 {
+		if common := CommonPrefixLength(l.GetKeyAt(0), l.GetKeyAt(int(l.N)-1)); common > 0 {
+			l.SetPrefixLength(len(l.GetPrefix()) + common)
+		}
+	}
+}
+
+/* AppendKeyAt appends full key at 'index' to 'buf'. */
+func (l *Leaf) AppendKeyAt(buf []byte, index int) []byte {
+	return append(append(buf, l.GetPrefix()...), l.GetKeyAt(index)...)
+}
+
+/* GetKeyAt returns key at 'index' without prefix. */
 func (l *Leaf) GetKeyAt(index int) []byte {
 	offset, length := l.GetKeyOffsetAndLength(index)
-	return l.Data[offset : offset+length]
+	return l.Data()[offset : offset+length]
 }
 
 func (l *Leaf) GetKeyOffsetAndLength(index int) (offset int, length int) {
 	switch {
 	case index < int(l.N)-1:
-		offset = int(binary.LittleEndian.Uint16(l.Data[l.GetKeyOffsetInData(index):]))
-		length = int(binary.LittleEndian.Uint16(l.Data[l.GetKeyOffsetInData(index+1):])) - offset
+		offset = GetPageOffset(l.Data()[l.GetKeyOffsetInData(index):], l.OffsetSize())
+		length = GetPageOffset(l.Data()[l.GetKeyOffsetInData(index+1):], l.OffsetSize()) - offset
 	case index == int(l.N)-1:
-		offset = int(binary.LittleEndian.Uint16(l.Data[l.GetKeyOffsetInData(index):]))
-		length = int(l.Head) - offset
+		offset = GetPageOffset(l.Data()[l.GetKeyOffsetInData(index):], l.OffsetSize())
+		length = l.Head() - offset
 	case index > int(l.N)-1:
-		offset = int(l.Head)
+		offset = l.Head()
 		length = 0
 	}
 	return
 }
 
 func (l *Leaf) GetKeyOffsetInData(index int) int {
-	var keyOffset uint16
-	return int(unsafe.Sizeof(keyOffset)) * index
+	return l.OffsetSize() * index
 }
 
-func (l *Leaf) GetKeyOffsets() []uint16 {
-	return *(*[]uint16)(unsafe.Pointer(&reflect.SliceHeader{Data: uintptr(unsafe.Pointer(&l.Data[0])), Len: int(l.N), Cap: int(l.N)}))
+/* AddKeyOffsets adds 'delta' to offsets of keys from 'from' up to, but not including, 'to'. */
+func (l *Leaf) AddKeyOffsets(from int, to int, delta int) {
+	data, size := l.Data(), l.OffsetSize()
+	for i := from; i < to; i++ {
+		offset := data[l.GetKeyOffsetInData(i):]
+		PutPageOffset(offset, size, GetPageOffset(offset, size)+delta)
+	}
 }
 
 func (l *Leaf) GetValueAt(index int) []byte {
 	offset, length := l.GetValueOffsetAndLength(index)
-	return l.Data[offset-length : offset]
+	return l.Data()[offset-length : offset]
 }
 
 /* value3 | value2 | value1 | value0 | offt3 | offt2 | offt1 | offt0 | */
@@ -113,69 +256,109 @@ func (l *Leaf) GetValueAt(index int) []byte {
 func (l *Leaf) GetValueOffsetAndLength(index int) (offset int, length int) {
 	switch {
 	case index < int(l.N)-1:
-		offset = int(binary.LittleEndian.Uint16(l.Data[l.GetValueOffsetInData(index):]))
-		length = offset - int(binary.LittleEndian.Uint16(l.Data[l.GetValueOffsetInData(index+1):]))
+		offset = GetPageOffset(l.Data()[l.GetValueOffsetInData(index):], l.OffsetSize())
+		length = offset - GetPageOffset(l.Data()[l.GetValueOffsetInData(index+1):], l.OffsetSize())
 	case index == int(l.N)-1:
-		offset = int(binary.LittleEndian.Uint16(l.Data[l.GetValueOffsetInData(index):]))
-		length = offset - (len(l.Data) - int(l.Tail))
+		offset = GetPageOffset(l.Data()[l.GetValueOffsetInData(index):], l.OffsetSize())
+		length = offset - (l.DataSize() - l.Tail())
 	case index > int(l.N)-1:
-		offset = len(l.Data) - int(l.Tail)
+		offset = l.DataSize() - l.Tail()
 		length = 0
 	}
 	return
 }
 
 func (l *Leaf) GetValueOffsetInData(index int) int {
-	var valueOffset uint16
-	return len(l.Data) - int(unsafe.Sizeof(valueOffset))*(index+1)
+	return l.DataSize() - l.OffsetSize()*(index+1)
 }
 
-func (l *Leaf) GetValueOffsets() []uint16 {
-	var valueOffset uint16
-
-	return *(*[]uint16)(unsafe.Pointer(&reflect.SliceHeader{Data: uintptr(unsafe.Pointer(&l.Data[0])) + uintptr(len(l.Data)) - unsafe.Sizeof(valueOffset)*uintptr(l.N), Len: int(l.N), Cap: int(l.N)}))
+/* AddValueOffsets adds 'delta' to offsets of values from 'from' up to, but not including, 'to'. */
+func (l *Leaf) AddValueOffsets(from int, to int, delta int) {
+	data, size := l.Data(), l.OffsetSize()
+	for i := from; i < to; i++ {
+		offset := data[l.GetValueOffsetInData(i):]
+		PutPageOffset(offset, size, GetPageOffset(offset, size)+delta)
+	}
 }
 
 func (l *Leaf) InsertKeyValueAt(key []byte, value []byte, index int) {
+	l.InsertKeyEncodedValueAt(key, EncodeRaw(value), index)
+}
+
+/* InsertKeyEncodedValueAt inserts 'key' with 'value' written right into leaf. */
+func (l *Leaf) InsertKeyEncodedValueAt(key []byte, value EncodedValue, index int) {
 	if index > int(l.N) {
 		panic("index out of range for insert")
 	}
 
+	prefix := l.GetPrefix()
+	if !bytes.HasPrefix(key, prefix) {
+		l.SetPrefixLength(CommonPrefixLength(key, prefix))
+		prefix = l.GetPrefix()
+	}
+	key = key[len(prefix):]
+
 	extraOffset := l.GetExtraOffset(1)
 	keyOffset, _ := l.GetKeyOffsetAndLength(index)
 	valueOffset, _ := l.GetValueOffsetAndLength(index)
-	if int(l.Head)+int(l.Tail)+len(key)+len(value)+2*extraOffset > len(l.Data) {
+	if l.Head()+l.Tail()+len(key)+value.Len()+2*extraOffset > l.DataSize() {
 		panic("insert key-value causes overflow")
 	}
 
-	keyOffsets := l.GetKeyOffsets()
-	valueOffsets := l.GetValueOffsets()
 	if extraOffset > 0 {
-		for i := 0; i < index; i++ {
-			keyOffsets[i] += uint16(extraOffset)
-			valueOffsets[int(l.N)-1-i] -= uint16(extraOffset)
-		}
+		l.AddKeyOffsets(0, index, extraOffset)
+		l.AddValueOffsets(0, index, -extraOffset)
 	}
-	for i := index; i < int(l.N); i++ {
-		keyOffsets[i] += uint16(len(key) + extraOffset)
-		valueOffsets[int(l.N)-1-i] -= uint16(len(value) + extraOffset)
+	l.AddKeyOffsets(index, int(l.N), len(key)+extraOffset)
+	l.AddValueOffsets(index, int(l.N), -(value.Len() + extraOffset))
+
+	copy(l.Data()[keyOffset+len(key)+extraOffset:], l.Data()[keyOffset:l.Head()])
+	copy(l.Data()[l.GetFirstKeyOffset()+extraOffset:], l.Data()[l.GetFirstKeyOffset():keyOffset])
+	copy(l.Data()[keyOffset+extraOffset:], key)
+	copy(l.Data()[l.GetKeyOffsetInData(index+1):], l.Data()[l.GetKeyOffsetInData(index):l.GetKeyOffsetInData(int(l.N))])
+	PutPageOffset(l.Data()[l.GetKeyOffsetInData(index):], l.OffsetSize(), keyOffset+extraOffset)
+
+	copy(l.Data()[l.DataSize()-l.Tail()-value.Len()-extraOffset:], l.Data()[l.DataSize()-l.Tail():valueOffset])
+	copy(l.Data()[valueOffset-extraOffset:], l.Data()[valueOffset:l.GetValueOffsetInData(int(l.N)-1)])
+	value.Put(l.Data()[valueOffset-value.Len()-extraOffset:])
+	copy(l.Data()[l.GetValueOffsetInData(int(l.N)):], l.Data()[l.GetValueOffsetInData(int(l.N)-1):l.GetValueOffsetInData(index-1)])
+	PutPageOffset(l.Data()[l.GetValueOffsetInData(index):], l.OffsetSize(), valueOffset-extraOffset)
+
+	l.SetHead(l.Head() + len(key) + extraOffset)
+	l.SetTail(l.Tail() + value.Len() + extraOffset)
+	l.N++
+}
+
+/* DeleteAt removes key and value at 'index'. Prefix of remaining keys is kept. */
+func (l *Leaf) DeleteAt(index int) {
+	if (index < 0) || (index >= int(l.N)) {
+		panic("leaf index out of range")
 	}
 
-	copy(l.Data[keyOffset+len(key)+extraOffset:], l.Data[keyOffset:l.Head])
-	copy(l.Data[l.GetFirstKeyOffset()+extraOffset:], l.Data[l.GetFirstKeyOffset():keyOffset])
-	copy(l.Data[keyOffset+extraOffset:], key)
-	copy(l.Data[l.GetKeyOffsetInData(index+1):], l.Data[l.GetKeyOffsetInData(index):l.GetKeyOffsetInData(int(l.N))])
-	binary.LittleEndian.PutUint16(l.Data[l.GetKeyOffsetInData(index):], uint16(keyOffset+extraOffset))
+	extraOffset := l.GetExtraOffset(-1)
+	firstKeyOffset := l.GetFirstKeyOffset()
+	firstValueOffset := l.GetFirstValueOffset()
+	keyOffset, keyLength := l.GetKeyOffsetAndLength(index)
+	valueOffset, valueLength := l.GetValueOffsetAndLength(index)
 
-	copy(l.Data[len(l.Data)-int(l.Tail)-len(value)-extraOffset:], l.Data[len(l.Data)-int(l.Tail):valueOffset])
-	copy(l.Data[valueOffset-extraOffset:], l.Data[valueOffset:l.GetValueOffsetInData(int(l.N)-1)])
-	copy(l.Data[valueOffset-len(value)-extraOffset:], value)
-	copy(l.Data[l.GetValueOffsetInData(int(l.N)):], l.Data[l.GetValueOffsetInData(int(l.N)-1):l.GetValueOffsetInData(index-1)])
-	binary.LittleEndian.PutUint16(l.Data[l.GetValueOffsetInData(index):], uint16(valueOffset-extraOffset))
+	/* NOTE(anton2920): offsets are shifted first, since keys and values are moved into space released by offsets. */
+	copy(l.Data()[l.GetKeyOffsetInData(index):], l.Data()[l.GetKeyOffsetInData(index+1):l.GetKeyOffsetInData(int(l.N))])
+	copy(l.Data()[firstKeyOffset-extraOffset:], l.Data()[firstKeyOffset:keyOffset])
+	copy(l.Data()[keyOffset-extraOffset:], l.Data()[keyOffset+keyLength:l.Head()])
 
-	l.Head += uint16(len(key) + extraOffset)
-	l.Tail += uint16(len(value) + extraOffset)
-	l.N++
+	/* value3 | value2 | value1 | value0 | offt3 | offt2 | offt1 | offt0 | */
+	copy(l.Data()[l.GetValueOffsetInData(int(l.N)-2):], l.Data()[l.GetValueOffsetInData(int(l.N)-1):l.GetValueOffsetInData(index)])
+	copy(l.Data()[valueOffset+extraOffset:], l.Data()[valueOffset:firstValueOffset])
+	copy(l.Data()[l.DataSize()-l.Tail()+valueLength+extraOffset:], l.Data()[l.DataSize()-l.Tail():valueOffset-valueLength])
+
+	l.SetHead(l.Head() - (keyLength + extraOffset))
+	l.SetTail(l.Tail() - (valueLength + extraOffset))
+	l.N--
+
+	l.AddKeyOffsets(0, index, -extraOffset)
+	l.AddValueOffsets(0, index, extraOffset)
+	l.AddKeyOffsets(index, int(l.N), -(keyLength + extraOffset))
+	l.AddValueOffsets(index, int(l.N), valueLength+extraOffset)
 }
 
 func (src *Leaf) MoveData(dst *Leaf, where int, from int, to int) {
@@ -189,6 +372,12 @@ func (src *Leaf) MoveData(dst *Leaf, where int, from int, to int) {
 	}
 	count := to - from
 
+	if dst.N == 0 {
+		dst.SetHead(copy(dst.Data(), src.GetPrefix()))
+	} else if !bytes.Equal(dst.GetPrefix(), src.GetPrefix()) {
+		panic("move data between leaves with different prefixes")
+	}
+
 	/* Bulk insert to 'dst[where:]' from 'src[from:to]'. */
 	extraOffset := dst.GetExtraOffset(count)
 	whereKeyOffset, _ := dst.GetKeyOffsetAndLength(where)
@@ -208,97 +397,90 @@ func (src *Leaf) MoveData(dst *Leaf, where int, from int, to int) {
 		valueLengths += int(valueLength)
 	}
 
-	if int(dst.Head)+int(dst.Tail)+keyLengths+valueLengths+extraOffset > len(dst.Data) {
+	if dst.Head()+dst.Tail()+keyLengths+valueLengths+extraOffset > dst.DataSize() {
 		panic("move data causes overflow")
 	}
 
-	keyOffsets := dst.GetKeyOffsets()
-	valueOffsets := dst.GetValueOffsets()
 	if extraOffset > 0 {
-		for i := 0; i < where; i++ {
-			keyOffsets[i] += uint16(extraOffset)
-			valueOffsets[int(dst.N)-1-i] -= uint16(extraOffset)
-		}
-	}
-	for i := where; i < int(dst.N); i++ {
-		keyOffsets[i] += uint16(keyLengths + extraOffset)
-		valueOffsets[int(dst.N)-1-i] -= uint16(valueLengths + extraOffset)
+		dst.AddKeyOffsets(0, where, extraOffset)
+		dst.AddValueOffsets(0, where, -extraOffset)
 	}
+	dst.AddKeyOffsets(where, int(dst.N), keyLengths+extraOffset)
+	dst.AddValueOffsets(where, int(dst.N), -(valueLengths + extraOffset))
 
-	copy(dst.Data[whereKeyOffset+keyLengths+extraOffset:], dst.Data[whereKeyOffset:dst.Head])
-	copy(dst.Data[dst.GetFirstKeyOffset()+extraOffset:], dst.Data[dst.GetFirstKeyOffset():whereKeyOffset])
-	copy(dst.Data[whereKeyOffset+extraOffset:], src.Data[fromKeyOffset:fromKeyOffset+keyLengths])
-	copy(dst.Data[dst.GetKeyOffsetInData(where+count):], dst.Data[dst.GetKeyOffsetInData(where):dst.GetKeyOffsetInData(int(dst.N))])
+	copy(dst.Data()[whereKeyOffset+keyLengths+extraOffset:], dst.Data()[whereKeyOffset:dst.Head()])
+	copy(dst.Data()[dst.GetFirstKeyOffset()+extraOffset:], dst.Data()[dst.GetFirstKeyOffset():whereKeyOffset])
+	copy(dst.Data()[whereKeyOffset+extraOffset:], src.Data()[fromKeyOffset:fromKeyOffset+keyLengths])
+	copy(dst.Data()[dst.GetKeyOffsetInData(where+count):], dst.Data()[dst.GetKeyOffsetInData(where):dst.GetKeyOffsetInData(int(dst.N))])
 
-	offset := uint16(whereKeyOffset + extraOffset)
-	binary.LittleEndian.PutUint16(dst.Data[dst.GetKeyOffsetInData(where):], offset)
+	offset := whereKeyOffset + extraOffset
+	PutPageOffset(dst.Data()[dst.GetKeyOffsetInData(where):], dst.OffsetSize(), offset)
 	w := where + 1
 	for i := from; i < to-1; i++ {
 		_, keyLength := src.GetKeyOffsetAndLength(i)
-		offset += uint16(keyLength)
-		binary.LittleEndian.PutUint16(dst.Data[dst.GetKeyOffsetInData(w):], offset)
+		offset += keyLength
+		PutPageOffset(dst.Data()[dst.GetKeyOffsetInData(w):], dst.OffsetSize(), offset)
 		w++
 	}
 
 	/* value3 | value2 | value1 | value0 | offt3 | offt2 | offt1 | offt0 | */
-	copy(dst.Data[len(dst.Data)-int(dst.Tail)-valueLengths-extraOffset:], dst.Data[len(dst.Data)-int(dst.Tail):whereValueOffset])
-	copy(dst.Data[whereValueOffset-extraOffset:], dst.Data[whereValueOffset:dst.GetFirstValueOffset()])
-	copy(dst.Data[whereValueOffset-valueLengths-extraOffset:], src.Data[fromValueOffset-valueLengths:fromValueOffset])
-	copy(dst.Data[dst.GetValueOffsetInData(int(dst.N)+count-1):], dst.Data[dst.GetValueOffsetInData(int(dst.N)-1):dst.GetValueOffsetInData(where-1)])
+	copy(dst.Data()[dst.DataSize()-dst.Tail()-valueLengths-extraOffset:], dst.Data()[dst.DataSize()-dst.Tail():whereValueOffset])
+	copy(dst.Data()[whereValueOffset-extraOffset:], dst.Data()[whereValueOffset:dst.GetFirstValueOffset()])
+	copy(dst.Data()[whereValueOffset-valueLengths-extraOffset:], src.Data()[fromValueOffset-valueLengths:fromValueOffset])
+	copy(dst.Data()[dst.GetValueOffsetInData(int(dst.N)+count-1):], dst.Data()[dst.GetValueOffsetInData(int(dst.N)-1):dst.GetValueOffsetInData(where-1)])
 
-	offset = uint16(whereValueOffset - extraOffset)
-	binary.LittleEndian.PutUint16(dst.Data[dst.GetValueOffsetInData(where):], offset)
+	offset = whereValueOffset - extraOffset
+	PutPageOffset(dst.Data()[dst.GetValueOffsetInData(where):], dst.OffsetSize(), offset)
 	w = where + 1
 	for i := from; i < to-1; i++ {
 		_, valueLength := src.GetValueOffsetAndLength(i)
-		offset -= uint16(valueLength)
-		binary.LittleEndian.PutUint16(dst.Data[dst.GetValueOffsetInData(w):], offset)
+		offset -= valueLength
+		PutPageOffset(dst.Data()[dst.GetValueOffsetInData(w):], dst.OffsetSize(), offset)
 		w++
 	}
 
-	dst.Head += uint16(keyLengths + extraOffset)
-	dst.Tail += uint16(valueLengths + extraOffset)
-	dst.N += uint8(count)
+	dst.SetHead(dst.Head() + keyLengths + extraOffset)
+	dst.SetTail(dst.Tail() + valueLengths + extraOffset)
+	dst.N += uint16(count)
 
 	/* Bulk remove of 'src[from:to]'.*/
 	extraOffset = src.GetExtraOffset(-count)
 
-	keyOffsets = src.GetKeyOffsets()
-	valueOffsets = src.GetValueOffsets()
 	if extraOffset > 0 {
-		for i := 0; i < from; i++ {
-			keyOffsets[i] -= uint16(extraOffset)
-			valueOffsets[int(src.N)-1-i] += uint16(extraOffset)
-		}
-	}
-	for i := to; i < int(src.N); i++ {
-		keyOffsets[i] -= uint16(keyLengths + extraOffset)
-		valueOffsets[int(src.N)-1-i] += uint16(valueLengths + extraOffset)
+		src.AddKeyOffsets(0, from, -extraOffset)
+		src.AddValueOffsets(0, from, extraOffset)
 	}
+	src.AddKeyOffsets(to, int(src.N), -(keyLengths + extraOffset))
+	src.AddValueOffsets(to, int(src.N), valueLengths+extraOffset)
 
-	copy(src.Data[src.GetKeyOffsetInData(from):], src.Data[src.GetKeyOffsetInData(to):src.GetKeyOffsetInData(int(src.N))])
-	copy(src.Data[src.GetFirstKeyOffset()-extraOffset:], src.Data[src.GetFirstKeyOffset():fromKeyOffset])
-	copy(src.Data[fromKeyOffset-extraOffset:], src.Data[fromKeyOffset+keyLengths:src.Head])
+	copy(src.Data()[src.GetKeyOffsetInData(from):], src.Data()[src.GetKeyOffsetInData(to):src.GetKeyOffsetInData(int(src.N))])
+	copy(src.Data()[src.GetFirstKeyOffset()-extraOffset:], src.Data()[src.GetFirstKeyOffset():fromKeyOffset])
+	copy(src.Data()[fromKeyOffset-extraOffset:], src.Data()[fromKeyOffset+keyLengths:src.Head()])
 
-	copy(src.Data[src.GetValueOffsetInData(from):], src.Data[src.GetValueOffsetInData(int(src.N)-1):src.GetValueOffsetInData(to-1)])
-	copy(src.Data[fromValueOffset+extraOffset:], src.Data[fromValueOffset:src.GetFirstValueOffset()])
-	copy(src.Data[len(src.Data)-int(src.Tail)+valueLengths+extraOffset:], src.Data[len(src.Data)-int(src.Tail):fromValueOffset-valueLengths])
+	copy(src.Data()[src.GetValueOffsetInData(from):], src.Data()[src.GetValueOffsetInData(int(src.N)-1):src.GetValueOffsetInData(to-1)])
+	copy(src.Data()[fromValueOffset+extraOffset:], src.Data()[fromValueOffset:src.GetFirstValueOffset()])
+	copy(src.Data()[src.DataSize()-src.Tail()+valueLengths+extraOffset:], src.Data()[src.DataSize()-src.Tail():fromValueOffset-valueLengths])
 
-	src.Head -= uint16(keyLengths + extraOffset)
-	src.Tail -= uint16(valueLengths + extraOffset)
-	src.N -= uint8(count)
+	src.SetHead(src.Head() - (keyLengths + extraOffset))
+	src.SetTail(src.Tail() - (valueLengths + extraOffset))
+	src.N -= uint16(count)
 }
 
-func (l *Leaf) OverflowAfterInsertKeyValue(keyLength int, valueLength int) bool {
-	return (int8(l.N) == ^0) || (int(l.Head)+int(l.Tail)+keyLength+valueLength+2*l.GetExtraOffset(1) > len(l.Data))
+func (l *Leaf) OverflowAfterInsertKeyValue(key []byte, valueLength int) bool {
+	/* Keys without leaf's prefix make all other keys longer. */
+	prefix := l.GetPrefix()
+	common := CommonPrefixLength(key, prefix)
+	growth := (len(prefix) - common) * int(l.N)
+
+	return (l.N == PageMaxEntries) || (l.Head()+l.Tail()+growth+len(key)-common+valueLength+2*l.GetExtraOffset(1) > l.DataSize())
 }
 
 func (l *Leaf) OverflowAfterInsertKeyValueInEmpty(keyLength int, valueLength int) bool {
-	return keyLength+valueLength+2*l.GetExtraOffset(1) > len(l.Data)
+	return keyLength+valueLength+2*l.GetExtraOffset(1) > l.DataSize()
 }
 
 func (l *Leaf) OverflowAfterInsertValue(valueLength int) bool {
-	return (int8(l.N) == ^0) || (int(l.Head)+int(l.Tail)+valueLength+2*l.GetExtraOffset(1) > len(l.Data))
+	return l.Head()+l.Tail()+valueLength+2*l.GetExtraOffset(1) > l.DataSize()
 }
 
 func (l *Leaf) SetKeyValueAt(key []byte, value []byte, index int) {
@@ -306,50 +488,54 @@ func (l *Leaf) SetKeyValueAt(key []byte, value []byte, index int) {
 		panic("leaf index out of range")
 	}
 
+	prefix := l.GetPrefix()
+	if !bytes.HasPrefix(key, prefix) {
+		panic("key does not have leaf's prefix")
+	}
+	key = key[len(prefix):]
+
 	keyOffset, keyLength := l.GetKeyOffsetAndLength(index)
 	valueOffset, valueLength := l.GetValueOffsetAndLength(index)
-	if int(l.Head)+int(l.Tail)+len(key)+len(value)-keyLength-valueLength > len(l.Data) {
+	if l.Head()+l.Tail()+len(key)+len(value)-keyLength-valueLength > l.DataSize() {
 		panic("set key-value causes overflow")
 	}
 
-	copy(l.Data[keyOffset+len(key):], l.Data[keyOffset+keyLength:l.Head])
-	copy(l.Data[keyOffset:], key)
+	copy(l.Data()[keyOffset+len(key):], l.Data()[keyOffset+keyLength:l.Head()])
+	copy(l.Data()[keyOffset:], key)
 
 	/* value3 | value2 | value1 | value0 | offt3 | offt2 | offt1 | offt0 | */
-	copy(l.Data[len(l.Data)-int(l.Tail)-len(value)+valueLength:], l.Data[len(l.Data)-int(l.Tail):valueOffset-valueLength])
-	copy(l.Data[valueOffset-len(value):], value)
+	copy(l.Data()[l.DataSize()-l.Tail()-len(value)+valueLength:], l.Data()[l.DataSize()-l.Tail():valueOffset-valueLength])
+	copy(l.Data()[valueOffset-len(value):], value)
 
-	keyOffsets := l.GetKeyOffsets()
-	valueOffsets := l.GetValueOffsets()
-	for i := index + 1; i < int(l.N); i++ {
-		keyOffsets[i] += uint16(len(key) - keyLength)
-		valueOffsets[int(l.N)-1-i] -= uint16(len(value) - valueLength)
-	}
+	l.AddKeyOffsets(index+1, int(l.N), len(key)-keyLength)
+	l.AddValueOffsets(index+1, int(l.N), -(len(value) - valueLength))
 
-	l.Head += uint16(len(key) - keyLength)
-	l.Tail += uint16(len(value) - valueLength)
+	l.SetHead(l.Head() + len(key) - keyLength)
+	l.SetTail(l.Tail() + len(value) - valueLength)
 }
 
 func (l *Leaf) SetValueAt(value []byte, index int) {
+	l.SetEncodedValueAt(EncodeRaw(value), index)
+}
+
+/* SetEncodedValueAt replaces value at 'index' with 'value' written right into leaf. */
+func (l *Leaf) SetEncodedValueAt(value EncodedValue, index int) {
 	if (index < 0) || (index >= int(l.N)) {
 		panic("leaf index out of range")
 	}
 
 	valueOffset, valueLength := l.GetValueOffsetAndLength(index)
-	if int(l.Head)+int(l.Tail)+len(value)-valueLength > len(l.Data) {
+	if l.Head()+l.Tail()+value.Len()-valueLength > l.DataSize() {
 		panic("set value causes overflow")
 	}
 
 	/* value3 | value2 | value1 | value0 | offt3 | offt2 | offt1 | offt0 | */
-	copy(l.Data[len(l.Data)-int(l.Tail)-len(value)+valueLength:], l.Data[len(l.Data)-int(l.Tail):valueOffset-valueLength])
-	copy(l.Data[valueOffset-len(value):], value)
+	copy(l.Data()[l.DataSize()-l.Tail()-value.Len()+valueLength:], l.Data()[l.DataSize()-l.Tail():valueOffset-valueLength])
+	value.Put(l.Data()[valueOffset-value.Len():])
 
-	valueOffsets := l.GetValueOffsets()
-	for i := index + 1; i < int(l.N); i++ {
-		valueOffsets[int(l.N)-1-i] -= uint16(len(value) - valueLength)
-	}
+	l.AddValueOffsets(index+1, int(l.N), -(value.Len() - valueLength))
 
-	l.Tail += uint16(len(value) - valueLength)
+	l.SetTail(l.Tail() + value.Len() - valueLength)
 }
 
 func (l *Leaf) String() string {
@@ -360,7 +546,7 @@ func (l *Leaf) String() string {
 		if i > 0 {
 			buf.WriteString(", ")
 		}
-		fmt.Fprintf(&buf, "%v", l.GetKeyAt(i))
+		fmt.Fprintf(&buf, "%v", l.AppendKeyAt(nil, i))
 	}
 
 	buf.WriteString("], Values: [")
@@ -378,8 +564,8 @@ func (l *Leaf) String() string {
 
 func (l *Leaf) Reset() {
 	l.N = 0
-	l.Head = 0
-	l.Tail = 0
+	l.SetHead(0)
+	l.SetTail(0)
 }
 
 func (l *Leaf) Page() *Page {
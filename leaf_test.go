@@ -1,6 +1,50 @@
 package main
 
-import "testing"
+import (
+	"bytes"
+	"testing"
+)
+
+func TestLeafPrefix(t *testing.T) {
+	var page Page
+	page.Init(PageTypeLeaf)
+
+	leaf := page.Leaf()
+	keys := [][]byte{[]byte("tenant-1/b"), []byte("tenant-1/c"), []byte("tenant-1/a"), []byte("tenant-2/a")}
+	for i, key := range keys[:2] {
+		leaf.InsertKeyValueAt(key, FullValue(key), i)
+	}
+
+	leaf.Compact()
+	if prefix := string(leaf.GetPrefix()); prefix != "tenant-1/" {
+		t.Fatalf("Expected prefix %q, got %q", "tenant-1/", prefix)
+	}
+
+	leaf.InsertKeyValueAt(keys[2], FullValue(keys[2]), 0)
+	leaf.InsertKeyValueAt(keys[3], FullValue(keys[3]), 3)
+	if prefix := string(leaf.GetPrefix()); prefix != "tenant-" {
+		t.Errorf("Expected prefix %q after insert, got %q", "tenant-", prefix)
+	}
+
+	expected := [][]byte{keys[2], keys[0], keys[1], keys[3]}
+	for i, key := range expected {
+		if got := leaf.AppendKeyAt(nil, i); !bytes.Equal(got, key) {
+			t.Errorf("Expected key %q at %d, got %q", key, i, got)
+		}
+		if got := leaf.GetValueAt(i); !bytes.Equal(got, FullValue(key)) {
+			t.Errorf("Expected value %q at %d, got %q", FullValue(key), i, got)
+		}
+		if pos, ok := leaf.Find(key); (!ok) || (pos+1 != i) {
+			t.Errorf("Expected to find key %q at %d, got %d", key, i, pos+1)
+		}
+	}
+	if pos, ok := leaf.Find([]byte("a")); (ok) || (pos != -1) {
+		t.Errorf("Expected key before prefix to be at -1, got %d", pos)
+	}
+	if pos, ok := leaf.Find([]byte("z")); (ok) || (pos != len(expected)-1) {
+		t.Errorf("Expected key after prefix to be at %d, got %d", len(expected)-1, pos)
+	}
+}
 
 func BenchmarkLeafInsertKeyValueAt(b *testing.B) {
 	var page Page
@@ -13,7 +57,7 @@ func BenchmarkLeafInsertKeyValueAt(b *testing.B) {
 	b.Run("Prepend", func(b *testing.B) {
 		leaf.InsertKeyValueAt(key, value, 0)
 		for i := 0; i < b.N; i++ {
-			if leaf.OverflowAfterInsertKeyValue(len(key), len(value)) {
+			if leaf.OverflowAfterInsertKeyValue(key, len(value)) {
 				leaf.Reset()
 			}
 			leaf.InsertKeyValueAt(key, value, 0)
@@ -22,10 +66,123 @@ func BenchmarkLeafInsertKeyValueAt(b *testing.B) {
 	b.Run("Append", func(b *testing.B) {
 		leaf.InsertKeyValueAt(key, value, 0)
 		for i := 0; i < b.N; i++ {
-			if leaf.OverflowAfterInsertKeyValue(len(key), len(value)) {
+			if leaf.OverflowAfterInsertKeyValue(key, len(value)) {
 				leaf.Reset()
 			}
 			leaf.InsertKeyValueAt(key, value, int(leaf.N))
 		}
 	})
 }
+
+func TestLeafDeleteAt(t *testing.T) {
+	var page Page
+	page.Init(PageTypeLeaf)
+
+	leaf := page.Leaf()
+	for i := 0; i < 3*ExtraOffsetAfter; i++ {
+		leaf.InsertKeyValueAt(int2Slice(i), FullValue(int2Slice(i)), i)
+	}
+	leaf.Compact()
+
+	/* Remove every third entry from the end, so that offsets shrink over several blocks. */
+	expected := make([]int, 0, leaf.N)
+	for i := 0; i < int(leaf.N); i++ {
+		if i%3 != 0 {
+			expected = append(expected, i)
+		}
+	}
+	for i := int(leaf.N) - 1; i >= 0; i-- {
+		if i%3 == 0 {
+			leaf.DeleteAt(i)
+		}
+	}
+
+	if int(leaf.N) != len(expected) {
+		t.Fatalf("Expected %d entries, got %d", len(expected), leaf.N)
+	}
+	for i, k := range expected {
+		if got := leaf.AppendKeyAt(nil, i); !bytes.Equal(got, int2Slice(k)) {
+			t.Errorf("Expected key %v at %d, got %v", int2Slice(k), i, got)
+		}
+		if got := leaf.GetValueAt(i); !bytes.Equal(got, FullValue(int2Slice(k))) {
+			t.Errorf("Expected value %v at %d, got %v", FullValue(int2Slice(k)), i, got)
+		}
+	}
+
+	/* Entries inserted after deletes must fit exactly into space released by them. */
+	leaf.InsertKeyValueAt(int2Slice(3), FullValue(int2Slice(3)), 2)
+	expected = append(expected[:2], append([]int{3}, expected[2:]...)...)
+	for i, k := range expected {
+		if got := leaf.GetValueAt(i); !bytes.Equal(got, FullValue(int2Slice(k))) {
+			t.Errorf("Expected value %v at %d after insert, got %v", FullValue(int2Slice(k)), i, got)
+		}
+	}
+	if size := leaf.GetFirstKeyOffset() + len(leaf.GetPrefix()) + len(expected)*(len(int2Slice(0))-len(leaf.GetPrefix())); leaf.Head() != size {
+		t.Errorf("Expected head %d, got %d", size, leaf.Head())
+	}
+
+	for leaf.N > 0 {
+		leaf.DeleteAt(int(leaf.N) / 2)
+	}
+	if (leaf.Tail() != 0) || (leaf.Head() != len(leaf.GetPrefix())) {
+		t.Errorf("Expected empty leaf, got head %d and tail %d", leaf.Head(), leaf.Tail())
+	}
+}
+
+func TestLeafFindWithHints(t *testing.T) {
+	var page Page
+	page.Init(PageTypeLeaf)
+
+	/* Keys are chosen so that many of them have equal hints. */
+	leaf := page.Leaf()
+	for i := 0; i < 200; i++ {
+		key := []byte{byte(i / 50), 0, byte(i % 7), 0, byte(i)}
+		if !leaf.OverflowAfterInsertKeyValue(key, 1) {
+			pos, ok := leaf.Find(key)
+			if !ok {
+				leaf.InsertKeyValueAt(key, []byte{byte(i)}, pos+1)
+			}
+		}
+	}
+	leaf.BuildHints()
+	if leaf.GetHints() == nil {
+		t.Fatalf("Expected leaf with %d entries to have space for hints", leaf.N)
+	}
+
+	for i := 0; i < 256; i++ {
+		for _, key := range [...][]byte{{byte(i / 50), 0, byte(i % 7), 0, byte(i)}, {byte(i / 50)}, {byte(i / 50), 0, byte(i % 7), 0, byte(i), 0}} {
+			expectedPos, expectedOk := leaf.Find(key)
+			if pos, ok := leaf.FindWithHints(key); (pos != expectedPos) || (ok != expectedOk) {
+				t.Errorf("Expected to find key %v at (%d, %t), got (%d, %t)", key, expectedPos, expectedOk, pos, ok)
+			}
+		}
+	}
+}
+
+func BenchmarkLeafFind(b *testing.B) {
+	var page Page
+	page.Init(PageTypeLeaf)
+
+	leaf := page.Leaf()
+	keys := make([][]byte, 256)
+	for i := range keys {
+		keys[i] = Uint16ToBytes(uint16(i * 257))
+		pos, _ := leaf.Find(keys[i])
+		leaf.InsertKeyValueAt(keys[i], nil, pos+1)
+	}
+	leaf.BuildHints()
+	if leaf.GetHints() == nil {
+		b.Fatalf("Expected leaf with %d entries to have space for hints", leaf.N)
+	}
+
+	b.Run("Find", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			leaf.Find(keys[i%len(keys)])
+		}
+	})
+	b.Run("FindWithHints", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			leaf.FindWithHints(keys[i%len(keys)])
+		}
+	})
+}
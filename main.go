@@ -39,7 +39,7 @@ func TreePrintSeq(t *Tree) {
 func main() {
 	var pager MemoryPager
 
-	t, err := GetTreeAt(&pager, -1)
+	t, err := GetTreeAtWithOptions(&pager, -1, TreeOptions{MaxOrder: 5})
 	if err != nil {
 		log.Fatalf("Failed to get first tree: %v", err)
 	}
@@ -55,7 +55,7 @@ func main() {
 	fmt.Println(t)
 	TreePrintSeq(t)
 
-	t, err = GetTreeAt(&pager, -1)
+	t, err = GetTreeAtWithOptions(&pager, -1, TreeOptions{MaxOrder: 5})
 	if err != nil {
 		log.Fatalf("Failed to get second tree: %v", err)
 	}
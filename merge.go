@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/anton2920/gofa/errors"
+	"github.com/anton2920/gofa/trace"
+)
+
+/* MergeOperator combines existing 'value' with 'operand' and returns new value. 'value' is nil if there's no such key yet. 'value' is a copy, so it may be modified and returned. */
+type MergeOperator func(value []byte, operand []byte) ([]byte, error)
+
+/* Merge combines value for 'key' with 'operand' using 'Tree.MergeOperator' and commits the change. Existing value is read and new one is written while tree is locked, so concurrent merges are never lost. */
+func (t *Tree) Merge(key []byte, operand []byte) error {
+	defer trace.End(trace.Begin(""))
+
+	if t.MergeOperator == nil {
+		return errors.New("tree has no merge operator")
+	}
+
+	page := t.getPage()
+	defer t.putPage(page)
+
+	t.Lock()
+	err := t.update(key, func(leaf *Leaf, old []byte) (EncodedValue, []byte, error) {
+		var value []byte
+		if old = t.liveValue(old); old != nil {
+			var err error
+			if value, err = t.appendValue(t.MergeBuffer[:0], old, page); err != nil {
+				return EncodedValue{}, nil, err
+			}
+		}
+
+		value, err := t.MergeOperator(value, operand)
+		if err != nil {
+			return EncodedValue{}, nil, fmt.Errorf("failed to merge value: %v", err)
+		}
+		t.MergeBuffer = value
+
+		v, err := t.encodeValue(leaf, key, value, 0)
+		return v, value, err
+	})
+	if err == nil {
+		err = t.writeMeta()
+	}
+	t.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return t.sync()
+}
+
+/* MergeAddInt64 adds 8-byte little-endian integers. */
+func MergeAddInt64(value []byte, operand []byte) ([]byte, error) {
+	x, err := mergeGetInt64(value)
+	if err != nil {
+		return nil, err
+	}
+	y, err := mergeGetInt64(operand)
+	if err != nil {
+		return nil, err
+	}
+	return mergePutInt64(value, x+y), nil
+}
+
+/* MergeMaxInt64 keeps the largest of 8-byte little-endian integers. */
+func MergeMaxInt64(value []byte, operand []byte) ([]byte, error) {
+	y, err := mergeGetInt64(operand)
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		return mergePutInt64(nil, y), nil
+	}
+
+	x, err := mergeGetInt64(value)
+	if err != nil {
+		return nil, err
+	}
+	if y > x {
+		x = y
+	}
+	return mergePutInt64(value, x), nil
+}
+
+/* MergeAppend appends 'operand' to the end of value. */
+func MergeAppend(value []byte, operand []byte) ([]byte, error) {
+	return append(value, operand...), nil
+}
+
+/* MergeSetUnion adds elements of set 'operand' to set 'value'. Sets are encoded with 'MergeSet'. */
+func MergeSetUnion(value []byte, operand []byte) ([]byte, error) {
+	xs, err := MergeSetElements(value)
+	if err != nil {
+		return nil, err
+	}
+	ys, err := MergeSetElements(operand)
+	if err != nil {
+		return nil, err
+	}
+	return MergeSet(append(xs, ys...)...), nil
+}
+
+/* MergeSet encodes sorted set of unique 'elements', each of them prefixed with its length as uvarint. */
+func MergeSet(elements ...[]byte) []byte {
+	var buffer []byte
+
+	sort.Slice(elements, func(i, j int) bool { return bytes.Compare(elements[i], elements[j]) < 0 })
+	for i, element := range elements {
+		if (i > 0) && (bytes.Equal(elements[i-1], element)) {
+			continue
+		}
+		var length [binary.MaxVarintLen64]byte
+		buffer = append(buffer, length[:binary.PutUvarint(length[:], uint64(len(element)))]...)
+		buffer = append(buffer, element...)
+	}
+
+	return buffer
+}
+
+/* MergeSetElements decodes set encoded with 'MergeSet'. Elements point into 'value'. */
+func MergeSetElements(value []byte) ([][]byte, error) {
+	var elements [][]byte
+
+	for len(value) > 0 {
+		length, n := binary.Uvarint(value)
+		if (n <= 0) || (uint64(len(value)-n) < length) {
+			return nil, errors.New("malformed set")
+		}
+		elements = append(elements, value[n:n+int(length)])
+		value = value[n+int(length):]
+	}
+
+	return elements, nil
+}
+
+func mergeGetInt64(value []byte) (int64, error) {
+	switch len(value) {
+	case 0:
+		return 0, nil
+	case 8:
+		return int64(binary.LittleEndian.Uint64(value)), nil
+	default:
+		return 0, fmt.Errorf("expected 8-byte integer, got %d bytes", len(value))
+	}
+}
+
+/* mergePutInt64 stores 'x' in 'value', reusing its memory if it's large enough. */
+func mergePutInt64(value []byte, x int64) []byte {
+	if cap(value) < 8 {
+		value = make([]byte, 8)
+	}
+	value = value[:8]
+	binary.LittleEndian.PutUint64(value, uint64(x))
+	return value
+}
@@ -1,6 +1,9 @@
 package main
 
-import "unsafe"
+import (
+	"bytes"
+	"unsafe"
+)
 
 type Meta struct {
 	PageHeader
@@ -11,7 +14,127 @@ type Meta struct {
 	Root        int64
 	EndSentinel int64
 
-	_ [PageSize - PageHeaderSize - 4*unsafe.Sizeof(int64(0))]byte
+	/* Parameters chosen when tree was created. */
+	PageSize   int64
+	OffsetSize int64
+	MaxOrder   int64
+	FillFactor int64
+
+	/* FreeList is an index of the first page in list of freed pages, which are reused before new pages are appended. Zero means list is empty. */
+	FreeList int64
+
+	/* Features is a set of 'TreeFeature*' flags tree was written with. Trees of versions before 5 have zero here. */
+	Features int64
+
+	/* KeyID identifies key pages of tree are encrypted with, see 'KeyIdentifier'. Zero means tree is not encrypted. */
+	KeyID int64
+
+	/* ValueThreshold is a length above which values are stored in 'ValueLog', if tree has one. Zero means values are never stored there. */
+	ValueThreshold int64
+
+	/* DedupMeta is an index of 'Meta' of tree, which maps hashes of values with 'ValueTypeShared' to their pages and reference counts. Zero means values are not deduplicated. */
+	DedupMeta int64
+
+	/* ComparatorName is a name of 'Comparator' keys are ordered with, padded with zeroes. Empty name means keys are ordered bytewise. */
+	ComparatorName [TreeComparatorNameSize]byte
+
+	/* Sequence is a number of the next value added to multimap tree. Values of the same key are ordered by their numbers. */
+	Sequence int64
+
+	/* IndexCatalog is an index of 'Meta' of tree, which maps names of secondary indexes to indexes of 'Meta' of their trees. Zero means tree has no indexes. */
+	IndexCatalog int64
+
+	/* Schema is an encoded 'Schema' of table stored in tree, see 'CreateTable'. SchemaLength of zero means tree is not a table. */
+	SchemaLength int64
+	Schema       [TreeSchemaSize]byte
+
+	_ [PageSize - PageHeaderSize - 16*unsafe.Sizeof(int64(0)) - TreeComparatorNameSize - TreeSchemaSize]byte
+}
+
+const (
+	/* TreeComparatorNameSize is a maximum length of 'Comparator' name. */
+	TreeComparatorNameSize = 64
+
+	/* TreeSchemaSize is a maximum length of encoded 'Schema'. */
+	TreeSchemaSize = 2048
+)
+
+const (
+	/* TreeFeatureWideHeader means pages use 'PageHeader' instead of 'PageHeaderV1'. */
+	TreeFeatureWideHeader = int64(1 << iota)
+
+	/* TreeFeaturePrefix means common prefix of keys in 'Leaf' and 'Node' pages may be stored only once. */
+	TreeFeaturePrefix
+
+	/* TreeFeatureHints means 'Leaf' and 'Node' pages have key hints in their free space. */
+	TreeFeatureHints
+
+	/* TreeFeatureValueLog means leaves may have values of 'ValueTypeLog'. */
+	TreeFeatureValueLog
+
+	/* TreeFeatureExtents means large values are stored in runs of contiguous pages with 'ValueTypeExtent' instead of chains of 'Overflow' pages. */
+	TreeFeatureExtents
+
+	/* TreeFeatureTTL means leaves may have values of 'ValueTypeTTL'. */
+	TreeFeatureTTL
+
+	/* TreeFeatureDedup means leaves may have values of 'ValueTypeShared'. */
+	TreeFeatureDedup
+
+	/* TreeFeatureComparator means keys are ordered with 'Comparator' named in 'Meta.ComparatorName'. */
+	TreeFeatureComparator
+
+	/* TreeFeatureMulti means tree is a multimap, see 'Tree.Add'. */
+	TreeFeatureMulti
+
+	TreeFeaturesSupported = TreeFeatureWideHeader | TreeFeaturePrefix | TreeFeatureHints | TreeFeatureValueLog | TreeFeatureExtents | TreeFeatureTTL | TreeFeatureDedup | TreeFeatureComparator | TreeFeatureMulti
+
+	/* TreeFeaturesOptional are features tree has only if it was created with corresponding 'TreeOptions'. */
+	TreeFeaturesOptional = TreeFeatureComparator | TreeFeatureMulti
+
+	/* TreeFeaturesBytewise are features of trees with bytewise order of keys. */
+	TreeFeaturesBytewise = TreeFeaturesSupported &^ TreeFeaturesOptional
+
+	/* TreeFeaturesComparator are features of trees with 'Comparator'. Prefix compression and key hints rely on bytewise order, so such trees don't have them. */
+	TreeFeaturesComparator = (TreeFeaturesSupported &^ (TreeFeaturePrefix | TreeFeatureHints | TreeFeaturesOptional)) | TreeFeatureComparator
+)
+
+/* TreeVersionFeatures returns features implied by 'version' for trees written before features were recorded in 'Meta'. */
+func TreeVersionFeatures(version int64) int64 {
+	var features int64
+
+	if version >= 2 {
+		features |= TreeFeatureWideHeader
+	}
+	if version >= 3 {
+		features |= TreeFeaturePrefix
+	}
+	if version >= 4 {
+		features |= TreeFeatureHints
+	}
+
+	return features
+}
+
+func (m *Meta) HasFeature(feature int64) bool {
+	return (m.Features & feature) == feature
+}
+
+/* LatestFeatures returns features tree written by this build has. */
+func (m *Meta) LatestFeatures() int64 {
+	features := TreeFeaturesBytewise
+	if m.HasFeature(TreeFeatureComparator) {
+		features = TreeFeaturesComparator
+	}
+	return features | (m.Features & TreeFeatureMulti)
+}
+
+func (m *Meta) GetComparatorName() string {
+	name := m.ComparatorName[:]
+	if n := bytes.IndexByte(name, 0); n >= 0 {
+		name = name[:n]
+	}
+	return string(name)
 }
 
 func (m *Meta) Page() *Page {
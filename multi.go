@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/anton2920/gofa/errors"
+	"github.com/anton2920/gofa/trace"
+)
+
+/* MultiIterator returns values of one key of multimap tree in order they were added. */
+type MultiIterator struct {
+	*TreeForwardIterator
+
+	ValuePage   *Page
+	ValueBuffer []byte
+}
+
+/* NOTE(anton2920): every value of multimap is stored as separate entry with key | escaped key | sequence number |, encoded with 'AppendKey', so values of one key are next to each other in order they were added and there's no limit on their number. */
+func multiKey(buf []byte, key []byte, seq int64) []byte {
+	return AppendKeyUint64(AppendKeyBytes(buf, key), uint64(seq))
+}
+
+/* multiRange returns bounds of keys of entries which hold values of 'key'. */
+func multiRange(key []byte) ([]byte, []byte) {
+	start := AppendKeyBytes(nil, key)
+
+	/* NOTE(anton2920): escaped key ends with | 0x00 0x01 |, so incrementing last byte gives the least key after all entries of 'key'. */
+	end := append([]byte{}, start...)
+	end[len(end)-1]++
+
+	return start, end
+}
+
+func (t *Tree) checkMulti() error {
+	if !t.Meta.HasFeature(TreeFeatureMulti) {
+		return errors.New("tree is not a multimap, it must be created with 'TreeOptions.Multi'")
+	}
+	return nil
+}
+
+/* Add adds 'value' to values of 'key' in multimap tree and commits the change. Values added before are kept, even if they are equal to 'value'. */
+func (t *Tree) Add(key []byte, value []byte) error {
+	defer trace.End(trace.Begin(""))
+
+	if err := t.checkMulti(); err != nil {
+		return err
+	}
+
+	t.Lock()
+	err := t.set(multiKey(nil, key, t.Meta.Sequence), value, false)
+	if err == nil {
+		t.Meta.Sequence++
+		t.MetaDirty = true
+		err = t.writeMeta()
+	}
+	t.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return t.sync()
+}
+
+/* GetAll returns iterator over values of 'key' in multimap tree. Like other iterators, it must not be used while tree is modified. */
+func (t *Tree) GetAll(key []byte) (*MultiIterator, error) {
+	defer trace.End(trace.Begin(""))
+
+	if err := t.checkMulti(); err != nil {
+		return nil, err
+	}
+
+	start, end := multiRange(key)
+	it, err := t.Seek(start)
+	if err != nil {
+		return nil, err
+	}
+	it.End = end
+
+	return &MultiIterator{TreeForwardIterator: it, ValuePage: t.NewPage()}, nil
+}
+
+/* Value returns current value. It's valid until the next call to 'Next'. */
+func (it *MultiIterator) Value() ([]byte, error) {
+	var err error
+	it.ValueBuffer, err = it.appendValue(it.ValueBuffer[:0], it.TreeForwardIterator.Value(), it.ValuePage)
+	return it.ValueBuffer, err
+}
+
+/* Remove removes all values of 'key' equal to 'value' from multimap tree and commits the change. It returns number of removed values. */
+func (t *Tree) Remove(key []byte, value []byte) (int, error) {
+	defer trace.End(trace.Begin(""))
+
+	if err := t.checkMulti(); err != nil {
+		return 0, err
+	}
+
+	t.Lock()
+	removed, err := t.remove(key, value)
+	if err == nil {
+		err = t.writeMeta()
+	}
+	t.Unlock()
+	if err != nil {
+		return removed, err
+	}
+
+	return removed, t.sync()
+}
+
+func (t *Tree) remove(key []byte, value []byte) (int, error) {
+	var keys [][]byte
+
+	it, err := t.GetAll(key)
+	if err != nil {
+		return 0, err
+	}
+	for it.Next() {
+		v, err := it.Value()
+		if err != nil {
+			return 0, fmt.Errorf("failed to read value: %v", err)
+		}
+		if bytes.Equal(v, value) {
+			keys = append(keys, append([]byte{}, it.Key()...))
+		}
+	}
+
+	for i, key := range keys {
+		if err := t.del(key); err != nil {
+			return i, err
+		}
+	}
+
+	return len(keys), nil
+}
@@ -14,8 +14,8 @@ import (
 type Node struct {
 	PageHeader
 
-	/* Data is structured as follows: | N*sizeof(uint16) bytes of keyOffsets | keys... | ...empty space... | N*sizeof(int64) bytes of children | */
-	Data [PageSize - PageHeaderSize]byte
+	/* data is structured as follows: | N*OffsetSize() bytes of keyOffsets | prefix | keys... | ...empty space... | N*sizeof(int64) bytes of children |, where prefix is common to all keys and is stored only once. Pages larger than 'PageSize' continue past the end of 'Node', see 'Data'. */
+	data [PageSize - PageHeaderSize]byte
 }
 
 func init() {
@@ -23,7 +23,7 @@ func init() {
 	page.Init(PageTypeNode)
 
 	node := page.Node()
-	debug.Printf("[node]: len(Node.Data) == %d\n", len(node.Data))
+	debug.Printf("[node]: len(Node.Data()) == %d\n", len(node.Data()))
 
 	node.Init([]byte{1, 2, 3, 4}, 0, 1)
 	debug.Printf("[node]: %v\n", node)
@@ -44,77 +44,182 @@ func init() {
 }
 
 func (n *Node) Init(key []byte, child0 int64, child1 int64) {
-	extraOffset := GetExtraOffset(0, 1)
+	extraOffset := GetExtraOffset(0, 1, n.OffsetSize())
 
 	n.SetChildAt(child0, -1)
 	n.SetChildAt(child1, 0)
 
-	n.Head = uint16(extraOffset)
-	n.Tail = uint16(unsafe.Sizeof(child0)) * 2
+	n.SetHead(extraOffset)
+	n.SetTail(int(unsafe.Sizeof(child0)) * 2)
 	n.N = 1
 
-	binary.LittleEndian.PutUint16(n.Data[n.GetKeyOffsetInData(0):], uint16(extraOffset))
+	PutPageOffset(n.Data()[n.GetKeyOffsetInData(0):], n.OffsetSize(), extraOffset)
 	n.SetKeyAt(key, 0)
 }
 
+/* Find returns index of child which may contain 'key'. */
 func (n *Node) Find(key []byte) int {
+	return n.find(key, nil, nil)
+}
+
+/* FindWithHints is like 'Find', but uses key hints stored in page. Hints must be up to date, see 'BuildHints'. */
+func (n *Node) FindWithHints(key []byte) int {
+	return n.find(key, n.GetHints(), nil)
+}
+
+/* FindWithComparator is like 'Find', but orders keys with 'cmp'. Node must have no prefix. */
+func (n *Node) FindWithComparator(key []byte, cmp Comparator) int {
+	return n.find(key, nil, cmp)
+}
+
+func (n *Node) find(key []byte, hints []byte, cmp Comparator) int {
 	defer trace.End(trace.Begin(""))
 
-	if res := bytes.Compare(key, n.GetKeyAt(int(n.N)-1)); res >= 0 {
+	prefix := n.GetPrefix()
+	if !bytes.HasPrefix(key, prefix) {
+		if bytes.Compare(key, prefix) < 0 {
+			return -1
+		}
 		return int(n.N) - 1
 	}
-	for i := 0; i < int(n.N); i++ {
-		if bytes.Compare(key, n.GetKeyAt(i)) < 0 {
-			return i - 1
+	key = key[len(prefix):]
+	hint := KeyHint(key)
+
+	lo, hi := 0, int(n.N)
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+
+		res := CompareKeyHints(hint, hints, mid)
+		if cmp != nil {
+			res = cmp.Compare(key, n.GetKeyAt(mid))
+		} else if res == 0 {
+			res = bytes.Compare(key, n.GetKeyAt(mid))
+		}
+
+		if res < 0 {
+			hi = mid
+		} else {
+			lo = mid + 1
 		}
 	}
-	return int(n.N) - 1
+
+	return lo - 1
+}
+
+/* GetHints returns key hints stored in free space after keys, or nil if there's not enough space for them. */
+func (n *Node) GetHints() []byte {
+	size := int(n.N) * KeyHintSize
+	if n.Head()+n.Tail()+size > n.DataSize() {
+		return nil
+	}
+	return n.Data()[n.Head() : n.Head()+size]
+}
+
+/* BuildHints stores key hints in free space of node. They are overwritten by any subsequent modification. */
+func (n *Node) BuildHints() {
+	if hints := n.GetHints(); hints != nil {
+		PutKeyHints(hints, int(n.N), n.GetKeyAt)
+	}
 }
 
 func (n *Node) GetChildAt(index int) int64 {
-	return int64(binary.LittleEndian.Uint64(n.Data[n.GetChildOffsetInData(index):]))
+	return int64(binary.LittleEndian.Uint64(n.Data()[n.GetChildOffsetInData(index):]))
 }
 
 func (n *Node) GetChildOffsetInData(index int) int {
 	var i int64
-	return len(n.Data) - (index+2)*int(unsafe.Sizeof(i))
+	return n.DataSize() - (index+2)*int(unsafe.Sizeof(i))
+}
+
+func (n *Node) DataSize() int {
+	return n.Size() - int(unsafe.Offsetof(n.data)) - n.FooterSize()
+}
+
+/* Data returns 'DataSize' bytes of node after its header. */
+func (n *Node) Data() []byte {
+	return *(*[]byte)(unsafe.Pointer(&reflect.SliceHeader{Data: uintptr(unsafe.Pointer(&n.data[0])), Len: n.DataSize(), Cap: n.DataSize()}))
 }
 
 func (n *Node) GetExtraOffset(count int) int {
-	return GetExtraOffset(int(n.N), count)
+	return GetExtraOffset(int(n.N), count, n.OffsetSize())
 }
 
 func (n *Node) GetFirstKeyOffset() int {
-	return GetExtraOffset(0, int(n.N))
+	return GetExtraOffset(0, int(n.N), n.OffsetSize())
 }
 
+/* GetPrefix returns bytes common to all keys in node. They are stored only once, right before the first key. */
+func (n *Node) GetPrefix() []byte {
+	offset, _ := n.GetKeyOffsetAndLength(0)
+	return n.Data()[n.GetFirstKeyOffset():offset]
+}
+
+/* SetPrefixLength re-encodes node, so that first 'length' bytes of its keys are stored only once. All keys must have these bytes in common. */
+func (n *Node) SetPrefixLength(length int) {
+	var child int64
+
+	buffer := make([]byte, n.Size())
+	old := n.Page().Clone().Node()
+
+	/* NOTE(anton2920): prefix is immediately followed by the rest of the first key. */
+	offset, keyLength := old.GetKeyOffsetAndLength(0)
+	prefix := old.Data()[old.GetFirstKeyOffset() : offset+keyLength][:length]
+
+	n.N = 0
+	n.SetHead(copy(n.Data(), prefix))
+	n.SetTail(int(unsafe.Sizeof(child)))
+	n.SetChildAt(old.GetChildAt(-1), -1)
+	for i := 0; i < int(old.N); i++ {
+		n.InsertKeyChildAt(old.AppendKeyAt(buffer[:0], i), old.GetChildAt(i), i)
+	}
+}
+
+/* Compact stores the longest prefix common to all keys only once. */
+func (n *Node) Compact() {
+	if n.N > 0 {
+		if common := CommonPrefixLength(n.GetKeyAt(0), n.GetKeyAt(int(n.N)-1)); common > 0 {
+			n.SetPrefixLength(len(n.GetPrefix()) + common)
+		}
+	}
+}
+
+/* AppendKeyAt appends full key at 'index' to 'buf'. */
+func (n *Node) AppendKeyAt(buf []byte, index int) []byte {
+	return append(append(buf, n.GetPrefix()...), n.GetKeyAt(index)...)
+}
+
+/* GetKeyAt returns key at 'index' without prefix. */
 func (n *Node) GetKeyAt(index int) []byte {
 	offset, length := n.GetKeyOffsetAndLength(index)
-	return n.Data[offset : offset+length]
+	return n.Data()[offset : offset+length]
 }
 
 func (n *Node) GetKeyOffsetAndLength(index int) (offset int, length int) {
 	switch {
 	case index < int(n.N)-1:
-		offset = int(binary.LittleEndian.Uint16(n.Data[n.GetKeyOffsetInData(index):]))
-		length = int(binary.LittleEndian.Uint16(n.Data[n.GetKeyOffsetInData(index+1):])) - offset
+		offset = GetPageOffset(n.Data()[n.GetKeyOffsetInData(index):], n.OffsetSize())
+		length = GetPageOffset(n.Data()[n.GetKeyOffsetInData(index+1):], n.OffsetSize()) - offset
 	case index == int(n.N)-1:
-		offset = int(binary.LittleEndian.Uint16(n.Data[n.GetKeyOffsetInData(index):]))
-		length = int(n.Head) - offset
+		offset = GetPageOffset(n.Data()[n.GetKeyOffsetInData(index):], n.OffsetSize())
+		length = n.Head() - offset
 	case index > int(n.N)-1:
-		offset = int(n.Head)
+		offset = n.Head()
 		length = 0
 	}
 	return
 }
 
 func (n *Node) GetKeyOffsetInData(index int) int {
-	var keyOffset uint16
-	return int(unsafe.Sizeof(keyOffset)) * index
+	return n.OffsetSize() * index
 }
 
-func (n *Node) GetKeyOffsets() []uint16 {
-	return *(*[]uint16)(unsafe.Pointer(&reflect.SliceHeader{Data: uintptr(unsafe.Pointer(&n.Data[0])), Len: int(n.N), Cap: int(n.N)}))
+/* AddKeyOffsets adds 'delta' to offsets of keys from 'from' up to, but not including, 'to'. */
+func (n *Node) AddKeyOffsets(from int, to int, delta int) {
+	data, size := n.Data(), n.OffsetSize()
+	for i := from; i < to; i++ {
+		offset := data[n.GetKeyOffsetInData(i):]
+		PutPageOffset(offset, size, GetPageOffset(offset, size)+delta)
+	}
 }
 
 func (n *Node) InsertKeyChildAt(key []byte, child int64, index int) {
@@ -122,33 +227,35 @@ func (n *Node) InsertKeyChildAt(key []byte, child int64, index int) {
 		panic("node index out of range")
 	}
 
+	prefix := n.GetPrefix()
+	if !bytes.HasPrefix(key, prefix) {
+		n.SetPrefixLength(CommonPrefixLength(key, prefix))
+		prefix = n.GetPrefix()
+	}
+	key = key[len(prefix):]
+
 	extraOffset := n.GetExtraOffset(1)
 	offset, _ := n.GetKeyOffsetAndLength(index)
-	if int(n.Head)+int(n.Tail)+len(key)+int(unsafe.Sizeof(child))+extraOffset > len(n.Data) {
+	if n.Head()+n.Tail()+len(key)+int(unsafe.Sizeof(child))+extraOffset > n.DataSize() {
 		panic("insert key-child causes overflow")
 	}
 
-	keyOffsets := n.GetKeyOffsets()
 	if extraOffset > 0 {
-		for i := 0; i < index; i++ {
-			keyOffsets[i] += uint16(extraOffset)
-		}
-	}
-	for i := index; i < int(n.N); i++ {
-		keyOffsets[i] += uint16(len(key) + int(extraOffset))
+		n.AddKeyOffsets(0, index, extraOffset)
 	}
+	n.AddKeyOffsets(index, int(n.N), len(key)+extraOffset)
 
-	copy(n.Data[offset+len(key)+extraOffset:], n.Data[offset:n.Head])
-	copy(n.Data[n.GetFirstKeyOffset()+extraOffset:], n.Data[n.GetFirstKeyOffset():offset])
-	copy(n.Data[offset+int(extraOffset):], key)
-	copy(n.Data[n.GetKeyOffsetInData(index+1):], n.Data[n.GetKeyOffsetInData(index):n.GetKeyOffsetInData(int(n.N))])
-	binary.LittleEndian.PutUint16(n.Data[n.GetKeyOffsetInData(index):], uint16(offset+int(extraOffset)))
+	copy(n.Data()[offset+len(key)+extraOffset:], n.Data()[offset:n.Head()])
+	copy(n.Data()[n.GetFirstKeyOffset()+extraOffset:], n.Data()[n.GetFirstKeyOffset():offset])
+	copy(n.Data()[offset+int(extraOffset):], key)
+	copy(n.Data()[n.GetKeyOffsetInData(index+1):], n.Data()[n.GetKeyOffsetInData(index):n.GetKeyOffsetInData(int(n.N))])
+	PutPageOffset(n.Data()[n.GetKeyOffsetInData(index):], n.OffsetSize(), offset+extraOffset)
 
-	copy(n.Data[n.GetChildOffsetInData(int(n.N)):], n.Data[n.GetChildOffsetInData(int(n.N)-1):n.GetChildOffsetInData(index-1)])
+	copy(n.Data()[n.GetChildOffsetInData(int(n.N)):], n.Data()[n.GetChildOffsetInData(int(n.N)-1):n.GetChildOffsetInData(index-1)])
 	n.SetChildAt(child, index)
 
-	n.Head += uint16(len(key) + extraOffset)
-	n.Tail += uint16(unsafe.Sizeof(child))
+	n.SetHead(n.Head() + len(key) + extraOffset)
+	n.SetTail(n.Tail() + int(unsafe.Sizeof(child)))
 	n.N++
 }
 
@@ -164,6 +271,12 @@ func (src *Node) MoveData(dst *Node, where int, from int, to int) {
 	}
 	count := to - from
 
+	if dst.N == 0 {
+		dst.SetHead(copy(dst.Data(), src.GetPrefix()))
+	} else if !bytes.Equal(dst.GetPrefix(), src.GetPrefix()) {
+		panic("move data between nodes with different prefixes")
+	}
+
 	/* Bulk insert keys to 'dst[where+1:]' from 'src[from+1:to]' and children to 'dst[where:]' from 'src[from:to]'. */
 	extraOffset := dst.GetExtraOffset(count - 1)
 	whereKeyOffset, _ := dst.GetKeyOffsetAndLength(where + 1)
@@ -178,36 +291,31 @@ func (src *Node) MoveData(dst *Node, where int, from int, to int) {
 
 	childrenLengths := int(unsafe.Sizeof(child)) * count
 
-	if int(dst.Head)+int(dst.Tail)+keyLengths+childrenLengths+extraOffset > len(dst.Data) {
+	if dst.Head()+dst.Tail()+keyLengths+childrenLengths+extraOffset > dst.DataSize() {
 		panic("move data causes overflow")
 	}
 
-	keyOffsets := dst.GetKeyOffsets()
 	if extraOffset > 0 {
-		for i := 0; i < where+1; i++ {
-			keyOffsets[i] += uint16(extraOffset)
-		}
-	}
-	for i := where + 1; i < int(dst.N); i++ {
-		keyOffsets[i] += uint16(keyLengths + extraOffset)
+		dst.AddKeyOffsets(0, where+1, extraOffset)
 	}
+	dst.AddKeyOffsets(where+1, int(dst.N), keyLengths+extraOffset)
 
-	copy(dst.Data[whereKeyOffset+keyLengths+extraOffset:], dst.Data[whereKeyOffset:dst.Head])
-	copy(dst.Data[dst.GetFirstKeyOffset()+extraOffset:], dst.Data[dst.GetFirstKeyOffset():whereKeyOffset])
-	copy(dst.Data[whereKeyOffset+extraOffset:], src.Data[fromKeyOffset:fromKeyOffset+keyLengths])
-	copy(dst.Data[dst.GetKeyOffsetInData(where+count):], dst.Data[dst.GetKeyOffsetInData(where+1):dst.GetKeyOffsetInData(int(dst.N))])
+	copy(dst.Data()[whereKeyOffset+keyLengths+extraOffset:], dst.Data()[whereKeyOffset:dst.Head()])
+	copy(dst.Data()[dst.GetFirstKeyOffset()+extraOffset:], dst.Data()[dst.GetFirstKeyOffset():whereKeyOffset])
+	copy(dst.Data()[whereKeyOffset+extraOffset:], src.Data()[fromKeyOffset:fromKeyOffset+keyLengths])
+	copy(dst.Data()[dst.GetKeyOffsetInData(where+count):], dst.Data()[dst.GetKeyOffsetInData(where+1):dst.GetKeyOffsetInData(int(dst.N))])
 
-	offset := uint16(whereKeyOffset + extraOffset)
-	binary.LittleEndian.PutUint16(dst.Data[dst.GetKeyOffsetInData(where+1):], offset)
+	offset := whereKeyOffset + extraOffset
+	PutPageOffset(dst.Data()[dst.GetKeyOffsetInData(where+1):], dst.OffsetSize(), offset)
 	w := where + 2
 	for i := from + 1; i < to-1; i++ {
 		_, keyLength := src.GetKeyOffsetAndLength(i)
-		offset += uint16(keyLength)
-		binary.LittleEndian.PutUint16(dst.Data[dst.GetKeyOffsetInData(w):], offset)
+		offset += keyLength
+		PutPageOffset(dst.Data()[dst.GetKeyOffsetInData(w):], dst.OffsetSize(), offset)
 		w++
 	}
 
-	copy(dst.Data[dst.GetChildOffsetInData(int(dst.N)+where-1):], dst.Data[dst.GetChildOffsetInData(int(dst.N)-1):dst.GetChildOffsetInData(where-1)])
+	copy(dst.Data()[dst.GetChildOffsetInData(int(dst.N)+where-1):], dst.Data()[dst.GetChildOffsetInData(int(dst.N)-1):dst.GetChildOffsetInData(where-1)])
 
 	w = where
 	for i := from; i < to; i++ {
@@ -215,22 +323,17 @@ func (src *Node) MoveData(dst *Node, where int, from int, to int) {
 		w++
 	}
 
-	dst.Head += uint16(keyLengths + extraOffset)
-	dst.Tail += uint16(childrenLengths)
-	dst.N += uint8(count - 1)
+	dst.SetHead(dst.Head() + keyLengths + extraOffset)
+	dst.SetTail(dst.Tail() + childrenLengths)
+	dst.N += uint16(count - 1)
 
 	/* Bulk remove of 'src[from:to]'.*/
 	extraOffset = src.GetExtraOffset(-count)
 
-	keyOffsets = src.GetKeyOffsets()
 	if extraOffset > 0 {
-		for i := 0; i < from; i++ {
-			keyOffsets[i] -= uint16(extraOffset)
-		}
-	}
-	for i := to; i < int(src.N); i++ {
-		keyOffsets[i] -= uint16(keyLengths + extraOffset)
+		src.AddKeyOffsets(0, from, -extraOffset)
 	}
+	src.AddKeyOffsets(to, int(src.N), -(keyLengths + extraOffset))
 
 	keyLengths = 0
 	fromKeyOffset, fromKeyLength = src.GetKeyOffsetAndLength(from)
@@ -241,24 +344,30 @@ func (src *Node) MoveData(dst *Node, where int, from int, to int) {
 		keyLengths += int(keyLength)
 	}
 
-	copy(src.Data[src.GetKeyOffsetInData(from):], src.Data[src.GetKeyOffsetInData(to):src.GetKeyOffsetInData(int(src.N))])
-	copy(src.Data[src.GetFirstKeyOffset()-extraOffset:], src.Data[src.GetFirstKeyOffset():fromKeyOffset])
-	copy(src.Data[fromKeyOffset-extraOffset:], src.Data[fromKeyOffset+keyLengths:src.Head])
+	copy(src.Data()[src.GetKeyOffsetInData(from):], src.Data()[src.GetKeyOffsetInData(to):src.GetKeyOffsetInData(int(src.N))])
+	copy(src.Data()[src.GetFirstKeyOffset()-extraOffset:], src.Data()[src.GetFirstKeyOffset():fromKeyOffset])
+	copy(src.Data()[fromKeyOffset-extraOffset:], src.Data()[fromKeyOffset+keyLengths:src.Head()])
 
-	copy(src.Data[src.GetChildOffsetInData(from):], src.Data[src.GetChildOffsetInData(int(src.N)-1):src.GetChildOffsetInData(to-1)])
+	copy(src.Data()[src.GetChildOffsetInData(from):], src.Data()[src.GetChildOffsetInData(int(src.N)-1):src.GetChildOffsetInData(to-1)])
 
-	src.Head -= uint16(keyLengths + extraOffset)
-	src.Tail -= uint16(childrenLengths)
-	src.N -= uint8(count)
+	src.SetHead(src.Head() - (keyLengths + extraOffset))
+	src.SetTail(src.Tail() - childrenLengths)
+	src.N -= uint16(count)
 }
 
-func (n *Node) OverflowAfterInsertKeyChild(keyLength int) bool {
+func (n *Node) OverflowAfterInsertKeyChild(key []byte) bool {
 	var child int64
-	return int(n.Head)+int(n.Tail)+keyLength+int(unsafe.Sizeof(child))+n.GetExtraOffset(1) > len(n.Data)
+
+	/* Keys without node's prefix make all other keys longer. */
+	prefix := n.GetPrefix()
+	common := CommonPrefixLength(key, prefix)
+	growth := (len(prefix) - common) * int(n.N)
+
+	return n.Head()+n.Tail()+growth+len(key)-common+int(unsafe.Sizeof(child))+n.GetExtraOffset(1) > n.DataSize()
 }
 
 func (n *Node) SetChildAt(offset int64, index int) {
-	binary.LittleEndian.PutUint64(n.Data[n.GetChildOffsetInData(index):], uint64(offset))
+	binary.LittleEndian.PutUint64(n.Data()[n.GetChildOffsetInData(index):], uint64(offset))
 }
 
 func (n *Node) SetKeyAt(key []byte, index int) {
@@ -266,21 +375,24 @@ func (n *Node) SetKeyAt(key []byte, index int) {
 		panic("node index out of range")
 	}
 
+	prefix := n.GetPrefix()
+	if !bytes.HasPrefix(key, prefix) {
+		n.SetPrefixLength(CommonPrefixLength(key, prefix))
+		prefix = n.GetPrefix()
+	}
+	key = key[len(prefix):]
+
 	offset, length := n.GetKeyOffsetAndLength(index)
-	if int(n.Head)+int(n.Tail)+len(key)-length > len(n.Data) {
+	if n.Head()+n.Tail()+len(key)-length > n.DataSize() {
 		panic("set key causes overflow")
 	}
 
-	keyOffsets := n.GetKeyOffsets()
-	for i := index + 1; i < int(n.N); i++ {
-		keyOffsets[i] += uint16(len(key) - length)
-	}
+	n.AddKeyOffsets(index+1, int(n.N), len(key)-length)
 
-	/* TODO(anton2920): find the minimum number of bytes so that this key is still distinct from other keys. */
-	copy(n.Data[offset+len(key):], n.Data[offset+length:n.Head])
-	copy(n.Data[offset:], key)
+	copy(n.Data()[offset+len(key):], n.Data()[offset+length:n.Head()])
+	copy(n.Data()[offset:], key)
 
-	n.Head += uint16(len(key) - length)
+	n.SetHead(n.Head() + len(key) - length)
 }
 
 func (n *Node) String() string {
@@ -299,9 +411,13 @@ func (n *Node) String() string {
 		if i > 0 {
 			buf.WriteString(", ")
 		}
-		fmt.Fprintf(&buf, "%v", n.GetKeyAt(i))
+		fmt.Fprintf(&buf, "%v", n.AppendKeyAt(nil, i))
 	}
 
 	buf.WriteString("] }")
 	return buf.String()
 }
+
+func (n *Node) Page() *Page {
+	return (*Page)(unsafe.Pointer(n))
+}
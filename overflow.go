@@ -1,20 +1,38 @@
 package main
 
-import "unsafe"
+import (
+	"reflect"
+	"unsafe"
+)
 
 type Overflow struct {
 	PageHeader
 
 	Next int64
 
-	Data [PageSize - PageHeaderSize - unsafe.Sizeof(int64(0))]byte
+	/* data continues past the end of 'Overflow' for pages larger than 'PageSize', see 'Data'. Its first 'Head' bytes are used. */
+	data [PageSize - PageHeaderSize - unsafe.Sizeof(int64(0))]byte
 }
 
+func (o *Overflow) DataSize() int {
+	return o.Size() - int(unsafe.Offsetof(o.data)) - o.FooterSize()
+}
+
+/* Data returns 'DataSize' bytes of overflow after its header. */
+func (o *Overflow) Data() []byte {
+	return *(*[]byte)(unsafe.Pointer(&reflect.SliceHeader{Data: uintptr(unsafe.Pointer(&o.data[0])), Len: o.DataSize(), Cap: o.DataSize()}))
+}
+
+/* SetValue stores as much of the tail of 'value' as fits and returns what is left. */
 func (o *Overflow) SetValue(value []byte) []byte {
-	o.Head = uint16(copy(o.Data[:], value[len(value)-len(o.Data):]))
-	return value[:len(value)-int(o.Head)]
+	tail := value
+	if len(tail) > o.DataSize() {
+		tail = tail[len(tail)-o.DataSize():]
+	}
+	o.SetHead(copy(o.Data(), tail))
+	return value[:len(value)-o.Head()]
 }
 
 func (o *Overflow) GetValue() []byte {
-	return o.Data[:o.Head]
+	return o.Data()[:o.Head()]
 }
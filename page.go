@@ -1,6 +1,8 @@
 package main
 
 import (
+	"encoding/binary"
+	"fmt"
 	"log"
 	"reflect"
 	"unsafe"
@@ -13,16 +15,46 @@ type PageType uint8
 type Page [PageSize]byte
 
 type PageHeader struct {
+	_ [0]int64
+
 	Type PageType
-	N    uint8
-	Head uint16
-	Tail uint16
-	_    [2]byte
+
+	/* Shift is a binary logarithm of page size, 0 means 'PageSize'. */
+	Shift uint8
+
+	N uint16
+
+	/* head and tail are low 16 bits of offsets 'Head' and 'Tail' return. Pages over 'PageWideSize' keep high bits in their last 'PageFooterSize' bytes. */
+	head uint16
+	tail uint16
+}
+
+/* PageHeaderV1 is a layout of page header used by trees of version 1. */
+type PageHeaderV1 struct {
+	Type  PageType
+	N     uint8
+	Head  uint16
+	Tail  uint16
+	Shift uint8
+	_     [1]byte
 }
 
 const (
-	PageSize       = 4096
+	PageMaxEntries   = 1<<16 - 1
+	PageMaxEntriesV1 = 1<<8 - 1
+
+	/* PageSize is a size of pages pager reads and writes and a default page size of trees. */
+	PageSize = 4096
+
+	/* MinPageSize and MaxPageSize are the smallest and the largest page sizes trees may use. Pages smaller than 'PageSize' share pages of pager, larger ones take several of them. */
+	MinPageSize = 512
+	MaxPageSize = 1 << 18
+
+	/* PageWideSize is the largest page size with 2-byte offsets, larger pages use 4-byte ones. */
+	PageWideSize = 1 << 16
+
 	PageHeaderSize = unsafe.Sizeof(PageHeader{})
+	PageFooterSize = 4
 )
 
 const (
@@ -31,17 +63,22 @@ const (
 	PageTypeNode
 	PageTypeLeaf
 	PageTypeOverflow
+	PageTypeFree
 )
 
 /* TODO(anton2920): find the best constant for time-space tradeoff. */
 const ExtraOffsetAfter = 16
 
+/* KeyHintSize is a width of key hints: first bytes of keys in big-endian order, padded with zeroes. Trees of version 4 and later keep array of them in free space of 'Leaf' and 'Node' pages, so binary search rarely has to follow key offsets. */
+const KeyHintSize = 4
+
 func init() {
 	var p Page
 	var m Meta
 	var n Node
 	var l Leaf
 	var o Overflow
+	var f Free
 
 	const (
 		psize = unsafe.Sizeof(p)
@@ -49,10 +86,11 @@ func init() {
 		nsize = unsafe.Sizeof(n)
 		lsize = unsafe.Sizeof(l)
 		osize = unsafe.Sizeof(o)
+		fsize = unsafe.Sizeof(f)
 	)
 
-	if (psize != msize) || (psize != nsize) || (psize != lsize) || (psize != osize) {
-		log.Panicf("[tree]: sizeof(Page) == %d, sizeof(Meta) == %d, sizeof(Node) == %d, sizeof(Leaf) == %d, sizeof(Oveflow) == %d", psize, msize, nsize, lsize, osize)
+	if (psize != msize) || (psize != nsize) || (psize != lsize) || (psize != osize) || (psize != fsize) {
+		log.Panicf("[tree]: sizeof(Page) == %d, sizeof(Meta) == %d, sizeof(Node) == %d, sizeof(Leaf) == %d, sizeof(Oveflow) == %d, sizeof(Free) == %d", psize, msize, nsize, lsize, osize, fsize)
 	}
 }
 
@@ -60,8 +98,129 @@ func (p *Page) Init(typ PageType) {
 	hdr := p.Header()
 	hdr.Type = typ
 	hdr.N = 0
-	hdr.Head = 0
-	hdr.Tail = 0
+	hdr.head = 0
+	hdr.tail = 0
+	hdr.Shift = 0
+}
+
+func (hdr *PageHeader) Size() int {
+	if hdr.Shift == 0 {
+		return PageSize
+	}
+	return 1 << hdr.Shift
+}
+
+func (hdr *PageHeader) SetSize(size int) {
+	hdr.Shift = 0
+	if size != PageSize {
+		for (1 << hdr.Shift) < size {
+			hdr.Shift++
+		}
+	}
+}
+
+/* OffsetSize returns width of offsets inside page. */
+func (hdr *PageHeader) OffsetSize() int {
+	return PageOffsetSize(hdr.Size())
+}
+
+/* FooterSize returns number of bytes at the end of page, which keep high bits of 'Head' and 'Tail'. */
+func (hdr *PageHeader) FooterSize() int {
+	if hdr.Size() > PageWideSize {
+		return PageFooterSize
+	}
+	return 0
+}
+
+func (hdr *PageHeader) footer() []byte {
+	return *(*[]byte)(unsafe.Pointer(&reflect.SliceHeader{Data: uintptr(unsafe.Pointer(hdr)) + uintptr(hdr.Size()-PageFooterSize), Len: PageFooterSize, Cap: PageFooterSize}))
+}
+
+func (hdr *PageHeader) Head() int {
+	if hdr.FooterSize() == 0 {
+		return int(hdr.head)
+	}
+	return int(hdr.head) | int(binary.LittleEndian.Uint16(hdr.footer()[0:]))<<16
+}
+
+func (hdr *PageHeader) SetHead(head int) {
+	hdr.head = uint16(head)
+	if hdr.FooterSize() != 0 {
+		binary.LittleEndian.PutUint16(hdr.footer()[0:], uint16(head>>16))
+	}
+}
+
+func (hdr *PageHeader) Tail() int {
+	if hdr.FooterSize() == 0 {
+		return int(hdr.tail)
+	}
+	return int(hdr.tail) | int(binary.LittleEndian.Uint16(hdr.footer()[2:]))<<16
+}
+
+func (hdr *PageHeader) SetTail(tail int) {
+	hdr.tail = uint16(tail)
+	if hdr.FooterSize() != 0 {
+		binary.LittleEndian.PutUint16(hdr.footer()[2:], uint16(tail>>16))
+	}
+}
+
+/* CheckPageSize returns error if 'size' cannot be used as a page size. */
+func CheckPageSize(size int) error {
+	if (size < MinPageSize) || (size > MaxPageSize) || (size&(size-1) != 0) {
+		return fmt.Errorf("page size must be a power of two between %d and %d, got %d", MinPageSize, MaxPageSize, size)
+	}
+	return nil
+}
+
+/* PageOffsetSize returns width of offsets inside pages of 'size' bytes. */
+func PageOffsetSize(size int) int {
+	if size > PageWideSize {
+		return 4
+	}
+	return 2
+}
+
+func GetPageOffset(buf []byte, offsetSize int) int {
+	if offsetSize == 4 {
+		return int(binary.LittleEndian.Uint32(buf))
+	}
+	return int(binary.LittleEndian.Uint16(buf))
+}
+
+func PutPageOffset(buf []byte, offsetSize int, offset int) {
+	if offsetSize == 4 {
+		binary.LittleEndian.PutUint32(buf, uint32(offset))
+	} else {
+		binary.LittleEndian.PutUint16(buf, uint16(offset))
+	}
+}
+
+/* UpgradeHeaderV1 converts header of a page read from tree of version 1 to the current layout. */
+func (p *Page) UpgradeHeaderV1() {
+	old := *(*PageHeaderV1)(unsafe.Pointer(p))
+
+	hdr := p.Header()
+	hdr.Type = old.Type
+	hdr.Shift = old.Shift
+	hdr.N = uint16(old.N)
+	hdr.head = old.Head
+	hdr.tail = old.Tail
+}
+
+/* DowngradeHeaderV1 converts header of a page to the layout of version 1, so it can be written to tree of that version. */
+func (p *Page) DowngradeHeaderV1() {
+	hdr := *p.Header()
+	if hdr.N > PageMaxEntriesV1 {
+		log.Panicf("[tree]: page with %d entries cannot be stored in tree of version 1", hdr.N)
+	}
+
+	old := (*PageHeaderV1)(unsafe.Pointer(p))
+	*old = PageHeaderV1{}
+	old.Type = hdr.Type
+	old.N = uint8(hdr.N)
+	old.Head = hdr.head
+	old.Tail = hdr.tail
+	old.Shift = hdr.Shift
 }
 
 func (p *Page) Header() *PageHeader {
@@ -104,16 +263,71 @@ func (p *Page) Overflow() *Overflow {
 	return (*Overflow)(unsafe.Pointer(p))
 }
 
-func GetExtraOffset(n int, count int) int {
-	var offset uint16
+func (p *Page) Free() *Free {
+	hdr := p.Header()
+	if hdr.Type != PageTypeFree {
+		log.Panicf("Page has type %d, but tried to use it as '*Free'", hdr.Type)
+	}
+	return (*Free)(unsafe.Pointer(p))
+}
 
+func GetExtraOffset(n int, count int, offsetSize int) int {
 	if count > 0 {
-		return (((count + (n % ExtraOffsetAfter) - 1) / ExtraOffsetAfter) + util.Bool2Int((n%ExtraOffsetAfter) == 0)) * int(unsafe.Sizeof(offset)) * ExtraOffsetAfter
+		return (((count + (n % ExtraOffsetAfter) - 1) / ExtraOffsetAfter) + util.Bool2Int((n%ExtraOffsetAfter) == 0)) * offsetSize * ExtraOffsetAfter
 	} else {
-		return (((-count + (ExtraOffsetAfter - (n % ExtraOffsetAfter))) / ExtraOffsetAfter) - util.Bool2Int((n%ExtraOffsetAfter) == 0)) * int(unsafe.Sizeof(offset)) * ExtraOffsetAfter
+		return (((-count + (ExtraOffsetAfter - (n % ExtraOffsetAfter))) / ExtraOffsetAfter) - util.Bool2Int((n%ExtraOffsetAfter) == 0)) * offsetSize * ExtraOffsetAfter
 	}
 }
 
+/* CommonPrefixLength returns number of leading bytes 'a' and 'b' have in common. */
+func CommonPrefixLength(a []byte, b []byte) int {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
+
+/* KeyHint returns hint for 'key'. If KeyHint(a) < KeyHint(b), then 'a' is less than 'b'. */
+func KeyHint(key []byte) uint32 {
+	var buffer [KeyHintSize]byte
+	copy(buffer[:], key)
+	return binary.BigEndian.Uint32(buffer[:])
+}
+
+/* CompareKeyHints compares 'hint' with 'index'th element of 'hints'. Result of 0 means keys have to be compared in full. */
+func CompareKeyHints(hint uint32, hints []byte, index int) int {
+	if hints == nil {
+		return 0
+	}
+
+	other := binary.BigEndian.Uint32(hints[index*KeyHintSize:])
+	switch {
+	case hint < other:
+		return -1
+	case hint > other:
+		return 1
+	}
+	return 0
+}
+
+/* PutKeyHints stores hints for 'n' keys returned by 'getKeyAt' into 'hints'. */
+func PutKeyHints(hints []byte, n int, getKeyAt func(int) []byte) {
+	for i := 0; i < n; i++ {
+		binary.BigEndian.PutUint32(hints[i*KeyHintSize:], KeyHint(getKeyAt(i)))
+	}
+}
+
+/* ShortestSeparator returns the shortest prefix of 'b' which is greater than 'a', so that a < separator <= b. Requires 'a' to be less than 'b'. */
+func ShortestSeparator(a []byte, b []byte) []byte {
+	return b[:CommonPrefixLength(a, b)+1]
+}
+
 func Page2Slice(p *Page) []Page {
 	return *(*[]Page)(unsafe.Pointer(&reflect.SliceHeader{Data: uintptr(unsafe.Pointer(p)), Len: 1, Cap: 1}))
 }
@@ -121,3 +335,16 @@ func Page2Slice(p *Page) []Page {
 func Pages2Bytes(ps []Page) []byte {
 	return *(*[]byte)(unsafe.Pointer(&reflect.SliceHeader{Data: uintptr(unsafe.Pointer(&ps[0])), Len: len(ps) * PageSize, Cap: cap(ps) * PageSize}))
 }
+
+/* Page2Pages returns 'n' pages starting with 'p', which must be the first of at least 'n' contiguous pages. */
+func Page2Pages(p *Page, n int) []Page {
+	return *(*[]Page)(unsafe.Pointer(&reflect.SliceHeader{Data: uintptr(unsafe.Pointer(p)), Len: n, Cap: n}))
+}
+
+/* Clone returns copy of page, which may be larger than 'PageSize'. */
+func (p *Page) Clone() *Page {
+	size := p.Header().Size()
+	pages := make([]Page, (size+PageSize-1)/PageSize)
+	copy(Pages2Bytes(pages), Pages2Bytes(Page2Pages(p, len(pages)))[:size])
+	return &pages[0]
+}
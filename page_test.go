@@ -1,9 +1,6 @@
 package main
 
-import (
-	"testing"
-	"unsafe"
-)
+import "testing"
 
 func TestGetExtraOffset(t *testing.T) {
 	/* ((count + l.N%Extra - 1) / Extra) + (l.N%Extra==0) */
@@ -76,11 +73,30 @@ func TestGetExtraOffset(t *testing.T) {
 		{9, 4, 1},
 	}
 	for _, test := range tests {
-		extra := GetExtraOffset(test.N, test.Count)
-		extra /= ExtraOffsetAfter * int(unsafe.Sizeof(uint16(0)))
+		extra := GetExtraOffset(test.N, test.Count, 2)
+		extra /= ExtraOffsetAfter * 2
 
 		if extra != test.Extra {
 			t.Errorf("For N = %d, count = %d expected %d, but got %d", test.N, test.Count, test.Extra, extra)
 		}
 	}
 }
+
+func TestShortestSeparator(t *testing.T) {
+	tests := [...]struct {
+		A, B     string
+		Expected string
+	}{
+		{"a", "b", "b"},
+		{"abc", "abd", "abd"},
+		{"tenant-1/zzzz", "tenant-2/aaaa", "tenant-2"},
+		{"abc", "abcdef", "abcd"},
+		{"", "abc", "a"},
+	}
+
+	for _, test := range tests {
+		if got := string(ShortestSeparator([]byte(test.A), []byte(test.B))); got != test.Expected {
+			t.Errorf("Expected separator between %q and %q to be %q, got %q", test.A, test.B, test.Expected, got)
+		}
+	}
+}
@@ -1,8 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
 	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/anton2920/gofa/errors"
 	"github.com/anton2920/gofa/trace"
 )
 
@@ -11,21 +23,72 @@ type Pager interface {
 	WritePagesAt(pages []Page, index int64) (int64, error)
 }
 
+/* Reserver is implemented by pagers which can append 'n' pages without writing them, so that they are written later with 'WritePagesAt'. Contents of such pages are undefined until then. */
+type Reserver interface {
+	ReservePages(n int64) (int64, error)
+}
+
+/* ErrPagesOutOfBounds is returned by pagers when requested pages don't exist. */
+var ErrPagesOutOfBounds = errors.New("pages index out of bounds")
+
+/* Syncer is implemented by pagers which can make previous writes durable. */
+type Syncer interface {
+	Sync(d Durability) error
+}
+
+type Durability int
+
+const (
+	/* DurabilityDefault uses durability level configured in pager. */
+	DurabilityDefault = Durability(iota)
+
+	/* DurabilityNone never syncs; writes become durable whenever OS decides so. */
+	DurabilityNone
+
+	/* DurabilitySync syncs on every commit. */
+	DurabilitySync
+
+	/* DurabilityGroup delays sync for 'GroupWindow', so that all commits made meanwhile share one sync. */
+	DurabilityGroup
+)
+
+/* CommitStats describes latency of commits made through 'Syncer'. */
+type CommitStats struct {
+	Commits int64
+	Syncs   int64
+
+	TotalLatency time.Duration
+	MaxLatency   time.Duration
+}
+
+type syncGroup struct {
+	Done chan struct{}
+	Err  error
+}
+
+/* MemoryPager keeps pages in memory. Like other pagers, it's safe for concurrent use, since pages may be read by 'ReadAheadPager' in background while tree writes them. */
 type MemoryPager struct {
+	sync.RWMutex
 	Pages []Page
 }
 
-var _ Pager = new(MemoryPager)
+var (
+	_ Pager    = new(MemoryPager)
+	_ Reserver = new(MemoryPager)
+)
 
 func (p *MemoryPager) ReadPagesAt(pages []Page, index int64) (int64, error) {
 	defer trace.End(trace.Begin(""))
 
+	p.RLock()
+	defer p.RUnlock()
+
 	if index < 0 {
 		index = int64(len(p.Pages))
 	}
 
 	if (index < 0) || (index >= int64(len(p.Pages))) {
-		return index, fmt.Errorf("pages index out of bounds")
+		return index, ErrPagesOutOfBounds
 	}
 
 	copy(pages, p.Pages[index:])
@@ -35,29 +98,151 @@ func (p *MemoryPager) ReadPagesAt(pages []Page, index int64) (int64, error) {
 func (p *MemoryPager) WritePagesAt(pages []Page, index int64) (int64, error) {
 	defer trace.End(trace.Begin(""))
 
+	p.Lock()
+	defer p.Unlock()
+
 	if index < 0 {
 		index = int64(len(p.Pages))
 	}
 
 	if (index < 0) || (index >= int64(len(p.Pages))+1) {
-		return -1, fmt.Errorf("pages index out of bounds")
+		return -1, ErrPagesOutOfBounds
 	}
 
-	if index == int64(len(p.Pages)) {
-		p.Pages = append(p.Pages, pages...)
-	} else {
-		copy(p.Pages[index:], pages)
-	}
+	n := copy(p.Pages[index:], pages)
+	p.Pages = append(p.Pages, pages[n:]...)
+
+	return index, nil
+}
+
+func (p *MemoryPager) ReservePages(n int64) (int64, error) {
+	p.Lock()
+	defer p.Unlock()
 
+	index := int64(len(p.Pages))
+	p.Pages = append(p.Pages, make([]Page, n)...)
 	return index, nil
 }
 
-/*
 type FilePager struct {
 	File *os.File
+
+	/* Count is a number of pages in file. */
+	Count int64
+
+	Durability  Durability
+	GroupWindow time.Duration
+
+	sync.Mutex
+	Group *syncGroup
+	Stats CommitStats
+}
+
+var (
+	_ Pager    = new(FilePager)
+	_ Syncer   = new(FilePager)
+	_ Reserver = new(FilePager)
+)
+
+/* FilePagerDefaultGroupWindow is a time 'DurabilityGroup' commits wait for others when 'FilePager.GroupWindow' is not set. */
+const FilePagerDefaultGroupWindow = 2 * time.Millisecond
+
+/* ReadAheadPager fetches pages which are likely to be requested next in background, with one multi-page read. Underlying pager is read from background goroutine while tree writes to it, so it must be safe for concurrent use. */
+type ReadAheadPager struct {
+	Pager
+
+	/* Window is a number of pages fetched with one read. */
+	Window int
+
+	sync.Mutex
+	Pages []Page
+	Spare []Page
+	Index int64
+	Count int
+
+	/* Last is an index of the last page requested with 'ReadPagesAt'. */
+	Last int64
+
+	/* Pending is non-nil while background read into 'Spare' is in progress. */
+	Pending      chan struct{}
+	PendingIndex int64
+	Generation   int
 }
 
-var _ Pager = new(FilePager)
+/* Prefetcher is implemented by pagers which can fetch pages before they are requested. */
+type Prefetcher interface {
+	Prefetch(index int64)
+}
+
+var (
+	_ Pager      = new(ReadAheadPager)
+	_ Prefetcher = new(ReadAheadPager)
+	_ Syncer     = new(ReadAheadPager)
+)
+
+/* ReadAheadDefaultWindow is a number of pages fetched ahead when 'ReadAheadPager.Window' is not set. */
+const ReadAheadDefaultWindow = 16
+
+/* CompressingPager stores pages compressed with DEFLATE as records of 'Stream'. */
+type CompressingPager struct {
+	Stream PageStream
+
+	/* Level is a DEFLATE compression level, 0 means 'flate.DefaultCompression'. */
+	Level int
+
+	sync.Mutex
+	Buffer bytes.Buffer
+	Writer *flate.Writer
+	Reader io.ReadCloser
+	Record []byte
+}
+
+var (
+	_ Pager  = new(CompressingPager)
+	_ Syncer = new(CompressingPager)
+)
+
+/* EncryptingPager stores pages sealed with AES-GCM as fixed-size records in underlying pager: | counter (8 bytes) | sealed page |. Record for page 'index' starts at byte 'PageSize + index*recordSize', after header page: | counter limit (8 bytes) | file ID (16 bytes) |. Nonce is made of per-write counter. Page index and file ID are used as additional data, so that records moved to another index or file fail to open. */
+type EncryptingPager struct {
+	Pager Pager
+
+	/* KeyID identifies key for caller and is recorded in 'Meta' of trees stored in pager. */
+	KeyID int64
+
+	sync.Mutex
+	AEAD cipher.AEAD
+
+	/* Counter is a counter for the next write. Limit is stored in header page and is greater than any counter used, so that it's not needed to read records to continue after them. It's raised by 'EncryptingPagerCounterBlock' at a time. */
+	Counter uint64
+	Limit   uint64
+
+	/* Count is a number of pages stored. */
+	Count int64
+
+	/* ID is a random identifier of file, chosen when it's created. */
+	ID [EncryptingPagerIDSize]byte
+
+	Nonce []byte
+	Pages []Page
+}
+
+const (
+	/* EncryptingPagerCounterBlock is a number of counters reserved with one write of header page. */
+	EncryptingPagerCounterBlock = 1 << 16
+
+	EncryptingPagerIDSize = 16
+)
+
+/* KeyIdentifier is implemented by pagers which encrypt pages, so trees can record which key they need. */
+type KeyIdentifier interface {
+	GetKeyID() int64
+}
+
+var (
+	_ Pager         = new(EncryptingPager)
+	_ Syncer        = new(EncryptingPager)
+	_ KeyIdentifier = new(EncryptingPager)
+)
 
 func FilePagerNew(path string) (*FilePager, error) {
 	var err error
@@ -68,6 +253,13 @@ func FilePagerNew(path string) (*FilePager, error) {
 		return nil, fmt.Errorf("failed to open/create file for pager: %v", err)
 	}
 
+	info, err := p.File.Stat()
+	if err != nil {
+		p.File.Close()
+		return nil, fmt.Errorf("failed to get size of pager file: %v", err)
+	}
+	p.Count = info.Size() / PageSize
+
 	return p, nil
 }
 
@@ -75,28 +267,581 @@ func (p *FilePager) Close() {
 	p.File.Close()
 }
 
-func (p *FilePager) ReadPagesAt(pages []Page, offset int64) error {
+func (p *FilePager) ReadPagesAt(pages []Page, index int64) (int64, error) {
+	defer trace.End(trace.Begin(""))
+
+	count := atomic.LoadInt64(&p.Count)
+	if index < 0 {
+		index = count
+	}
+
+	if (index < 0) || (index >= count) {
+		return index, ErrPagesOutOfBounds
+	}
+
+	if _, err := p.File.ReadAt(Pages2Bytes(pages), index*PageSize); (err != nil) && (err != io.EOF) {
+		return index, fmt.Errorf("failed to read %d pages at %d: %v", len(pages), index, err)
+	}
+	return index, nil
+}
+
+func (p *FilePager) WritePagesAt(pages []Page, index int64) (int64, error) {
 	defer trace.End(trace.Begin(""))
 
-	if _, err := p.File.ReadAt(Pages2Bytes(pages), offset); (err != nil) && (err != io.EOF) {
-		return fmt.Errorf("failed to read %d pages at %d: %v", len(pages), offset, err)
+	n := int64(len(pages))
+	if index < 0 {
+		/* NOTE(anton2920): appends reserve their pages before writing, so that trees sharing pager don't get the same index. */
+		index = atomic.AddInt64(&p.Count, n) - n
+	} else if index > atomic.LoadInt64(&p.Count) {
+		return -1, ErrPagesOutOfBounds
+	}
+
+	if _, err := p.File.WriteAt(Pages2Bytes(pages), index*PageSize); err != nil {
+		return -1, fmt.Errorf("failed to write %d pages at %d: %v", len(pages), index, err)
+	}
+	for {
+		count := atomic.LoadInt64(&p.Count)
+		if (index+n <= count) || (atomic.CompareAndSwapInt64(&p.Count, count, index+n)) {
+			break
+		}
+	}
+
+	return index, nil
+}
+
+/* ReservePages grows number of pages in file without writing them. File itself grows when they are written. */
+func (p *FilePager) ReservePages(n int64) (int64, error) {
+	return atomic.AddInt64(&p.Count, n) - n, nil
+}
+
+/* Sync makes all previous writes durable according to 'd' or, if it is 'DurabilityDefault', to 'p.Durability'. */
+func (p *FilePager) Sync(d Durability) error {
+	defer trace.End(trace.Begin(""))
+
+	var err error
+
+	if d == DurabilityDefault {
+		d = p.Durability
 	}
+
+	start := time.Now()
+	switch d {
+	case DurabilityDefault, DurabilityNone:
+	case DurabilitySync:
+		err = p.sync()
+	case DurabilityGroup:
+		p.Lock()
+		group := p.Group
+		leader := group == nil
+		if leader {
+			group = &syncGroup{Done: make(chan struct{})}
+			p.Group = group
+		}
+		p.Unlock()
+
+		if leader {
+			window := p.GroupWindow
+			if window <= 0 {
+				window = FilePagerDefaultGroupWindow
+			}
+			time.Sleep(window)
+
+			/* NOTE(anton2920): commits arriving from now on are not covered by this sync and must start new group. */
+			p.Lock()
+			p.Group = nil
+			p.Unlock()
+
+			group.Err = p.sync()
+			close(group.Done)
+		} else {
+			<-group.Done
+		}
+		err = group.Err
+	default:
+		return fmt.Errorf("unknown durability level %d", d)
+	}
+	latency := time.Since(start)
+
+	p.Lock()
+	p.Stats.Commits++
+	p.Stats.TotalLatency += latency
+	if latency > p.Stats.MaxLatency {
+		p.Stats.MaxLatency = latency
+	}
+	p.Unlock()
+
+	return err
+}
+
+func (p *FilePager) sync() error {
+	defer trace.End(trace.Begin("main.FilePager.Sync"))
+
+	if err := p.File.Sync(); err != nil {
+		return fmt.Errorf("failed to sync writes to disk: %v", err)
+	}
+
+	p.Lock()
+	p.Stats.Syncs++
+	p.Unlock()
+
 	return nil
 }
 
-func (p *FilePager) WritePagesAt(pages []Page, offset int64) error {
+/* CommitStats returns statistics of commits made so far. */
+func (p *FilePager) CommitStats() CommitStats {
+	p.Lock()
+	defer p.Unlock()
+	return p.Stats
+}
+
+func (p *ReadAheadPager) window() int {
+	if p.Window <= 0 {
+		return ReadAheadDefaultWindow
+	}
+	return p.Window
+}
+
+/* Prefetch starts background read of 'Window' pages beginning at 'index', unless they are already fetched or being fetched. Only accesses that look sequential, i.e. 'index' is shortly after the last page read, trigger read-ahead. */
+func (p *ReadAheadPager) Prefetch(index int64) {
 	defer trace.End(trace.Begin(""))
 
-	if _, err := p.File.WriteAt(Pages2Bytes(pages), offset); err != nil {
-		return fmt.Errorf("failed to write %d pages at %d: %v", len(pages), offset, err)
+	window := p.window()
+
+	p.Lock()
+	if (index <= p.Last) || (index-p.Last > int64(window)) || (p.Pending != nil) || ((index >= p.Index) && (index < p.Index+int64(p.Count))) {
+		p.Unlock()
+		return
+	}
+
+	if len(p.Spare) != window {
+		p.Spare = make([]Page, window)
 	}
-	if false {
-		defer trace.End(trace.Begin("main.WritePagesAt.Sync"))
+	spare := p.Spare
+	done := make(chan struct{})
+	generation := p.Generation
+	p.Pending = done
+	p.PendingIndex = index
+	p.Unlock()
+
+	go func() {
+		/* NOTE(anton2920): pages past the end of underlying pager are left zeroed. */
+		for i := 0; i < len(spare); i++ {
+			spare[i] = Page{}
+		}
+		_, err := p.Pager.ReadPagesAt(spare, index)
 
-		if err := p.File.Sync(); err != nil {
-			return fmt.Errorf("failed to sync writes to disk: %v", err)
+		p.Lock()
+		if (err == nil) && (generation == p.Generation) {
+			p.Spare = p.Pages
+			p.Pages = spare
+			p.Index = index
+			p.Count = len(spare)
 		}
+		p.Pending = nil
+		p.Unlock()
+
+		close(done)
+	}()
+}
+
+func (p *ReadAheadPager) ReadPagesAt(pages []Page, index int64) (int64, error) {
+	defer trace.End(trace.Begin(""))
+
+	if index >= 0 {
+		p.Lock()
+		p.Last = index
+		if (p.Pending != nil) && (index >= p.PendingIndex) && (index+int64(len(pages)) <= p.PendingIndex+int64(p.window())) {
+			pending := p.Pending
+			p.Unlock()
+			<-pending
+			p.Lock()
+		}
+		if (index >= p.Index) && (index+int64(len(pages)) <= p.Index+int64(p.Count)) {
+			copy(pages, p.Pages[index-p.Index:])
+			p.Unlock()
+			return index, nil
+		}
+		p.Unlock()
+	}
+
+	return p.Pager.ReadPagesAt(pages, index)
+}
+
+func (p *ReadAheadPager) Sync(d Durability) error {
+	if s, ok := p.Pager.(Syncer); ok {
+		return s.Sync(d)
+	}
+	return nil
+}
+
+func (p *ReadAheadPager) WritePagesAt(pages []Page, index int64) (int64, error) {
+	defer trace.End(trace.Begin(""))
+
+	index, err := p.Pager.WritePagesAt(pages, index)
+	if err != nil {
+		return index, err
+	}
+
+	p.Lock()
+	if (index < p.Index+int64(p.Count)) && (index+int64(len(pages)) > p.Index) {
+		p.Count = 0
+	}
+	p.Generation++
+	p.Unlock()
+
+	return index, nil
+}
+
+/* CompressingPagerNew opens compressed pages stored in 'pager'. */
+func CompressingPagerNew(pager Pager) (*CompressingPager, error) {
+	p := new(CompressingPager)
+	p.Stream.Pager = pager
+	if err := p.Stream.Open(); err != nil {
+		return nil, fmt.Errorf("failed to open compressed pages: %v", err)
+	}
+	return p, nil
+}
+
+func (p *CompressingPager) ReadPagesAt(pages []Page, index int64) (int64, error) {
+	defer trace.End(trace.Begin(""))
+
+	var err error
+
+	p.Lock()
+	defer p.Unlock()
+
+	if index < 0 {
+		index = p.Stream.Count()
+	}
+
+	if (index < 0) || (index >= p.Stream.Count()) {
+		return index, ErrPagesOutOfBounds
+	}
+
+	for i := 0; (i < len(pages)) && (index+int64(i) < p.Stream.Count()); i++ {
+		p.Record, err = p.Stream.ReadRecord(p.Record, index+int64(i))
+		if err != nil {
+			return index, fmt.Errorf("failed to read compressed page %d: %v", index+int64(i), err)
+		}
+
+		if p.Reader == nil {
+			p.Reader = flate.NewReader(bytes.NewReader(p.Record))
+		} else if err := p.Reader.(flate.Resetter).Reset(bytes.NewReader(p.Record), nil); err != nil {
+			return index, fmt.Errorf("failed to reset decompressor: %v", err)
+		}
+		if _, err := io.ReadFull(p.Reader, pages[i][:]); err != nil {
+			return index, fmt.Errorf("failed to decompress page %d: %v", index+int64(i), err)
+		}
+	}
+
+	return index, nil
+}
+
+func (p *CompressingPager) WritePagesAt(pages []Page, index int64) (int64, error) {
+	defer trace.End(trace.Begin(""))
+
+	var err error
+
+	p.Lock()
+	defer p.Unlock()
+
+	if index < 0 {
+		index = p.Stream.Count()
+	}
+
+	if (index < 0) || (index >= p.Stream.Count()+1) {
+		return -1, ErrPagesOutOfBounds
+	}
+
+	if p.Writer == nil {
+		level := p.Level
+		if level == 0 {
+			level = flate.DefaultCompression
+		}
+		if p.Writer, err = flate.NewWriter(&p.Buffer, level); err != nil {
+			return -1, fmt.Errorf("failed to create compressor: %v", err)
+		}
+	}
+
+	for i := 0; i < len(pages); i++ {
+		p.Buffer.Reset()
+		p.Writer.Reset(&p.Buffer)
+		if _, err := p.Writer.Write(pages[i][:]); err != nil {
+			p.Stream.DiscardBatch()
+			return -1, fmt.Errorf("failed to compress page %d: %v", index+int64(i), err)
+		}
+		if err := p.Writer.Close(); err != nil {
+			p.Stream.DiscardBatch()
+			return -1, fmt.Errorf("failed to compress page %d: %v", index+int64(i), err)
+		}
+		p.Stream.AppendRecord(index+int64(i), p.Buffer.Bytes())
+	}
+	if err := p.Stream.Flush(); err != nil {
+		return -1, fmt.Errorf("failed to write compressed pages: %v", err)
+	}
+
+	return index, nil
+}
+
+func (p *CompressingPager) Sync(d Durability) error {
+	/* NOTE(anton2920): stream is compacted here, not in 'WritePagesAt', so writes don't wait for it. */
+	var err error
+	p.Lock()
+	if p.Stream.NeedsCompact() {
+		err = p.Stream.Compact()
+	}
+	p.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to compact stream: %v", err)
+	}
+
+	return p.Stream.Sync(d)
+}
+
+/* EncryptingPagerNew opens pages stored in 'pager' and sealed with 'key', which must be 16, 24 or 32 bytes long to select AES-128, AES-192 or AES-256. Only header page is read, records are decrypted when pages are read. */
+func EncryptingPagerNew(pager Pager, keyID int64, key []byte) (*EncryptingPager, error) {
+	p := new(EncryptingPager)
+	p.Pager = pager
+	p.KeyID = keyID
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+	p.AEAD, err = cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AES-GCM: %v", err)
+	}
+	p.Nonce = make([]byte, p.AEAD.NonceSize())
+
+	count, err := countPages(pager)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count encrypted pages: %v", err)
+	}
+	if count > 0 {
+		var header Page
+
+		if _, err := pager.ReadPagesAt(Page2Slice(&header), 0); err != nil {
+			return nil, fmt.Errorf("failed to read header of encrypted pages: %v", err)
+		}
+		p.Limit = binary.LittleEndian.Uint64(header[:])
+		p.Counter = p.Limit
+		copy(p.ID[:], header[8:])
+
+		/* NOTE(anton2920): records are written in order of pages, so the last page of underlying pager holds end of the last record and less than one record after it. */
+		p.Count = (count - 1) * PageSize / p.recordSize()
+	} else if _, err := rand.Read(p.ID[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate file ID: %v", err)
+	}
+
+	return p, nil
+}
+
+/* countPages returns number of pages in 'pager' with binary search for the first page which is out of bounds. */
+func countPages(pager Pager) (int64, error) {
+	var page Page
+
+	exists := func(index int64) (bool, error) {
+		if _, err := pager.ReadPagesAt(Page2Slice(&page), index); err == ErrPagesOutOfBounds {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	/* NOTE(anton2920): number of pages is at least 'lo' and less than 'hi'. */
+	lo, hi := int64(0), int64(1)
+	for {
+		ok, err := exists(hi - 1)
+		if err != nil {
+			return -1, err
+		} else if !ok {
+			break
+		}
+		lo, hi = hi, hi*2
+	}
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		ok, err := exists(mid - 1)
+		if err != nil {
+			return -1, err
+		} else if ok {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+
+	return lo, nil
+}
+
+func (p *EncryptingPager) GetKeyID() int64 {
+	return p.KeyID
+}
+
+/* GetAdditional returns additional data for record of page 'index'. */
+func (p *EncryptingPager) GetAdditional(additional []byte, index int64) []byte {
+	binary.LittleEndian.PutUint64(additional, uint64(index))
+	copy(additional[8:], p.ID[:])
+	return additional
+}
+
+/* GetNonce returns nonce for write with 'counter'. */
+func (p *EncryptingPager) GetNonce(counter uint64) []byte {
+	binary.LittleEndian.PutUint64(p.Nonce, counter)
+	return p.Nonce
+}
+
+func (p *EncryptingPager) recordSize() int64 {
+	return 8 + PageSize + int64(p.AEAD.Overhead())
+}
+
+/* recordOffset returns byte offset of record for page 'index' in underlying pager. */
+func (p *EncryptingPager) recordOffset(index int64) int64 {
+	return PageSize + index*p.recordSize()
+}
+
+/* getPages returns buffer for 'n' pages of underlying pager. */
+func (p *EncryptingPager) getPages(n int64) []Page {
+	if int64(len(p.Pages)) < n {
+		p.Pages = make([]Page, n)
+	}
+	return p.Pages[:n]
+}
+
+func (p *EncryptingPager) ReadPagesAt(pages []Page, index int64) (int64, error) {
+	defer trace.End(trace.Begin(""))
+
+	var additional [8 + EncryptingPagerIDSize]byte
+
+	p.Lock()
+	defer p.Unlock()
+
+	if index < 0 {
+		index = p.Count
+	}
+
+	if (index < 0) || (index >= p.Count) {
+		return index, ErrPagesOutOfBounds
+	}
+
+	n := int64(len(pages))
+	if index+n > p.Count {
+		n = p.Count - index
+	}
+	start, end := p.recordOffset(index), p.recordOffset(index+n)
+	first, last := start/PageSize, (end-1)/PageSize
+
+	buffer := p.getPages(last - first + 1)
+	if _, err := p.Pager.ReadPagesAt(buffer, first); err != nil {
+		return index, fmt.Errorf("failed to read encrypted pages %d-%d: %v", index, index+n-1, err)
+	}
+	records := Pages2Bytes(buffer)[start-first*PageSize:]
+
+	size := p.recordSize()
+	for i := int64(0); i < n; i++ {
+		record := records[i*size : (i+1)*size]
+
+		if _, err := p.AEAD.Open(pages[i][:0], p.GetNonce(binary.LittleEndian.Uint64(record)), record[8:], p.GetAdditional(additional[:], index+i)); err != nil {
+			return index, fmt.Errorf("failed to decrypt page %d: %v", index+i, err)
+		}
+	}
+
+	return index, nil
+}
+
+func (p *EncryptingPager) WritePagesAt(pages []Page, index int64) (int64, error) {
+	defer trace.End(trace.Begin(""))
+
+	var additional [8 + EncryptingPagerIDSize]byte
+
+	p.Lock()
+	defer p.Unlock()
+
+	if index < 0 {
+		index = p.Count
+	}
+
+	if (index < 0) || (index >= p.Count+1) {
+		return -1, ErrPagesOutOfBounds
+	}
+
+	n := int64(len(pages))
+	if p.Counter+uint64(n) > p.Limit {
+		if err := p.raiseLimit(p.Counter + uint64(n) + EncryptingPagerCounterBlock); err != nil {
+			return -1, err
+		}
+	}
+
+	start, end := p.recordOffset(index), p.recordOffset(index+n)
+	first, last := start/PageSize, (end-1)/PageSize
+
+	/* NOTE(anton2920): the first and the last pages may also hold parts of neighbouring records. */
+	buffer := p.getPages(last - first + 1)
+	if start%PageSize != 0 {
+		if err := p.readPage(&buffer[0], first); err != nil {
+			return -1, err
+		}
+	}
+	if (end%PageSize != 0) && ((last != first) || (start%PageSize == 0)) {
+		if err := p.readPage(&buffer[last-first], last); err != nil {
+			return -1, err
+		}
+	}
+	records := Pages2Bytes(buffer)[start-first*PageSize:]
+
+	size := p.recordSize()
+	for i := int64(0); i < n; i++ {
+		record := records[i*size : (i+1)*size]
+		counter := p.Counter
+		p.Counter++
+
+		binary.LittleEndian.PutUint64(record, counter)
+		p.AEAD.Seal(record[8:8], p.GetNonce(counter), pages[i][:], p.GetAdditional(additional[:], index+i))
+	}
+
+	if _, err := p.Pager.WritePagesAt(buffer, first); err != nil {
+		return -1, fmt.Errorf("failed to write encrypted pages %d-%d: %v", index, index+n-1, err)
+	}
+	if index+n > p.Count {
+		p.Count = index + n
+	}
+
+	return index, nil
+}
+
+/* readPage reads page 'index' of underlying pager into 'page'. Pages past the end are read as zeroed. */
+func (p *EncryptingPager) readPage(page *Page, index int64) error {
+	*page = Page{}
+	if _, err := p.Pager.ReadPagesAt(Page2Slice(page), index); (err != nil) && (err != ErrPagesOutOfBounds) {
+		return fmt.Errorf("failed to read page %d of encrypted pages: %v", index, err)
+	}
+	return nil
+}
+
+/* raiseLimit writes new counter limit to header page. Header is synced before counters below 'limit' are used, so they are never used again after crash. */
+func (p *EncryptingPager) raiseLimit(limit uint64) error {
+	var header Page
+
+	binary.LittleEndian.PutUint64(header[:], limit)
+	copy(header[8:], p.ID[:])
+	if _, err := p.Pager.WritePagesAt(Page2Slice(&header), 0); err != nil {
+		return fmt.Errorf("failed to write header of encrypted pages: %v", err)
+	}
+	if syncer, ok := p.Pager.(Syncer); ok {
+		if err := syncer.Sync(DurabilitySync); err != nil {
+			return fmt.Errorf("failed to sync header of encrypted pages: %v", err)
+		}
+	}
+	p.Limit = limit
+
+	return nil
+}
+
+func (p *EncryptingPager) Sync(d Durability) error {
+	if syncer, ok := p.Pager.(Syncer); ok {
+		return syncer.Sync(d)
 	}
 	return nil
 }
-*/
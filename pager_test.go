@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestFilePagerDurability(t *testing.T) {
+	const (
+		Writers = 8
+		Keys    = 64
+	)
+
+	tests := [...]struct {
+		Name       string
+		Durability Durability
+	}{
+		{"None", DurabilityNone},
+		{"Sync", DurabilitySync},
+		{"Group", DurabilityGroup},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), test.Name+"_test.tree")
+
+			pager, err := FilePagerNew(path)
+			if err != nil {
+				t.Fatalf("Failed to create new file pager: %v", err)
+			}
+			pager.Durability = test.Durability
+
+			tree, err := GetTreeAt(pager, -1)
+			if err != nil {
+				t.Fatalf("Failed to create new tree: %v", err)
+			}
+
+			var wg sync.WaitGroup
+			for w := 0; w < Writers; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					for k := w * Keys; k < (w+1)*Keys; k++ {
+						if err := tree.Set(int2Slice(k), int2Slice(k)); err != nil {
+							t.Errorf("Error on 'Set': %v", err)
+						}
+					}
+				}(w)
+			}
+			wg.Wait()
+
+			stats := pager.CommitStats()
+			if stats.Commits != Writers*Keys {
+				t.Errorf("Expected %d commits, got %d", Writers*Keys, stats.Commits)
+			}
+			switch test.Durability {
+			case DurabilityNone:
+				if stats.Syncs != 0 {
+					t.Errorf("Expected no syncs, got %d", stats.Syncs)
+				}
+			case DurabilitySync:
+				if stats.Syncs != stats.Commits {
+					t.Errorf("Expected %d syncs, got %d", stats.Commits, stats.Syncs)
+				}
+			case DurabilityGroup:
+				if (stats.Syncs == 0) || (stats.Syncs >= stats.Commits) {
+					t.Errorf("Expected commits to share syncs, got %d syncs for %d commits", stats.Syncs, stats.Commits)
+				}
+			}
+			pager.Close()
+
+			pager, err = FilePagerNew(path)
+			if err != nil {
+				t.Fatalf("Failed to reopen file pager: %v", err)
+			}
+			defer pager.Close()
+
+			tree, err = GetTreeAt(pager, 0)
+			if err != nil {
+				t.Fatalf("Failed to reopen tree: %v", err)
+			}
+			for k := 0; k < Writers*Keys; k++ {
+				got, err := tree.Get(int2Slice(k))
+				if err != nil {
+					t.Fatalf("Error on 'Get': %v", err)
+				} else if (got == nil) || (slice2Int(got) != k) {
+					t.Errorf("Expected value %v after reopen, got %v", k, got)
+				}
+			}
+		})
+	}
+}
+
+func TestCompressingPager(t *testing.T) {
+	var backing MemoryPager
+
+	pager, err := CompressingPagerNew(&backing)
+	if err != nil {
+		t.Fatalf("Failed to create new compressing pager: %v", err)
+	}
+	tree, err := GetTreeAt(pager, -1)
+	if err != nil {
+		t.Fatalf("Failed to create new tree: %v", err)
+	}
+
+	/* Every 100th value needs overflow pages. */
+	value := func(i int) []byte {
+		value := []byte(fmt.Sprintf(`{"id": %d, "name": "user%d", "active": true, "tags": ["a", "b", "c"]}`, i, i))
+		if i%100 == 0 {
+			value = bytes.Repeat(value, 2*PageSize/len(value))
+		}
+		return value
+	}
+	for i := 0; i < N; i++ {
+		if err := tree.Set(int2Slice(i), value(i)); err != nil {
+			t.Fatalf("Error on 'Set': %v", err)
+		}
+	}
+
+	/* NOTE(anton2920): stream is compacted once overwritten records take half of it, so backing pager may hold up to twice as much as live records. */
+	if int64(len(backing.Pages)) >= pager.Stream.Count() {
+		t.Errorf("Expected pages to be compressed at least twice, got %d backing pages for %d pages", len(backing.Pages), pager.Stream.Count())
+	}
+
+	pager, err = CompressingPagerNew(&backing)
+	if err != nil {
+		t.Fatalf("Failed to reopen compressing pager: %v", err)
+	}
+	tree, err = GetTreeAt(pager, tree.MetaIndex)
+	if err != nil {
+		t.Fatalf("Failed to open tree: %v", err)
+	}
+	for i := 0; i < N; i++ {
+		got, err := tree.Get(int2Slice(i))
+		if err != nil {
+			t.Fatalf("Error on 'Get': %v", err)
+		} else if !bytes.Equal(got, value(i)) {
+			t.Errorf("Expected value %q, got %q", value(i), got)
+		}
+	}
+}
+
+func TestPageStream(t *testing.T) {
+	const count = 20
+
+	var backing MemoryPager
+	failing := failingPager{Pager: &backing}
+
+	record := func(index int64, version int) []byte {
+		return bytes.Repeat([]byte{byte(index), byte(version)}, PageSize/3)
+	}
+	check := func(t *testing.T, version int) {
+		t.Helper()
+
+		s := PageStream{Pager: &backing}
+		if err := s.Open(); err != nil {
+			t.Fatalf("Failed to open stream: %v", err)
+		}
+		if s.Count() != count {
+			t.Fatalf("Expected %d records, got %d", count, s.Count())
+		}
+		for index := int64(0); index < count; index++ {
+			got, err := s.ReadRecord(nil, index)
+			if err != nil {
+				t.Fatalf("Failed to read record %d: %v", index, err)
+			} else if !bytes.Equal(got, record(index, version)) {
+				t.Errorf("Expected record %d of version %d", index, version)
+			}
+		}
+	}
+
+	s := PageStream{Pager: &failing}
+	if err := s.Open(); err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	/* Pages are created in order, but later versions are written in reverse, so that compaction has to reorder them. */
+	for version := 0; version < 3; version++ {
+		for i := int64(0); i < count; i++ {
+			index := i
+			if version > 0 {
+				index = count - 1 - i
+			}
+			s.AppendRecord(index, record(index, version))
+		}
+		if err := s.Flush(); err != nil {
+			t.Fatalf("Failed to flush stream: %v", err)
+		}
+	}
+	check(t, 2)
+
+	t.Run("Tail", func(t *testing.T) {
+		var header [PageRecordHeaderSize]byte
+
+		/* Record for page far past the end and record longer than pager must both end stream. */
+		for _, tail := range [...][2]uint64{{1 << 60, 1}, {0, 1<<32 - 1}} {
+			s := PageStream{Pager: &backing}
+			if err := s.Open(); err != nil {
+				t.Fatalf("Failed to open stream: %v", err)
+			}
+			binary.LittleEndian.PutUint64(header[:], tail[0])
+			binary.LittleEndian.PutUint32(header[8:], uint32(tail[1]))
+			if _, err := s.Append(header[:]); err != nil {
+				t.Fatalf("Failed to append garbage: %v", err)
+			}
+			check(t, 2)
+		}
+	})
+
+	t.Run("Compact", func(t *testing.T) {
+		pages, err := countPages(&backing)
+		if err != nil {
+			t.Fatalf("Failed to count pages: %v", err)
+		}
+
+		/* Interrupted compaction must leave stream as it was. */
+		failing.Fail = pages
+		if err := s.Compact(); err == nil {
+			t.Fatalf("Expected compaction to fail")
+		}
+		check(t, 2)
+
+		failing.Fail = 0
+		for i := 0; i < 2; i++ {
+			if err := s.Compact(); err != nil {
+				t.Fatalf("Failed to compact stream: %v", err)
+			}
+			check(t, 2)
+		}
+		if s.Start != 1 {
+			t.Errorf("Expected the second compaction to reuse pages at the beginning, stream starts at %d", s.Start)
+		}
+	})
+
+	t.Run("Header", func(t *testing.T) {
+		var header Page
+
+		binary.LittleEndian.PutUint64(header[:], 1<<40)
+		if _, err := backing.WritePagesAt(Page2Slice(&header), 0); err != nil {
+			t.Fatalf("Failed to write header: %v", err)
+		}
+		s := PageStream{Pager: &backing}
+		if err := s.Open(); err == nil {
+			t.Errorf("Expected error for stream starting past the end")
+		}
+	})
+}
+
+func TestEncryptingPager(t *testing.T) {
+	var backing MemoryPager
+
+	key := bytes.Repeat([]byte{0xA5}, 32)
+	pager, err := EncryptingPagerNew(&backing, 1, key)
+	if err != nil {
+		t.Fatalf("Failed to create new encrypting pager: %v", err)
+	}
+	tree, err := GetTreeAt(pager, -1)
+	if err != nil {
+		t.Fatalf("Failed to create new tree: %v", err)
+	}
+
+	/* Every 100th value needs overflow pages. */
+	value := func(i int) []byte {
+		value := []byte(fmt.Sprintf("secret customer data #%d", i))
+		if i%100 == 0 {
+			value = bytes.Repeat(value, 2*PageSize/len(value))
+		}
+		return value
+	}
+	for i := 0; i < N; i++ {
+		if err := tree.Set(int2Slice(i), value(i)); err != nil {
+			t.Fatalf("Error on 'Set': %v", err)
+		}
+	}
+	if bytes.Contains(Pages2Bytes(backing.Pages), []byte("secret customer data")) {
+		t.Errorf("Expected underlying pager to have no plaintext")
+	}
+
+	/* Only header and pages needed to count them are read on open. */
+	counting := countingPager{Pager: &backing}
+	count, counter := pager.Count, pager.Counter
+	pager, err = EncryptingPagerNew(&counting, 1, key)
+	if err != nil {
+		t.Fatalf("Failed to reopen encrypting pager: %v", err)
+	}
+	if counting.Reads > 64 {
+		t.Errorf("Expected at most 64 reads on open, got %d", counting.Reads)
+	}
+	if pager.Count != count {
+		t.Errorf("Expected %d pages after reopen, got %d", count, pager.Count)
+	}
+	if pager.Counter < counter {
+		t.Errorf("Expected counter to continue after %d, got %d", counter, pager.Counter)
+	}
+	tree, err = GetTreeAt(pager, tree.MetaIndex)
+	if err != nil {
+		t.Fatalf("Failed to open tree: %v", err)
+	}
+	for i := 0; i < N; i++ {
+		got, err := tree.Get(int2Slice(i))
+		if err != nil {
+			t.Fatalf("Error on 'Get': %v", err)
+		} else if !bytes.Equal(got, value(i)) {
+			t.Errorf("Expected value %q, got %q", value(i), got)
+		}
+	}
+
+	t.Run("WrongKey", func(t *testing.T) {
+		pager, err := EncryptingPagerNew(&backing, 1, bytes.Repeat([]byte{0x5A}, 32))
+		if err != nil {
+			t.Fatalf("Failed to create encrypting pager: %v", err)
+		}
+		if _, err := GetTreeAt(pager, tree.MetaIndex); err == nil {
+			t.Errorf("Expected error on opening tree with wrong key, got nothing")
+		}
+	})
+	t.Run("WrongKeyID", func(t *testing.T) {
+		pager, err := EncryptingPagerNew(&backing, 2, key)
+		if err != nil {
+			t.Fatalf("Failed to create encrypting pager: %v", err)
+		}
+		if _, err := GetTreeAt(pager, tree.MetaIndex); err == nil {
+			t.Errorf("Expected error on opening tree with wrong key ID, got nothing")
+		}
+	})
+	t.Run("SwappedPages", func(t *testing.T) {
+		pager, err := EncryptingPagerNew(&backing, 1, key)
+		if err != nil {
+			t.Fatalf("Failed to create encrypting pager: %v", err)
+		}
+		size := pager.recordSize()
+		buf := Pages2Bytes(backing.Pages)
+		record := make([]byte, size)
+		copy(record, buf[pager.recordOffset(1):])
+		copy(buf[pager.recordOffset(1):pager.recordOffset(2)], buf[pager.recordOffset(2):])
+		copy(buf[pager.recordOffset(2):], record)
+
+		var page Page
+		if _, err := pager.ReadPagesAt(Page2Slice(&page), 1); err == nil {
+			t.Errorf("Expected error on reading page moved to another index, got nothing")
+		}
+	})
+	t.Run("OtherFile", func(t *testing.T) {
+		var other MemoryPager
+
+		pager, err := EncryptingPagerNew(&other, 1, key)
+		if err != nil {
+			t.Fatalf("Failed to create encrypting pager: %v", err)
+		}
+		var page Page
+		if _, err := pager.WritePagesAt(Page2Slice(&page), -1); err != nil {
+			t.Fatalf("Failed to write page: %v", err)
+		}
+		copy(Pages2Bytes(other.Pages)[pager.recordOffset(0):pager.recordOffset(1)], Pages2Bytes(backing.Pages)[pager.recordOffset(0):])
+		if _, err := pager.ReadPagesAt(Page2Slice(&page), 0); err == nil {
+			t.Errorf("Expected error on reading page moved from another file, got nothing")
+		}
+	})
+}
+
+/* readSizesPager records number of pages in each read from underlying pager. Reads may come from background goroutine of 'ReadAheadPager'. */
+type readSizesPager struct {
+	Pager
+
+	sync.Mutex
+	Sizes []int
+}
+
+func (p *readSizesPager) ReadPagesAt(pages []Page, index int64) (int64, error) {
+	p.Lock()
+	p.Sizes = append(p.Sizes, len(pages))
+	p.Unlock()
+	return p.Pager.ReadPagesAt(pages, index)
+}
+
+func TestReadAheadPager(t *testing.T) {
+	const window = 8
+
+	counting := readSizesPager{Pager: new(MemoryPager)}
+	pager := ReadAheadPager{Pager: &counting, Window: window}
+
+	tree, err := GetTreeAtWithOptions(&pager, -1, TreeOptions{MaxOrder: 5})
+	if err != nil {
+		t.Fatalf("Failed to create new tree: %v", err)
+	}
+	/* Keys are ascending, so leaves are mostly written one after another. */
+	for i := 0; i < 1000; i++ {
+		if err := tree.Set([]byte(fmt.Sprintf("key%06d", i)), nil); err != nil {
+			t.Fatalf("Error on 'Set': %v", err)
+		}
+	}
+
+	var leaves int
+	for index := tree.Meta.Root; ; {
+		var page Page
+		if _, err := tree.ReadPageAt(&page, index); err != nil {
+			t.Fatalf("Failed to read page: %v", err)
+		}
+		if page.Type() == PageTypeLeaf {
+			for index != tree.Meta.EndSentinel {
+				if _, err := tree.ReadPageAt(&page, index); err != nil {
+					t.Fatalf("Failed to read page: %v", err)
+				}
+				index = page.Leaf().Next
+				leaves++
+			}
+			break
+		}
+		index = page.Node().GetChildAt(-1)
+	}
+
+	/* Concurrent writes race with background reads, unless underlying pager is safe for concurrent use. */
+	it, err := tree.Seek(nil)
+	if err != nil {
+		t.Fatalf("Failed to seek: %v", err)
+	}
+	for i := 0; (i < 100) && (it.Next()); i++ {
+		if err := tree.Set([]byte(fmt.Sprintf("key%06d", i)), []byte("updated")); err != nil {
+			t.Fatalf("Error on 'Set': %v", err)
+		}
+	}
+
+	counting.Sizes = counting.Sizes[:0]
+	it, err = tree.Seek(nil)
+	if err != nil {
+		t.Fatalf("Failed to seek: %v", err)
+	}
+	var n int
+	for it.Next() {
+		n++
+	}
+	if n != 1000 {
+		t.Errorf("Expected 1000 entries, got %d", n)
+	}
+
+	/* Path to the first leaf and the leaf itself are read one by one, all other leaves are read a window at a time. */
+	counting.Lock()
+	var windows, singles int
+	for _, size := range counting.Sizes {
+		if size == window {
+			windows++
+		} else {
+			singles++
+		}
+	}
+	counting.Unlock()
+	if expected := (leaves + window - 1) / window; (windows < expected) || (windows > 2*expected) {
+		t.Errorf("Expected about %d reads of %d pages for %d leaves, got %d", expected, window, leaves, windows)
+	}
+	if singles > 8 {
+		t.Errorf("Expected at most %d single-page reads, got %d: %v", 8, singles, counting.Sizes)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+/* sqlPlan is a way rows which may match statement are read. */
+type sqlPlan struct {
+	/* Index is read in 'Range' and rows of its entries are looked up. Nil means table is read in 'Range'. */
+	Index *Index
+	Range sqlRange
+
+	/* Rows is an estimated number of rows read and Total is a number of rows in table. */
+	Rows  int64
+	Total int64
+}
+
+/* sqlIndexFetchCost is how many times reading row through index is slower than in scan of table. */
+const sqlIndexFetchCost = 4
+
+/* sqlPlan chooses the cheapest scan of primary key or secondary index for 'where', see 'Tree.EstimateRange'. */
+func (tb *Table) sqlPlan(where SQLExpr) (sqlPlan, error) {
+	total, err := tb.EstimateRange(nil, nil)
+	if err != nil {
+		return sqlPlan{}, fmt.Errorf("failed to estimate number of rows: %v", err)
+	}
+
+	plan := sqlPlan{Range: tb.sqlRange(where), Rows: total, Total: total}
+	if !plan.Range.Empty() {
+		start, end := sqlRangeKeys(plan.Range, sqlPrimaryKey)
+		if plan.Rows, err = tb.EstimateRange(start, end); err != nil {
+			return sqlPlan{}, fmt.Errorf("failed to estimate number of rows in range of primary key: %v", err)
+		}
+	}
+
+	cost := plan.Rows
+	conjuncts := sqlConjuncts(where)
+	for _, name := range tb.Schema.Indexes {
+		var r sqlRange
+
+		idx := tb.Index(name)
+		if eq := sqlBounds(conjuncts, &tb.Schema.Columns[tb.Schema.Column(name)], &r); eq != nil {
+			r = sqlRange{Prefix: []interface{}{eq}}
+		} else if r.Empty() {
+			continue
+		}
+
+		start, end := sqlRangeKeys(r, sqlIndexKey)
+		rows, err := idx.EstimateRange(start, end)
+		if err != nil {
+			return sqlPlan{}, fmt.Errorf("failed to estimate number of entries in range of index %q: %v", name, err)
+		}
+		if rows*sqlIndexFetchCost < cost {
+			plan = sqlPlan{Index: idx, Range: r, Rows: rows, Total: total}
+			cost = rows * sqlIndexFetchCost
+		}
+	}
+
+	return plan, nil
+}
+
+/* Empty returns whether range has no bounds. */
+func (r *sqlRange) Empty() bool {
+	return (len(r.Prefix) == 0) && (r.Lo == nil) && (r.Hi == nil)
+}
+
+/* sqlRangeKeys returns bounds of keys of entries in 'r'. 'encode' returns prefix of keys for 'values'. */
+func sqlRangeKeys(r sqlRange, encode func(values []interface{}) []byte) ([]byte, []byte) {
+	var start, end []byte
+
+	/* NOTE(anton2920): 0xFF is greater than any tag, so it ends keys with that prefix. */
+	prefix := r.Prefix[:len(r.Prefix):len(r.Prefix)]
+	if r.Lo != nil {
+		start = encode(append(prefix, r.Lo))
+		if !r.LoInclusive {
+			start = append(start, 0xFF)
+		}
+	} else if len(prefix) > 0 {
+		start = encode(prefix)
+	}
+	if r.Hi != nil {
+		end = encode(append(prefix, r.Hi))
+		if r.HiInclusive {
+			end = append(end, 0xFF)
+		}
+	} else if len(prefix) > 0 {
+		end = append(encode(prefix), 0xFF)
+	}
+
+	return start, end
+}
+
+/* sqlPrimaryKey returns prefix of keys of rows for 'values'. */
+func sqlPrimaryKey(values []interface{}) []byte {
+	key, _ := AppendKey(nil, values...)
+	return key
+}
+
+/* sqlIndexKey returns prefix of keys of index entries for 'values[0]'. */
+func sqlIndexKey(values []interface{}) []byte {
+	key, _ := AppendKey(nil, values[0])
+	return AppendKeyBytes(nil, key)
+}
+
+/* sqlScanPlan calls 'fn' for rows read with 'plan' which match 'where', until it returns false. */
+func (tb *Table) sqlScanPlan(plan *sqlPlan, where SQLExpr, fn func(Row) bool) error {
+	if plan.Index == nil {
+		return tb.sqlScan(plan.Range, where, fn)
+	}
+	return tb.sqlScanIndex(plan.Index, plan.Range, where, fn)
+}
+
+/* sqlScanIndex calls 'fn' for rows which indexed values are in 'r' and which match 'where', until it returns false. */
+func (tb *Table) sqlScanIndex(idx *Index, r sqlRange, where SQLExpr, fn func(Row) bool) error {
+	lo, hi := r.Lo, r.Hi
+	loInclusive, hiInclusive := r.LoInclusive, r.HiInclusive
+	if len(r.Prefix) > 0 {
+		lo, hi = r.Prefix[0], r.Prefix[0]
+		loInclusive, hiInclusive = true, true
+	}
+
+	var loKey, hiKey []byte
+	var err error
+	if lo != nil {
+		if loKey, err = AppendKey(nil, lo); err != nil {
+			return err
+		}
+	}
+	if hi != nil {
+		if hiKey, err = AppendKey(nil, hi); err != nil {
+			return err
+		}
+	}
+
+	it, err := idx.Seek(loKey)
+	if err != nil {
+		return err
+	}
+	for it.Next() {
+		key := it.IndexKey()
+		if (lo != nil) && (!loInclusive) && (bytes.Equal(key, loKey)) {
+			continue
+		}
+		if hi != nil {
+			if res := bytes.Compare(key, hiKey); (res > 0) || ((res == 0) && (!hiInclusive)) {
+				return nil
+			}
+		}
+
+		row, err := tb.decodeRow(it.Key(), it.Value())
+		if err != nil {
+			return err
+		}
+		match, err := tb.sqlEval(where, row)
+		if err != nil {
+			return err
+		}
+		if (match == true) && (!fn(row)) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+/* sqlExplain returns result with description of 'plan' for table 'name'. */
+func (tb *Table) sqlExplain(name string, plan *sqlPlan) *SQLResult {
+	var description string
+
+	switch {
+	case plan.Index != nil:
+		description = fmt.Sprintf("INDEX RANGE SCAN %s USING %s (%s)", name, plan.Index.Name, plan.Range.Describe([]string{plan.Index.Name}))
+	case !plan.Range.Empty():
+		description = fmt.Sprintf("PRIMARY KEY RANGE SCAN %s (%s)", name, plan.Range.Describe(tb.Schema.PrimaryKey))
+	default:
+		description = fmt.Sprintf("FULL SCAN %s", name)
+	}
+
+	return &SQLResult{Columns: []string{"plan", "rows", "total"}, Rows: []Row{{description, plan.Rows, plan.Total}}}
+}
+
+/* Describe returns conditions of range on 'columns' joined with AND. */
+func (r *sqlRange) Describe(columns []string) string {
+	var conditions []string
+
+	for i, value := range r.Prefix {
+		conditions = append(conditions, fmt.Sprintf("%s = %s", columns[i], sqlFormat(value)))
+	}
+	if r.Lo != nil {
+		op := ">"
+		if r.LoInclusive {
+			op = ">="
+		}
+		conditions = append(conditions, fmt.Sprintf("%s %s %s", columns[len(r.Prefix)], op, sqlFormat(r.Lo)))
+	}
+	if r.Hi != nil {
+		op := "<"
+		if r.HiInclusive {
+			op = "<="
+		}
+		conditions = append(conditions, fmt.Sprintf("%s %s %s", columns[len(r.Prefix)], op, sqlFormat(r.Hi)))
+	}
+
+	return strings.Join(conditions, " AND ")
+}
+
+/* sqlFormat returns SQL literal of 'value'. */
+func sqlFormat(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return "NULL"
+	case string:
+		return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+	case []byte:
+		return fmt.Sprintf("X'%X'", value)
+	case bool:
+		if value {
+			return "TRUE"
+		}
+		return "FALSE"
+	default:
+		return fmt.Sprint(value)
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/anton2920/gofa/errors"
+	"github.com/anton2920/gofa/trace"
+)
+
+/* ValueReader reads value stored in tree without loading all of it in memory. Only pages holding requested bytes are read. Pages of value are freed when key is updated or deleted, so reads fail with 'ErrValueChanged' afterwards. Reads of values in value log fail the same way, when key is updated, deleted or its value is moved by 'CollectValueLog'. */
+type ValueReader struct {
+	Tree *Tree
+	Type ValueType
+
+	/* Key and Raw are key reader was opened for and value stored for it in leaf, tagged with its 'ValueType'. Freed is 'Tree.Freed' when pages of value were checked last. */
+	Key   []byte
+	Raw   []byte
+	Freed int64
+
+	/* Value is a whole value for values stored in leaf or part of value stored in leaf before chain of 'Overflow' pages. */
+	Value []byte
+
+	/* Overflows are indices of 'Overflow' pages of value in order of their data and Offsets are offsets of their data in value. */
+	Overflows []int64
+	Offsets   []int64
+
+	/* Index is a first page of 'ValueTypeExtent' value. */
+	Index int64
+
+	/* Ptr is a location of 'ValueTypeLog' value. */
+	Ptr ValueLogPointer
+
+	Length int64
+	Offset int64
+}
+
+var (
+	_ io.ReadSeeker = new(ValueReader)
+	_ io.ReaderAt   = new(ValueReader)
+)
+
+/* ErrValueChanged is returned by 'ValueReader' when key was updated or deleted after reader was opened. */
+var ErrValueChanged = errors.New("value was changed after reader was opened")
+
+/* SetFromChunkPages is a number of pages 'SetFrom' reads and writes at once. */
+const SetFromChunkPages = 64
+
+/* Size returns length of value. */
+func (r *ValueReader) Size() int64 {
+	return r.Length
+}
+
+func (r *ValueReader) Read(buf []byte) (int, error) {
+	n, err := r.ReadAt(buf, r.Offset)
+	r.Offset += int64(n)
+	return n, err
+}
+
+func (r *ValueReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.Offset
+	case io.SeekEnd:
+		offset += r.Length
+	default:
+		return 0, fmt.Errorf("unknown whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	r.Offset = offset
+	return offset, nil
+}
+
+func (r *ValueReader) ReadAt(buf []byte, offset int64) (int, error) {
+	defer trace.End(trace.Begin(""))
+
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if offset >= r.Length {
+		return 0, io.EOF
+	}
+
+	var err error
+	if int64(len(buf)) > r.Length-offset {
+		buf = buf[:r.Length-offset]
+		err = io.EOF
+	}
+	if len(buf) == 0 {
+		return 0, err
+	}
+
+	switch r.Type {
+	case ValueTypeExtent, ValueTypePartial:
+		r.Tree.RLock()
+		rerr := r.check()
+		if rerr == nil {
+			if r.Type == ValueTypeExtent {
+				rerr = r.readExtentAt(buf, offset)
+			} else {
+				rerr = r.readOverflowsAt(buf, offset)
+			}
+		}
+		r.Tree.RUnlock()
+		if rerr != nil {
+			return 0, rerr
+		}
+	case ValueTypeLog:
+		r.Tree.RLock()
+		rerr := r.checkLog()
+		r.Tree.RUnlock()
+		if rerr == nil {
+			ptr := ValueLogPointer{Segment: r.Ptr.Segment, Offset: r.Ptr.Offset + offset, Length: int64(len(buf))}
+			if _, rerr = r.Tree.ValueLog.AppendValue(buf[:0], ptr); (rerr != nil) && (!r.Tree.ValueLog.HasSegment(r.Ptr.Segment)) {
+				rerr = ErrValueChanged
+			}
+		}
+		if rerr != nil {
+			return 0, rerr
+		}
+	default:
+		copy(buf, r.Value[offset:])
+	}
+
+	return len(buf), err
+}
+
+/* check returns 'ErrValueChanged' if pages of value were freed since reader was opened. Pages are freed only when key no longer has the same value, even if they are reused for equal one later. Tree must be locked for reading. */
+func (r *ValueReader) check() error {
+	t := r.Tree
+	if t.Freed == r.Freed {
+		return nil
+	}
+
+	switch r.Type {
+	case ValueTypeExtent:
+		for i := int64(0); i < t.extentPages(r.Length); i++ {
+			if t.freedSince(r.Index+i*t.PageSpan(), r.Freed) {
+				return ErrValueChanged
+			}
+		}
+	case ValueTypePartial:
+		for _, index := range r.Overflows {
+			if t.freedSince(index, r.Freed) {
+				return ErrValueChanged
+			}
+		}
+	}
+	r.Freed = t.Freed
+
+	return nil
+}
+
+/* checkLog returns 'ErrValueChanged' if key no longer points to the same place in value log. Places in log are never reused. Tree must be locked for reading. */
+func (r *ValueReader) checkLog() error {
+	page := r.Tree.getPage()
+	defer r.Tree.putPage(page)
+
+	v, err := r.Tree.findValue(page, r.Key)
+	if err != nil {
+		return err
+	} else if !bytes.Equal(v, r.Raw) {
+		return ErrValueChanged
+	}
+	return nil
+}
+
+func (r *ValueReader) readExtentAt(buf []byte, offset int64) error {
+	first := offset / PageSize
+	last := (offset + int64(len(buf)) - 1) / PageSize
+	pages := make([]Page, last-first+1)
+
+	if _, err := r.Tree.Pager.ReadPagesAt(pages, r.Tree.pagerIndex(r.Index)+first); err != nil {
+		return fmt.Errorf("failed to read %d pages of extent: %v", len(pages), err)
+	}
+	copy(buf, Pages2Bytes(pages)[offset-first*PageSize:])
+
+	return nil
+}
+
+func (r *ValueReader) readOverflowsAt(buf []byte, offset int64) error {
+	page := r.Tree.NewPage()
+
+	if offset < int64(len(r.Value)) {
+		n := copy(buf, r.Value[offset:])
+		buf = buf[n:]
+		offset += int64(n)
+	}
+
+	i := sort.Search(len(r.Offsets), func(i int) bool { return r.Offsets[i] > offset }) - 1
+	for ; len(buf) > 0; i++ {
+		if _, err := r.Tree.ReadPageAt(page, r.Overflows[i]); err != nil {
+			return fmt.Errorf("failed to read overflow: %v", err)
+		}
+		n := copy(buf, page.Overflow().GetValue()[offset-r.Offsets[i]:])
+		buf = buf[n:]
+		offset += int64(n)
+	}
+
+	return nil
+}
+
+/* Open returns reader of value for 'key' or nil, if there's no such key. */
+func (t *Tree) Open(key []byte) (*ValueReader, error) {
+	defer trace.End(trace.Begin(""))
+
+	t.RLock()
+	defer t.RUnlock()
+
+	v, err := t.getRaw(key)
+	if (err != nil) || (v == nil) {
+		return nil, err
+	}
+
+	r := &ValueReader{Tree: t, Key: append([]byte(nil), key...), Raw: v, Freed: t.Freed}
+	if ValueGetType(v) == ValueTypeShared {
+		_, v = ValueGetShared(v)
+	}
+
+	r.Type = ValueGetType(v)
+	switch r.Type {
+	case ValueTypeExtent:
+		r.Index, r.Length = ValueGetExtent(v)
+	case ValueTypeLog:
+		if t.ValueLog == nil {
+			return nil, errors.New("tree has values in value log, but no log is set")
+		}
+		r.Ptr = ValueGetLog(v)
+		r.Length = r.Ptr.Length
+	case ValueTypeFull:
+		r.Value = ValueGetFull(v)
+		r.Length = int64(len(r.Value))
+	case ValueTypePartial:
+		/* NOTE(anton2920): chain is walked once to find where data of each 'Overflow' page is in value, so that reads after seek need only pages they touch. */
+		var next int64
+
+		page := t.NewPage()
+		r.Value, next = ValueGetPartial(v)
+		r.Length = int64(len(r.Value))
+		for next != 0 {
+			if _, err := t.ReadPageAt(page, next); err != nil {
+				return nil, fmt.Errorf("failed to read overflow: %v", err)
+			}
+			r.Overflows = append(r.Overflows, next)
+			r.Offsets = append(r.Offsets, r.Length)
+			r.Length += int64(len(page.Overflow().GetValue()))
+			next = page.Overflow().Next
+		}
+	}
+
+	return r, nil
+}
+
+/* SetFrom inserts or updates value for 'key' with 'size' bytes read from 'r' and commits the change. Values which don't fit into leaf are written to extent or value log in chunks, without keeping the whole value in memory. Tree is locked only to allocate pages for value and to put it into leaf, not while 'r' is read. */
+func (t *Tree) SetFrom(key []byte, r io.Reader, size int64) error {
+	defer trace.End(trace.Begin(""))
+
+	t.RLock()
+	page := t.NewPage()
+	t.InitPage(page, PageTypeLeaf)
+	inline := (!page.Leaf().OverflowAfterInsertKeyValueInEmpty(len(key), FullValueLen(nil)+int(size))) || ((!t.Meta.HasFeature(TreeFeatureExtents)) && (!t.logs(size)))
+	logs := t.logs(size)
+	t.RUnlock()
+
+	if inline {
+		value := make([]byte, size)
+		if _, err := io.ReadFull(r, value); err != nil {
+			return fmt.Errorf("failed to read value: %v", err)
+		}
+		return t.Set(key, value)
+	}
+
+	var err error
+	if logs {
+		err = t.setLogFrom(key, r, size)
+	} else {
+		err = t.setExtentFrom(key, r, size)
+	}
+	if err != nil {
+		return err
+	}
+
+	return t.sync()
+}
+
+/* setLogFrom appends value read from 'r' to value log and puts pointer to it for 'key'. */
+func (t *Tree) setLogFrom(key []byte, r io.Reader, size int64) error {
+	ptr, err := t.ValueLog.AppendFrom(key, r, size)
+	if err != nil {
+		return fmt.Errorf("failed to append value to log: %v", err)
+	}
+
+	t.Lock()
+	/* NOTE(anton2920): segment could be collected before value was put into leaf, since value was not referenced by tree yet. */
+	if !t.ValueLog.HasSegment(ptr.Segment) {
+		err = fmt.Errorf("value log segment %d was collected before value was stored", ptr.Segment)
+	} else {
+		err = t.set(key, LogValue(ptr), true)
+	}
+	if err == nil {
+		err = t.writeMeta()
+	}
+	t.Unlock()
+
+	return err
+}
+
+/* setExtentFrom writes value read from 'r' to run of contiguous pages and puts it for 'key'. Run is shared with identical value stored before, if tree deduplicates values. */
+func (t *Tree) setExtentFrom(key []byte, r io.Reader, size int64) error {
+	t.Lock()
+	n := t.extentPages(size)
+	index, err := t.reserveRun(n)
+	dedup := t.Meta.DedupMeta != 0
+	t.Unlock()
+	if err != nil {
+		return err
+	}
+
+	/* NOTE(anton2920): hash is known only after value is written, so pages of duplicate are freed right away. */
+	var hash [ValueHashSize]byte
+	h := sha256.New()
+	if dedup {
+		r = io.TeeReader(r, h)
+	}
+	werr := t.writeRunFrom(r, index, size)
+
+	t.Lock()
+	if werr != nil {
+		err = werr
+		if ferr := t.freePages(index, n); ferr != nil {
+			err = fmt.Errorf("%v; failed to free pages of value: %v", werr, ferr)
+		}
+	} else {
+		v := EncodeExtent(index, size)
+		if dedup {
+			var ok bool
+
+			h.Sum(hash[:0])
+			if v, ok, err = t.reuseShared(hash); (err == nil) && (ok) {
+				err = t.freePages(index, n)
+			} else if err == nil {
+				v, err = t.putShared(hash, EncodeExtent(index, size))
+			}
+		}
+		if err == nil {
+			err = t.set(key, v.Bytes(), true)
+		}
+	}
+	if err == nil {
+		err = t.writeMeta()
+	}
+	t.Unlock()
+
+	return err
+}
+
+/* logs returns whether value of 'size' bytes is stored in value log. */
+func (t *Tree) logs(size int64) bool {
+	return (t.ValueLog != nil) && (t.Meta.ValueThreshold > 0) && (size > t.Meta.ValueThreshold) && (size <= ValueLogMaxValueSize) && (t.Meta.HasFeature(TreeFeatureValueLog))
+}
+
+/* writeRunFrom writes 'size' bytes read from 'r' to pages starting at 'index', reserved with 'reserveRun'. Tree doesn't have to be locked, since no one else writes these pages. */
+func (t *Tree) writeRunFrom(r io.Reader, index int64, size int64) error {
+	pages := make([]Page, SetFromChunkPages)
+
+	index = t.pagerIndex(index)
+
+	for size > 0 {
+		n := int64(len(pages)) * PageSize
+		if n > size {
+			n = size
+		}
+		chunk := pages[:(n+PageSize-1)/PageSize]
+		if _, err := io.ReadFull(r, Pages2Bytes(chunk)[:n]); err != nil {
+			return fmt.Errorf("failed to read value: %v", err)
+		}
+		if _, err := t.Pager.WritePagesAt(chunk, index); err != nil {
+			return fmt.Errorf("failed to write %d pages of extent: %v", len(chunk), err)
+		}
+		index += int64(len(chunk))
+		size -= n
+	}
+
+	return nil
+}
@@ -0,0 +1,738 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/anton2920/gofa/errors"
+)
+
+/* SQLStatement is a pointer to one of statements below. */
+type SQLStatement interface{}
+
+type SQLCreateTable struct {
+	Table  string
+	Schema Schema
+}
+
+/* SQLCreateIndex creates secondary index on 'Column' of 'Table', see 'Table.CreateColumnIndex'. */
+type SQLCreateIndex struct {
+	Table  string
+	Column string
+}
+
+type SQLInsert struct {
+	Table string
+
+	/* Columns are names of columns of 'Values', nil means all columns. */
+	Columns []string
+	Values  [][]interface{}
+}
+
+type SQLSelect struct {
+	Table string
+
+	/* Columns are names of selected columns, nil means all columns. */
+	Columns []string
+	Where   SQLExpr
+
+	/* OrderBy must be a prefix of primary key. */
+	OrderBy []string
+	Desc    bool
+
+	/* Limit is a maximum number of returned rows, -1 means no limit. */
+	Limit int64
+}
+
+type SQLAssignment struct {
+	Column string
+	Value  interface{}
+}
+
+type SQLUpdate struct {
+	Table string
+	Set   []SQLAssignment
+	Where SQLExpr
+}
+
+type SQLDelete struct {
+	Table string
+	Where SQLExpr
+}
+
+/* SQLExplain returns plan of 'Statement' instead of executing it. */
+type SQLExplain struct {
+	Statement SQLStatement
+}
+
+/* SQLExpr is one of 'SQLBinary', 'SQLNot', 'SQLColumn' and 'SQLLiteral'. Nil expression is true. */
+type SQLExpr interface{}
+
+/* SQLBinary is a comparison, AND or OR of its operands. */
+type SQLBinary struct {
+	Op    string
+	Left  SQLExpr
+	Right SQLExpr
+}
+
+type SQLNot struct {
+	X SQLExpr
+}
+
+type SQLColumn struct {
+	Name string
+}
+
+/* SQLLiteral is a value of one of types allowed in 'Row'. */
+type SQLLiteral struct {
+	Value interface{}
+}
+
+type sqlTokenKind int
+
+const (
+	sqlTokenEOF = sqlTokenKind(iota)
+	sqlTokenIdent
+	sqlTokenInt
+	sqlTokenFloat
+	sqlTokenString
+	sqlTokenBytes
+	sqlTokenSymbol
+)
+
+type sqlToken struct {
+	Kind sqlTokenKind
+
+	/* Text is an upper-cased identifier, symbol or unquoted literal. */
+	Text string
+
+	/* Ident is identifier as it's written in query. */
+	Ident string
+	Pos   int
+}
+
+type sqlParser struct {
+	Tokens []sqlToken
+	Pos    int
+}
+
+var sqlColumnTypes = map[string]ColumnType{
+	"INT": ColumnTypeInt, "INTEGER": ColumnTypeInt, "BIGINT": ColumnTypeInt,
+	"UINT": ColumnTypeUint, "UNSIGNED": ColumnTypeUint,
+	"FLOAT": ColumnTypeFloat, "REAL": ColumnTypeFloat, "DOUBLE": ColumnTypeFloat,
+	"STRING": ColumnTypeString, "TEXT": ColumnTypeString, "VARCHAR": ColumnTypeString,
+	"BYTES": ColumnTypeBytes, "BLOB": ColumnTypeBytes,
+	"BOOL": ColumnTypeBool, "BOOLEAN": ColumnTypeBool,
+}
+
+func sqlTokenize(query string) ([]sqlToken, error) {
+	var tokens []sqlToken
+
+	for i := 0; i < len(query); {
+		c := query[i]
+		start := i
+
+		switch {
+		case (c == ' ') || (c == '\t') || (c == '\n') || (c == '\r'):
+			i++
+			continue
+		case (c == '-') && (i+1 < len(query)) && (query[i+1] == '-'):
+			for (i < len(query)) && (query[i] != '\n') {
+				i++
+			}
+			continue
+		case ((c == 'x') || (c == 'X')) && (i+1 < len(query)) && (query[i+1] == '\''):
+			s, n, err := sqlScanString(query[i+1:])
+			if err != nil {
+				return nil, fmt.Errorf("at %d: %v", start, err)
+			}
+			tokens = append(tokens, sqlToken{Kind: sqlTokenBytes, Text: s, Pos: start})
+			i += 1 + n
+		case (c == '_') || ((c >= 'a') && (c <= 'z')) || ((c >= 'A') && (c <= 'Z')):
+			for (i < len(query)) && ((query[i] == '_') || ((query[i] >= 'a') && (query[i] <= 'z')) || ((query[i] >= 'A') && (query[i] <= 'Z')) || (isDigit(query[i]))) {
+				i++
+			}
+			tokens = append(tokens, sqlToken{Kind: sqlTokenIdent, Text: strings.ToUpper(query[start:i]), Ident: query[start:i], Pos: start})
+		case isDigit(c) || ((c == '.') && (i+1 < len(query)) && (isDigit(query[i+1]))):
+			kind := sqlTokenInt
+			for (i < len(query)) && (isDigit(query[i])) {
+				i++
+			}
+			if (i < len(query)) && (query[i] == '.') {
+				kind = sqlTokenFloat
+				for i++; (i < len(query)) && (isDigit(query[i])); i++ {
+				}
+			}
+			if (i < len(query)) && ((query[i] == 'e') || (query[i] == 'E')) {
+				kind = sqlTokenFloat
+				if i++; (i < len(query)) && ((query[i] == '-') || (query[i] == '+')) {
+					i++
+				}
+				for (i < len(query)) && (isDigit(query[i])) {
+					i++
+				}
+			}
+			tokens = append(tokens, sqlToken{Kind: kind, Text: query[start:i], Pos: start})
+		case c == '\'':
+			s, n, err := sqlScanString(query[i:])
+			if err != nil {
+				return nil, fmt.Errorf("at %d: %v", start, err)
+			}
+			tokens = append(tokens, sqlToken{Kind: sqlTokenString, Text: s, Pos: start})
+			i += n
+		default:
+			var symbol string
+			if i+1 < len(query) {
+				switch query[i : i+2] {
+				case "<=", ">=", "!=":
+					symbol = query[i : i+2]
+				case "<>":
+					symbol = "!="
+				}
+			}
+			if symbol == "" {
+				if strings.IndexByte("(),*;=<>-", c) == -1 {
+					return nil, fmt.Errorf("at %d: unexpected character %q", start, c)
+				}
+				symbol = query[i : i+1]
+			}
+			tokens = append(tokens, sqlToken{Kind: sqlTokenSymbol, Text: symbol, Pos: start})
+			i += len(symbol)
+		}
+	}
+
+	return append(tokens, sqlToken{Kind: sqlTokenEOF, Pos: len(query)}), nil
+}
+
+/* sqlScanString returns contents of string literal at the beginning of 's' and its length. */
+func sqlScanString(s string) (string, int, error) {
+	var buf strings.Builder
+
+	for i := 1; i < len(s); i++ {
+		if s[i] != '\'' {
+			buf.WriteByte(s[i])
+		} else if (i+1 < len(s)) && (s[i+1] == '\'') {
+			buf.WriteByte('\'')
+			i++
+		} else {
+			return buf.String(), i + 1, nil
+		}
+	}
+	return "", 0, errors.New("string literal is not terminated")
+}
+
+/* ParseSQL parses one statement of 'query'. */
+func ParseSQL(query string) (SQLStatement, error) {
+	tokens, err := sqlTokenize(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to tokenize query: %v", err)
+	}
+
+	p := sqlParser{Tokens: tokens}
+	stmt, err := p.statement()
+	if err == nil {
+		p.accept(";")
+		if p.peek().Kind != sqlTokenEOF {
+			err = p.errorf("unexpected %q after statement", p.peek().Text)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse query: %v", err)
+	}
+
+	return stmt, nil
+}
+
+/* peek returns the next token or 'sqlTokenEOF'. */
+func (p *sqlParser) peek() sqlToken {
+	if p.Pos >= len(p.Tokens) {
+		return p.Tokens[len(p.Tokens)-1]
+	}
+	return p.Tokens[p.Pos]
+}
+
+func (p *sqlParser) next() sqlToken {
+	tok := p.peek()
+	p.Pos++
+	return tok
+}
+
+func (p *sqlParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("at %d: %s", p.peek().Pos, fmt.Sprintf(format, args...))
+}
+
+/* accept skips keyword or symbol 'text', if it's next. */
+func (p *sqlParser) accept(text string) bool {
+	if tok := p.peek(); ((tok.Kind == sqlTokenIdent) || (tok.Kind == sqlTokenSymbol)) && (tok.Text == text) {
+		p.Pos++
+		return true
+	}
+	return false
+}
+
+func (p *sqlParser) expect(text string) error {
+	if !p.accept(text) {
+		return p.errorf("expected %q, got %q", text, p.peek().Text)
+	}
+	return nil
+}
+
+func (p *sqlParser) ident() (string, error) {
+	tok := p.peek()
+	if tok.Kind != sqlTokenIdent {
+		return "", p.errorf("expected name, got %q", tok.Text)
+	}
+	p.Pos++
+	return tok.Ident, nil
+}
+
+func (p *sqlParser) identList() ([]string, error) {
+	var names []string
+	for {
+		name, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+		if !p.accept(",") {
+			return names, nil
+		}
+	}
+}
+
+func (p *sqlParser) statement() (SQLStatement, error) {
+	switch tok := p.next(); tok.Text {
+	case "CREATE":
+		if p.accept("INDEX") {
+			return p.createIndex()
+		}
+		return p.createTable()
+	case "INSERT":
+		return p.insert()
+	case "SELECT":
+		return p.selectStatement()
+	case "UPDATE":
+		return p.update()
+	case "DELETE":
+		return p.delete()
+	case "EXPLAIN":
+		return p.explain()
+	default:
+		p.Pos--
+		return nil, p.errorf("unknown statement %q", tok.Text)
+	}
+}
+
+func (p *sqlParser) createTable() (SQLStatement, error) {
+	var stmt SQLCreateTable
+	var err error
+
+	if err := p.expect("TABLE"); err != nil {
+		return nil, err
+	}
+	if stmt.Table, err = p.ident(); err != nil {
+		return nil, err
+	}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+
+	for {
+		if p.accept("PRIMARY") {
+			if err := p.expect("KEY"); err != nil {
+				return nil, err
+			}
+			if stmt.Schema.PrimaryKey != nil {
+				return nil, p.errorf("primary key is already defined")
+			}
+			if err := p.expect("("); err != nil {
+				return nil, err
+			}
+			if stmt.Schema.PrimaryKey, err = p.identList(); err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+		} else {
+			var column Column
+			if column.Name, err = p.ident(); err != nil {
+				return nil, err
+			}
+
+			tok := p.next()
+			typ, ok := sqlColumnTypes[tok.Text]
+			if (tok.Kind != sqlTokenIdent) || (!ok) {
+				p.Pos--
+				return nil, p.errorf("unknown column type %q", tok.Text)
+			}
+			column.Type = typ
+			stmt.Schema.Columns = append(stmt.Schema.Columns, column)
+
+			if p.accept("PRIMARY") {
+				if err := p.expect("KEY"); err != nil {
+					return nil, err
+				}
+				if stmt.Schema.PrimaryKey != nil {
+					return nil, p.errorf("primary key is already defined")
+				}
+				stmt.Schema.PrimaryKey = []string{column.Name}
+			}
+		}
+
+		if !p.accept(",") {
+			break
+		}
+	}
+
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	return &stmt, nil
+}
+
+func (p *sqlParser) createIndex() (SQLStatement, error) {
+	var stmt SQLCreateIndex
+	var err error
+
+	if err := p.expect("ON"); err != nil {
+		return nil, err
+	}
+	if stmt.Table, err = p.ident(); err != nil {
+		return nil, err
+	}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	if stmt.Column, err = p.ident(); err != nil {
+		return nil, err
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+
+	return &stmt, nil
+}
+
+func (p *sqlParser) insert() (SQLStatement, error) {
+	var stmt SQLInsert
+	var err error
+
+	if err := p.expect("INTO"); err != nil {
+		return nil, err
+	}
+	if stmt.Table, err = p.ident(); err != nil {
+		return nil, err
+	}
+	if p.accept("(") {
+		if stmt.Columns, err = p.identList(); err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expect("VALUES"); err != nil {
+		return nil, err
+	}
+
+	for {
+		var values []interface{}
+
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		for {
+			value, err := p.literal()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+			if !p.accept(",") {
+				break
+			}
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		stmt.Values = append(stmt.Values, values)
+
+		if !p.accept(",") {
+			return &stmt, nil
+		}
+	}
+}
+
+func (p *sqlParser) selectStatement() (SQLStatement, error) {
+	stmt := SQLSelect{Limit: -1}
+	var err error
+
+	if !p.accept("*") {
+		if stmt.Columns, err = p.identList(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expect("FROM"); err != nil {
+		return nil, err
+	}
+	if stmt.Table, err = p.ident(); err != nil {
+		return nil, err
+	}
+	if stmt.Where, err = p.where(); err != nil {
+		return nil, err
+	}
+
+	if p.accept("ORDER") {
+		if err := p.expect("BY"); err != nil {
+			return nil, err
+		}
+		for {
+			name, err := p.ident()
+			if err != nil {
+				return nil, err
+			}
+			stmt.OrderBy = append(stmt.OrderBy, name)
+
+			desc := p.accept("DESC")
+			if !desc {
+				p.accept("ASC")
+			}
+			if (len(stmt.OrderBy) > 1) && (desc != stmt.Desc) {
+				return nil, p.errorf("all columns in ORDER BY must have the same direction")
+			}
+			stmt.Desc = desc
+
+			if !p.accept(",") {
+				break
+			}
+		}
+	}
+
+	if p.accept("LIMIT") {
+		tok := p.next()
+		if tok.Kind != sqlTokenInt {
+			p.Pos--
+			return nil, p.errorf("expected number of rows, got %q", tok.Text)
+		}
+		if stmt.Limit, err = strconv.ParseInt(tok.Text, 10, 64); err != nil {
+			return nil, fmt.Errorf("at %d: invalid limit: %v", tok.Pos, err)
+		}
+	}
+
+	return &stmt, nil
+}
+
+func (p *sqlParser) update() (SQLStatement, error) {
+	var stmt SQLUpdate
+	var err error
+
+	if stmt.Table, err = p.ident(); err != nil {
+		return nil, err
+	}
+	if err := p.expect("SET"); err != nil {
+		return nil, err
+	}
+	for {
+		var assignment SQLAssignment
+		if assignment.Column, err = p.ident(); err != nil {
+			return nil, err
+		}
+		if err := p.expect("="); err != nil {
+			return nil, err
+		}
+		if assignment.Value, err = p.literal(); err != nil {
+			return nil, err
+		}
+		stmt.Set = append(stmt.Set, assignment)
+
+		if !p.accept(",") {
+			break
+		}
+	}
+	if stmt.Where, err = p.where(); err != nil {
+		return nil, err
+	}
+
+	return &stmt, nil
+}
+
+func (p *sqlParser) delete() (SQLStatement, error) {
+	var stmt SQLDelete
+	var err error
+
+	if err := p.expect("FROM"); err != nil {
+		return nil, err
+	}
+	if stmt.Table, err = p.ident(); err != nil {
+		return nil, err
+	}
+	if stmt.Where, err = p.where(); err != nil {
+		return nil, err
+	}
+
+	return &stmt, nil
+}
+
+func (p *sqlParser) explain() (SQLStatement, error) {
+	var stmt SQLExplain
+	var err error
+
+	switch tok := p.peek(); tok.Text {
+	case "SELECT", "UPDATE", "DELETE":
+		if stmt.Statement, err = p.statement(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, p.errorf("expected SELECT, UPDATE or DELETE, got %q", tok.Text)
+	}
+
+	return &stmt, nil
+}
+
+func (p *sqlParser) where() (SQLExpr, error) {
+	if !p.accept("WHERE") {
+		return nil, nil
+	}
+	return p.or()
+}
+
+func (p *sqlParser) or() (SQLExpr, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("OR") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = SQLBinary{Op: "OR", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *sqlParser) and() (SQLExpr, error) {
+	left, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("AND") {
+		right, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		left = SQLBinary{Op: "AND", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *sqlParser) not() (SQLExpr, error) {
+	if p.accept("NOT") {
+		x, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return SQLNot{X: x}, nil
+	}
+	return p.comparison()
+}
+
+func (p *sqlParser) comparison() (SQLExpr, error) {
+	left, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+
+	switch tok := p.peek(); tok.Text {
+	case "=", "!=", "<", "<=", ">", ">=":
+		if tok.Kind != sqlTokenSymbol {
+			break
+		}
+		p.Pos++
+
+		right, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		return SQLBinary{Op: tok.Text, Left: left, Right: right}, nil
+	}
+	return left, nil
+}
+
+func (p *sqlParser) operand() (SQLExpr, error) {
+	if p.accept("(") {
+		x, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return x, nil
+	}
+
+	if tok := p.peek(); (tok.Kind == sqlTokenIdent) && (tok.Text != "TRUE") && (tok.Text != "FALSE") && (tok.Text != "NULL") {
+		p.Pos++
+		return SQLColumn{Name: tok.Ident}, nil
+	}
+
+	value, err := p.literal()
+	if err != nil {
+		return nil, err
+	}
+	return SQLLiteral{Value: value}, nil
+}
+
+/* literal parses constant. Integers which don't fit into 'int64' are 'uint64'. */
+func (p *sqlParser) literal() (interface{}, error) {
+	negative := p.accept("-")
+
+	tok := p.next()
+	switch {
+	case tok.Kind == sqlTokenInt:
+		text := tok.Text
+		if negative {
+			text = "-" + text
+		}
+		x, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			/* NOTE(anton2920): positive integers above 'math.MaxInt64' are allowed for UINT columns. */
+			if !negative {
+				if u, err := strconv.ParseUint(text, 10, 64); err == nil {
+					return u, nil
+				}
+			}
+			return nil, fmt.Errorf("at %d: invalid integer: %v", tok.Pos, err)
+		}
+		return x, nil
+	case tok.Kind == sqlTokenFloat:
+		x, err := strconv.ParseFloat(tok.Text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("at %d: invalid number: %v", tok.Pos, err)
+		}
+		if negative {
+			x = -x
+		}
+		return x, nil
+	case negative:
+	case tok.Kind == sqlTokenString:
+		return tok.Text, nil
+	case tok.Kind == sqlTokenBytes:
+		x, err := hex.DecodeString(tok.Text)
+		if err != nil {
+			return nil, fmt.Errorf("at %d: invalid bytes: %v", tok.Pos, err)
+		}
+		return x, nil
+	case (tok.Kind == sqlTokenIdent) && (tok.Text == "TRUE"):
+		return true, nil
+	case (tok.Kind == sqlTokenIdent) && (tok.Text == "FALSE"):
+		return false, nil
+	case (tok.Kind == sqlTokenIdent) && (tok.Text == "NULL"):
+		return nil, nil
+	}
+
+	p.Pos--
+	return nil, p.errorf("expected value, got %q", tok.Text)
+}
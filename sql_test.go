@@ -0,0 +1,369 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseSQL(t *testing.T) {
+	tests := [...]struct {
+		Query    string
+		Expected SQLStatement
+	}{
+		{
+			"CREATE TABLE users (id INT PRIMARY KEY, name TEXT, photo BLOB);",
+			&SQLCreateTable{Table: "users", Schema: Schema{Columns: []Column{{"id", ColumnTypeInt}, {"name", ColumnTypeString}, {"photo", ColumnTypeBytes}}, PrimaryKey: []string{"id"}}},
+		},
+		{
+			"create table t (a uint, b float, c bool, primary key (b, a))",
+			&SQLCreateTable{Table: "t", Schema: Schema{Columns: []Column{{"a", ColumnTypeUint}, {"b", ColumnTypeFloat}, {"c", ColumnTypeBool}}, PrimaryKey: []string{"b", "a"}}},
+		},
+		{
+			"INSERT INTO users (id, name) VALUES (1, 'it''s'), (-2, NULL), (3, X'00ff')",
+			&SQLInsert{Table: "users", Columns: []string{"id", "name"}, Values: [][]interface{}{{int64(1), "it's"}, {int64(-2), nil}, {int64(3), []byte{0, 0xFF}}}},
+		},
+		{
+			"SELECT id, name FROM users WHERE id >= 10 AND (name = 'a' OR NOT active) ORDER BY id DESC LIMIT 5",
+			&SQLSelect{
+				Table:   "users",
+				Columns: []string{"id", "name"},
+				Where: SQLBinary{Op: "AND",
+					Left:  SQLBinary{Op: ">=", Left: SQLColumn{"id"}, Right: SQLLiteral{int64(10)}},
+					Right: SQLBinary{Op: "OR", Left: SQLBinary{Op: "=", Left: SQLColumn{"name"}, Right: SQLLiteral{"a"}}, Right: SQLNot{SQLColumn{"active"}}},
+				},
+				OrderBy: []string{"id"},
+				Desc:    true,
+				Limit:   5,
+			},
+		},
+		{
+			"SELECT * FROM t WHERE 1.5e1 <> b",
+			&SQLSelect{Table: "t", Where: SQLBinary{Op: "!=", Left: SQLLiteral{15.0}, Right: SQLColumn{"b"}}, Limit: -1},
+		},
+		{
+			"UPDATE users SET name = 'x', active = TRUE WHERE id = 1",
+			&SQLUpdate{Table: "users", Set: []SQLAssignment{{"name", "x"}, {"active", true}}, Where: SQLBinary{Op: "=", Left: SQLColumn{"id"}, Right: SQLLiteral{int64(1)}}},
+		},
+		{
+			"DELETE FROM users -- everything\n",
+			&SQLDelete{Table: "users"},
+		},
+		{
+			"CREATE INDEX ON users (name)",
+			&SQLCreateIndex{Table: "users", Column: "name"},
+		},
+		{
+			"EXPLAIN DELETE FROM users WHERE id = 1",
+			&SQLExplain{&SQLDelete{Table: "users", Where: SQLBinary{Op: "=", Left: SQLColumn{"id"}, Right: SQLLiteral{int64(1)}}}},
+		},
+	}
+
+	for _, test := range tests {
+		stmt, err := ParseSQL(test.Query)
+		if err != nil {
+			t.Errorf("Failed to parse %q: %v", test.Query, err)
+		} else if !reflect.DeepEqual(stmt, test.Expected) {
+			t.Errorf("Expected %#v for %q, got %#v", test.Expected, test.Query, stmt)
+		}
+	}
+
+	for _, query := range [...]string{"", "DROP TABLE users", "SELECT FROM users", "SELECT * FROM users WHERE", "INSERT INTO t VALUES (1", "SELECT * FROM t LIMIT x", "SELECT * FROM t; x", "SELECT 'a FROM t", "SELECT * FROM t WHERE a ? 1", "CREATE INDEX ON t", "EXPLAIN INSERT INTO t VALUES (1)", "EXPLAIN EXPLAIN SELECT * FROM t"} {
+		if _, err := ParseSQL(query); err == nil {
+			t.Errorf("Expected error on parsing %q, got nothing", query)
+		}
+	}
+}
+
+func TestDatabaseExec(t *testing.T) {
+	var pager MemoryPager
+
+	db, err := DatabaseOpen(&pager, -1)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+
+	exec := func(query string) *SQLResult {
+		t.Helper()
+		result, err := db.Exec(query)
+		if err != nil {
+			t.Fatalf("Failed to execute %q: %v", query, err)
+		}
+		return result
+	}
+
+	exec("CREATE TABLE orders (customer TEXT, id INT, amount FLOAT, paid BOOL, PRIMARY KEY (customer, id))")
+	for i := 0; i < 300; i++ {
+		exec(fmt.Sprintf("INSERT INTO orders VALUES ('customer%d', %d, %d.5, %v)", i%3, i, i, i%2 == 0))
+	}
+	if _, err := db.Exec("INSERT INTO orders VALUES ('customer0', 0, 1, TRUE)"); err != ErrRowExists {
+		t.Errorf("Expected %v on inserting duplicate, got %v", ErrRowExists, err)
+	}
+
+	/* Reopen database to check that catalog and schema are persisted. */
+	db, err = DatabaseOpen(&pager, db.Catalog.MetaIndex)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+
+	result := exec("SELECT id, amount FROM orders WHERE customer = 'customer1' AND id > 10 AND id <= 40 AND paid = FALSE ORDER BY customer, id LIMIT 3")
+	if expected := []Row{{int64(13), 13.5}, {int64(19), 19.5}, {int64(25), 25.5}}; !reflect.DeepEqual(result.Rows, expected) {
+		t.Errorf("Expected rows %v, got %v", expected, result.Rows)
+	}
+	if expected := []string{"id", "amount"}; !reflect.DeepEqual(result.Columns, expected) {
+		t.Errorf("Expected columns %v, got %v", expected, result.Columns)
+	}
+
+	result = exec("SELECT id FROM orders WHERE customer = 'customer2' ORDER BY customer DESC, id DESC LIMIT 2")
+	if expected := []Row{{int64(299)}, {int64(296)}}; !reflect.DeepEqual(result.Rows, expected) {
+		t.Errorf("Expected rows %v, got %v", expected, result.Rows)
+	}
+
+	result = exec("SELECT * FROM orders WHERE id = 7 OR amount < 1")
+	if len(result.Rows) != 2 {
+		t.Errorf("Expected 2 rows, got %v", result.Rows)
+	}
+
+	if result := exec("UPDATE orders SET paid = TRUE, amount = 0 WHERE customer = 'customer0' AND id < 30"); result.Affected != 10 {
+		t.Errorf("Expected 10 updated rows, got %d", result.Affected)
+	}
+	if result := exec("SELECT * FROM orders WHERE paid AND amount = 0"); len(result.Rows) != 10 {
+		t.Errorf("Expected 10 rows, got %d", len(result.Rows))
+	}
+	if result := exec("DELETE FROM orders WHERE customer >= 'customer1'"); result.Affected != 200 {
+		t.Errorf("Expected 200 deleted rows, got %d", result.Affected)
+	}
+	if result := exec("SELECT customer FROM orders"); len(result.Rows) != 100 {
+		t.Errorf("Expected 100 rows, got %d", len(result.Rows))
+	}
+
+	exec("CREATE TABLE counters (id UINT PRIMARY KEY, value INT)")
+	exec("INSERT INTO counters VALUES (18446744073709551615, 1)")
+	exec("INSERT INTO counters (id) VALUES (1)")
+	if result := exec("SELECT id FROM counters WHERE id > 9223372036854775807"); !reflect.DeepEqual(result.Rows, []Row{{uint64(18446744073709551615)}}) {
+		t.Errorf("Expected row with maximum id, got %v", result.Rows)
+	}
+	if result := exec("SELECT id FROM counters WHERE NOT (value = 2)"); !reflect.DeepEqual(result.Rows, []Row{{uint64(18446744073709551615)}}) {
+		t.Errorf("Expected only row with non-NULL value, got %v", result.Rows)
+	}
+	if result := exec("SELECT id FROM counters WHERE value = 2 OR id = 1"); !reflect.DeepEqual(result.Rows, []Row{{uint64(1)}}) {
+		t.Errorf("Expected row with id 1, got %v", result.Rows)
+	}
+
+	for _, query := range [...]string{
+		"CREATE TABLE orders (id INT PRIMARY KEY)",
+		"SELECT * FROM missing",
+		"SELECT missing FROM orders",
+		"SELECT * FROM orders WHERE amount = 'x'",
+		"SELECT * FROM orders ORDER BY amount",
+		"UPDATE orders SET id = 1",
+		"INSERT INTO orders (customer) VALUES ('x')",
+		"INSERT INTO orders VALUES ('x', 1.5, 1, TRUE)",
+	} {
+		if _, err := db.Exec(query); err == nil {
+			t.Errorf("Expected error on executing %q, got nothing", query)
+		}
+	}
+
+	/* Statements which fail on one of rows change nothing. */
+	for _, query := range [...]string{
+		"INSERT INTO orders VALUES ('y', 1, 1, TRUE), ('x', 1.5, 1, TRUE)",
+		"INSERT INTO orders VALUES ('y', 1, 1, TRUE), ('customer0', 0, 1, TRUE)",
+		"INSERT INTO orders VALUES ('y', 1, 1, TRUE), ('y', 1, 2, TRUE)",
+	} {
+		if _, err := db.Exec(query); err == nil {
+			t.Errorf("Expected error on executing %q, got nothing", query)
+		}
+		if result := exec("SELECT * FROM orders WHERE customer = 'y'"); len(result.Rows) != 0 {
+			t.Errorf("Expected no rows after failed %q, got %v", query, result.Rows)
+		}
+	}
+}
+
+func TestDatabaseExecConcurrent(t *testing.T) {
+	const tables = 6
+	const rows = 200
+
+	pager, err := FilePagerNew(filepath.Join(t.TempDir(), "concurrent_test.db"))
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	defer pager.Close()
+
+	db, err := DatabaseOpen(pager, -1)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	for i := 0; i < tables; i++ {
+		if _, err := db.Exec(fmt.Sprintf("CREATE TABLE t%d (id INT PRIMARY KEY, value TEXT)", i)); err != nil {
+			t.Fatalf("Failed to create table: %v", err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, tables)
+	for i := 0; i < tables; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < rows; j++ {
+				if _, err := db.Exec(fmt.Sprintf("INSERT INTO t%d VALUES (%d, 'value%d')", i, j, j)); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("Failed to insert row: %v", err)
+	}
+
+	for i := 0; i < tables; i++ {
+		result, err := db.Exec(fmt.Sprintf("SELECT * FROM t%d", i))
+		if err != nil {
+			t.Fatalf("Failed to select rows: %v", err)
+		}
+		if len(result.Rows) != rows {
+			t.Errorf("Expected %d rows in table %d, got %d", rows, i, len(result.Rows))
+		}
+	}
+}
+
+func TestTableSQLRange(t *testing.T) {
+	var pager MemoryPager
+
+	db, err := DatabaseOpen(&pager, -1)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	table, err := db.CreateTable("t", Schema{Columns: []Column{{"a", ColumnTypeString}, {"b", ColumnTypeFloat}, {"c", ColumnTypeInt}}, PrimaryKey: []string{"a", "b"}})
+	if err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	tests := [...]struct {
+		Where    string
+		Expected sqlRange
+	}{
+		{"c = 1", sqlRange{}},
+		{"a = 'x' OR b = 1", sqlRange{}},
+		{"'x' = a", sqlRange{Prefix: []interface{}{"x"}}},
+		{"a = 'x' AND b = 2 AND c = 3", sqlRange{Prefix: []interface{}{"x", 2.0}}},
+		{"a > 'x' AND b = 2", sqlRange{Lo: "x"}},
+		{"a = 'x' AND 1 < b AND b <= 5 AND b < 5 AND b >= 1", sqlRange{Prefix: []interface{}{"x"}, Lo: 1.0, Hi: 5.0}},
+		{"a < 'y' AND a <= 'y' AND a >= 'b'", sqlRange{Lo: "b", LoInclusive: true, Hi: "y"}},
+	}
+	for _, test := range tests {
+		stmt, err := ParseSQL("SELECT * FROM t WHERE " + test.Where)
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %v", test.Where, err)
+		}
+		if r := table.sqlRange(stmt.(*SQLSelect).Where); !reflect.DeepEqual(r, test.Expected) {
+			t.Errorf("Expected range %+v for %q, got %+v", test.Expected, test.Where, r)
+		}
+	}
+}
+
+func TestDatabasePlanner(t *testing.T) {
+	var pager MemoryPager
+
+	db, err := DatabaseOpen(&pager, -1)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+
+	exec := func(query string) *SQLResult {
+		t.Helper()
+		result, err := db.Exec(query)
+		if err != nil {
+			t.Fatalf("Failed to execute %q: %v", query, err)
+		}
+		return result
+	}
+	explain := func(query string, expected string, rows int64) {
+		t.Helper()
+		result := exec("EXPLAIN " + query)
+		if plan := result.Rows[0][0]; plan != expected {
+			t.Errorf("Expected plan %q for %q, got %q", expected, query, plan)
+		}
+		/* Estimates may be off as much as pages differ in how full they are. */
+		if n := result.Rows[0][1].(int64); (n < rows/2) || (n > rows*2) {
+			t.Errorf("Expected about %d rows to be read for %q, got %d", rows, query, n)
+		}
+		if total := result.Rows[0][2].(int64); (total < 1000) || (total > 4000) {
+			t.Errorf("Expected about %d rows in table, got %d", 2000, total)
+		}
+	}
+
+	exec("CREATE TABLE items (id INT PRIMARY KEY, category INT, price FLOAT, name TEXT)")
+	exec("CREATE INDEX ON items (category)")
+	for i := 0; i < 2000; i += 100 {
+		var values []string
+		for j := i; j < i+100; j++ {
+			values = append(values, fmt.Sprintf("(%d, %d, %d, 'item%d')", j, j%100, j, j))
+		}
+		exec("INSERT INTO items VALUES " + strings.Join(values, ", "))
+	}
+	/* Index created after rows are inserted is filled with them. */
+	exec("CREATE INDEX ON items (price)")
+	exec("INSERT INTO items VALUES (-1, NULL, NULL, 'nothing')")
+	exec("DELETE FROM items WHERE id = -1")
+
+	explain("SELECT * FROM items WHERE id = 5", "PRIMARY KEY RANGE SCAN items (id = 5)", 1)
+	explain("SELECT * FROM items WHERE id >= 100 AND id < 200", "PRIMARY KEY RANGE SCAN items (id >= 100 AND id < 200)", 100)
+	explain("SELECT * FROM items WHERE name = 'item7'", "FULL SCAN items", 2000)
+	explain("SELECT * FROM items WHERE category = 7 OR price = 7", "FULL SCAN items", 2000)
+	explain("SELECT * FROM items WHERE category > 1", "FULL SCAN items", 2000)
+	explain("SELECT * FROM items WHERE 7 = category", "INDEX RANGE SCAN items USING category (category = 7)", 20)
+	explain("UPDATE items SET name = 'x' WHERE category = 7 AND price > 100 AND price <= 110.5", "INDEX RANGE SCAN items USING price (price > 100 AND price <= 110.5)", 10)
+	explain("DELETE FROM items WHERE category = 7 AND id < 10", "PRIMARY KEY RANGE SCAN items (id < 10)", 10)
+
+	result := exec("SELECT id, price FROM items WHERE category = 7 AND price < 1000 ORDER BY id DESC LIMIT 3")
+	if expected := []Row{{int64(907), 907.0}, {int64(807), 807.0}, {int64(707), 707.0}}; !reflect.DeepEqual(result.Rows, expected) {
+		t.Errorf("Expected rows %v, got %v", expected, result.Rows)
+	}
+	result = exec("SELECT id FROM items WHERE price > 1995")
+	if expected := []Row{{int64(1996)}, {int64(1997)}, {int64(1998)}, {int64(1999)}}; !reflect.DeepEqual(result.Rows, expected) {
+		t.Errorf("Expected rows %v, got %v", expected, result.Rows)
+	}
+
+	if result := exec("UPDATE items SET category = 1000 WHERE category = 7"); result.Affected != 20 {
+		t.Errorf("Expected 20 updated rows, got %d", result.Affected)
+	}
+
+	/* Reopen database to check that indexes are defined again and are still maintained. */
+	db, err = DatabaseOpen(&pager, db.Catalog.MetaIndex)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+
+	if result := exec("SELECT * FROM items WHERE category = 7"); len(result.Rows) != 0 {
+		t.Errorf("Expected no rows in old category, got %v", result.Rows)
+	}
+	if result := exec("DELETE FROM items WHERE category = 1000"); result.Affected != 20 {
+		t.Errorf("Expected 20 deleted rows, got %d", result.Affected)
+	}
+	if result := exec("SELECT * FROM items WHERE category = 1000"); len(result.Rows) != 0 {
+		t.Errorf("Expected no rows in new category, got %v", result.Rows)
+	}
+	if result := exec("SELECT * FROM items WHERE category = 8"); len(result.Rows) != 20 {
+		t.Errorf("Expected 20 rows, got %d", len(result.Rows))
+	}
+
+	for _, query := range [...]string{
+		"CREATE INDEX ON items (id)",
+		"CREATE INDEX ON items (missing)",
+		"CREATE INDEX ON items (category)",
+		"CREATE INDEX ON missing (category)",
+		"EXPLAIN SELECT * FROM items WHERE missing = 1",
+	} {
+		if _, err := db.Exec(query); err == nil {
+			t.Errorf("Expected error on executing %q, got nothing", query)
+		}
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/anton2920/gofa/trace"
+)
+
+/* PageStream stores variable-size records for pages one after another in pages of underlying pager, so that they can span page boundaries: | index (8 bytes) | length (4 bytes) | data |. Records are appended, so the last record for an index is the current one, and stream is compacted when overwritten records take more space than live ones. It is used by pagers which change size of pages they store. */
+type PageStream struct {
+	Pager
+
+	/* Start is a page of underlying pager stream starts at. It's stored in header page: | start (8 bytes) |, which is the first page of underlying pager. */
+	Start int64
+
+	/* Size is a number of bytes in stream and Live is a number of bytes taken by current records. */
+	Size int64
+	Live int64
+
+	/* Tail is a copy of the last partially filled page, so appends don't have to read it back. */
+	Tail Page
+
+	/* Extents maps page index to data of its last record. */
+	Extents []PageExtent
+
+	/* Batch holds records appended with 'AppendRecord', but not yet written with 'Flush'. */
+	Batch        []byte
+	BatchIndices []int64
+}
+
+/* PageExtent is a location of record's data in 'PageStream'. */
+type PageExtent struct {
+	Offset int64
+	Length int64
+}
+
+const PageRecordHeaderSize = 12
+
+/* PageStreamCompactMinPages is a number of pages stream must take before it's compacted. */
+const PageStreamCompactMinPages = 16
+
+/* Open reads header page and headers of all records stored in underlying pager to find the latest record for each page. Stream ends with zero length, with record which can't be there or which doesn't fit into underlying pager, as after interrupted append. Header page is written, if underlying pager is empty. */
+func (s *PageStream) Open() error {
+	defer trace.End(trace.Begin(""))
+
+	var header [PageRecordHeaderSize]byte
+	var offset int64
+
+	var page Page
+	if _, err := s.Pager.ReadPagesAt(Page2Slice(&page), 0); err == ErrPagesOutOfBounds {
+		if err := s.writeHeader(1); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return fmt.Errorf("failed to read header of stream: %v", err)
+	} else {
+		s.Start = int64(binary.LittleEndian.Uint64(page[:]))
+	}
+
+	pages, err := countPages(s.Pager)
+	if err != nil {
+		return fmt.Errorf("failed to count pages of stream: %v", err)
+	}
+	if (s.Start < 1) || (s.Start > pages) {
+		return fmt.Errorf("stream starts at page %d, which is out of bounds", s.Start)
+	}
+	end := (pages - s.Start) * PageSize
+
+	s.Extents = s.Extents[:0]
+	s.Live = 0
+	for offset+PageRecordHeaderSize <= end {
+		if err := s.ReadAt(header[:], offset); err != nil {
+			return fmt.Errorf("failed to read record at %d: %v", offset, err)
+		}
+		index := int64(binary.LittleEndian.Uint64(header[:]))
+		length := int64(binary.LittleEndian.Uint32(header[8:]))
+		if (length == 0) || (index > s.Count()) || (offset+PageRecordHeaderSize+length > end) {
+			break
+		}
+		s.SetExtent(index, PageExtent{Offset: offset + PageRecordHeaderSize, Length: length})
+		offset += PageRecordHeaderSize + length
+	}
+
+	s.Size = offset
+	s.Tail = Page{}
+	if offset%PageSize != 0 {
+		if err := s.ReadAt(s.Tail[:], offset/PageSize*PageSize); err != nil {
+			return fmt.Errorf("failed to read last page of stream: %v", err)
+		}
+	}
+	return nil
+}
+
+/* writeHeader makes stream start at page 'start' of underlying pager. */
+func (s *PageStream) writeHeader(start int64) error {
+	var header Page
+
+	binary.LittleEndian.PutUint64(header[:], uint64(start))
+	if _, err := s.Pager.WritePagesAt(Page2Slice(&header), 0); err != nil {
+		return fmt.Errorf("failed to write header of stream: %v", err)
+	}
+	s.Start = start
+
+	return nil
+}
+
+/* Count returns number of pages stored in stream. */
+func (s *PageStream) Count() int64 {
+	return int64(len(s.Extents))
+}
+
+func (s *PageStream) SetExtent(index int64, extent PageExtent) {
+	for int64(len(s.Extents)) <= index {
+		s.Extents = append(s.Extents, PageExtent{})
+	}
+	if s.Extents[index].Length > 0 {
+		s.Live -= PageRecordHeaderSize + s.Extents[index].Length
+	}
+	s.Extents[index] = extent
+	s.Live += PageRecordHeaderSize + extent.Length
+}
+
+/* ReadRecord returns data of the last record for page 'index', reusing 'buf' if it's large enough. */
+func (s *PageStream) ReadRecord(buf []byte, index int64) ([]byte, error) {
+	if (index < 0) || (index >= s.Count()) {
+		return nil, fmt.Errorf("page index %d is out of bounds", index)
+	}
+
+	extent := s.Extents[index]
+	if int64(cap(buf)) < extent.Length {
+		buf = make([]byte, extent.Length)
+	}
+	buf = buf[:extent.Length]
+
+	if err := s.ReadAt(buf, extent.Offset); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+/* AppendRecord adds record for page 'index' with 'data' to batch, which is written with 'Flush'. */
+func (s *PageStream) AppendRecord(index int64, data []byte) {
+	var header [PageRecordHeaderSize]byte
+
+	binary.LittleEndian.PutUint64(header[:], uint64(index))
+	binary.LittleEndian.PutUint32(header[8:], uint32(len(data)))
+
+	s.Batch = append(s.Batch, header[:]...)
+	s.Batch = append(s.Batch, data...)
+	s.BatchIndices = append(s.BatchIndices, index)
+}
+
+/* DiscardBatch drops records appended with 'AppendRecord' since the last 'Flush'. */
+func (s *PageStream) DiscardBatch() {
+	s.Batch = s.Batch[:0]
+	s.BatchIndices = s.BatchIndices[:0]
+}
+
+/* Flush writes all records in batch with one append. */
+func (s *PageStream) Flush() error {
+	defer trace.End(trace.Begin(""))
+
+	batch := s.Batch
+	s.Batch = s.Batch[:0]
+	indices := s.BatchIndices
+	s.BatchIndices = s.BatchIndices[:0]
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	offset, err := s.Append(batch)
+	if err != nil {
+		return err
+	}
+
+	for _, index := range indices {
+		length := int64(binary.LittleEndian.Uint32(batch[8:]))
+		s.SetExtent(index, PageExtent{Offset: offset + PageRecordHeaderSize, Length: length})
+		offset += PageRecordHeaderSize + length
+		batch = batch[PageRecordHeaderSize+length:]
+	}
+	return nil
+}
+
+/* NeedsCompact returns whether stream is large enough and more than half of it is taken by overwritten records. */
+func (s *PageStream) NeedsCompact() bool {
+	return (s.Size > PageStreamCompactMinPages*PageSize) && (s.Size > 2*s.Live)
+}
+
+/* Compact copies current records one after another into pages of underlying pager which are not used by stream, dropping overwritten ones, and switches header to the copy after it's synced. Stream is left unchanged, if compaction is interrupted. */
+func (s *PageStream) Compact() error {
+	defer trace.End(trace.Begin(""))
+
+	/* NOTE(anton2920): copy goes before stream, if it fits there, or after the page with zero header at the end of stream otherwise, so that pages are reused once stream is compacted twice. */
+	start := s.Start + (s.Size+PageRecordHeaderSize-1)/PageSize + 1
+	if 1+(s.Live+PageRecordHeaderSize+PageSize-1)/PageSize <= s.Start {
+		start = 1
+	}
+
+	extents := make([]PageExtent, len(s.Extents))
+
+	/* NOTE(anton2920): 'pages' hold copied records starting at page 'first' of copy. */
+	pages := make([]Page, PageStreamCompactMinPages)
+	buf := Pages2Bytes(pages)
+	var first, n int64
+	var record []byte
+
+	flush := func(all bool) error {
+		count := n / PageSize
+		if all {
+			/* NOTE(anton2920): stream must end with zero header, while pages after it may still hold old records. */
+			count = (n+PageRecordHeaderSize-1)/PageSize + 1
+			if count > int64(len(pages)) {
+				pages = append(pages, make([]Page, count-int64(len(pages)))...)
+				buf = Pages2Bytes(pages)
+			}
+			for i := n; i < count*PageSize; i++ {
+				buf[i] = 0
+			}
+		}
+		if count == 0 {
+			return nil
+		}
+		if _, err := s.Pager.WritePagesAt(pages[:count], start+first); err != nil {
+			return fmt.Errorf("failed to write %d pages of stream: %v", count, err)
+		}
+		if !all {
+			n = int64(copy(buf, buf[count*PageSize:n]))
+			first += count
+		}
+		return nil
+	}
+
+	/* NOTE(anton2920): records are copied in order of pages, so that 'Open' finds each page index at most one past the last one. */
+	for index := int64(0); index < s.Count(); index++ {
+		var err error
+
+		if record, err = s.ReadRecord(record, index); err != nil {
+			return fmt.Errorf("failed to read record for page %d: %v", index, err)
+		}
+		if n+PageRecordHeaderSize+int64(len(record)) > int64(len(buf)) {
+			if err := flush(false); err != nil {
+				return err
+			}
+			if n+PageRecordHeaderSize+int64(len(record)) > int64(len(buf)) {
+				pages = append(pages, make([]Page, (n+PageRecordHeaderSize+int64(len(record))+PageSize-1)/PageSize-int64(len(pages)))...)
+				buf = Pages2Bytes(pages)
+			}
+		}
+
+		binary.LittleEndian.PutUint64(buf[n:], uint64(index))
+		binary.LittleEndian.PutUint32(buf[n+8:], uint32(len(record)))
+		copy(buf[n+PageRecordHeaderSize:], record)
+		extents[index] = PageExtent{Offset: first*PageSize + n + PageRecordHeaderSize, Length: int64(len(record))}
+		n += PageRecordHeaderSize + int64(len(record))
+	}
+	if err := flush(true); err != nil {
+		return err
+	}
+	if err := s.Sync(DurabilitySync); err != nil {
+		return fmt.Errorf("failed to sync copy of stream: %v", err)
+	}
+	if err := s.writeHeader(start); err != nil {
+		return err
+	}
+	if err := s.Sync(DurabilitySync); err != nil {
+		return fmt.Errorf("failed to sync header of stream: %v", err)
+	}
+
+	s.Extents = extents
+	s.Size = first*PageSize + n
+	s.Tail = Page{}
+	if s.Size%PageSize != 0 {
+		s.Tail = pages[n/PageSize]
+	}
+	return nil
+}
+
+/* ReadAt reads len(buf) bytes at 'offset' with one multi-page read. Bytes past the end of stream, but within pages of underlying pager, are read as they are stored there. It returns 'ErrPagesOutOfBounds' if 'offset' is past the end of underlying pager. */
+func (s *PageStream) ReadAt(buf []byte, offset int64) error {
+	defer trace.End(trace.Begin(""))
+
+	if offset < 0 {
+		return fmt.Errorf("stream offset %d is out of bounds", offset)
+	}
+	if len(buf) == 0 {
+		return nil
+	}
+
+	first := offset / PageSize
+	last := (offset + int64(len(buf)) - 1) / PageSize
+	pages := make([]Page, last-first+1)
+	if _, err := s.Pager.ReadPagesAt(pages, s.Start+first); err == ErrPagesOutOfBounds {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("failed to read %d pages of stream: %v", len(pages), err)
+	}
+	copy(buf, Pages2Bytes(pages)[offset-first*PageSize:])
+
+	return nil
+}
+
+/* Append writes 'buf' at the end of stream with one multi-page write and returns its offset. */
+func (s *PageStream) Append(buf []byte) (int64, error) {
+	defer trace.End(trace.Begin(""))
+
+	offset := s.Size
+	first := offset / PageSize
+	/* NOTE(anton2920): pages are written up to the end of zero header after the last record, so stream ends there even if pages after it hold old records. */
+	last := (offset + int64(len(buf)) + PageRecordHeaderSize - 1) / PageSize
+
+	pages := make([]Page, last-first+1)
+	pages[0] = s.Tail
+	copy(Pages2Bytes(pages)[offset-first*PageSize:], buf)
+
+	if _, err := s.Pager.WritePagesAt(pages, s.Start+first); err != nil {
+		return -1, fmt.Errorf("failed to write %d pages of stream: %v", len(pages), err)
+	}
+
+	s.Size += int64(len(buf))
+	s.Tail = Page{}
+	if s.Size%PageSize != 0 {
+		s.Tail = pages[s.Size/PageSize-first]
+	}
+
+	return offset, nil
+}
+
+func (s *PageStream) Sync(d Durability) error {
+	if syncer, ok := s.Pager.(Syncer); ok {
+		return syncer.Sync(d)
+	}
+	return nil
+}
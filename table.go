@@ -0,0 +1,677 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/anton2920/gofa/errors"
+	"github.com/anton2920/gofa/trace"
+)
+
+type ColumnType int64
+
+const (
+	ColumnTypeNone = ColumnType(iota)
+	ColumnTypeInt
+	ColumnTypeUint
+	ColumnTypeFloat
+	ColumnTypeString
+	ColumnTypeBytes
+	ColumnTypeBool
+)
+
+type Column struct {
+	Name string
+	Type ColumnType
+}
+
+/* Schema describes rows of table. */
+type Schema struct {
+	Columns []Column
+
+	/* PrimaryKey are names of columns which values identify row, in order rows are sorted by them. */
+	PrimaryKey []string
+
+	/* Indexes are names of columns which have secondary indexes, see 'Table.CreateColumnIndex'. Index has the same name as its column. */
+	Indexes []string
+}
+
+/* Row holds values of columns in order of 'Schema.Columns'. Values are 'int64', 'uint64', 'float64', 'string', '[]byte' and 'bool' for corresponding column types or nil, which means value is missing. Values of primary key can't be missing. */
+type Row []interface{}
+
+/* Table stores rows in tree. Keys are values of primary key and values are values of other columns, both encoded with 'AppendKey'. */
+type Table struct {
+	*Tree
+	Schema Schema
+
+	/* Key are positions of primary key columns in 'Schema.Columns'. */
+	Key []int
+}
+
+/* TableIterator returns rows of table in order of their primary keys. */
+type TableIterator struct {
+	Table *Table
+	It    *TreeForwardIterator
+	Page  *Page
+
+	Row         Row
+	ValueBuffer []byte
+}
+
+var (
+	/* ErrRowExists is returned by 'Table.Insert' when row with the same primary key is already stored. */
+	ErrRowExists = errors.New("row with the same primary key already exists")
+
+	/* ErrRowNotFound is returned by 'Table.Update' and 'Table.Delete' when there's no row with requested primary key. */
+	ErrRowNotFound = errors.New("row not found")
+)
+
+func (typ ColumnType) String() string {
+	switch typ {
+	default:
+		return fmt.Sprintf("ColumnType(%d)", int64(typ))
+	case ColumnTypeInt:
+		return "INT"
+	case ColumnTypeUint:
+		return "UINT"
+	case ColumnTypeFloat:
+		return "FLOAT"
+	case ColumnTypeString:
+		return "STRING"
+	case ColumnTypeBytes:
+		return "BYTES"
+	case ColumnTypeBool:
+		return "BOOL"
+	}
+}
+
+/* Column returns position of column 'name' or -1, if there's no such column. */
+func (s *Schema) Column(name string) int {
+	for i := range s.Columns {
+		if s.Columns[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+/* Check returns positions of primary key columns or error, if schema is not valid. */
+func (s *Schema) Check() ([]int, error) {
+	if len(s.Columns) == 0 {
+		return nil, errors.New("schema has no columns")
+	}
+	for i, column := range s.Columns {
+		if len(column.Name) == 0 {
+			return nil, fmt.Errorf("column %d has no name", i)
+		}
+		if s.Column(column.Name) != i {
+			return nil, fmt.Errorf("duplicate column %q", column.Name)
+		}
+		if (column.Type <= ColumnTypeNone) || (column.Type > ColumnTypeBool) {
+			return nil, fmt.Errorf("column %q has unknown type %d", column.Name, column.Type)
+		}
+	}
+
+	if len(s.PrimaryKey) == 0 {
+		return nil, errors.New("schema has no primary key")
+	}
+	key := make([]int, len(s.PrimaryKey))
+	for i, name := range s.PrimaryKey {
+		if key[i] = s.Column(name); key[i] == -1 {
+			return nil, fmt.Errorf("primary key column %q does not exist", name)
+		}
+		for j := 0; j < i; j++ {
+			if key[j] == key[i] {
+				return nil, fmt.Errorf("duplicate primary key column %q", name)
+			}
+		}
+	}
+
+	for i, name := range s.Indexes {
+		column := s.Column(name)
+		if column == -1 {
+			return nil, fmt.Errorf("indexed column %q does not exist", name)
+		}
+		for _, k := range key {
+			if k == column {
+				return nil, fmt.Errorf("primary key column %q can't be indexed", name)
+			}
+		}
+		for j := 0; j < i; j++ {
+			if s.Indexes[j] == name {
+				return nil, fmt.Errorf("duplicate index of column %q", name)
+			}
+		}
+	}
+
+	return key, nil
+}
+
+/* Encode returns schema encoded with 'AppendKey' as tuple of primary key column names followed by tuples of column names and types and by names of indexed columns. */
+func (s *Schema) Encode() ([]byte, error) {
+	primaryKey := make([]interface{}, len(s.PrimaryKey))
+	for i, name := range s.PrimaryKey {
+		primaryKey[i] = name
+	}
+	buf, err := AppendKey(nil, primaryKey)
+	if err != nil {
+		return nil, err
+	}
+	for _, column := range s.Columns {
+		if buf, err = AppendKey(buf, []interface{}{column.Name, int64(column.Type)}); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range s.Indexes {
+		if buf, err = AppendKey(buf, name); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+/* encodeMeta returns encoded schema, which must fit into 'Meta.Schema'. */
+func (s *Schema) encodeMeta() ([]byte, error) {
+	buf, err := s.Encode()
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode schema: %v", err)
+	}
+	if len(buf) > TreeSchemaSize {
+		return nil, fmt.Errorf("encoded schema is %d bytes long, which is more than %d", len(buf), TreeSchemaSize)
+	}
+	return buf, nil
+}
+
+/* DecodeSchema returns schema encoded with 'Schema.Encode'. */
+func DecodeSchema(buf []byte) (Schema, error) {
+	var s Schema
+
+	elements, err := DecodeKey(buf)
+	if err != nil {
+		return Schema{}, err
+	}
+	if len(elements) == 0 {
+		return Schema{}, errors.New("schema is empty")
+	}
+
+	primaryKey, ok := elements[0].([]interface{})
+	if !ok {
+		return Schema{}, errors.New("schema has malformed primary key")
+	}
+	for _, element := range primaryKey {
+		name, ok := element.(string)
+		if !ok {
+			return Schema{}, errors.New("schema has malformed primary key")
+		}
+		s.PrimaryKey = append(s.PrimaryKey, name)
+	}
+
+	for _, element := range elements[1:] {
+		if name, ok := element.(string); ok {
+			s.Indexes = append(s.Indexes, name)
+			continue
+		}
+
+		column, ok := element.([]interface{})
+		if (!ok) || (len(column) != 2) {
+			return Schema{}, errors.New("schema has malformed column")
+		}
+		name, ok1 := column[0].(string)
+		typ, ok2 := column[1].(int64)
+		if (!ok1) || (!ok2) {
+			return Schema{}, errors.New("schema has malformed column")
+		}
+		s.Columns = append(s.Columns, Column{Name: name, Type: ColumnType(typ)})
+	}
+
+	return s, nil
+}
+
+/* CheckValue returns 'value' converted to type of column 'typ' or error, if it has different type. */
+func CheckValue(typ ColumnType, value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case int:
+		value = int64(v)
+	case int8:
+		value = int64(v)
+	case int16:
+		value = int64(v)
+	case int32:
+		value = int64(v)
+	case uint:
+		value = uint64(v)
+	case uint8:
+		value = uint64(v)
+	case uint16:
+		value = uint64(v)
+	case uint32:
+		value = uint64(v)
+	case float32:
+		value = float64(v)
+	}
+
+	var ok bool
+	switch typ {
+	case ColumnTypeInt:
+		_, ok = value.(int64)
+	case ColumnTypeUint:
+		_, ok = value.(uint64)
+	case ColumnTypeFloat:
+		_, ok = value.(float64)
+	case ColumnTypeString:
+		_, ok = value.(string)
+	case ColumnTypeBytes:
+		_, ok = value.([]byte)
+	case ColumnTypeBool:
+		_, ok = value.(bool)
+	}
+	if !ok {
+		return nil, fmt.Errorf("expected value of type %v, got %T", typ, value)
+	}
+	return value, nil
+}
+
+/* CreateTable makes empty 'tree' a table with 'schema'. Schema is stored in tree's 'Meta'. */
+func CreateTable(tree *Tree, schema Schema) (*Table, error) {
+	defer trace.End(trace.Begin(""))
+
+	key, err := schema.Check()
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema: %v", err)
+	}
+	buf, err := schema.encodeMeta()
+	if err != nil {
+		return nil, err
+	}
+
+	tree.Lock()
+	defer tree.Unlock()
+
+	if (tree.Comparator != nil) || (tree.Meta.HasFeature(TreeFeatureMulti)) {
+		return nil, errors.New("table must be stored in tree with unique keys in bytewise order")
+	}
+	if tree.Meta.SchemaLength != 0 {
+		return nil, errors.New("tree already has table")
+	}
+	it, err := tree.Begin()
+	if err != nil {
+		return nil, err
+	}
+	if it.Next() {
+		return nil, errors.New("tree is not empty")
+	}
+
+	tb := &Table{Tree: tree, Schema: schema, Key: key}
+	for _, name := range schema.Indexes {
+		if _, err := tree.createIndex(name, tb.columnExtractor(schema.Column(name))); err != nil {
+			return nil, err
+		}
+	}
+
+	tree.Meta.SchemaLength = int64(copy(tree.Meta.Schema[:], buf))
+	tree.MetaDirty = true
+	if err := tree.writeMeta(); err != nil {
+		return nil, err
+	}
+	if err := tree.sync(); err != nil {
+		return nil, err
+	}
+
+	return tb, nil
+}
+
+/* OpenTable returns table stored in 'tree'. */
+func OpenTable(tree *Tree) (*Table, error) {
+	defer trace.End(trace.Begin(""))
+
+	if tree.Meta.SchemaLength == 0 {
+		return nil, errors.New("tree has no table")
+	}
+	if (tree.Meta.SchemaLength < 0) || (tree.Meta.SchemaLength > TreeSchemaSize) {
+		return nil, fmt.Errorf("tree has schema of invalid length %d", tree.Meta.SchemaLength)
+	}
+
+	schema, err := DecodeSchema(tree.Meta.Schema[:tree.Meta.SchemaLength])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode schema: %v", err)
+	}
+	key, err := schema.Check()
+	if err != nil {
+		return nil, fmt.Errorf("tree has invalid schema: %v", err)
+	}
+
+	tb := &Table{Tree: tree, Schema: schema, Key: key}
+	for _, name := range schema.Indexes {
+		if _, err := tree.CreateIndex(name, tb.columnExtractor(schema.Column(name))); err != nil {
+			return nil, fmt.Errorf("failed to open index of column %q: %v", name, err)
+		}
+	}
+
+	return tb, nil
+}
+
+/* CreateColumnIndex creates secondary index of column 'name' filled with existing rows and commits the change. Index is defined every time table is opened. Rows without value of column are not indexed. */
+func (tb *Table) CreateColumnIndex(name string) (*Index, error) {
+	defer trace.End(trace.Begin(""))
+
+	schema := tb.Schema
+	schema.Indexes = append(schema.Indexes[:len(schema.Indexes):len(schema.Indexes)], name)
+	if _, err := schema.Check(); err != nil {
+		return nil, err
+	}
+	buf, err := schema.encodeMeta()
+	if err != nil {
+		return nil, err
+	}
+
+	t := tb.Tree
+	t.Lock()
+	idx, err := t.createIndex(name, tb.columnExtractor(schema.Column(name)))
+	if err == nil {
+		t.Meta.SchemaLength = int64(copy(t.Meta.Schema[:], buf))
+		t.MetaDirty = true
+		err = t.writeMeta()
+	}
+	if err == nil {
+		tb.Schema = schema
+	}
+	t.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return idx, t.sync()
+}
+
+/* columnExtractor returns extractor of index of 'column', which keys are values of column encoded with 'AppendKey'. */
+func (tb *Table) columnExtractor(column int) IndexExtractor {
+	/* Values of rows have only columns which are not in primary key. */
+	var pos int
+	for i := 0; i < column; i++ {
+		if !tb.isKey(i) {
+			pos++
+		}
+	}
+
+	return func(value []byte) []byte {
+		values, err := DecodeKey(value)
+		if (err != nil) || (pos >= len(values)) || (values[pos] == nil) {
+			return nil
+		}
+		key, err := AppendKey(nil, values[pos])
+		if err != nil {
+			return nil
+		}
+		return key
+	}
+}
+
+/* CheckRow returns copy of 'row' with values converted to types of columns or error, if it doesn't match schema. */
+func (tb *Table) CheckRow(row Row) (Row, error) {
+	if len(row) != len(tb.Schema.Columns) {
+		return nil, fmt.Errorf("expected %d columns, got %d", len(tb.Schema.Columns), len(row))
+	}
+
+	checked := make(Row, len(row))
+	for i, column := range tb.Schema.Columns {
+		value, err := CheckValue(column.Type, row[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of column %q: %v", column.Name, err)
+		}
+		checked[i] = value
+	}
+	for _, i := range tb.Key {
+		if checked[i] == nil {
+			return nil, fmt.Errorf("primary key column %q has no value", tb.Schema.Columns[i].Name)
+		}
+	}
+
+	return checked, nil
+}
+
+/* EncodeKey returns key of row with primary key 'values'. */
+func (tb *Table) EncodeKey(values ...interface{}) ([]byte, error) {
+	if len(values) != len(tb.Key) {
+		return nil, fmt.Errorf("expected %d values of primary key, got %d", len(tb.Key), len(values))
+	}
+
+	var buf []byte
+	for i, value := range values {
+		column := &tb.Schema.Columns[tb.Key[i]]
+		value, err := CheckValue(column.Type, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of column %q: %v", column.Name, err)
+		} else if value == nil {
+			return nil, fmt.Errorf("primary key column %q has no value", column.Name)
+		}
+		if buf, err = AppendKey(buf, value); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+/* encodeRow returns key and value of checked 'row'. */
+func (tb *Table) encodeRow(row Row) ([]byte, []byte, error) {
+	var key, value []byte
+	var err error
+
+	for _, i := range tb.Key {
+		if key, err = AppendKey(key, row[i]); err != nil {
+			return nil, nil, err
+		}
+	}
+	value = []byte{}
+	for i := range row {
+		if !tb.isKey(i) {
+			if value, err = AppendKey(value, row[i]); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	return key, value, nil
+}
+
+/* decodeRow returns row with key and value encoded with 'encodeRow'. */
+func (tb *Table) decodeRow(key []byte, value []byte) (Row, error) {
+	keys, err := DecodeKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode primary key: %v", err)
+	}
+	values, err := DecodeKey(value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode row: %v", err)
+	}
+	if (len(keys) != len(tb.Key)) || (len(keys)+len(values) != len(tb.Schema.Columns)) {
+		return nil, errors.New("row does not match schema")
+	}
+
+	row := make(Row, len(tb.Schema.Columns))
+	for i, k := range tb.Key {
+		row[k] = keys[i]
+	}
+	for i := range row {
+		if !tb.isKey(i) {
+			row[i] = values[0]
+			values = values[1:]
+		}
+	}
+	return row, nil
+}
+
+func (tb *Table) isKey(column int) bool {
+	for _, k := range tb.Key {
+		if k == column {
+			return true
+		}
+	}
+	return false
+}
+
+/* putRows stores 'rows' and commits the change. 'exists' tells whether rows must already be stored. Rows are checked before any of them is stored. */
+func (tb *Table) putRows(rows []Row, exists bool) error {
+	keys := make([][]byte, len(rows))
+	values := make([][]byte, len(rows))
+	for i := range rows {
+		row, err := tb.CheckRow(rows[i])
+		if err != nil {
+			return err
+		}
+		if keys[i], values[i], err = tb.encodeRow(row); err != nil {
+			return err
+		}
+	}
+
+	t := tb.Tree
+	t.Lock()
+	err := tb.checkKeys(keys, exists)
+	for i := 0; (err == nil) && (i < len(keys)); i++ {
+		key, value := keys[i], values[i]
+		err = t.update(key, func(leaf *Leaf, old []byte) (EncodedValue, []byte, error) {
+			v, err := t.encodeValue(leaf, key, value, 0)
+			return v, value, err
+		})
+	}
+	if err == nil {
+		err = t.writeMeta()
+	}
+	t.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return t.sync()
+}
+
+/* deleteRows removes rows with primary 'keys' and commits the change. All keys are checked before any row is removed. */
+func (tb *Table) deleteRows(keys [][]byte) error {
+	t := tb.Tree
+	t.Lock()
+	err := tb.checkKeys(keys, true)
+	for i := 0; (err == nil) && (i < len(keys)); i++ {
+		err = t.del(keys[i])
+	}
+	if err == nil {
+		err = t.writeMeta()
+	}
+	t.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return t.sync()
+}
+
+/* checkKeys returns 'ErrRowExists' or 'ErrRowNotFound', if rows with 'keys' are stored or repeat, or are not stored. */
+func (tb *Table) checkKeys(keys [][]byte, exists bool) error {
+	t := tb.Tree
+	page := t.getPage()
+	defer t.putPage(page)
+
+	seen := make(map[string]struct{})
+	for _, key := range keys {
+		v, err := t.findValue(page, key)
+		if err != nil {
+			return err
+		}
+		live := t.liveValue(v) != nil
+
+		if !exists {
+			if _, ok := seen[string(key)]; (ok) || (live) {
+				return ErrRowExists
+			}
+			seen[string(key)] = struct{}{}
+		} else if !live {
+			return ErrRowNotFound
+		}
+	}
+	return nil
+}
+
+/* Insert adds new 'row' and commits the change. It returns 'ErrRowExists' if there's row with the same primary key. */
+func (tb *Table) Insert(row Row) error {
+	defer trace.End(trace.Begin(""))
+	return tb.putRows([]Row{row}, false)
+}
+
+/* Update replaces row with the same primary key as 'row' and commits the change. It returns 'ErrRowNotFound' if there's no such row. */
+func (tb *Table) Update(row Row) error {
+	defer trace.End(trace.Begin(""))
+	return tb.putRows([]Row{row}, true)
+}
+
+/* Delete removes row with primary key 'values' and commits the change. It returns 'ErrRowNotFound' if there's no such row. */
+func (tb *Table) Delete(values ...interface{}) error {
+	defer trace.End(trace.Begin(""))
+
+	key, err := tb.EncodeKey(values...)
+	if err != nil {
+		return err
+	}
+	return tb.deleteRows([][]byte{key})
+}
+
+/* Lookup returns row with primary key 'values' or nil, if there's no such row. */
+func (tb *Table) Lookup(values ...interface{}) (Row, error) {
+	defer trace.End(trace.Begin(""))
+
+	key, err := tb.EncodeKey(values...)
+	if err != nil {
+		return nil, err
+	}
+	value, err := tb.Get(key)
+	if (err != nil) || (value == nil) {
+		return nil, err
+	}
+	return tb.decodeRow(key, value)
+}
+
+/* Scan returns iterator over all rows. */
+func (tb *Table) Scan() (*TableIterator, error) {
+	return tb.ScanFrom()
+}
+
+/* ScanFrom returns iterator over rows with primary keys greater or equal to 'values', which may be a prefix of primary key. Like other iterators, it must not be used while table is modified. */
+func (tb *Table) ScanFrom(values ...interface{}) (*TableIterator, error) {
+	defer trace.End(trace.Begin(""))
+
+	if len(values) > len(tb.Key) {
+		return nil, fmt.Errorf("expected at most %d values of primary key, got %d", len(tb.Key), len(values))
+	}
+
+	var key []byte
+	for i, value := range values {
+		column := &tb.Schema.Columns[tb.Key[i]]
+		value, err := CheckValue(column.Type, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of column %q: %v", column.Name, err)
+		}
+		if key, err = AppendKey(key, value); err != nil {
+			return nil, err
+		}
+	}
+
+	it, err := tb.Seek(key)
+	if err != nil {
+		return nil, err
+	}
+	return &TableIterator{Table: tb, It: it, Page: tb.NewPage()}, nil
+}
+
+/* Next moves iterator to the next row. It returns false after the last row or if row can't be read. */
+func (it *TableIterator) Next() bool {
+	if !it.It.Next() {
+		return false
+	}
+
+	var err error
+	if it.ValueBuffer, err = it.Table.appendValue(it.ValueBuffer[:0], it.It.Value(), it.Page); err != nil {
+		return false
+	}
+	if it.Row, err = it.Table.decodeRow(it.It.Key(), it.ValueBuffer); err != nil {
+		return false
+	}
+	return true
+}
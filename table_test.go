@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestTable(t *testing.T) {
+	var pager MemoryPager
+
+	schema := Schema{
+		Columns: []Column{
+			{"name", ColumnTypeString},
+			{"city", ColumnTypeString},
+			{"id", ColumnTypeInt},
+			{"balance", ColumnTypeFloat},
+			{"active", ColumnTypeBool},
+			{"photo", ColumnTypeBytes},
+		},
+		PrimaryKey: []string{"city", "id"},
+	}
+
+	tree, err := GetTreeAtWithOptions(&pager, -1, TreeOptions{MaxOrder: 5})
+	if err != nil {
+		t.Fatalf("Failed to create new tree: %v", err)
+	}
+	table, err := CreateTable(tree, schema)
+	if err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	if _, err := CreateTable(tree, schema); err == nil {
+		t.Errorf("Expected error on creating table twice, got nothing")
+	}
+
+	cities := [...]string{"Berlin", "Amsterdam", "Cairo"}
+	for i := 0; i < 100; i++ {
+		row := Row{fmt.Sprintf("user%d", i), cities[i%len(cities)], 50 - i, float64(i) / 2, i%2 == 0, nil}
+		if i%10 == 0 {
+			row[5] = []byte{0, byte(i)}
+		}
+		if err := table.Insert(row); err != nil {
+			t.Fatalf("Error on 'Insert': %v", err)
+		}
+	}
+	if err := table.Insert(Row{"again", "Berlin", 50, 0.0, true, nil}); err != ErrRowExists {
+		t.Errorf("Expected %v on inserting duplicate, got %v", ErrRowExists, err)
+	}
+	if err := table.Insert(Row{"bad", "Berlin", "51", 0.0, true, nil}); err == nil {
+		t.Errorf("Expected error on inserting row with wrong type, got nothing")
+	}
+	if err := table.Insert(Row{"bad", nil, 51, 0.0, true, nil}); err == nil {
+		t.Errorf("Expected error on inserting row without primary key, got nothing")
+	}
+
+	if err := table.Update(Row{"updated", "Berlin", 50, -1.5, false, []byte("photo")}); err != nil {
+		t.Fatalf("Error on 'Update': %v", err)
+	}
+	if err := table.Update(Row{"missing", "Berlin", 1000, 0.0, false, nil}); err != ErrRowNotFound {
+		t.Errorf("Expected %v on updating missing row, got %v", ErrRowNotFound, err)
+	}
+	if err := table.Delete("Amsterdam", 49); err != nil {
+		t.Fatalf("Error on 'Delete': %v", err)
+	}
+	if err := table.Delete("Amsterdam", 49); err != ErrRowNotFound {
+		t.Errorf("Expected %v on deleting missing row, got %v", ErrRowNotFound, err)
+	}
+
+	tree, err = GetTreeAt(&pager, tree.MetaIndex)
+	if err != nil {
+		t.Fatalf("Failed to open tree: %v", err)
+	}
+	table, err = OpenTable(tree)
+	if err != nil {
+		t.Fatalf("Failed to open table: %v", err)
+	}
+	if !reflect.DeepEqual(table.Schema, schema) {
+		t.Errorf("Expected schema %v, got %v", schema, table.Schema)
+	}
+
+	row, err := table.Lookup("Berlin", 50)
+	if err != nil {
+		t.Fatalf("Error on 'Lookup': %v", err)
+	}
+	if expected := (Row{"updated", "Berlin", int64(50), -1.5, false, []byte("photo")}); !reflect.DeepEqual(row, expected) {
+		t.Errorf("Expected row %v, got %v", expected, row)
+	}
+	if row, err := table.Lookup("Amsterdam", 49); (err != nil) || (row != nil) {
+		t.Errorf("Expected no deleted row, got %v, %v", row, err)
+	}
+
+	it, err := table.ScanFrom("Berlin")
+	if err != nil {
+		t.Fatalf("Failed to scan table: %v", err)
+	}
+	var prev Row
+	var n int
+	for it.Next() {
+		if it.Row[1] != "Berlin" {
+			if it.Row[1] != "Cairo" {
+				t.Errorf("Expected rows of %q to follow rows of %q, got %q", "Cairo", "Berlin", it.Row[1])
+			}
+			break
+		}
+		if (prev != nil) && (prev[2].(int64) >= it.Row[2].(int64)) {
+			t.Errorf("Expected rows to be ordered by id, got %v after %v", it.Row[2], prev[2])
+		}
+		prev = it.Row
+		n++
+	}
+	if n != 34 {
+		t.Errorf("Expected %d rows of %q, got %d", 34, "Berlin", n)
+	}
+
+	it, err = table.Scan()
+	if err != nil {
+		t.Fatalf("Failed to scan table: %v", err)
+	}
+	for n = 0; it.Next(); n++ {
+	}
+	if n != 99 {
+		t.Errorf("Expected %d rows, got %d", 99, n)
+	}
+
+	/* NOTE(anton2920): chains of 'Overflow' pages are read through page of iterator, which must be as large as pages of tree. */
+	tree, err = GetTreeAtWithOptions(&pager, -1, TreeOptions{PageSize: MaxPageSize})
+	if err != nil {
+		t.Fatalf("Failed to create new tree: %v", err)
+	}
+	tree.Meta.Features &^= TreeFeatureExtents
+	if table, err = CreateTable(tree, schema); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	photo := bytes.Repeat([]byte("photo"), MaxPageSize)
+	if err := table.Insert(Row{"large", "Berlin", 1, 0.0, true, photo}); err != nil {
+		t.Fatalf("Error on 'Insert': %v", err)
+	}
+	if it, err = table.Scan(); err != nil {
+		t.Fatalf("Failed to scan table: %v", err)
+	}
+	if !it.Next() {
+		t.Fatalf("Expected row, got nothing")
+	}
+	if !bytes.Equal(it.Row[5].([]byte), photo) {
+		t.Errorf("Expected photo of %d bytes, got %d bytes", len(photo), len(it.Row[5].([]byte)))
+	}
+}
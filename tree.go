@@ -2,12 +2,15 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"sync"
+	"time"
 	"unsafe"
 
 	"github.com/anton2920/gofa/errors"
 	"github.com/anton2920/gofa/trace"
+	"github.com/anton2920/gofa/util"
 )
 
 /* Tree is an implementation of a B+tree. */
@@ -16,27 +19,100 @@ type Tree struct {
 	Pager
 	Meta
 
+	/* MetaIndex is an index of page with 'Meta'; MetaDirty is set when 'Meta' must be written on next commit. */
+	MetaIndex int64
+	MetaDirty bool
+
+	/* Durability overrides pager's default durability for commits of this tree. */
+	Durability Durability
+
+	/* ValueLog stores values longer than 'Meta.ValueThreshold'. It must be set after tree is opened if tree has values in it. */
+	ValueLog *ValueLog
+
+	/* Dedup maps hashes of shared values to their pages and reference counts. It is opened when needed from 'Meta.DedupMeta'. */
+	Dedup *Tree
+
+	/* MergeOperator combines values in 'Merge'. It must be set after tree is opened. */
+	MergeOperator MergeOperator
+	MergeBuffer   []byte
+
+	/* Now returns current time for expiry of values, nil means 'time.Now'. */
+	Now func() time.Time
+
+	/* Comparator orders keys, nil means bytewise order. It's set from options tree is opened with. */
+	Comparator Comparator
+
+	/* Indexes are secondary indexes updated together with tree, see 'CreateIndex'. Catalog maps their names to their trees. It is opened when needed from 'Meta.IndexCatalog'. IndexesDefined is set once all indexes in catalog are defined. */
+	Indexes        []*Index
+	Catalog        *Tree
+	IndexesDefined bool
+
+	/* SweepLeaf is an index of leaf 'Sweep' continues from, zero means the first one. */
+	SweepLeaf int64
+
+	/* Freed is a number of times pages were put to free list and FreedAt is its value when each page was freed last, so that 'ValueReader' knows when pages of its value may be reused. */
+	Freed   int64
+	FreedAt []int64
+
+	/* OldValue holds copy of value replaced by 'update' or removed by 'del', since leaf it was in is modified before indexes are updated and its pages are freed. */
+	OldValue   []byte
 	SearchPath []TreePathItem
 }
 
 type TreeForwardIterator struct {
 	*Tree
-	Leaf
+	*Leaf
 	Current int
+
+	/* KeyBuffer holds full key returned by 'Key()', since leaves store only key suffixes. */
+	KeyBuffer []byte
+
+	/* End is an exclusive upper bound for keys returned by iterator, nil means no bound. */
+	End []byte
 }
 
 type TreePathItem struct {
-	Page
+	*Page
 	Index int64
 	Pos   int
 }
 
+/* TreeOptions are parameters of a new tree. They are recorded in 'Meta' and existing trees are always opened with their recorded parameters. Zero values mean defaults. */
+type TreeOptions struct {
+	/* PageSize is a power of two between 'MinPageSize' and 'MaxPageSize'. Pages over 'PageWideSize' use 4-byte offsets. */
+	PageSize int
+
+	/* MaxOrder is a maximum number of children in node. Leaves hold at most 'MaxOrder-1' entries. */
+	MaxOrder int
+
+	/* FillFactor is a percentage of entries left in the old page when it's split. */
+	FillFactor int
+
+	/* ValueThreshold is a length above which values are stored in 'Tree.ValueLog', 0 means never. */
+	ValueThreshold int
+
+	/* Dedup makes values stored in extents share pages with identical values stored before. */
+	Dedup bool
+
+	/* Comparator orders keys, nil means bytewise order. Unlike other options, it must also be given when existing tree is opened and must have the same name as the one tree was created with. */
+	Comparator Comparator
+
+	/* Multi makes tree a multimap, in which key may have many values, see 'Tree.Add'. */
+	Multi bool
+}
+
 const (
-	//TreeMaxOrder = 1 << 8
-	TreeMaxOrder = 5
+	TreeMinOrder        = 3
+	TreeMaxOrder        = PageMaxEntries + 1
+	TreeMaxOrderV1      = PageMaxEntriesV1 + 1
+	TreeDefaultMaxOrder = TreeMaxOrder
 
-	TreeMagic   = 0xFAFEFAAF
-	TreeVersion = 0x1
+	TreeDefaultFillFactor = 50
+
+	TreeMagic = 0xFAFEFAAF
+
+	/* TreeVersion 2 widened 'PageHeader.N' to 16 bits, version 3 added prefix compression of keys, version 4 added key hints and version 5 recorded them as 'Meta.Features'. Trees of older versions are still supported and are written in their original format, see 'Tree.Upgrade'. */
+	TreeVersion = 0x5
 )
 
 func duplicate(buffer []byte, x []byte) []byte {
@@ -60,94 +136,429 @@ func slice2Int(buf []byte) int {
 	return int(*(*int)(unsafe.Pointer(&buf[0])))
 }
 
+func (opts *TreeOptions) Check() error {
+	if opts.PageSize == 0 {
+		opts.PageSize = PageSize
+	}
+	if err := CheckPageSize(opts.PageSize); err != nil {
+		return err
+	}
+
+	if opts.MaxOrder == 0 {
+		opts.MaxOrder = TreeDefaultMaxOrder
+	}
+	if (opts.MaxOrder < TreeMinOrder) || (opts.MaxOrder > TreeMaxOrder) {
+		return fmt.Errorf("tree order must be between %d and %d, got %d", TreeMinOrder, TreeMaxOrder, opts.MaxOrder)
+	}
+
+	if opts.FillFactor == 0 {
+		opts.FillFactor = TreeDefaultFillFactor
+	}
+	if (opts.FillFactor < 1) || (opts.FillFactor > 99) {
+		return fmt.Errorf("fill factor must be between 1 and 99, got %d", opts.FillFactor)
+	}
+
+	if opts.ValueThreshold < 0 {
+		return fmt.Errorf("value threshold must not be negative, got %d", opts.ValueThreshold)
+	}
+
+	if opts.Comparator != nil {
+		if name := opts.Comparator.Name(); (len(name) == 0) || (len(name) > TreeComparatorNameSize) {
+			return fmt.Errorf("comparator name must be from 1 to %d bytes long, got %q", TreeComparatorNameSize, name)
+		}
+		if opts.Multi {
+			return errors.New("multimap trees order keys bytewise, comparator can't be used")
+		}
+	}
+
+	return nil
+}
+
 func GetTreeAt(pager Pager, index int64) (*Tree, error) {
+	return GetTreeAtWithOptions(pager, index, TreeOptions{})
+}
+
+/* GetTreeAtWithOptions opens tree which 'Meta' is at 'index' or creates new one with 'opts' if there's no page at 'index'. */
+func GetTreeAtWithOptions(pager Pager, index int64, opts TreeOptions) (*Tree, error) {
 	defer trace.End(trace.Begin(""))
 
 	var t Tree
 
 	t.Pager = pager
 
-	base, err := t.ReadPageAt(t.Meta.Page(), index)
+	base, err := t.Pager.ReadPagesAt(Page2Slice(t.Meta.Page()), index)
+	if (err != nil) && (err != ErrPagesOutOfBounds) {
+		return nil, fmt.Errorf("failed to read meta: %v", err)
+	}
 	if err != nil {
-		const (
-			Meta = iota
-			Root
-			End
-			Count
-		)
+		var meta Meta
 
-		var pages [Count]Page
+		if err := opts.Check(); err != nil {
+			return nil, fmt.Errorf("invalid tree options: %v", err)
+		}
 
-		pages[Meta].Init(PageTypeMeta)
-		meta := pages[Meta].Meta()
+		meta.Page().Init(PageTypeMeta)
 		meta.Magic = TreeMagic
 		meta.Version = TreeVersion
-		meta.Root = base + Root
-		meta.EndSentinel = base + End
+		meta.Features = TreeFeaturesBytewise
+		if opts.Comparator != nil {
+			meta.Features = TreeFeaturesComparator
+			copy(meta.ComparatorName[:], opts.Comparator.Name())
+		}
+		if opts.Multi {
+			meta.Features |= TreeFeatureMulti
+		}
+		if k, ok := pager.(KeyIdentifier); ok {
+			meta.KeyID = k.GetKeyID()
+		}
+		meta.PageSize = int64(opts.PageSize)
+		meta.OffsetSize = int64(PageOffsetSize(opts.PageSize))
+		meta.MaxOrder = int64(opts.MaxOrder)
+		meta.FillFactor = int64(opts.FillFactor)
+		meta.ValueThreshold = int64(opts.ValueThreshold)
+		t.Meta = meta
+
+		/* NOTE(anton2920): root and end sentinel follow 'Meta'. Pages smaller than pager's share one page of pager, the rest of which is put to free list. */
+		first := t.treeIndex(base + 1)
+		count := t.PageSlots()
+		if count < 2 {
+			count = 2
+		}
+		pages := make([]Page, 1+t.pagerPages(count))
+		run := Pages2Bytes(pages[1:])
+
+		meta.Root = first
+		meta.EndSentinel = first + t.PageSpan()
+		if count > 2 {
+			meta.FreeList = first + 2
+		}
+
+		page := t.NewPage()
+		t.InitPage(page, PageTypeLeaf)
+		page.Leaf().Next = meta.EndSentinel
+		t.putRunPage(run, 0, page)
 
-		pages[Root].Init(PageTypeLeaf)
-		leaf := pages[Root].Leaf()
-		leaf.Next = base + End
+		t.InitPage(page, PageTypeLeaf)
+		t.putRunPage(run, 1, page)
 
-		pages[End].Init(PageTypeLeaf)
+		t.InitPage(page, PageTypeFree)
+		for i := int64(2); i < count; i++ {
+			page.Free().Next = first + i + 1
+			if i == count-1 {
+				page.Free().Next = 0
+			}
+			t.putRunPage(run, i, page)
+		}
 
-		if _, err := t.Pager.WritePagesAt(pages[:], base); err != nil {
+		pages[0] = *meta.Page()
+		if _, err := t.Pager.WritePagesAt(pages, base); err != nil {
 			return nil, fmt.Errorf("failed to write initial pages: %v", err)
 		}
 
-		t.Meta.Magic = meta.Magic
-		t.Meta.Version = meta.Version
-		t.Meta.Root = meta.Root
-		t.Meta.EndSentinel = meta.EndSentinel
+		if opts.Dedup {
+			dedup, err := GetTreeAt(pager, -1)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create dedup tree: %v", err)
+			}
+			meta.DedupMeta = dedup.MetaIndex
+			if _, err := t.Pager.WritePagesAt(Page2Slice(meta.Page()), base); err != nil {
+				return nil, fmt.Errorf("failed to write meta: %v", err)
+			}
+			t.Dedup = dedup
+		}
+
+		t.Meta = meta
 	}
+	t.MetaIndex = base
 
 	if t.Meta.Magic != TreeMagic {
 		return nil, fmt.Errorf("wrong tree magic: %d != %d", TreeMagic, t.Meta.Magic)
 	}
 
+	if (t.Meta.Version < 1) || (t.Meta.Version > TreeVersion) {
+		return nil, fmt.Errorf("unsupported tree version %d, this build supports versions from 1 to %d", t.Meta.Version, TreeVersion)
+	}
+	if t.Meta.Version < 5 {
+		t.Meta.Features = TreeVersionFeatures(t.Meta.Version)
+	}
+	if unsupported := t.Meta.Features &^ TreeFeaturesSupported; unsupported != 0 {
+		return nil, fmt.Errorf("tree uses unsupported features %#x", unsupported)
+	}
+	if (t.Meta.DedupMeta != 0) && (!t.Meta.HasFeature(TreeFeatureExtents)) {
+		return nil, errors.New("tree deduplicates values, but stores them without extents")
+	}
+
+	var comparatorName string
+	if opts.Comparator != nil {
+		comparatorName = opts.Comparator.Name()
+	}
+	if t.Meta.GetComparatorName() != comparatorName {
+		return nil, fmt.Errorf("tree orders keys with comparator %q, but %q is given", t.Meta.GetComparatorName(), comparatorName)
+	}
+	t.Comparator = opts.Comparator
+
+	if !t.Meta.HasFeature(TreeFeatureWideHeader) {
+		t.Meta.Page().UpgradeHeaderV1()
+	}
+
+	var keyID int64
+	if k, ok := pager.(KeyIdentifier); ok {
+		keyID = k.GetKeyID()
+	}
+	if t.Meta.KeyID != keyID {
+		return nil, fmt.Errorf("tree is encrypted with key %d, but pager uses key %d", t.Meta.KeyID, keyID)
+	}
+
+	/* NOTE(anton2920): trees created before parameters were recorded in 'Meta' have zeroes there. */
+	if t.Meta.OffsetSize == 0 {
+		t.Meta.OffsetSize = 2
+	}
+	opts = TreeOptions{PageSize: int(t.Meta.PageSize), MaxOrder: int(t.Meta.MaxOrder), FillFactor: int(t.Meta.FillFactor)}
+	if (!t.Meta.HasFeature(TreeFeatureWideHeader)) && ((opts.MaxOrder == 0) || (opts.MaxOrder > TreeMaxOrderV1)) {
+		opts.MaxOrder = TreeMaxOrderV1
+	}
+	if err := opts.Check(); err != nil {
+		return nil, fmt.Errorf("tree has unsupported parameters: %v", err)
+	}
+	if t.Meta.OffsetSize != int64(PageOffsetSize(opts.PageSize)) {
+		return nil, fmt.Errorf("tree has unsupported parameters: %d-byte page offsets with %d-byte pages", t.Meta.OffsetSize, opts.PageSize)
+	}
+	t.Meta.PageSize = int64(opts.PageSize)
+	t.Meta.MaxOrder = int64(opts.MaxOrder)
+	t.Meta.FillFactor = int64(opts.FillFactor)
+
 	return &t, nil
 
 }
 
 func (it *TreeForwardIterator) Next() bool {
-	it.Current++
-	if it.Current >= int(it.Leaf.N) {
-		if it.Leaf.Next == it.Meta.EndSentinel {
-			return false
+	for {
+		it.Current++
+		/* NOTE(anton2920): leaves may become empty after deletes. */
+		for it.Current >= int(it.Leaf.N) {
+			if it.Leaf.Next == it.Meta.EndSentinel {
+				return false
+			}
+			if _, err := it.ReadPageAt(it.Leaf.Page(), it.Leaf.Next); err != nil {
+				return false
+			}
+			it.Current = 0
+			it.ReadAhead()
 		}
-		if _, err := it.ReadPageAt(it.Leaf.Page(), it.Leaf.Next); err != nil {
+		if (it.End != nil) && (it.compare(it.Key(), it.End) >= 0) {
 			return false
 		}
-		it.Current = 0
+		/* NOTE(anton2920): expired values are skipped until 'Sweep' deletes them. */
+		if it.liveValue(it.Leaf.GetValueAt(it.Current)) != nil {
+			return true
+		}
+	}
+}
+
+/* ReadAhead hints pager that leaves following the current one are going to be read soon. */
+func (it *TreeForwardIterator) ReadAhead() {
+	if p, ok := it.Pager.(Prefetcher); ok && (it.Leaf.Next != it.Meta.EndSentinel) {
+		p.Prefetch(it.pagerIndex(it.Leaf.Next))
 	}
-	return true
 }
 
 func (it *TreeForwardIterator) Key() []byte {
-	return it.Leaf.GetKeyAt(it.Current)
+	it.KeyBuffer = it.Leaf.AppendKeyAt(it.KeyBuffer[:0], it.Current)
+	return it.KeyBuffer
 }
 
+/* Value returns value at current position tagged with its 'ValueType'. */
 func (it *TreeForwardIterator) Value() []byte {
-	return it.Leaf.GetValueAt(it.Current)
+	v := it.Leaf.GetValueAt(it.Current)
+	if ValueGetType(v) == ValueTypeTTL {
+		_, v = ValueGetTTL(v)
+	}
+	return v
+}
+
+/* InitPage initializes 'page' of type 'typ' with tree's page size. */
+func (t *Tree) InitPage(page *Page, typ PageType) {
+	page.Init(typ)
+
+	hdr := page.Header()
+	hdr.SetSize(int(t.Meta.PageSize))
+	hdr.SetHead(0)
+	hdr.SetTail(0)
+}
+
+/* PageSpan returns number of pages of pager each page of tree takes. Such page at 'index' takes pages of pager from 'index' to 'index+PageSpan()-1'. */
+func (t *Tree) PageSpan() int64 {
+	if t.Meta.PageSize > PageSize {
+		return t.Meta.PageSize / PageSize
+	}
+	return 1
 }
 
+/* PageSlots returns number of pages of tree stored in each page of pager. Page of tree at 'index' is stored at slot 'index%PageSlots()' of page of pager at 'index/PageSlots()'. */
+func (t *Tree) PageSlots() int64 {
+	if t.Meta.PageSize < PageSize {
+		return PageSize / t.Meta.PageSize
+	}
+	return 1
+}
+
+/* NewPage returns buffer for one page of tree. */
+func (t *Tree) NewPage() *Page {
+	return &make([]Page, t.PageSpan())[0]
+}
+
+/* getPage returns scratch page of tree for lookups. It must be returned with 'putPage'. */
+func (t *Tree) getPage() *Page {
+	if t.PageSpan() > 1 {
+		return t.NewPage()
+	}
+	return treePagePool.Get().(*Page)
+}
+
+func (t *Tree) putPage(page *Page) {
+	if t.PageSpan() == 1 {
+		treePagePool.Put(page)
+	}
+}
+
+/* pagerIndex returns index of page of pager, where page of tree at 'index' starts. */
+func (t *Tree) pagerIndex(index int64) int64 {
+	return index / t.PageSlots()
+}
+
+/* treeIndex returns index of page of tree, which starts at page of pager at 'index'. */
+func (t *Tree) treeIndex(index int64) int64 {
+	return index * t.PageSlots()
+}
+
+/* pagerPages returns number of pages of pager 'n' contiguous pages of tree take. Runs of pages smaller than pager's must be a multiple of 'PageSlots' long. */
+func (t *Tree) pagerPages(n int64) int64 {
+	return n * t.PageSpan() / t.PageSlots()
+}
+
+/* putRunPage copies 'page' to 'i'th page of tree in 'run' of contiguous pages. */
+func (t *Tree) putRunPage(run []byte, i int64, page *Page) {
+	size := t.Meta.PageSize
+	copy(run[i*size:(i+1)*size], Pages2Bytes(Page2Pages(page, int(t.PageSpan()))))
+}
+
+/* getRunPage copies 'i'th page of tree in 'run' of contiguous pages to 'page'. */
+func (t *Tree) getRunPage(page *Page, run []byte, i int64) {
+	size := t.Meta.PageSize
+	copy(Pages2Bytes(Page2Pages(page, int(t.PageSpan()))), run[i*size:(i+1)*size])
+}
+
+/* SplitAt returns number of entries left in the old page when page with 'n' entries is split. */
+func (t *Tree) SplitAt(n int) int {
+	half := n * int(t.Meta.FillFactor) / 100
+	if half > n-1 {
+		half = n - 1
+	}
+	if half < 1 {
+		half = 1
+	}
+	return half
+}
+
+/* FindInNode is like 'node.Find', but uses tree's comparator and key hints if tree has them. */
+func (t *Tree) FindInNode(node *Node, key []byte) int {
+	if t.Comparator != nil {
+		return node.FindWithComparator(key, t.Comparator)
+	} else if t.Meta.HasFeature(TreeFeatureHints) {
+		return node.FindWithHints(key)
+	}
+	return node.Find(key)
+}
+
+/* FindInLeaf is like 'leaf.Find', but uses tree's comparator and key hints if tree has them. */
+func (t *Tree) FindInLeaf(leaf *Leaf, key []byte) (int, bool) {
+	if t.Comparator != nil {
+		return leaf.FindWithComparator(key, t.Comparator)
+	} else if t.Meta.HasFeature(TreeFeatureHints) {
+		return leaf.FindWithHints(key)
+	}
+	return leaf.Find(key)
+}
+
+/* ReadPageAt reads page at 'index' and converts it from on-disk format of tree's version. 'page' must be large enough to hold page of tree, see 'NewPage'. */
 func (t *Tree) ReadPageAt(page *Page, index int64) (int64, error) {
-	return t.Pager.ReadPagesAt(Page2Slice(page), index)
+	var err error
+
+	if slots := t.PageSlots(); slots > 1 {
+		buffer := treePagePool.Get().(*Page)
+		if _, err = t.Pager.ReadPagesAt(Page2Slice(buffer), index/slots); err == nil {
+			t.getRunPage(page, buffer[:], index%slots)
+		}
+		treePagePool.Put(buffer)
+	} else {
+		_, err = t.Pager.ReadPagesAt(Page2Pages(page, int(t.PageSpan())), index)
+	}
+	if err != nil {
+		return -1, err
+	}
+
+	if !t.Meta.HasFeature(TreeFeatureWideHeader) {
+		page.UpgradeHeaderV1()
+	}
+	return index, nil
 }
 
+/* WritePageAt writes 'page' at 'index' in on-disk format of tree's version. Negative 'index' means page is taken from free list or appended. */
 func (t *Tree) WritePageAt(page *Page, index int64) (int64, error) {
-	return t.Pager.WritePagesAt(Page2Slice(page), index)
+	if (index < 0) && (t.Meta.FreeList == 0) && (t.PageSlots() > 1) {
+		/* NOTE(anton2920): new page of pager holds several pages of tree, so all of them are put to free list. */
+		first, err := t.reserveRun(t.PageSlots())
+		if err != nil {
+			return -1, err
+		}
+		if err := t.putFree(first, t.PageSlots()); err != nil {
+			return -1, err
+		}
+	}
+	if (index < 0) && (t.Meta.FreeList != 0) {
+		var err error
+		if index, err = t.allocPage(); err != nil {
+			return -1, err
+		}
+	}
+	if t.Meta.HasFeature(TreeFeatureHints) {
+		switch page.Type() {
+		case PageTypeNode:
+			page.Node().BuildHints()
+		case PageTypeLeaf:
+			page.Leaf().BuildHints()
+		}
+	}
+	if !t.Meta.HasFeature(TreeFeatureWideHeader) {
+		page = page.Clone()
+		page.DowngradeHeaderV1()
+	}
+
+	if slots := t.PageSlots(); slots > 1 {
+		buffer := treePagePool.Get().(*Page)
+		defer treePagePool.Put(buffer)
+
+		if _, err := t.Pager.ReadPagesAt(Page2Slice(buffer), index/slots); err != nil {
+			return -1, fmt.Errorf("failed to read page of pager with page %d: %v", index, err)
+		}
+		t.putRunPage(buffer[:], index%slots, page)
+		if _, err := t.Pager.WritePagesAt(Page2Slice(buffer), index/slots); err != nil {
+			return -1, err
+		}
+		return index, nil
+	}
+	return t.Pager.WritePagesAt(Page2Pages(page, int(t.PageSpan())), index)
 }
 
 func (t *Tree) Begin() (*TreeForwardIterator, error) {
 	var it TreeForwardIterator
-	var page Page
 
 	it.Tree = t
+	page := t.NewPage()
 
 	index := t.Meta.Root
 	for index != 0 {
-		if _, err := t.ReadPageAt(&page, index); err != nil {
+		if _, err := t.ReadPageAt(page, index); err != nil {
 			return nil, fmt.Errorf("failed to read page: %v", err)
 		}
 
@@ -157,7 +568,8 @@ func (t *Tree) Begin() (*TreeForwardIterator, error) {
 			index = node.GetChildAt(-1)
 		case PageTypeLeaf:
 			it.Current = -1
-			it.Leaf = *page.Leaf()
+			it.Leaf = page.Leaf()
+			it.ReadAhead()
 			return &it, nil
 		}
 	}
@@ -165,93 +577,553 @@ func (t *Tree) Begin() (*TreeForwardIterator, error) {
 	panic("unreachable")
 }
 
+/* Seek returns iterator positioned right before the first key that is greater or equal to 'key'. */
+func (t *Tree) Seek(key []byte) (*TreeForwardIterator, error) {
+	var it TreeForwardIterator
+
+	it.Tree = t
+	page := t.NewPage()
+
+	index := t.Meta.Root
+	for index != 0 {
+		if _, err := t.ReadPageAt(page, index); err != nil {
+			return nil, fmt.Errorf("failed to read page: %v", err)
+		}
+
+		switch page.Type() {
+		case PageTypeNode:
+			node := page.Node()
+			index = node.GetChildAt(t.FindInNode(node, key))
+		case PageTypeLeaf:
+			leaf := page.Leaf()
+			it.Current, _ = t.FindInLeaf(leaf, key)
+			it.Leaf = leaf
+			it.ReadAhead()
+			return &it, nil
+		}
+	}
+
+	panic("unreachable")
+}
+
+/* Partition splits key space into about 'n' ranges using separator keys from upper levels of the tree and returns one bounded iterator per range. Iterators are independent and may be used from different goroutines as long as tree is not modified. */
+func (t *Tree) Partition(n int) ([]*TreeForwardIterator, error) {
+	defer trace.End(trace.Begin(""))
+
+	page := t.NewPage()
+
+	if n < 1 {
+		n = 1
+	}
+
+	/* Descend level by level until there are enough separators or the next level consists of leaves. */
+	var keys [][]byte
+	level := []int64{t.Meta.Root}
+forLevel:
+	for (len(keys) < n-1) && (len(level) > 0) {
+		var levelKeys [][]byte
+		var children []int64
+
+		for _, index := range level {
+			if _, err := t.ReadPageAt(page, index); err != nil {
+				return nil, fmt.Errorf("failed to read page: %v", err)
+			}
+			if page.Type() != PageTypeNode {
+				break forLevel
+			}
+
+			node := page.Node()
+			for i := -1; i < int(node.N); i++ {
+				if i >= 0 {
+					levelKeys = append(levelKeys, node.AppendKeyAt(nil, i))
+				}
+				children = append(children, node.GetChildAt(i))
+			}
+		}
+		keys = levelKeys
+		level = children
+	}
+
+	bounds := make([][]byte, 0, n-1)
+	if len(keys) <= n-1 {
+		bounds = append(bounds, keys...)
+	} else {
+		for i := 1; i < n; i++ {
+			bounds = append(bounds, keys[i*len(keys)/n])
+		}
+	}
+
+	its := make([]*TreeForwardIterator, len(bounds)+1)
+	for i := 0; i < len(its); i++ {
+		var start []byte
+		if i > 0 {
+			start = bounds[i-1]
+		}
+
+		it, err := t.Seek(start)
+		if err != nil {
+			return nil, fmt.Errorf("failed to seek to partition start: %v", err)
+		}
+		if i < len(bounds) {
+			it.End = bounds[i]
+		}
+		its[i] = it
+	}
+
+	return its, nil
+}
+
+/* EstimateRange returns estimated number of entries with keys in range ['start', 'end'). Nil 'start' or 'end' means range is not bounded from that side. Estimate reads only as many pages as two lookups: fractions of entries before bounds are estimated from positions of bounds in pages on the way to leaves which may have them. Estimate is exact when both bounds fall into the same leaf. Expired values are counted too. */
+func (t *Tree) EstimateRange(start []byte, end []byte) (int64, error) {
+	defer trace.End(trace.Begin(""))
+
+	t.RLock()
+	defer t.RUnlock()
+
+	page := t.getPage()
+	defer t.putPage(page)
+
+	lo, err := t.estimatePosition(page, start, false)
+	if err != nil {
+		return 0, err
+	}
+	hi, err := t.estimatePosition(page, end, end == nil)
+	if err != nil {
+		return 0, err
+	}
+
+	if lo.Leaf == hi.Leaf {
+		if hi.Pos <= lo.Pos {
+			return 0, nil
+		}
+		return int64(hi.Pos - lo.Pos), nil
+	} else if hi.Fraction <= lo.Fraction {
+		return 0, nil
+	}
+
+	/* Each leaf holds about its share of all entries, so number of entries is extrapolated from both leaves. */
+	total := float64(lo.N+hi.N) / (lo.Width + hi.Width)
+	return int64((hi.Fraction-lo.Fraction)*total + 0.5), nil
+}
+
+/* treePosition is a position of key in tree estimated by 'estimatePosition'. */
+type treePosition struct {
+	/* Fraction is an estimated fraction of all entries which keys are less than key. */
+	Fraction float64
+
+	/* Leaf is an index of leaf which may have key. N is a number of entries in leaf, Pos is a number of them with keys less than key and Width is an estimated fraction of all entries leaf holds. */
+	Leaf   int64
+	N, Pos int
+	Width  float64
+}
+
+/* estimatePosition returns estimated position of 'key' or of the end of tree, if 'last' is true. Entries are assumed to be evenly spread between children of each node. */
+func (t *Tree) estimatePosition(page *Page, key []byte, last bool) (treePosition, error) {
+	p := treePosition{Width: 1}
+
+	index := t.Meta.Root
+	for index != 0 {
+		if _, err := t.ReadPageAt(page, index); err != nil {
+			return treePosition{}, fmt.Errorf("failed to read page: %v", err)
+		}
+
+		switch page.Type() {
+		case PageTypeNode:
+			node := page.Node()
+			pos := int(node.N) - 1
+			if !last {
+				pos = t.FindInNode(node, key)
+			}
+			p.Width /= float64(node.N) + 1
+			p.Fraction += float64(pos+1) * p.Width
+			index = node.GetChildAt(pos)
+		case PageTypeLeaf:
+			leaf := page.Leaf()
+			p.Leaf = index
+			p.N = int(leaf.N)
+			p.Pos = p.N
+			if !last {
+				pos, _ := t.FindInLeaf(leaf, key)
+				p.Pos = pos + 1
+			}
+			if p.N > 0 {
+				p.Fraction += float64(p.Pos) / float64(p.N) * p.Width
+			}
+			return p, nil
+		}
+	}
+
+	return p, nil
+}
+
+/* Commit writes modified 'Meta' and makes all previous writes durable according to tree's or pager's durability level. */
+func (t *Tree) Commit() error {
+	defer trace.End(trace.Begin(""))
+
+	t.Lock()
+	err := t.writeMeta()
+	t.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return t.sync()
+}
+
+func (t *Tree) writeMeta() error {
+	if t.MetaDirty {
+		/* NOTE(anton2920): 'Meta' always takes one page of pager, whatever page size of tree is. */
+		page := *t.Meta.Page()
+		if !t.Meta.HasFeature(TreeFeatureWideHeader) {
+			page.DowngradeHeaderV1()
+		}
+		if _, err := t.Pager.WritePagesAt(Page2Slice(&page), t.MetaIndex); err != nil {
+			return fmt.Errorf("failed to write meta: %v", err)
+		}
+		t.MetaDirty = false
+	}
+	return nil
+}
+
+func (t *Tree) sync() error {
+	/* NOTE(anton2920): values must become durable before pointers to them. */
+	if t.ValueLog != nil {
+		if err := t.ValueLog.Sync(t.Durability); err != nil {
+			return fmt.Errorf("failed to commit value log: %v", err)
+		}
+	}
+	if s, ok := t.Pager.(Syncer); ok {
+		if err := s.Sync(t.Durability); err != nil {
+			return fmt.Errorf("failed to commit: %v", err)
+		}
+	}
+	return nil
+}
+
+/* Get returns copy of value for 'key' or nil, if there's no such key. */
 func (t *Tree) Get(key []byte) ([]byte, error) {
 	defer trace.End(trace.Begin(""))
 
-	var buffer []byte
-	var page Page
-	var v []byte
+	t.RLock()
+	defer t.RUnlock()
+
+	page := t.getPage()
+	defer t.putPage(page)
 
+	v, err := t.findValue(page, key)
+	if (err != nil) || (v == nil) {
+		return nil, err
+	}
+	return t.appendValue([]byte{}, v, page)
+}
+
+/* GetAppend appends value for 'key' to 'dst' and returns extended buffer. If there's no such key, 'dst' is returned unchanged. Values stored in leaf are appended without allocations, if 'dst' has enough capacity. */
+func (t *Tree) GetAppend(dst []byte, key []byte) ([]byte, error) {
+	defer trace.End(trace.Begin(""))
+
+	t.RLock()
+	defer t.RUnlock()
+
+	page := t.getPage()
+	defer t.putPage(page)
+
+	v, err := t.findValue(page, key)
+	if (err != nil) || (v == nil) {
+		return dst, err
+	}
+	return t.appendValue(dst, v, page)
+}
+
+/* View calls 'fn' with value for 'key', if there is such key. Value is valid only until 'fn' returns and must not be modified. Tree is locked for reading while 'fn' runs. */
+func (t *Tree) View(key []byte, fn func(value []byte)) error {
+	defer trace.End(trace.Begin(""))
+
+	t.RLock()
+	defer t.RUnlock()
+
+	page := t.getPage()
+	defer t.putPage(page)
+
+	v, err := t.findValue(page, key)
+	if (err != nil) || (v == nil) {
+		return err
+	}
+	if ValueGetType(v) == ValueTypeFull {
+		/* NOTE(anton2920): values stored in leaf are passed without copying. */
+		fn(ValueGetFull(v))
+		return nil
+	}
+
+	value, err := t.appendValue(nil, v, page)
+	if err != nil {
+		return err
+	}
+	fn(value)
+	return nil
+}
+
+/* treePagePool holds scratch pages for lookups, so that they don't allocate. */
+var treePagePool = sync.Pool{New: func() interface{} { return new(Page) }}
+
+/* findValue reads leaf which may have 'key' into 'page' and returns value stored there for 'key' tagged with its 'ValueType' or nil, if there's no such key or its value has expired. */
+func (t *Tree) findValue(page *Page, key []byte) ([]byte, error) {
 	index := t.Meta.Root
 	for index != 0 {
-		if _, err := t.ReadPageAt(&page, index); err != nil {
+		if _, err := t.ReadPageAt(page, index); err != nil {
 			return nil, fmt.Errorf("failed to read page: %v", err)
 		}
 
 		switch page.Type() {
 		case PageTypeNode:
 			node := page.Node()
-			pos := node.Find(key)
-			index = node.GetChildAt(pos)
+			index = node.GetChildAt(t.FindInNode(node, key))
 		case PageTypeLeaf:
-			index = 0
 			leaf := page.Leaf()
-			pos, ok := leaf.Find(key)
-			if ok {
-				v = leaf.GetValueAt(pos + 1)
-				switch ValueGetType(v) {
-				default:
-					panic("unknown value type")
-				case ValueTypeFull:
-					return ValueGetFull(v), nil
-				case ValueTypePartial:
-					v, next := ValueGetPartial(v)
-					buffer = append(buffer, v...)
-
-					for next != 0 {
-						if _, err := t.ReadPageAt(&page, next); err != nil {
-							return nil, fmt.Errorf("failed to read page: %v", err)
-						}
-						overflow := page.Overflow()
-						buffer = append(buffer, overflow.GetValue()...)
-						next = overflow.Next
-					}
-
-					return buffer, nil
-				}
+			if pos, ok := t.FindInLeaf(leaf, key); ok {
+				return t.liveValue(leaf.GetValueAt(pos + 1)), nil
 			}
+			return nil, nil
 		}
 	}
 
 	return nil, nil
 }
 
-func (t *Tree) Del(key []byte) error {
-	return errors.New("not implemented")
+/* getRaw returns copy of value stored in leaf for 'key' tagged with its 'ValueType' or nil, if there's no such key or its value has expired. */
+func (t *Tree) getRaw(key []byte) ([]byte, error) {
+	page := t.getPage()
+	defer t.putPage(page)
+
+	v, err := t.findValue(page, key)
+	if (err != nil) || (v == nil) {
+		return nil, err
+	}
+	return append([]byte(nil), v...), nil
 }
 
-func (t *Tree) Has(key []byte) (bool, error) {
+/* appendValue appends value tagged with its 'ValueType' to 'dst'. Value may be in 'page', which is reused for reading overflow pages. */
+func (t *Tree) appendValue(dst []byte, v []byte, page *Page) ([]byte, error) {
+	switch ValueGetType(v) {
+	default:
+		panic("unknown value type")
+	case ValueTypeFull:
+		return append(dst, ValueGetFull(v)...), nil
+	case ValueTypePartial:
+		v, next := ValueGetPartial(v)
+		dst = append(dst, v...)
+
+		for next != 0 {
+			if _, err := t.ReadPageAt(page, next); err != nil {
+				return nil, fmt.Errorf("failed to read page: %v", err)
+			}
+			overflow := page.Overflow()
+			dst = append(dst, overflow.GetValue()...)
+			next = overflow.Next
+		}
+
+		return dst, nil
+	case ValueTypeExtent:
+		index, length := ValueGetExtent(v)
+		pages := make([]Page, (length+PageSize-1)/PageSize)
+		if _, err := t.Pager.ReadPagesAt(pages, t.pagerIndex(index)); err != nil {
+			return nil, fmt.Errorf("failed to read %d pages of extent: %v", len(pages), err)
+		}
+		if (len(dst) == 0) && (int64(cap(dst)) < length) {
+			/* NOTE(anton2920): 'append' would have allocated new buffer anyway. */
+			return Pages2Bytes(pages)[:length], nil
+		}
+		return append(dst, Pages2Bytes(pages)[:length]...), nil
+	case ValueTypeLog:
+		if t.ValueLog == nil {
+			return nil, errors.New("tree has values in value log, but no log is set")
+		}
+		return t.ValueLog.AppendValue(dst, ValueGetLog(v))
+	case ValueTypeShared:
+		_, v := ValueGetShared(v)
+		return t.appendValue(dst, v, page)
+	}
+}
+
+/* Del removes 'key' with its value and commits the change. Pages which hold value are put to free list. Leaves are never merged, so they may become empty. */
+func (t *Tree) Del(key []byte) error {
 	defer trace.End(trace.Begin(""))
 
-	var page Page
+	t.Lock()
+	err := t.del(key)
+	if err == nil {
+		err = t.writeMeta()
+	}
+	t.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return t.sync()
+}
+
+func (t *Tree) del(key []byte) error {
+	if err := t.checkIndexes(); err != nil {
+		return err
+	}
+
+	page := t.NewPage()
 
-	offset := t.Meta.Root
-	for offset != 0 {
-		if _, err := t.ReadPageAt(&page, offset); err != nil {
-			return false, fmt.Errorf("failed to read page: %v", err)
+	index := t.Meta.Root
+	for index != 0 {
+		if _, err := t.ReadPageAt(page, index); err != nil {
+			return fmt.Errorf("failed to read page: %v", err)
 		}
 
 		switch page.Type() {
 		case PageTypeNode:
 			node := page.Node()
-			index := node.Find(key)
-			offset = node.GetChildAt(index)
+			index = node.GetChildAt(t.FindInNode(node, key))
 		case PageTypeLeaf:
 			leaf := page.Leaf()
-			_, ok := leaf.Find(key)
-			return ok, nil
+			pos, ok := t.FindInLeaf(leaf, key)
+			if !ok {
+				return nil
+			}
+
+			old := append(t.OldValue[:0], leaf.GetValueAt(pos+1)...)
+			t.OldValue = old
+			changes, err := t.indexChanges(key, old, nil, nil)
+			if err != nil {
+				return err
+			}
+
+			leaf.DeleteAt(pos + 1)
+			if _, err := t.WritePageAt(page, index); err != nil {
+				return fmt.Errorf("failed to write updated leaf: %v", err)
+			}
+			err = t.updateIndexes(changes)
+			if err := t.freeValue(old); err != nil {
+				return fmt.Errorf("failed to free value: %v", err)
+			}
+			return err
 		}
 	}
 
-	return false, nil
+	return nil
+}
+
+func (t *Tree) Has(key []byte) (bool, error) {
+	defer trace.End(trace.Begin(""))
+
+	t.RLock()
+	defer t.RUnlock()
+
+	page := t.getPage()
+	defer t.putPage(page)
+
+	v, err := t.findValue(page, key)
+	return v != nil, err
 }
 
+/* Set inserts or updates value for 'key' and commits the change. Concurrent calls wait for each other, but may share one sync if pager uses 'DurabilityGroup'. */
 func (t *Tree) Set(key []byte, value []byte) error {
 	defer trace.End(trace.Begin(""))
 
-	var page Page
+	t.Lock()
+	err := t.set(key, value, false)
+	if err == nil {
+		err = t.writeMeta()
+	}
+	t.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return t.sync()
+}
+
+/* encodeValue stores parts of 'value' which don't fit into 'leaf' elsewhere and returns value tagged with its 'ValueType' to be put into leaf. Data of value which fits into leaf is not copied. 'extra' bytes are reserved for header wrapping the result. */
+func (t *Tree) encodeValue(leaf *Leaf, key []byte, value []byte, extra int) (EncodedValue, error) {
+	if t.logs(int64(len(value))) {
+		ptr, err := t.ValueLog.Append(key, value)
+		if err != nil {
+			return EncodedValue{}, fmt.Errorf("failed to append value to log: %v", err)
+		}
+		return EncodeLog(ptr), nil
+	}
+
+	if (leaf.OverflowAfterInsertKeyValueInEmpty(len(key), extra+FullValueLen(value))) && (t.Meta.HasFeature(TreeFeatureExtents)) {
+		/* NOTE(anton2920): pages of extent have no header and are written bypassing 'WritePageAt', which would treat them as tree pages. */
+		var hash [ValueHashSize]byte
+		if t.Meta.DedupMeta != 0 {
+			hash = sha256.Sum256(value)
+			if v, ok, err := t.reuseShared(hash); (err != nil) || (ok) {
+				return v, err
+			}
+		}
+
+		n := t.extentPages(int64(len(value)))
+		pages := make([]Page, t.pagerPages(n))
+		copy(Pages2Bytes(pages), value)
+		index, err := t.allocRun(n)
+		if err != nil {
+			return EncodedValue{}, err
+		}
+		if index != -1 {
+			index = t.pagerIndex(index)
+		}
+		index, err = t.Pager.WritePagesAt(pages, index)
+		if err != nil {
+			return EncodedValue{}, fmt.Errorf("failed to write %d pages of extent: %v", len(pages), err)
+		}
+		index = t.treeIndex(index)
+
+		if t.Meta.DedupMeta != 0 {
+			return t.putShared(hash, EncodeExtent(index, int64(len(value))))
+		}
+		return EncodeExtent(index, int64(len(value))), nil
+	}
+
+	if leaf.OverflowAfterInsertKeyValueInEmpty(len(key), extra+FullValueLen(value)) {
+		page := t.NewPage()
+		t.InitPage(page, PageTypeOverflow)
+		overflow := page.Overflow()
+
+		value = overflow.SetValue(value)
+		index, err := t.WritePageAt(page, -1)
+		if err != nil {
+			return EncodedValue{}, fmt.Errorf("failed to write new overflow: %v", err)
+		}
+
+		for (len(value) != 0) && (leaf.OverflowAfterInsertKeyValueInEmpty(len(key), extra+PartialValueLen(value))) {
+			overflow.Next = index
+			value = overflow.SetValue(value)
+			index, err = t.WritePageAt(page, -1)
+			if err != nil {
+				return EncodedValue{}, fmt.Errorf("failed to write new overflow: %v", err)
+			}
+		}
+
+		return EncodePartial(value, index), nil
+	}
+
+	return EncodeFull(value), nil
+}
+
+/* set puts 'value' for 'key'. If 'encoded' is true, 'value' is already tagged with its 'ValueType'. */
+func (t *Tree) set(key []byte, value []byte, encoded bool) error {
+	return t.update(key, func(leaf *Leaf, old []byte) (EncodedValue, []byte, error) {
+		if encoded {
+			return EncodeRaw(value), nil, nil
+		}
+		v, err := t.encodeValue(leaf, key, value, 0)
+		return v, value, err
+	})
+}
+
+/* update puts value returned by 'fn' for 'key'. 'fn' is called with leaf which has or will have 'key' and with value stored there for 'key' tagged with its 'ValueType' or nil, if there's no such key. It returns new value tagged with its 'ValueType' and the value itself, if it's known, so that indexes don't have to read it back. Changes of indexes are found before leaf is written and are applied after it, then pages of old value are put to free list. Leaf and each index are written on their own, so error after leaf is written may leave indexes behind it. */
+func (t *Tree) update(key []byte, fn func(leaf *Leaf, old []byte) (EncodedValue, []byte, error)) error {
+	if err := t.checkIndexes(); err != nil {
+		return err
+	}
+
+	page := t.NewPage()
 
-	var err error
 	var ok bool
 	var pos int
 
@@ -260,106 +1132,123 @@ func (t *Tree) Set(key []byte, value []byte) error {
 	index := t.Meta.Root
 forIndex:
 	for index != 0 {
-		if _, err := t.ReadPageAt(&page, index); err != nil {
+		if _, err := t.ReadPageAt(page, index); err != nil {
 			return fmt.Errorf("failed to read page: %v", err)
 		}
 
 		switch page.Type() {
 		case PageTypeNode:
 			node := page.Node()
-			pos = node.Find(key)
-			t.SearchPath = append(t.SearchPath, TreePathItem{page, index, pos})
+			pos = t.FindInNode(node, key)
+			t.pushPath(page, index, pos)
 			index = node.GetChildAt(pos)
 		case PageTypeLeaf:
 			leaf := page.Leaf()
-			pos, ok = leaf.Find(key)
+			pos, ok = t.FindInLeaf(leaf, key)
 			break forIndex
 		}
 	}
 
-	var overflow bool
 	leaf := page.Leaf()
 
-	if leaf.OverflowAfterInsertKeyValueInEmpty(len(key), FullValueLen(value)) {
-		var page Page
-		page.Init(PageTypeOverflow)
-		overflow := page.Overflow()
+	var old []byte
+	if ok {
+		old = append(t.OldValue[:0], leaf.GetValueAt(pos+1)...)
+		t.OldValue = old
+	}
+	v, value, err := fn(leaf, old)
+	if err != nil {
+		return err
+	}
 
-		value = overflow.SetValue(value)
-		index, err := t.WritePageAt(&page, -1)
-		if err != nil {
-			return fmt.Errorf("failed to write new overflow: %v", err)
-		}
+	changes, err := t.indexChanges(key, old, v.Bytes(), value)
+	if err != nil {
+		return err
+	}
 
-		for (len(value) != 0) && (leaf.OverflowAfterInsertKeyValueInEmpty(len(key), PartialValueLen(value))) {
-			overflow.Next = index
-			value = overflow.SetValue(value)
-			index, err = t.WritePageAt(&page, -1)
-			if err != nil {
-				return fmt.Errorf("failed to write new overflow: %v", err)
-			}
+	if err := t.putValue(page, index, pos, ok, key, v); err != nil {
+		return err
+	}
+	err = t.updateIndexes(changes)
+	if old != nil {
+		if err := t.freeValue(old); err != nil {
+			return fmt.Errorf("failed to free old value: %v", err)
 		}
-
-		/* TODO(anton2920): remove extra memory allocation. */
-		value = PartialValue(value, index)
-	} else {
-		/* TODO(anton2920): remove extra memory allocation. */
-		value = FullValue(value)
 	}
 
+	return err
+}
+
+/* putValue puts 'v' for 'key' into leaf 'page' at 'index', where 'key' is at 'pos+1', if 'ok' is true, or is inserted there otherwise. Leaf is split if needed, with new keys inserted into nodes in 't.SearchPath'. */
+func (t *Tree) putValue(page *Page, index int64, pos int, ok bool, key []byte, v EncodedValue) error {
+	var overflow bool
+	var err error
+
+	leaf := page.Leaf()
+
 	if ok {
 		/* Found key, check for overflow before updating value. */
-		overflow = leaf.OverflowAfterInsertValue(len(value))
+		overflow = leaf.OverflowAfterInsertValue(v.Len())
 	} else {
 		/* Check for overflow before inserting new key. */
-		overflow = leaf.OverflowAfterInsertKeyValue(len(key), len(value)) || (leaf.N >= TreeMaxOrder-1)
+		overflow = leaf.OverflowAfterInsertKeyValue(key, v.Len()) || (int(leaf.N) >= int(t.Meta.MaxOrder)-1)
 	}
 
 	if !overflow {
 		if ok {
 			/* Updating value for existing key. */
-			leaf.SetValueAt(value, pos+1)
+			leaf.SetEncodedValueAt(v, pos+1)
 		} else {
 			/* Insering new key-value. */
-			leaf.InsertKeyValueAt(key, value, pos+1)
+			leaf.InsertKeyEncodedValueAt(key, v, pos+1)
 		}
-		if _, err = t.WritePageAt(&page, index); err != nil {
+		if _, err = t.WritePageAt(page, index); err != nil {
 			return fmt.Errorf("failed to write updated leaf: %v", err)
 		}
 		return nil
 	}
 
 	/* Split leaf into two. */
-	var newLeaf Leaf
-	newLeaf.Page().Init(PageTypeLeaf)
-	newBuffer := make([]byte, PageSize)
+	newPage := t.NewPage()
+	t.InitPage(newPage, PageTypeLeaf)
+	newLeaf := newPage.Leaf()
+	newBuffer := make([]byte, t.Meta.PageSize)
 
-	half := int(leaf.N) / 2
-	if pos < half-1 {
-		leaf.MoveData(&newLeaf, 0, half-1, -1)
-		if ok {
-			leaf.SetValueAt(value, pos)
+	half := leaf.FindSplit(t.SplitAt(int(leaf.N)+util.Bool2Int(!ok)), pos+1, key, v.Len(), ok)
+	if ok {
+		/* Existing key is at 'pos+1'. */
+		leaf.MoveData(newLeaf, 0, half, -1)
+		if pos+1 < half {
+			leaf.SetEncodedValueAt(v, pos+1)
 		} else {
-			leaf.InsertKeyValueAt(key, value, pos+1)
+			newLeaf.SetEncodedValueAt(v, pos+1-half)
 		}
+	} else if pos < half-1 {
+		leaf.MoveData(newLeaf, 0, half-1, -1)
+		leaf.InsertKeyEncodedValueAt(key, v, pos+1)
 	} else {
-		leaf.MoveData(&newLeaf, 0, half, -1)
-		if ok {
-			newLeaf.SetValueAt(value, pos-half)
-		} else {
-			newLeaf.InsertKeyValueAt(key, value, pos+1-half)
-		}
+		leaf.MoveData(newLeaf, 0, half, -1)
+		newLeaf.InsertKeyEncodedValueAt(key, v, pos+1-half)
+	}
+
+	if t.Meta.HasFeature(TreeFeaturePrefix) {
+		leaf.Compact()
+		newLeaf.Compact()
 	}
 
 	newLeaf.Next = leaf.Next
-	newKey := duplicate(newBuffer, newLeaf.GetKeyAt(0))
-	newPage, err := t.WritePageAt(newLeaf.Page(), -1)
+	/* Only enough bytes to tell apart the last key of 'leaf' and the first key of 'newLeaf' are promoted. Prefixes don't separate keys in order of comparator, so whole key is promoted then. */
+	newKey := newLeaf.AppendKeyAt(newBuffer[:0], 0)
+	if t.Comparator == nil {
+		newKey = ShortestSeparator(leaf.AppendKeyAt(make([]byte, 0, t.Meta.PageSize), int(leaf.N)-1), newKey)
+	}
+	newIndex, err := t.WritePageAt(newPage, -1)
 	if err != nil {
 		return fmt.Errorf("failed to write new leaf: %v", err)
 	}
 
-	leaf.Next = newPage
-	if _, err = t.WritePageAt(&page, index); err != nil {
+	leaf.Next = newIndex
+	if _, err = t.WritePageAt(page, index); err != nil {
 		return fmt.Errorf("failed to write updated leaf: %v", err)
 	}
 
@@ -371,72 +1260,98 @@ forIndex:
 
 		node.SetChildAt(index, pos)
 
-		overflow = node.OverflowAfterInsertKeyChild(len(key)) || (node.N >= TreeMaxOrder-1)
+		overflow = node.OverflowAfterInsertKeyChild(newKey) || (int(node.N) >= int(t.Meta.MaxOrder)-1)
 		if !overflow {
-			node.InsertKeyChildAt(newKey, newPage, pos+1)
-			if _, err = t.WritePageAt(&page, t.SearchPath[p].Index); err != nil {
+			node.InsertKeyChildAt(newKey, newIndex, pos+1)
+			if _, err = t.WritePageAt(page, t.SearchPath[p].Index); err != nil {
 				return fmt.Errorf("failed to write updated node: %v", err)
 			}
 			return nil
 		}
 
 		var insertKey []byte
-		var newNode Page
-		newNode.Init(PageTypeNode)
 
-		insertBuffer := make([]byte, PageSize)
+		newNode := t.NewPage()
+		t.InitPage(newNode, PageTypeNode)
 
-		half = int(node.N) / 2
+		insertBuffer := make([]byte, t.Meta.PageSize)
+
+		half = t.SplitAt(int(node.N))
 		if pos < half-1 {
 			insertKey = duplicate(insertBuffer, newKey)
-			newKey = duplicate(newBuffer, node.GetKeyAt(half-1))
+			newKey = node.AppendKeyAt(newBuffer[:0], half-1)
 
 			node.MoveData(newNode.Node(), -1, half-1, -1)
-			node.InsertKeyChildAt(insertKey, newPage, pos+1)
+			node.InsertKeyChildAt(insertKey, newIndex, pos+1)
 		} else if pos == half-1 {
-			insertKey = duplicate(insertBuffer, node.GetKeyAt(half))
+			insertKey = node.AppendKeyAt(insertBuffer[:0], half)
 			insertPage := node.GetChildAt(half)
 
 			node.MoveData(newNode.Node(), -1, half, -1)
-			newNode.Node().SetChildAt(newPage, -1)
+			newNode.Node().SetChildAt(newIndex, -1)
 			newNode.Node().InsertKeyChildAt(insertKey, insertPage, pos+1-half)
 		} else {
 			insertKey = duplicate(insertBuffer, newKey)
-			newKey = duplicate(newBuffer, node.GetKeyAt(half))
+			newKey = node.AppendKeyAt(newBuffer[:0], half)
 
 			node.MoveData(newNode.Node(), -1, half, -1)
-			newNode.Node().InsertKeyChildAt(insertKey, newPage, pos-half)
+			newNode.Node().InsertKeyChildAt(insertKey, newIndex, pos-half)
+		}
+
+		if t.Meta.HasFeature(TreeFeaturePrefix) {
+			node.Compact()
+			newNode.Node().Compact()
 		}
 
-		newPage, err = t.WritePageAt(&newNode, -1)
+		newIndex, err = t.WritePageAt(newNode, -1)
 		if err != nil {
 			return fmt.Errorf("failed to write new node: %v", err)
 		}
 
-		index, err = t.WritePageAt(&page, t.SearchPath[p].Index)
+		index, err = t.WritePageAt(page, t.SearchPath[p].Index)
 		if err != nil {
 			return fmt.Errorf("failed to write updated node: %v", err)
 		}
 	}
 
-	var root Page
-	root.Init(PageTypeNode)
+	root := t.NewPage()
+	t.InitPage(root, PageTypeNode)
 	node := root.Node()
-	node.Init(newKey, t.Meta.Root, newPage)
+	node.Init(newKey, t.Meta.Root, newIndex)
 
-	t.Meta.Root, err = t.WritePageAt(&root, -1)
+	t.Meta.Root, err = t.WritePageAt(root, -1)
 	if err != nil {
 		return fmt.Errorf("failed to write new root: %v", err)
 	}
+	t.MetaDirty = true
 
 	return nil
 }
 
+/* pushPath appends node 'page' at 'index' with position 'pos' in it to 't.SearchPath'. Pages of items are copied to buffers kept in 't.SearchPath' between calls. */
+func (t *Tree) pushPath(page *Page, index int64, pos int) {
+	n := len(t.SearchPath)
+	if n < cap(t.SearchPath) {
+		t.SearchPath = t.SearchPath[:n+1]
+	} else {
+		t.SearchPath = append(t.SearchPath, TreePathItem{})
+	}
+
+	item := &t.SearchPath[n]
+	if item.Page == nil {
+		item.Page = t.NewPage()
+	}
+	span := int(t.PageSpan())
+	copy(Page2Pages(item.Page, span), Page2Pages(page, span))
+	item.Index = index
+	item.Pos = pos
+}
+
 func (t *Tree) stringImpl(buf *bytes.Buffer, index int64, level int) error {
-	var page Page
+	page := t.NewPage()
 
 	if index != 0 {
-		if _, err := t.ReadPageAt(&page, index); err != nil {
+		if _, err := t.ReadPageAt(page, index); err != nil {
 			return fmt.Errorf("failed to read page: %v", err)
 		}
 
@@ -448,7 +1363,7 @@ func (t *Tree) stringImpl(buf *bytes.Buffer, index int64, level int) error {
 		case PageTypeNode:
 			node := page.Node()
 			for i := 0; i < int(node.N); i++ {
-				fmt.Fprintf(buf, "%4d", slice2Int(node.GetKeyAt(i)))
+				fmt.Fprintf(buf, "%4d", slice2Int(node.AppendKeyAt(nil, i)))
 			}
 			buf.WriteRune('\n')
 
@@ -458,7 +1373,7 @@ func (t *Tree) stringImpl(buf *bytes.Buffer, index int64, level int) error {
 		case PageTypeLeaf:
 			leaf := page.Leaf()
 			for i := 0; i < int(leaf.N); i++ {
-				fmt.Fprintf(buf, "%4d", slice2Int(leaf.GetKeyAt(i)))
+				fmt.Fprintf(buf, "%4d", slice2Int(leaf.AppendKeyAt(nil, i)))
 			}
 			buf.WriteRune('\n')
 		}
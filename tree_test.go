@@ -3,15 +3,27 @@ package main
 import (
 	"bytes"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/anton2920/gofa/errors"
+	"github.com/anton2920/gofa/util"
 )
 
 const N = 10000
 
-func testTreeGet(t *testing.T, g Generator, pager Pager) {
+func testTreeGet(t *testing.T, g Generator, pager Pager, opts TreeOptions) {
 	t.Helper()
 
-	tree, err := GetTreeAt(pager, -1)
+	tree, err := GetTreeAtWithOptions(pager, -1, opts)
 	if err != nil {
 		t.Fatalf("Failed to create new tree: %v", err)
 	}
@@ -35,10 +47,10 @@ func testTreeGet(t *testing.T, g Generator, pager Pager) {
 	}
 }
 
-func testTreeDel(t *testing.T, g Generator, pager Pager) {
+func testTreeDel(t *testing.T, g Generator, pager Pager, opts TreeOptions) {
 	t.Helper()
 
-	tree, err := GetTreeAt(pager, -1)
+	tree, err := GetTreeAtWithOptions(pager, -1, opts)
 	if err != nil {
 		t.Fatalf("Failed to create new tree: %v", err)
 	}
@@ -65,12 +77,20 @@ func testTreeDel(t *testing.T, g Generator, pager Pager) {
 			t.Errorf("Expected key %v to be removed, but it's still present", k)
 		}
 	}
+
+	it, err := tree.Begin()
+	if err != nil {
+		t.Fatalf("Failed to create iterator: %v", err)
+	}
+	if it.Next() {
+		t.Errorf("Expected no keys after removing all of them, got %v", it.Key())
+	}
 }
 
-func testTreeHas(t *testing.T, g Generator, pager Pager) {
+func testTreeHas(t *testing.T, g Generator, pager Pager, opts TreeOptions) {
 	t.Helper()
 
-	tree, err := GetTreeAt(pager, -1)
+	tree, err := GetTreeAtWithOptions(pager, -1, opts)
 	if err != nil {
 		t.Fatalf("Failed to create new tree: %v", err)
 	}
@@ -93,10 +113,67 @@ func testTreeHas(t *testing.T, g Generator, pager Pager) {
 	}
 }
 
-func testTreeSet(t *testing.T, g Generator, pager Pager) {
+func testTreePartition(t *testing.T, g Generator, pager Pager, opts TreeOptions) {
 	t.Helper()
 
-	tree, err := GetTreeAt(pager, -1)
+	tree, err := GetTreeAtWithOptions(pager, -1, opts)
+	if err != nil {
+		t.Fatalf("Failed to create new tree: %v", err)
+	}
+
+	m := make(map[int]struct{})
+	for i := 0; i < N; i++ {
+		k := g.Generate()
+
+		m[k] = struct{}{}
+		if err := tree.Set(int2Slice(k), ZeroValue); err != nil {
+			t.Fatalf("Error on 'Set': %v", err)
+		}
+	}
+
+	for _, n := range [...]int{1, 2, 7, 64} {
+		its, err := tree.Partition(n)
+		if err != nil {
+			t.Fatalf("Error on 'Partition': %v", err)
+		}
+
+		keys := make([][][]byte, len(its))
+		var wg sync.WaitGroup
+		for i, it := range its {
+			wg.Add(1)
+			go func(i int, it *TreeForwardIterator) {
+				defer wg.Done()
+				for it.Next() {
+					keys[i] = append(keys[i], append([]byte{}, it.Key()...))
+				}
+			}(i, it)
+		}
+		wg.Wait()
+
+		var prev []byte
+		var count int
+		for i := 0; i < len(keys); i++ {
+			for _, key := range keys[i] {
+				if (prev != nil) && (bytes.Compare(prev, key) >= 0) {
+					t.Errorf("Partitions of %d are overlapping or unordered at key %v", n, slice2Int(key))
+				}
+				if _, ok := m[slice2Int(key)]; !ok {
+					t.Errorf("Unexpected key %v in partition", slice2Int(key))
+				}
+				prev = key
+				count++
+			}
+		}
+		if count != len(m) {
+			t.Errorf("Expected %d keys in %d partitions, got %d", len(m), n, count)
+		}
+	}
+}
+
+func testTreeSet(t *testing.T, g Generator, pager Pager, opts TreeOptions) {
+	t.Helper()
+
+	tree, err := GetTreeAtWithOptions(pager, -1, opts)
 	if err != nil {
 		t.Fatalf("Failed to create new tree: %v", err)
 	}
@@ -125,10 +202,10 @@ func testTreeSet(t *testing.T, g Generator, pager Pager) {
 	}
 }
 
-func testTreeSetLarge(t *testing.T, g Generator, pager Pager) {
+func testTreeSetLarge(t *testing.T, g Generator, pager Pager, opts TreeOptions) {
 	t.Helper()
 
-	tree, err := GetTreeAt(pager, -1)
+	tree, err := GetTreeAtWithOptions(pager, -1, opts)
 	if err != nil {
 		t.Fatalf("Failed to create new tree: %v", err)
 	}
@@ -160,16 +237,66 @@ func testTreeSetLarge(t *testing.T, g Generator, pager Pager) {
 	}
 }
 
+func testTreeUpdate(t *testing.T, g Generator, pager Pager, opts TreeOptions) {
+	t.Helper()
+
+	tree, err := GetTreeAtWithOptions(pager, -1, opts)
+	if err != nil {
+		t.Fatalf("Failed to create new tree: %v", err)
+	}
+
+	m := make(map[int]int)
+	for i := 0; i < N; i++ {
+		k := g.Generate()
+
+		m[k] = 0
+		if err := tree.Set(int2Slice(k), ZeroValue); err != nil {
+			t.Fatalf("Error on 'Set': %v", err)
+		}
+	}
+
+	/* Growing values force splits on updates of existing keys. */
+	value := make([]byte, tree.Meta.PageSize/4)
+	for k := range m {
+		m[k] = k
+		copy(value, int2Slice(k))
+		if err := tree.Set(int2Slice(k), value); err != nil {
+			t.Fatalf("Error on 'Set': %v", err)
+		}
+	}
+
+	for k, v := range m {
+		got, err := tree.Get(int2Slice(k))
+		if err != nil {
+			t.Errorf("Error on 'Get': %v", err)
+		} else if (len(got) != len(value)) || (slice2Int(got) != v) {
+			t.Errorf("Expected value %v, got %v", v, got)
+		}
+	}
+}
+
+var testTreeOptions = [...]struct {
+	Name    string
+	Options TreeOptions
+}{
+	{"Default", TreeOptions{}},
+	{"Order5", TreeOptions{MaxOrder: 5}},
+	{"Order5Fill90", TreeOptions{MaxOrder: 5, FillFactor: 90}},
+	{"Page1K", TreeOptions{PageSize: 1024}},
+}
+
 func TestTree(t *testing.T) {
 	ops := [...]struct {
 		Name string
-		Func func(*testing.T, Generator, Pager)
+		Func func(*testing.T, Generator, Pager, TreeOptions)
 	}{
 		{"Get", testTreeGet},
-		// 	{"Del", testTreeDel},
+		{"Del", testTreeDel},
 		{"Has", testTreeHas},
+		{"Partition", testTreePartition},
 		{"Set", testTreeSet},
 		{"SetLarge", testTreeSetLarge},
+		{"Update", testTreeUpdate},
 	}
 
 	generators := [...]Generator{
@@ -186,84 +313,351 @@ func TestTree(t *testing.T) {
 				t.Run(generator.String(), func(t *testing.T) {
 					t.Parallel()
 					t.Run("MemoryPager", func(t *testing.T) {
-						op.Func(t, generator, new(MemoryPager))
+						for _, opts := range testTreeOptions {
+							t.Run(opts.Name, func(t *testing.T) {
+								op.Func(t, generator, new(MemoryPager), opts.Options)
+							})
+						}
+					})
+					t.Run("FilePager", func(t *testing.T) {
+						filePager, err := FilePagerNew(filepath.Join(t.TempDir(), generator.String()+"_test.tree"))
+						if err != nil {
+							t.Fatalf("Failed to create new file pager: %v", err)
+						}
+						defer filePager.Close()
+						op.Func(t, generator, filePager, TreeOptions{MaxOrder: 5})
+					})
+					t.Run("ReadAheadPager", func(t *testing.T) {
+						op.Func(t, generator, &ReadAheadPager{Pager: new(MemoryPager)}, TreeOptions{MaxOrder: 5})
 					})
-					/*
-						t.Run("FilePager", func(t *testing.T) {
-							t.Skip()
-							filePager, err := FilePagerNew(generator.String() + "_test.tree")
-							if err != nil {
-								t.Fatalf("Failed to create new file pager: %v", err)
-							}
-							defer filePager.Close()
-							op.Func(t, generator, filePager)
-						})
-					*/
 				})
 			}
 		})
 	}
 }
 
-func benchmarkTreeGet(b *testing.B, g Generator, pager Pager) {
-	b.Helper()
+func TestTreeOptions(t *testing.T) {
+	var pager MemoryPager
 
-	tree, err := GetTreeAt(pager, -1)
+	opts := TreeOptions{PageSize: 2048, MaxOrder: 7, FillFactor: 70}
+	tree, err := GetTreeAtWithOptions(&pager, -1, opts)
 	if err != nil {
-		b.Fatalf("Failed to create new tree: %v", err)
+		t.Fatalf("Failed to create new tree: %v", err)
+	}
+	for i := 0; i < N; i++ {
+		if err := tree.Set(int2Slice(i), int2Slice(i)); err != nil {
+			t.Fatalf("Error on 'Set': %v", err)
+		}
 	}
 
-	for i := 0; i < b.N; i++ {
-		_ = tree.Set(int2Slice(g.Generate()), ZeroValue)
+	tree, err = GetTreeAtWithOptions(&pager, tree.MetaIndex, TreeOptions{})
+	if err != nil {
+		t.Fatalf("Failed to open tree: %v", err)
+	}
+	if (tree.Meta.PageSize != int64(opts.PageSize)) || (tree.Meta.MaxOrder != int64(opts.MaxOrder)) || (tree.Meta.FillFactor != int64(opts.FillFactor)) {
+		t.Errorf("Expected tree to be opened with %+v, got page size %d, order %d and fill factor %d", opts, tree.Meta.PageSize, tree.Meta.MaxOrder, tree.Meta.FillFactor)
+	}
+	for i := 0; i < N; i++ {
+		got, err := tree.Get(int2Slice(i))
+		if err != nil {
+			t.Fatalf("Error on 'Get': %v", err)
+		} else if (got == nil) || (slice2Int(got) != i) {
+			t.Errorf("Expected value %v, got %v", i, got)
+		}
 	}
 
-	g.Reset()
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		_, _ = tree.Get(int2Slice(g.Generate()))
+	for _, opts := range [...]TreeOptions{{PageSize: 1000}, {PageSize: 2 * MaxPageSize}, {MaxOrder: 2}, {MaxOrder: TreeMaxOrder + 1}, {FillFactor: 100}} {
+		if _, err := GetTreeAtWithOptions(new(MemoryPager), -1, opts); err == nil {
+			t.Errorf("Expected error for options %+v, got nothing", opts)
+		}
 	}
 }
 
-func benchmarkTreeDel(b *testing.B, g Generator, pager Pager) {
-	b.Helper()
+func TestTreePageSize(t *testing.T) {
+	pagerPages := make(map[int]int)
+	for _, size := range [...]int{MinPageSize, PageSize, 2 * PageWideSize} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			var pager MemoryPager
 
-	tree, err := GetTreeAt(pager, -1)
+			tree, err := GetTreeAtWithOptions(&pager, -1, TreeOptions{PageSize: size})
+			if err != nil {
+				t.Fatalf("Failed to create new tree: %v", err)
+			}
+			for i := 0; i < N; i++ {
+				if err := tree.Set(int2Slice(i), int2Slice(i)); err != nil {
+					t.Fatalf("Error on 'Set': %v", err)
+				}
+			}
+			pagerPages[size] = len(pager.Pages)
+
+			/* Values longer than page are stored in extents, which take whole pages of pager. */
+			values := make([][]byte, 8)
+			for i := range values {
+				values[i] = bytes.Repeat([]byte{byte(i + 1)}, (i+1)*size/2)
+				if err := tree.Set(int2Slice(N+i), values[i]); err != nil {
+					t.Fatalf("Error on 'Set': %v", err)
+				}
+			}
+			for i := 0; i < N; i += 2 {
+				if err := tree.Del(int2Slice(i)); err != nil {
+					t.Fatalf("Error on 'Del': %v", err)
+				}
+			}
+			if err := tree.Del(int2Slice(N)); err != nil {
+				t.Fatalf("Error on 'Del': %v", err)
+			}
+			if err := tree.Set(int2Slice(N), values[0]); err != nil {
+				t.Fatalf("Error on 'Set': %v", err)
+			}
+
+			tree, err = GetTreeAtWithOptions(&pager, tree.MetaIndex, TreeOptions{})
+			if err != nil {
+				t.Fatalf("Failed to open tree: %v", err)
+			}
+			if (tree.Meta.PageSize != int64(size)) || (tree.Meta.OffsetSize != int64(PageOffsetSize(size))) {
+				t.Errorf("Expected tree with %d-byte pages and %d-byte offsets, got %d-byte pages and %d-byte offsets", size, PageOffsetSize(size), tree.Meta.PageSize, tree.Meta.OffsetSize)
+			}
+			for i := 0; i < N; i++ {
+				got, err := tree.Get(int2Slice(i))
+				if err != nil {
+					t.Fatalf("Error on 'Get': %v", err)
+				} else if (i%2 == 0) && (got != nil) {
+					t.Errorf("Expected key %d to be deleted, got %v", i, got)
+				} else if (i%2 == 1) && ((got == nil) || (slice2Int(got) != i)) {
+					t.Errorf("Expected value %v, got %v", i, got)
+				}
+			}
+			for i := range values {
+				if got, err := tree.Get(int2Slice(N + i)); err != nil {
+					t.Fatalf("Error on 'Get': %v", err)
+				} else if !bytes.Equal(got, values[i]) {
+					t.Errorf("Expected value of length %d for key %d, got value of length %d", len(values[i]), N+i, len(got))
+				}
+			}
+
+			it, err := tree.Begin()
+			if err != nil {
+				t.Fatalf("Failed to create iterator: %v", err)
+			}
+			var count int
+			for it.Next() {
+				count++
+			}
+			if count != N/2+len(values) {
+				t.Errorf("Expected %d keys, got %d", N/2+len(values), count)
+			}
+		})
+	}
+
+	/* Pages smaller than pager's share its pages. */
+	if pagerPages[MinPageSize] > 2*pagerPages[PageSize] {
+		t.Errorf("Expected tree with %d-byte pages to take about as many bytes as tree with %d-byte pages, got %d and %d pages of pager", MinPageSize, PageSize, pagerPages[MinPageSize], pagerPages[PageSize])
+	}
+}
+
+func TestTreePrefix(t *testing.T) {
+	var pager MemoryPager
+
+	tree, err := GetTreeAt(&pager, -1)
 	if err != nil {
-		b.Fatalf("Failed to create new tree: %v", err)
+		t.Fatalf("Failed to create new tree: %v", err)
 	}
 
-	for i := 0; i < b.N; i++ {
-		_ = tree.Set(int2Slice(g.Generate()), ZeroValue)
+	/* Keys share long prefixes of tenant ID and big-endian timestamp. */
+	key := func(i int) []byte {
+		key := []byte("tenant-0000000000000000/")
+		key[len(key)-2] += byte(i % 3)
+		key = append(key, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(key[len(key)-8:], uint64(1700000000000+i))
+		return key
 	}
 
-	g.Reset()
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		_ = tree.Del(int2Slice(g.Generate()))
+	for i := 0; i < N; i++ {
+		if err := tree.Set(key(i), int2Slice(i)); err != nil {
+			t.Fatalf("Error on 'Set': %v", err)
+		}
+	}
+	for i := 0; i < N; i++ {
+		got, err := tree.Get(key(i))
+		if err != nil {
+			t.Fatalf("Error on 'Get': %v", err)
+		} else if (got == nil) || (slice2Int(got) != i) {
+			t.Errorf("Expected value %v, got %v", i, got)
+		}
+	}
+
+	it, err := tree.Begin()
+	if err != nil {
+		t.Fatalf("Failed to create iterator: %v", err)
+	}
+	var prev []byte
+	var count int
+	for it.Next() {
+		if bytes.Compare(prev, it.Key()) >= 0 {
+			t.Fatalf("Expected keys in ascending order, got %q after %q", it.Key(), prev)
+		}
+		prev = append(prev[:0], it.Key()...)
+		count++
+	}
+	if count != N {
+		t.Errorf("Expected %d keys, got %d", N, count)
+	}
+
+	var leaves, prefixes int
+	for i := range pager.Pages {
+		page := &pager.Pages[i]
+		if page.Type() == PageTypeLeaf {
+			leaves++
+			prefixes += util.Bool2Int(len(page.Leaf().GetPrefix()) > 0)
+		}
+	}
+	if prefixes == 0 {
+		t.Errorf("Expected leaves to have common prefixes, none of %d do", leaves)
 	}
 }
 
-func benchmarkTreeSet(b *testing.B, g Generator, pager Pager) {
-	b.Helper()
+func TestTreeSeparators(t *testing.T) {
+	var pager MemoryPager
 
-	tree, err := GetTreeAt(pager, -1)
+	tree, err := GetTreeAt(&pager, -1)
 	if err != nil {
-		b.Fatalf("Failed to create new tree: %v", err)
+		t.Fatalf("Failed to create new tree: %v", err)
 	}
 
-	for i := 0; i < b.N; i++ {
-		_ = tree.Set(int2Slice(g.Generate()), ZeroValue)
+	/* Keys differ in their first bytes and are followed by long common tail. */
+	const tail = 200
+	key := func(i int) []byte {
+		key := make([]byte, 4+tail)
+		binary.BigEndian.PutUint32(key, uint32(i))
+		return key
+	}
+
+	for i := 0; i < N; i++ {
+		if err := tree.Set(key(i), int2Slice(i)); err != nil {
+			t.Fatalf("Error on 'Set': %v", err)
+		}
+	}
+	for i := 0; i < N; i++ {
+		got, err := tree.Get(key(i))
+		if err != nil {
+			t.Fatalf("Error on 'Get': %v", err)
+		} else if (got == nil) || (slice2Int(got) != i) {
+			t.Errorf("Expected value %v, got %v", i, got)
+		}
+	}
+
+	var nodes int
+	for i := range pager.Pages {
+		page := &pager.Pages[i]
+		if page.Type() == PageTypeNode {
+			node := page.Node()
+			for j := 0; j < int(node.N); j++ {
+				if key := node.AppendKeyAt(nil, j); len(key) >= tail {
+					t.Errorf("Expected separator to be truncated, got %d bytes", len(key))
+				}
+			}
+			nodes++
+		}
+	}
+	if nodes == 0 {
+		t.Errorf("Expected tree to have nodes")
 	}
 }
 
-func BenchmarkTree(b *testing.B) {
-	ops := [...]struct {
-		Name string
-		Func func(*testing.B, Generator, Pager)
+/* testTreeDowngradeV1 rewrites all pages in 'pager' in format of version 1: | Type | N | Head | Tail | 2 bytes of padding |. Tree must not use features of later versions. */
+func testTreeDowngradeV1(pager *MemoryPager) {
+	for i := range pager.Pages {
+		page := &pager.Pages[i]
+		hdr := *page.Header()
+		if hdr.Type == PageTypeMeta {
+			meta := page.Meta()
+			meta.Version = 1
+			meta.PageSize = 0
+			meta.OffsetSize = 0
+			meta.MaxOrder = 0
+			meta.FillFactor = 0
+			meta.Features = 0
+		}
+		page[0] = byte(hdr.Type)
+		page[1] = byte(hdr.N)
+		binary.LittleEndian.PutUint16(page[2:], uint16(hdr.Head()))
+		binary.LittleEndian.PutUint16(page[4:], uint16(hdr.Tail()))
+		page[6] = 0
+		page[7] = 0
+	}
+}
+
+func TestTreeVersion1(t *testing.T) {
+	var pager MemoryPager
+
+	tree, err := GetTreeAtWithOptions(&pager, -1, TreeOptions{MaxOrder: 5})
+	if err != nil {
+		t.Fatalf("Failed to create new tree: %v", err)
+	}
+	tree.Meta.Features = TreeFeatureWideHeader
+	for i := 0; i < N/2; i++ {
+		if err := tree.Set(int2Slice(i), int2Slice(i)); err != nil {
+			t.Fatalf("Error on 'Set': %v", err)
+		}
+	}
+	testTreeDowngradeV1(&pager)
+
+	tree, err = GetTreeAt(&pager, 0)
+	if err != nil {
+		t.Fatalf("Failed to open tree of version 1: %v", err)
+	}
+	if tree.Meta.MaxOrder != TreeMaxOrderV1 {
+		t.Errorf("Expected tree of version 1 to have order %d, got %d", TreeMaxOrderV1, tree.Meta.MaxOrder)
+	}
+	for i := N / 2; i < N; i++ {
+		if err := tree.Set(int2Slice(i), int2Slice(i)); err != nil {
+			t.Fatalf("Error on 'Set': %v", err)
+		}
+	}
+	for i := 0; i < N; i++ {
+		got, err := tree.Get(int2Slice(i))
+		if err != nil {
+			t.Fatalf("Error on 'Get': %v", err)
+		} else if (got == nil) || (slice2Int(got) != i) {
+			t.Errorf("Expected value %v, got %v", i, got)
+		}
+	}
+
+	for i := range pager.Pages {
+		page := &pager.Pages[i]
+		/* Non-empty leaf of version 1 has non-zero 'N' in the second byte, where current format has zero 'Shift'. */
+		if (page.Type() == PageTypeLeaf) && (binary.LittleEndian.Uint16(page[2:]) != 0) && (page[1] == 0) {
+			t.Errorf("Page %d is not in format of version 1", i)
+		}
+	}
+}
+
+func TestTreeEstimateRange(t *testing.T) {
+	tree, err := GetTreeAt(new(MemoryPager), -1)
+	if err != nil {
+		t.Fatalf("Failed to create new tree: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := tree.Set([]byte{byte(i)}, ZeroValue); err != nil {
+			t.Fatalf("Error on 'Set': %v", err)
+		}
+	}
+
+	/* Ranges in one leaf are counted exactly. */
+	for _, test := range [...]struct {
+		Start, End []byte
+		Expected   int64
 	}{
-		{"Get", benchmarkTreeGet},
-		//	{"Del", benchmarkTreeDel},
-		{"Set", benchmarkTreeSet},
+		{nil, nil, 10},
+		{[]byte{2}, []byte{7}, 5},
+		{[]byte{2, 0}, nil, 7},
+		{[]byte{7}, []byte{2}, 0},
+	} {
+		if n, err := tree.EstimateRange(test.Start, test.End); err != nil {
+			t.Fatalf("Error on 'EstimateRange': %v", err)
+		} else if n != test.Expected {
+			t.Errorf("Expected %d entries in range [%v, %v), got %d", test.Expected, test.Start, test.End, n)
+		}
 	}
 
 	generators := [...]Generator{
@@ -272,25 +666,1288 @@ func BenchmarkTree(b *testing.B) {
 		new(DescendingGenerator),
 		new(SawtoothGenerator),
 	}
+	for _, generator := range generators {
+		for _, opts := range [...]TreeOptions{{}, {PageSize: 1024}} {
+			generator.Reset()
+			tree, err := GetTreeAtWithOptions(new(MemoryPager), -1, opts)
+			if err != nil {
+				t.Fatalf("Failed to create new tree: %v", err)
+			}
 
-	for _, op := range ops {
-		b.Run(op.Name, func(b *testing.B) {
-			for _, generator := range generators {
-				generator.Reset()
-				b.Run(generator.String(), func(b *testing.B) {
-					b.Run("MemoryPager", func(b *testing.B) {
-						op.Func(b, generator, new(MemoryPager))
+			m := make(map[int]struct{})
+			for i := 0; i < N; i++ {
+				k := generator.Generate()
+
+				m[k] = struct{}{}
+				if err := tree.Set(int2Slice(k), ZeroValue); err != nil {
+					t.Fatalf("Error on 'Set': %v", err)
+				}
+			}
+			keys := make([][]byte, 0, len(m))
+			for k := range m {
+				keys = append(keys, int2Slice(k))
+			}
+			sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+
+			/* Estimates may be off as much as pages differ in how full they are. */
+			for _, r := range [...][2]int{{0, len(keys)}, {0, len(keys) / 2}, {len(keys) / 4, len(keys) / 2}, {len(keys) / 10, len(keys) * 9 / 10}, {len(keys) / 3, len(keys)/3 + 50}} {
+				start := keys[r[0]]
+				if r[0] == 0 {
+					start = nil
+				}
+				var end []byte
+				if r[1] < len(keys) {
+					end = keys[r[1]]
+				}
+
+				n, err := tree.EstimateRange(start, end)
+				if err != nil {
+					t.Fatalf("Error on 'EstimateRange': %v", err)
+				}
+				if expected := int64(r[1] - r[0]); (n < expected/2) || (n > expected*2) {
+					t.Errorf("Expected about %d entries in range [%d, %d) of tree with page size %d filled by %v, got %d", expected, r[0], r[1], opts.PageSize, generator, n)
+				}
+			}
+		}
+	}
+}
+
+func TestTreeUpgrade(t *testing.T) {
+	var pager MemoryPager
+
+	tree, err := GetTreeAtWithOptions(&pager, -1, TreeOptions{MaxOrder: 5})
+	if err != nil {
+		t.Fatalf("Failed to create new tree: %v", err)
+	}
+	tree.Meta.Features = TreeFeatureWideHeader
+
+	/* Every 10th value needs overflow pages, which have to be upgraded too. */
+	value := func(i int) []byte {
+		if i%10 == 0 {
+			return bytes.Repeat(int2Slice(i), PageSize/4)
+		}
+		return int2Slice(i)
+	}
+	for i := 0; i < N/2; i++ {
+		if err := tree.Set(int2Slice(i), value(i)); err != nil {
+			t.Fatalf("Error on 'Set': %v", err)
+		}
+	}
+	testTreeDowngradeV1(&pager)
+
+	tree, err = GetTreeAt(&pager, 0)
+	if err != nil {
+		t.Fatalf("Failed to open tree of version 1: %v", err)
+	}
+	if err := tree.Upgrade(); err != nil {
+		t.Fatalf("Failed to upgrade tree: %v", err)
+	}
+
+	tree, err = GetTreeAt(&pager, 0)
+	if err != nil {
+		t.Fatalf("Failed to open upgraded tree: %v", err)
+	}
+	if (tree.Meta.Version != TreeVersion) || (tree.Meta.Features != TreeFeaturesBytewise) {
+		t.Errorf("Expected upgraded tree to have version %d and features %#x, got %d and %#x", TreeVersion, TreeFeaturesBytewise, tree.Meta.Version, tree.Meta.Features)
+	}
+	for i := N / 2; i < N; i++ {
+		if err := tree.Set(int2Slice(i), value(i)); err != nil {
+			t.Fatalf("Error on 'Set': %v", err)
+		}
+	}
+	for i := 0; i < N; i++ {
+		got, err := tree.Get(int2Slice(i))
+		if err != nil {
+			t.Fatalf("Error on 'Get': %v", err)
+		} else if !bytes.Equal(got, value(i)) {
+			t.Errorf("Expected value %v, got %v", value(i), got)
+		}
+	}
+}
+
+func TestTreeUnsupported(t *testing.T) {
+	tests := [...]struct {
+		Name   string
+		Modify func(*Meta)
+	}{
+		{"Version0", func(meta *Meta) { meta.Version = 0 }},
+		{"NewerVersion", func(meta *Meta) { meta.Version = TreeVersion + 1 }},
+		{"UnknownFeature", func(meta *Meta) { meta.Features |= TreeFeaturesSupported + 1 }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			var pager MemoryPager
+
+			tree, err := GetTreeAt(&pager, -1)
+			if err != nil {
+				t.Fatalf("Failed to create new tree: %v", err)
+			}
+			test.Modify(pager.Pages[tree.MetaIndex].Meta())
+
+			if _, err := GetTreeAt(&pager, tree.MetaIndex); err == nil {
+				t.Errorf("Expected error on opening tree, got nothing")
+			}
+		})
+	}
+}
+
+func TestTreeValueLog(t *testing.T) {
+	var pager MemoryPager
+
+	dir := t.TempDir()
+	log, err := ValueLogOpen(dir)
+	if err != nil {
+		t.Fatalf("Failed to open value log: %v", err)
+	}
+	log.SegmentSize = 4 * PageSize
+
+	tree, err := GetTreeAtWithOptions(&pager, -1, TreeOptions{ValueThreshold: 64})
+	if err != nil {
+		t.Fatalf("Failed to create new tree: %v", err)
+	}
+	tree.ValueLog = log
+
+	/* Every other value goes to log, every third is overwritten, leaving garbage in log. */
+	value := func(i int, gen int) []byte {
+		if i%2 == 0 {
+			return bytes.Repeat(int2Slice(i+gen), 32)
+		}
+		return int2Slice(i + gen)
+	}
+	for gen := 0; gen < 2; gen++ {
+		for i := 0; i < N; i++ {
+			if (gen == 0) || (i%3 == 0) {
+				if err := tree.Set(int2Slice(i), value(i, gen)); err != nil {
+					t.Fatalf("Error on 'Set': %v", err)
+				}
+			}
+		}
+	}
+	expected := func(i int) []byte {
+		if i%3 == 0 {
+			return value(i, 1)
+		}
+		return value(i, 0)
+	}
+
+	segments := log.SegmentIDs()
+	if len(segments) < 2 {
+		t.Fatalf("Expected multiple value log segments, got %d", len(segments))
+	}
+	for _, segment := range segments[:len(segments)-1] {
+		if _, err := tree.CollectValueLog(segment); err != nil {
+			t.Fatalf("Failed to collect value log segment %d: %v", segment, err)
+		}
+	}
+	for _, segment := range segments[:len(segments)-1] {
+		if _, err := os.Stat(ValueLogSegmentPath(dir, segment)); !os.IsNotExist(err) {
+			t.Errorf("Expected segment %d to be removed, got %v", segment, err)
+		}
+	}
+	log.Close()
+
+	log, err = ValueLogOpen(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen value log: %v", err)
+	}
+	defer log.Close()
+
+	tree, err = GetTreeAt(&pager, 0)
+	if err != nil {
+		t.Fatalf("Failed to open tree: %v", err)
+	}
+	if _, err := tree.Get(int2Slice(0)); err == nil {
+		t.Errorf("Expected error on 'Get' without value log, got nothing")
+	}
+	tree.ValueLog = log
+
+	for i := 0; i < N; i++ {
+		got, err := tree.Get(int2Slice(i))
+		if err != nil {
+			t.Fatalf("Error on 'Get': %v", err)
+		} else if !bytes.Equal(got, expected(i)) {
+			t.Errorf("Expected value %v, got %v", expected(i), got)
+		}
+	}
+}
+
+/* countingPager counts calls to underlying pager. */
+type countingPager struct {
+	Pager
+	Reads  int
+	Writes int
+}
+
+func (p *countingPager) ReadPagesAt(pages []Page, index int64) (int64, error) {
+	p.Reads++
+	return p.Pager.ReadPagesAt(pages, index)
+}
+
+func (p *countingPager) WritePagesAt(pages []Page, index int64) (int64, error) {
+	p.Writes++
+	return p.Pager.WritePagesAt(pages, index)
+}
+
+/* failingPager fails writes of page 'Fail', if it is not zero. */
+type failingPager struct {
+	Pager
+	Fail int64
+}
+
+func (p *failingPager) WritePagesAt(pages []Page, index int64) (int64, error) {
+	if (p.Fail != 0) && (index == p.Fail) {
+		return -1, errors.New("injected write failure")
+	}
+	return p.Pager.WritePagesAt(pages, index)
+}
+
+func TestTreeExtents(t *testing.T) {
+	pager := countingPager{Pager: new(MemoryPager)}
+
+	tree, err := GetTreeAt(&pager, -1)
+	if err != nil {
+		t.Fatalf("Failed to create new tree: %v", err)
+	}
+	if err := tree.Set(int2Slice(0), ZeroValue); err != nil {
+		t.Fatalf("Error on 'Set': %v", err)
+	}
+
+	value := make([]byte, 10*PageSize+PageSize/2)
+	if _, err := rand.Read(value); err != nil {
+		t.Fatalf("Failed to generate value: %v", err)
+	}
+
+	/* One write for extent and one for leaf. */
+	pager.Reads, pager.Writes = 0, 0
+	if err := tree.Set(int2Slice(1), value); err != nil {
+		t.Fatalf("Error on 'Set': %v", err)
+	}
+	if pager.Writes != 2 {
+		t.Errorf("Expected 2 writes, got %d", pager.Writes)
+	}
+
+	/* One read for leaf and one for extent. */
+	pager.Reads, pager.Writes = 0, 0
+	got, err := tree.Get(int2Slice(1))
+	if err != nil {
+		t.Fatalf("Error on 'Get': %v", err)
+	} else if !bytes.Equal(got, value) {
+		t.Errorf("Expected value of length %d, got value of length %d", len(value), len(got))
+	}
+	if pager.Reads != 2 {
+		t.Errorf("Expected 2 reads, got %d", pager.Reads)
+	}
+
+	/* Pages of old value must stay allocated if leaf with new value fails to be written. */
+	failing := failingPager{Pager: &pager, Fail: tree.Meta.Root}
+	tree.Pager = &failing
+	if err := tree.Set(int2Slice(1), make([]byte, len(value))); err == nil {
+		t.Errorf("Expected error on writing leaf, got nothing")
+	}
+	failing.Fail = 0
+	if err := tree.Set(int2Slice(2), make([]byte, len(value))); err != nil {
+		t.Fatalf("Error on 'Set': %v", err)
+	}
+	if got, err := tree.Get(int2Slice(1)); err != nil {
+		t.Fatalf("Error on 'Get': %v", err)
+	} else if !bytes.Equal(got, value) {
+		t.Errorf("Expected old value to be intact after failed 'Set'")
+	}
+}
+
+func TestTreeGetAppend(t *testing.T) {
+	var pager MemoryPager
+
+	tree, err := GetTreeAt(&pager, -1)
+	if err != nil {
+		t.Fatalf("Failed to create new tree: %v", err)
+	}
+
+	value := func(i int) []byte {
+		if i%100 == 0 {
+			return bytes.Repeat(int2Slice(i), PageSize/4)
+		}
+		return int2Slice(i)
+	}
+	for i := 0; i < N/10; i++ {
+		if err := tree.Set(int2Slice(i), value(i)); err != nil {
+			t.Fatalf("Error on 'Set': %v", err)
+		}
+	}
+
+	prefix := []byte("prefix")
+	for i := 0; i < N/10; i++ {
+		got, err := tree.GetAppend(prefix, int2Slice(i))
+		if err != nil {
+			t.Fatalf("Error on 'GetAppend': %v", err)
+		} else if (!bytes.HasPrefix(got, prefix)) || (!bytes.Equal(got[len(prefix):], value(i))) {
+			t.Errorf("Expected value %v after prefix, got %v", value(i), got)
+		}
+
+		var called bool
+		if err := tree.View(int2Slice(i), func(v []byte) {
+			called = true
+			if !bytes.Equal(v, value(i)) {
+				t.Errorf("Expected value %v, got %v", value(i), v)
+			}
+		}); err != nil {
+			t.Fatalf("Error on 'View': %v", err)
+		} else if !called {
+			t.Errorf("Expected 'View' to call function for key %d", i)
+		}
+	}
+
+	if got, err := tree.GetAppend(prefix, int2Slice(N)); (err != nil) || (!bytes.Equal(got, prefix)) {
+		t.Errorf("Expected unchanged buffer for missing key, got %v, %v", got, err)
+	}
+	if err := tree.View(int2Slice(N), func([]byte) { t.Errorf("Expected no call for missing key") }); err != nil {
+		t.Fatalf("Error on 'View': %v", err)
+	}
+
+	key := int2Slice(1)
+	buffer := make([]byte, 0, 64)
+	if allocs := testing.AllocsPerRun(100, func() { buffer, _ = tree.GetAppend(buffer[:0], key) }); allocs > 0 {
+		t.Errorf("Expected no allocations in 'GetAppend', got %v", allocs)
+	}
+	if allocs := testing.AllocsPerRun(100, func() { _ = tree.View(key, func([]byte) {}) }); allocs > 0 {
+		t.Errorf("Expected no allocations in 'View', got %v", allocs)
+	}
+}
+
+func TestTreeMerge(t *testing.T) {
+	tests := [...]struct {
+		Name     string
+		Operator MergeOperator
+		Operands [][]byte
+		Expected []byte
+	}{
+		{"AddInt64", MergeAddInt64, [][]byte{int2Slice(1), int2Slice(2), int2Slice(-5)}, int2Slice(-2)},
+		{"MaxInt64", MergeMaxInt64, [][]byte{int2Slice(-3), int2Slice(7), int2Slice(2)}, int2Slice(7)},
+		{"Append", MergeAppend, [][]byte{[]byte("a"), []byte("bc"), []byte("d")}, []byte("abcd")},
+		{"SetUnion", MergeSetUnion, [][]byte{MergeSet([]byte("b"), []byte("a")), MergeSet([]byte("c"), []byte("a"))}, MergeSet([]byte("a"), []byte("b"), []byte("c"))},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			tree, err := GetTreeAt(new(MemoryPager), -1)
+			if err != nil {
+				t.Fatalf("Failed to create new tree: %v", err)
+			}
+			if err := tree.Merge(int2Slice(0), test.Operands[0]); err == nil {
+				t.Errorf("Expected error on 'Merge' without operator, got nothing")
+			}
+			tree.MergeOperator = test.Operator
+
+			for i := 0; i < N/10; i++ {
+				for _, operand := range test.Operands {
+					if err := tree.Merge(int2Slice(i), operand); err != nil {
+						t.Fatalf("Error on 'Merge': %v", err)
+					}
+				}
+			}
+			for i := 0; i < N/10; i++ {
+				got, err := tree.Get(int2Slice(i))
+				if err != nil {
+					t.Fatalf("Error on 'Get': %v", err)
+				} else if !bytes.Equal(got, test.Expected) {
+					t.Errorf("Expected value %v, got %v", test.Expected, got)
+				}
+			}
+		})
+	}
+
+	t.Run("Concurrent", func(t *testing.T) {
+		var wg sync.WaitGroup
+
+		const workers = 8
+
+		tree, err := GetTreeAt(new(MemoryPager), -1)
+		if err != nil {
+			t.Fatalf("Failed to create new tree: %v", err)
+		}
+		tree.MergeOperator = MergeAddInt64
+
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < N/10; i++ {
+					if err := tree.Merge(int2Slice(i%10), int2Slice(1)); err != nil {
+						t.Errorf("Error on 'Merge': %v", err)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		for i := 0; i < 10; i++ {
+			got, err := tree.Get(int2Slice(i))
+			if err != nil {
+				t.Fatalf("Error on 'Get': %v", err)
+			} else if slice2Int(got) != workers*N/100 {
+				t.Errorf("Expected counter %d, got %d", workers*N/100, slice2Int(got))
+			}
+		}
+	})
+}
+
+func TestTreeTTL(t *testing.T) {
+	var pager MemoryPager
+
+	tree, err := GetTreeAt(&pager, -1)
+	if err != nil {
+		t.Fatalf("Failed to create new tree: %v", err)
+	}
+	now := time.Unix(0, 0)
+	tree.Now = func() time.Time { return now }
+
+	/* Odd keys expire, every 10th value needs overflow pages, which must be reclaimed. */
+	value := func(i int) []byte {
+		if i%10 == 1 {
+			return bytes.Repeat(int2Slice(i), PageSize/4)
+		}
+		return int2Slice(i)
+	}
+	for i := 0; i < N/10; i++ {
+		if i%2 == 1 {
+			err = tree.SetWithTTL(int2Slice(i), value(i), time.Minute)
+		} else {
+			err = tree.Set(int2Slice(i), value(i))
+		}
+		if err != nil {
+			t.Fatalf("Error on 'Set': %v", err)
+		}
+	}
+
+	check := func(expired bool) {
+		t.Helper()
+
+		for i := 0; i < N/10; i++ {
+			live := (i%2 == 0) || (!expired)
+
+			got, err := tree.Get(int2Slice(i))
+			if err != nil {
+				t.Fatalf("Error on 'Get': %v", err)
+			} else if (live) && (!bytes.Equal(got, value(i))) {
+				t.Errorf("Expected value %v, got %v", value(i), got)
+			} else if (!live) && (got != nil) {
+				t.Errorf("Expected key %d to expire, got %v", i, got)
+			}
+
+			if ok, err := tree.Has(int2Slice(i)); err != nil {
+				t.Fatalf("Error on 'Has': %v", err)
+			} else if ok != live {
+				t.Errorf("Expected 'Has' for key %d to be %v, got %v", i, live, ok)
+			}
+		}
+
+		it, err := tree.Begin()
+		if err != nil {
+			t.Fatalf("Failed to create iterator: %v", err)
+		}
+		var count int
+		for it.Next() {
+			if k := slice2Int(it.Key()); (k%2 == 1) && (expired) {
+				t.Errorf("Expected iterator to skip expired key %d", k)
+			}
+			count++
+		}
+		expected := N / 10
+		if expired {
+			expected /= 2
+		}
+		if count != expected {
+			t.Errorf("Expected %d keys from iterator, got %d", expected, count)
+		}
+	}
+
+	check(false)
+	now = now.Add(time.Hour)
+	check(true)
+
+	pages := len(pager.Pages)
+	var deleted int
+	for {
+		n, err := tree.Sweep(10)
+		if err != nil {
+			t.Fatalf("Error on 'Sweep': %v", err)
+		}
+		deleted += n
+		if tree.SweepLeaf == 0 {
+			break
+		}
+	}
+	if deleted != N/10/2 {
+		t.Errorf("Expected %d expired values to be deleted, got %d", N/10/2, deleted)
+	}
+	if tree.Meta.FreeList == 0 {
+		t.Errorf("Expected overflow pages of expired values to be freed")
+	}
+	check(true)
+
+	/* Freed pages are reused before new ones are appended. */
+	for i := 1; i < N/10; i += 10 {
+		if err := tree.Set(int2Slice(i), value(i)); err != nil {
+			t.Fatalf("Error on 'Set': %v", err)
+		}
+	}
+	if len(pager.Pages) != pages {
+		t.Errorf("Expected %d pages after reusing freed ones, got %d", pages, len(pager.Pages))
+	}
+}
+
+func TestTreeDedup(t *testing.T) {
+	var pager MemoryPager
+
+	tree, err := GetTreeAtWithOptions(&pager, -1, TreeOptions{Dedup: true})
+	if err != nil {
+		t.Fatalf("Failed to create new tree: %v", err)
+	}
+
+	values := [...][]byte{
+		bytes.Repeat([]byte("attachment-1"), PageSize),
+		bytes.Repeat([]byte("attachment-2"), PageSize),
+	}
+	const keys = 100
+	for i := 0; i < keys; i++ {
+		if err := tree.Set(int2Slice(i), values[i%2]); err != nil {
+			t.Fatalf("Error on 'Set': %v", err)
+		}
+	}
+	value := values[0]
+	if err := tree.SetFrom(int2Slice(keys), bytes.NewReader(value), int64(len(value))); err != nil {
+		t.Fatalf("Error on 'SetFrom': %v", err)
+	}
+
+	/* Each value is stored once, the rest are leaves and nodes of both trees. */
+	if max := 2*len(values[0])/PageSize + 2*keys; len(pager.Pages) > max {
+		t.Errorf("Expected at most %d pages, got %d", max, len(pager.Pages))
+	}
+
+	tree, err = GetTreeAt(&pager, 0)
+	if err != nil {
+		t.Fatalf("Failed to open tree: %v", err)
+	}
+	for i := 0; i <= keys; i++ {
+		got, err := tree.Get(int2Slice(i))
+		if err != nil {
+			t.Fatalf("Error on 'Get': %v", err)
+		} else if !bytes.Equal(got, values[i%2]) {
+			t.Errorf("Expected value of key %d to be shared value %d", i, i%2)
+		}
+	}
+
+	/* Pages are freed only when the last reference is gone. Pages written by 'SetFrom' for duplicate are already free. */
+	free := tree.Meta.FreeList
+	for i := 1; i < keys; i += 2 {
+		if err := tree.Del(int2Slice(i)); err != nil {
+			t.Fatalf("Error on 'Del': %v", err)
+		}
+		if (i < keys-1) && (tree.Meta.FreeList != free) {
+			t.Fatalf("Expected no freed pages while value is referenced, got free list at %d", tree.Meta.FreeList)
+		}
+	}
+	if tree.Meta.FreeList == free {
+		t.Errorf("Expected pages of value without references to be freed")
+	}
+	for i := 0; i <= keys; i += 2 {
+		if err := tree.Set(int2Slice(i), int2Slice(i)); err != nil {
+			t.Fatalf("Error on 'Set': %v", err)
+		}
+	}
+	if got, err := tree.Get(int2Slice(keys - 1)); (err != nil) || (got != nil) {
+		t.Errorf("Expected deleted key to be missing, got %v, %v", got, err)
+	}
+
+	if _, refs, err := tree.findShared(sha256.Sum256(values[0])); (err != nil) || (refs != 0) {
+		t.Errorf("Expected no references to overwritten value, got %d, %v", refs, err)
+	}
+
+	/* Only extents are shared, so tree with chains of 'Overflow' pages can't deduplicate values. */
+	tree.Meta.Features &^= TreeFeatureExtents
+	tree.MetaDirty = true
+	if err := tree.writeMeta(); err != nil {
+		t.Fatalf("Failed to write meta: %v", err)
+	}
+	if _, err := GetTreeAt(&pager, 0); err == nil {
+		t.Errorf("Expected error on opening tree with dedup and without extents, got nothing")
+	}
+}
+
+func TestTreeOpen(t *testing.T) {
+	pager := countingPager{Pager: new(MemoryPager)}
+
+	log, err := ValueLogOpen(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to open value log: %v", err)
+	}
+	defer log.Close()
+
+	tree, err := GetTreeAtWithOptions(&pager, -1, TreeOptions{ValueThreshold: 200 * PageSize})
+	if err != nil {
+		t.Fatalf("Failed to create new tree: %v", err)
+	}
+	tree.ValueLog = log
+
+	/* Values are stored in leaf, in extent and in value log. */
+	values := [...][]byte{
+		make([]byte, 100),
+		make([]byte, 3*SetFromChunkPages*PageSize+PageSize/3),
+		make([]byte, 250*PageSize+1),
+	}
+	for i, value := range values {
+		if _, err := rand.Read(value); err != nil {
+			t.Fatalf("Failed to generate value: %v", err)
+		}
+		if err := tree.SetFrom(int2Slice(i), bytes.NewReader(value), int64(len(value))); err != nil {
+			t.Fatalf("Error on 'SetFrom': %v", err)
+		}
+	}
+	if err := tree.SetFrom(int2Slice(len(values)), bytes.NewReader(values[0]), int64(len(values[0]))+1); err == nil {
+		t.Errorf("Expected error on 'SetFrom' with short reader, got nothing")
+	}
+
+	for i, value := range values {
+		r, err := tree.Open(int2Slice(i))
+		if err != nil {
+			t.Fatalf("Error on 'Open': %v", err)
+		}
+		if r.Size() != int64(len(value)) {
+			t.Errorf("Expected size %d, got %d", len(value), r.Size())
+		}
+
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("Failed to read value: %v", err)
+		} else if !bytes.Equal(got, value) {
+			t.Errorf("Expected value of length %d, got value of length %d", len(value), len(got))
+		}
+
+		offset := int64(len(value)) / 2
+		if _, err := r.Seek(offset, io.SeekStart); err != nil {
+			t.Fatalf("Failed to seek: %v", err)
+		}
+		pager.Reads = 0
+		got = make([]byte, 10)
+		if _, err := io.ReadFull(r, got); err != nil {
+			t.Fatalf("Failed to read value after seek: %v", err)
+		} else if !bytes.Equal(got, value[offset:offset+10]) {
+			t.Errorf("Expected %v, got %v", value[offset:offset+10], got)
+		}
+		if pager.Reads > 1 {
+			t.Errorf("Expected at most 1 read, got %d", pager.Reads)
+		}
+	}
+
+	if r, err := tree.Open(int2Slice(len(values))); (err != nil) || (r != nil) {
+		t.Errorf("Expected no reader for missing key, got %v, %v", r, err)
+	}
+
+	/* Pages of value which failed to be read are put back to free list. */
+	value := values[1]
+	if err := tree.SetFrom(int2Slice(len(values)), bytes.NewReader(value[:len(value)-1]), int64(len(value))); err == nil {
+		t.Errorf("Expected error on 'SetFrom' with short reader, got nothing")
+	}
+	count := len(pager.Pager.(*MemoryPager).Pages)
+	if err := tree.SetFrom(int2Slice(len(values)), bytes.NewReader(value), int64(len(value))); err != nil {
+		t.Fatalf("Error on 'SetFrom': %v", err)
+	}
+	if n := len(pager.Pager.(*MemoryPager).Pages) - count; n > 2 {
+		t.Errorf("Expected pages of failed 'SetFrom' to be reused, got %d new pages", n)
+	}
+
+	/* Tree is not locked while value is read. */
+	unlocked := lockCheckingReader{Reader: bytes.NewReader(value), Tree: tree}
+	if err := tree.SetFrom(int2Slice(len(values)+1), &unlocked, int64(len(value))); err != nil {
+		t.Fatalf("Error on 'SetFrom': %v", err)
+	}
+	if unlocked.Locked {
+		t.Errorf("Expected tree to be unlocked while value is read")
+	}
+
+	/* Reader refuses to read pages of value which was replaced. */
+	r, err := tree.Open(int2Slice(1))
+	if err != nil {
+		t.Fatalf("Error on 'Open': %v", err)
+	}
+	if err := tree.Set(int2Slice(1), values[0]); err != nil {
+		t.Fatalf("Error on 'Set': %v", err)
+	}
+	if _, err := r.ReadAt(make([]byte, 10), 0); err != ErrValueChanged {
+		t.Errorf("Expected %v, got %v", ErrValueChanged, err)
+	}
+	testValueReaderReuse(t, tree)
+
+	/* Values in chains of 'Overflow' pages are read page by page. */
+	tree.Meta.Features &^= TreeFeatureExtents
+	value = make([]byte, 20*PageSize)
+	if _, err := rand.Read(value); err != nil {
+		t.Fatalf("Failed to generate value: %v", err)
+	}
+	if err := tree.Set(int2Slice(100), value); err != nil {
+		t.Fatalf("Error on 'Set': %v", err)
+	}
+	r, err = tree.Open(int2Slice(100))
+	if err != nil {
+		t.Fatalf("Error on 'Open': %v", err)
+	}
+	if len(r.Value) >= PageSize {
+		t.Errorf("Expected only part of value in leaf to be kept by reader, got %d bytes", len(r.Value))
+	}
+	for _, offset := range [...]int64{0, 10, PageSize - 5, int64(len(value)) / 2, int64(len(value)) - 10} {
+		pager.Reads = 0
+		got := make([]byte, 10)
+		if _, err := r.ReadAt(got, offset); err != nil {
+			t.Fatalf("Failed to read value at %d: %v", offset, err)
+		} else if !bytes.Equal(got, value[offset:offset+10]) {
+			t.Errorf("Expected %v at %d, got %v", value[offset:offset+10], offset, got)
+		}
+		if pager.Reads > 2 {
+			t.Errorf("Expected at most 2 reads at %d, got %d", offset, pager.Reads)
+		}
+	}
+	if got, err := io.ReadAll(r); err != nil {
+		t.Fatalf("Failed to read value: %v", err)
+	} else if !bytes.Equal(got, value) {
+		t.Errorf("Expected value of length %d, got value of length %d", len(value), len(got))
+	}
+	testValueReaderReuse(t, tree)
+
+	/* Values in value log can't be read after key is updated or they are moved. */
+	tree.Meta.ValueThreshold = PageSize
+	for i := 0; i < 2; i++ {
+		if err := tree.Set(int2Slice(200), value); err != nil {
+			t.Fatalf("Error on 'Set': %v", err)
+		}
+		r, err = tree.Open(int2Slice(200))
+		if err != nil {
+			t.Fatalf("Error on 'Open': %v", err)
+		}
+		if r.Type != ValueTypeLog {
+			t.Fatalf("Expected value in value log, got value of type %d", r.Type)
+		}
+		if i == 0 {
+			err = tree.Set(int2Slice(200), value)
+		} else {
+			err = log.Rotate()
+			if err == nil {
+				_, err = tree.CollectValueLog(log.SegmentIDs()[0])
+			}
+		}
+		if err != nil {
+			t.Fatalf("Failed to change value: %v", err)
+		}
+		if _, err := r.ReadAt(make([]byte, 10), 0); err != ErrValueChanged {
+			t.Errorf("Expected %v, got %v", ErrValueChanged, err)
+		}
+	}
+}
+
+/* testValueReaderReuse checks that reader notices its pages were reused for value, which is stored in the same pages, and that it keeps reading, when pages of other values are freed. */
+func testValueReaderReuse(t *testing.T, tree *Tree) {
+	t.Helper()
+
+	values := [...][]byte{bytes.Repeat([]byte{'A'}, 20000), bytes.Repeat([]byte{'B'}, 20000), bytes.Repeat([]byte{'C'}, 20000)}
+	if err := tree.Set(int2Slice(300), values[0]); err != nil {
+		t.Fatalf("Error on 'Set': %v", err)
+	}
+	r, err := tree.Open(int2Slice(300))
+	if err != nil {
+		t.Fatalf("Error on 'Open': %v", err)
+	}
+	if err := tree.Set(int2Slice(301), values[0]); err != nil {
+		t.Fatalf("Error on 'Set': %v", err)
+	}
+	if err := tree.Del(int2Slice(301)); err != nil {
+		t.Fatalf("Error on 'Del': %v", err)
+	}
+	got := make([]byte, 10)
+	if _, err := r.ReadAt(got, 10000); err != nil {
+		t.Errorf("Expected value to be read after other value is freed, got %v", err)
+	} else if !bytes.Equal(got, values[0][:10]) {
+		t.Errorf("Expected %q, got %q", values[0][:10], got)
+	}
+
+	for _, value := range values[1:] {
+		if err := tree.Set(int2Slice(300), value); err != nil {
+			t.Fatalf("Error on 'Set': %v", err)
+		}
+	}
+	if _, err := r.ReadAt(got, 10000); err != ErrValueChanged {
+		t.Errorf("Expected %v after pages of value are reused, got %v, %q", ErrValueChanged, err, got)
+	}
+}
+
+/* lockCheckingReader records whether 'Tree' was locked while it was read. */
+type lockCheckingReader struct {
+	io.Reader
+	Tree   *Tree
+	Locked bool
+}
+
+func (r *lockCheckingReader) Read(buf []byte) (int, error) {
+	if r.Tree.TryLock() {
+		r.Tree.Unlock()
+	} else {
+		r.Locked = true
+	}
+	return r.Reader.Read(buf)
+}
+
+func benchmarkTreeGet(b *testing.B, g Generator, pager Pager) {
+	b.Helper()
+
+	tree, err := GetTreeAt(pager, -1)
+	if err != nil {
+		b.Fatalf("Failed to create new tree: %v", err)
+	}
+
+	for i := 0; i < b.N; i++ {
+		_ = tree.Set(int2Slice(g.Generate()), ZeroValue)
+	}
+
+	g.Reset()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = tree.Get(int2Slice(g.Generate()))
+	}
+}
+
+func benchmarkTreeDel(b *testing.B, g Generator, pager Pager) {
+	b.Helper()
+
+	tree, err := GetTreeAt(pager, -1)
+	if err != nil {
+		b.Fatalf("Failed to create new tree: %v", err)
+	}
+
+	for i := 0; i < b.N; i++ {
+		_ = tree.Set(int2Slice(g.Generate()), ZeroValue)
+	}
+
+	g.Reset()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = tree.Del(int2Slice(g.Generate()))
+	}
+}
+
+func benchmarkTreeScan(b *testing.B, g Generator, pager Pager) {
+	b.Helper()
+
+	tree, err := GetTreeAt(pager, -1)
+	if err != nil {
+		b.Fatalf("Failed to create new tree: %v", err)
+	}
+
+	for i := 0; i < b.N; i++ {
+		_ = tree.Set(int2Slice(g.Generate()), ZeroValue)
+	}
+
+	b.ResetTimer()
+	it, err := tree.Begin()
+	if err != nil {
+		b.Fatalf("Failed to get iterator: %v", err)
+	}
+	for it.Next() {
+	}
+}
+
+func benchmarkTreeSet(b *testing.B, g Generator, pager Pager) {
+	b.Helper()
+
+	tree, err := GetTreeAt(pager, -1)
+	if err != nil {
+		b.Fatalf("Failed to create new tree: %v", err)
+	}
+
+	for i := 0; i < b.N; i++ {
+		_ = tree.Set(int2Slice(g.Generate()), ZeroValue)
+	}
+}
+
+func TestTreeComparator(t *testing.T) {
+	var pager MemoryPager
+
+	tree, err := GetTreeAtWithOptions(&pager, -1, TreeOptions{MaxOrder: 5, Comparator: NumericComparator})
+	if err != nil {
+		t.Fatalf("Failed to create new tree: %v", err)
+	}
+	if (tree.Meta.Features != TreeFeaturesComparator) || (tree.Meta.GetComparatorName() != NumericComparator.Name()) {
+		t.Fatalf("Expected features %#x and comparator %q, got %#x and %q", TreeFeaturesComparator, NumericComparator.Name(), tree.Meta.Features, tree.Meta.GetComparatorName())
+	}
+
+	/* NOTE(anton2920): keys are inserted out of order, so that every split promotes keys of both orders. */
+	for j := 0; j < N; j++ {
+		i := (j * 7919) % N
+		key := []byte(fmt.Sprintf("item%d", i))
+		if err := tree.Set(key, key); err != nil {
+			t.Fatalf("Error on 'Set': %v", err)
+		}
+	}
+
+	tree, err = GetTreeAtWithOptions(&pager, tree.MetaIndex, TreeOptions{Comparator: NumericComparator})
+	if err != nil {
+		t.Fatalf("Failed to open tree: %v", err)
+	}
+	it, err := tree.Begin()
+	if err != nil {
+		t.Fatalf("Failed to create iterator: %v", err)
+	}
+	var i int
+	for it.Next() {
+		if expected := fmt.Sprintf("item%d", i); string(it.Key()) != expected {
+			t.Fatalf("Expected key %q at %d, got %q", expected, i, it.Key())
+		}
+		i++
+	}
+	if i != N {
+		t.Errorf("Expected %d keys, got %d", N, i)
+	}
+	if got, err := tree.Get([]byte("item0042")); err != nil {
+		t.Fatalf("Error on 'Get': %v", err)
+	} else if got != nil {
+		t.Errorf("Expected no value for key with leading zeroes, got %q", got)
+	}
+
+	for _, opts := range [...]TreeOptions{{}, {Comparator: CaseInsensitiveComparator}} {
+		if _, err := GetTreeAtWithOptions(&pager, tree.MetaIndex, opts); err == nil {
+			t.Errorf("Expected error on opening tree with comparator %v, got nothing", opts.Comparator)
+		}
+	}
+
+	var bytewise MemoryPager
+	tree, err = GetTreeAt(&bytewise, -1)
+	if err != nil {
+		t.Fatalf("Failed to create new tree: %v", err)
+	}
+	if _, err := GetTreeAtWithOptions(&bytewise, tree.MetaIndex, TreeOptions{Comparator: NumericComparator}); err == nil {
+		t.Errorf("Expected error on opening bytewise tree with comparator, got nothing")
+	}
+}
+
+func TestTreeMulti(t *testing.T) {
+	var pager MemoryPager
+
+	tree, err := GetTreeAtWithOptions(&pager, -1, TreeOptions{MaxOrder: 5, Multi: true})
+	if err != nil {
+		t.Fatalf("Failed to create new tree: %v", err)
+	}
+
+	/* NOTE(anton2920): key "a" has more values than fit into one leaf, "a\x00" and "" sort right next to it. */
+	keys := [...]string{"a", "a\x00", "", "b"}
+	expected := make(map[string][]string)
+	for i := 0; i < 1000; i++ {
+		key := keys[i%len(keys)]
+		if i%5 != 0 {
+			key = "a"
+		}
+		value := fmt.Sprintf("value%d", i%100)
+		if err := tree.Add([]byte(key), []byte(value)); err != nil {
+			t.Fatalf("Error on 'Add': %v", err)
+		}
+		expected[key] = append(expected[key], value)
+	}
+
+	check := func(tree *Tree) {
+		t.Helper()
+		for _, key := range keys {
+			it, err := tree.GetAll([]byte(key))
+			if err != nil {
+				t.Fatalf("Error on 'GetAll': %v", err)
+			}
+			var got []string
+			for it.Next() {
+				value, err := it.Value()
+				if err != nil {
+					t.Fatalf("Failed to get value: %v", err)
+				}
+				got = append(got, string(value))
+			}
+			if fmt.Sprint(got) != fmt.Sprint(expected[key]) {
+				t.Errorf("Expected values %v of key %q, got %v", expected[key], key, got)
+			}
+		}
+	}
+	check(tree)
+
+	removed, err := tree.Remove([]byte("a"), []byte("value1"))
+	if err != nil {
+		t.Fatalf("Error on 'Remove': %v", err)
+	}
+	var left []string
+	for _, value := range expected["a"] {
+		if value != "value1" {
+			left = append(left, value)
+		}
+	}
+	if removed != len(expected["a"])-len(left) {
+		t.Errorf("Expected %d values to be removed, got %d", len(expected["a"])-len(left), removed)
+	}
+	expected["a"] = left
+
+	tree, err = GetTreeAt(&pager, tree.MetaIndex)
+	if err != nil {
+		t.Fatalf("Failed to open tree: %v", err)
+	}
+	check(tree)
+
+	if err := tree.Add([]byte("b"), []byte("last")); err != nil {
+		t.Fatalf("Error on 'Add': %v", err)
+	}
+	expected["b"] = append(expected["b"], "last")
+	check(tree)
+
+	if _, err := GetTreeAtWithOptions(&pager, -1, TreeOptions{Multi: true, Comparator: NumericComparator}); err == nil {
+		t.Errorf("Expected error on creating multimap tree with comparator, got nothing")
+	}
+	tree, err = GetTreeAt(&pager, -1)
+	if err != nil {
+		t.Fatalf("Failed to create new tree: %v", err)
+	}
+	if err := tree.Add([]byte("a"), []byte("b")); err == nil {
+		t.Errorf("Expected error on 'Add' to regular tree, got nothing")
+	}
+
+	/* NOTE(anton2920): chains of 'Overflow' pages are read through page of iterator, which must be as large as pages of tree. */
+	tree, err = GetTreeAtWithOptions(&pager, -1, TreeOptions{PageSize: MaxPageSize, Multi: true})
+	if err != nil {
+		t.Fatalf("Failed to create new tree: %v", err)
+	}
+	tree.Meta.Features &^= TreeFeatureExtents
+	large := bytes.Repeat([]byte("large"), MaxPageSize)
+	if err := tree.Add([]byte("a"), large); err != nil {
+		t.Fatalf("Error on 'Add': %v", err)
+	}
+	it, err := tree.GetAll([]byte("a"))
+	if err != nil {
+		t.Fatalf("Error on 'GetAll': %v", err)
+	}
+	if !it.Next() {
+		t.Fatalf("Expected value of key %q, got nothing", "a")
+	}
+	if value, err := it.Value(); err != nil {
+		t.Errorf("Failed to get value: %v", err)
+	} else if !bytes.Equal(value, large) {
+		t.Errorf("Expected value of %d bytes, got %d bytes", len(large), len(value))
+	}
+}
+
+func TestTreeIndex(t *testing.T) {
+	var pager MemoryPager
+	var now time.Time
+
+	/* Values are "city:name", values without city are not indexed. */
+	city := func(value []byte) []byte {
+		if n := bytes.IndexByte(value, ':'); n >= 0 {
+			return value[:n]
+		}
+		return nil
+	}
+
+	tree, err := GetTreeAtWithOptions(&pager, -1, TreeOptions{MaxOrder: 5})
+	if err != nil {
+		t.Fatalf("Failed to create new tree: %v", err)
+	}
+	tree.Now = func() time.Time { return now }
+
+	expected := make(map[string]string)
+	set := func(key string, value string) {
+		t.Helper()
+		if err := tree.Set([]byte(key), []byte(value)); err != nil {
+			t.Fatalf("Error on 'Set': %v", err)
+		}
+		expected[key] = value
+	}
+	check := func(tree *Tree) {
+		t.Helper()
+
+		var want []string
+		for key, value := range expected {
+			if c := city([]byte(value)); c != nil {
+				want = append(want, fmt.Sprintf("%s/%s=%s", c, key, value))
+			}
+		}
+		sort.Strings(want)
+
+		it, err := tree.Index("city").Seek(nil)
+		if err != nil {
+			t.Fatalf("Failed to seek index: %v", err)
+		}
+		var got []string
+		for it.Next() {
+			got = append(got, fmt.Sprintf("%s/%s=%s", it.IndexKey(), it.Key(), it.Value()))
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("Expected index entries %v, got %v", want, got)
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		set(fmt.Sprintf("user%03d", i), fmt.Sprintf("city%d:name%d", i%7, i))
+	}
+	if _, err := tree.CreateIndex("city", city); err != nil {
+		t.Fatalf("Failed to create index: %v", err)
+	}
+	check(tree)
+
+	for i := 0; i < 100; i += 3 {
+		set(fmt.Sprintf("user%03d", i), fmt.Sprintf("city%d:moved%d", i%5, i))
+	}
+	set("user001", "nowhere")
+	set("user200", "city1:new")
+	for i := 0; i < 100; i += 10 {
+		key := fmt.Sprintf("user%03d", i)
+		if err := tree.Del([]byte(key)); err != nil {
+			t.Fatalf("Error on 'Del': %v", err)
+		}
+		delete(expected, key)
+	}
+	if err := tree.SetWithTTL([]byte("user300"), []byte("city0:temporary"), time.Second); err != nil {
+		t.Fatalf("Error on 'SetWithTTL': %v", err)
+	}
+	expected["user300"] = "city0:temporary"
+	check(tree)
+
+	it, err := tree.Index("city").Seek([]byte("city6"))
+	if err != nil {
+		t.Fatalf("Failed to seek index: %v", err)
+	}
+	if (!it.Next()) || (string(it.IndexKey()) != "city6") {
+		t.Errorf("Expected iterator to start at %q, got %q", "city6", it.IndexKey())
+	}
+
+	now = now.Add(time.Minute)
+	delete(expected, "user300")
+	check(tree)
+	if _, err := tree.Sweep(1 << 20); err != nil {
+		t.Fatalf("Error on 'Sweep': %v", err)
+	}
+	if ok, err := tree.Index("city").Has(indexEntryKey([]byte("city0"), []byte("user300"))); (err != nil) || (ok) {
+		t.Errorf("Expected swept value to be removed from index, got %v, %v", ok, err)
+	}
+
+	tree, err = GetTreeAt(&pager, tree.MetaIndex)
+	if err != nil {
+		t.Fatalf("Failed to open tree: %v", err)
+	}
+	if err := tree.Set([]byte("user002"), []byte("city3:early")); err == nil {
+		t.Errorf("Expected error on 'Set' before index is defined, got nothing")
+	}
+	if _, err := tree.CreateIndex("city", city); err != nil {
+		t.Fatalf("Failed to open index: %v", err)
+	}
+	check(tree)
+	if _, err := tree.CreateIndex("city", city); err == nil {
+		t.Errorf("Expected error on defining index twice, got nothing")
+	}
+
+	set("user002", "city3:again")
+	check(tree)
+
+	/* Index must not change if leaf of primary tree fails to be written. */
+	failing := failingPager{Pager: new(MemoryPager)}
+	tree, err = GetTreeAt(&failing, -1)
+	if err != nil {
+		t.Fatalf("Failed to create new tree: %v", err)
+	}
+	if _, err := tree.CreateIndex("city", city); err != nil {
+		t.Fatalf("Failed to create index: %v", err)
+	}
+	expected = make(map[string]string)
+	set("user000", "city0:name0")
+	failing.Fail = tree.Meta.Root
+	if err := tree.Set([]byte("user000"), []byte("city1:name0")); err == nil {
+		t.Errorf("Expected error on writing leaf, got nothing")
+	}
+	failing.Fail = 0
+	check(tree)
+
+	/* Pages of old value are freed, even if index fails to be written after leaf. */
+	if err := tree.Set([]byte("user000"), bytes.Repeat([]byte("city0:"), PageSize)); err != nil {
+		t.Fatalf("Error on 'Set': %v", err)
+	}
+	freed := tree.Freed
+	failing.Fail = tree.Index("city").Meta.Root
+	if err := tree.Set([]byte("user000"), []byte("city1:name0")); err == nil {
+		t.Errorf("Expected error on writing index, got nothing")
+	}
+	failing.Fail = 0
+	if tree.Freed == freed {
+		t.Errorf("Expected pages of old value to be freed")
+	}
+}
+
+func TestComparators(t *testing.T) {
+	tests := [...]struct {
+		Comparator Comparator
+		Keys       []string
+	}{
+		{CaseInsensitiveComparator, []string{"", "[", "_", "A", "ab", "AC", "b"}},
+		{NumericComparator, []string{"", "01", "1", "2", "10", "a", "a1b", "a01c", "a2", "a10", "a10b", "b"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Comparator.Name(), func(t *testing.T) {
+			for i := 0; i < len(test.Keys); i++ {
+				for j := 0; j < len(test.Keys); j++ {
+					res := test.Comparator.Compare([]byte(test.Keys[i]), []byte(test.Keys[j]))
+					if ((i < j) && (res >= 0)) || ((i == j) && (res != 0)) || ((i > j) && (res <= 0)) {
+						t.Errorf("Unexpected result %d of comparing %q and %q", res, test.Keys[i], test.Keys[j])
+					}
+				}
+			}
+		})
+	}
+	if res := CaseInsensitiveComparator.Compare([]byte("Key"), []byte("kEY")); res != 0 {
+		t.Errorf("Expected keys to be equal, got %d", res)
+	}
+}
+
+func BenchmarkTree(b *testing.B) {
+	ops := [...]struct {
+		Name string
+		Func func(*testing.B, Generator, Pager)
+	}{
+		{"Get", benchmarkTreeGet},
+		//	{"Del", benchmarkTreeDel},
+		{"Scan", benchmarkTreeScan},
+		{"Set", benchmarkTreeSet},
+	}
+
+	generators := [...]Generator{
+		new(RandomGenerator),
+		new(AscendingGenerator),
+		new(DescendingGenerator),
+		new(SawtoothGenerator),
+	}
+
+	for _, op := range ops {
+		b.Run(op.Name, func(b *testing.B) {
+			for _, generator := range generators {
+				generator.Reset()
+				b.Run(generator.String(), func(b *testing.B) {
+					b.Run("MemoryPager", func(b *testing.B) {
+						op.Func(b, generator, new(MemoryPager))
+					})
+					b.Run("FilePager", func(b *testing.B) {
+						filePager, err := FilePagerNew(filepath.Join(b.TempDir(), generator.String()+"_test.tree"))
+						if err != nil {
+							b.Fatalf("Failed to create new file pager: %v", err)
+						}
+						defer filePager.Close()
+						op.Func(b, generator, filePager)
+					})
+					b.Run("ReadAheadFilePager", func(b *testing.B) {
+						filePager, err := FilePagerNew(filepath.Join(b.TempDir(), generator.String()+"_test.tree"))
+						if err != nil {
+							b.Fatalf("Failed to create new file pager: %v", err)
+						}
+						defer filePager.Close()
+						op.Func(b, generator, &ReadAheadPager{Pager: filePager})
 					})
-					/*
-						b.Run("FilePager", func(b *testing.B) {
-							filePager, err := FilePagerNew(generator.String() + "_test.tree")
-							if err != nil {
-								b.Fatalf("Failed to create new file pager: %v", err)
-							}
-							defer filePager.Close()
-							op.Func(b, generator, filePager)
-						})
-					*/
 				})
 			}
 		})
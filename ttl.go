@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/anton2920/gofa/errors"
+	"github.com/anton2920/gofa/trace"
+)
+
+/* SetWithTTL inserts or updates value for 'key', which expires after 'ttl', and commits the change. Expired values are hidden from 'Get', 'Has' and iterators and are deleted by 'Sweep'. */
+func (t *Tree) SetWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	defer trace.End(trace.Begin(""))
+
+	if !t.Meta.HasFeature(TreeFeatureTTL) {
+		return errors.New("tree does not support values with TTL, upgrade it first")
+	}
+
+	t.Lock()
+	expiry := t.now() + int64(ttl)
+	err := t.update(key, func(leaf *Leaf, old []byte) (EncodedValue, []byte, error) {
+		v, err := t.encodeValue(leaf, key, value, TTLValueLen())
+		if err != nil {
+			return EncodedValue{}, nil, err
+		}
+		return EncodeTTL(v, expiry), value, nil
+	})
+	if err == nil {
+		err = t.writeMeta()
+	}
+	t.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return t.sync()
+}
+
+/* Sweep deletes expired values from at most 'leaves' leaves and commits the change. Each call continues from the leaf previous one stopped at and wraps around after the last leaf, so calling it periodically eventually reclaims pages of all expired values. It returns number of deleted values. */
+func (t *Tree) Sweep(leaves int) (int, error) {
+	defer trace.End(trace.Begin(""))
+
+	t.Lock()
+	deleted, err := t.sweep(leaves)
+	if err == nil {
+		err = t.writeMeta()
+	}
+	t.Unlock()
+	if err != nil {
+		return deleted, err
+	}
+
+	return deleted, t.sync()
+}
+
+func (t *Tree) sweep(leaves int) (int, error) {
+	if err := t.checkIndexes(); err != nil {
+		return 0, err
+	}
+
+	page := t.NewPage()
+	var deleted int
+
+	index := t.SweepLeaf
+	if index == 0 {
+		for index = t.Meta.Root; ; {
+			if _, err := t.ReadPageAt(page, index); err != nil {
+				return 0, fmt.Errorf("failed to read page: %v", err)
+			}
+			if page.Type() != PageTypeNode {
+				break
+			}
+			index = page.Node().GetChildAt(-1)
+		}
+	}
+
+	now := t.now()
+	for i := 0; (i < leaves) && (index != t.Meta.EndSentinel); i++ {
+		if _, err := t.ReadPageAt(page, index); err != nil {
+			return deleted, fmt.Errorf("failed to read page: %v", err)
+		}
+		leaf := page.Leaf()
+
+		var values [][]byte
+		var changes []indexChange
+		n := deleted
+		for j := int(leaf.N) - 1; j >= 0; j-- {
+			if v := leaf.GetValueAt(j); ValueExpired(v, now) {
+				value := append([]byte{}, v...)
+				c, err := t.indexChanges(leaf.AppendKeyAt(nil, j), value, nil, nil)
+				if err != nil {
+					return n, err
+				}
+				values = append(values, value)
+				changes = append(changes, c...)
+				leaf.DeleteAt(j)
+				deleted++
+			}
+		}
+		if deleted > n {
+			if _, err := t.WritePageAt(page, index); err != nil {
+				return n, fmt.Errorf("failed to write updated leaf: %v", err)
+			}
+		}
+		err := t.updateIndexes(changes)
+		for _, value := range values {
+			if err := t.freeValue(value); err != nil {
+				return deleted, fmt.Errorf("failed to free value: %v", err)
+			}
+		}
+		if err != nil {
+			return deleted, err
+		}
+
+		index = leaf.Next
+	}
+
+	if index == t.Meta.EndSentinel {
+		index = 0
+	}
+	t.SweepLeaf = index
+
+	return deleted, nil
+}
+
+/* ValueExpired returns whether value tagged with its 'ValueType' has expired at 'now'. */
+func ValueExpired(v []byte, now int64) bool {
+	if ValueGetType(v) != ValueTypeTTL {
+		return false
+	}
+	expiry, _ := ValueGetTTL(v)
+	return expiry <= now
+}
+
+/* liveValue returns value tagged with its 'ValueType' without expiry or nil, if it has expired. */
+func (t *Tree) liveValue(v []byte) []byte {
+	if (v == nil) || (ValueGetType(v) != ValueTypeTTL) {
+		return v
+	}
+	expiry, v := ValueGetTTL(v)
+	if expiry <= t.now() {
+		return nil
+	}
+	return v
+}
+
+/* now returns current time in nanoseconds since Unix epoch. */
+func (t *Tree) now() int64 {
+	if t.Now != nil {
+		return t.Now().UnixNano()
+	}
+	return time.Now().UnixNano()
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/anton2920/gofa/trace"
+)
+
+/* Upgrade rewrites all pages of tree in place in layout of 'TreeVersion', so that tree can use all features supported by this build. Meta is written last, but upgrade is not atomic: tree interrupted in the middle must be restored from a copy. */
+func (t *Tree) Upgrade() error {
+	defer trace.End(trace.Begin(""))
+
+	t.Lock()
+	defer t.Unlock()
+
+	if (t.Meta.Version == TreeVersion) && (t.Meta.Features == t.Meta.LatestFeatures()) {
+		return nil
+	}
+
+	/* NOTE(anton2920): pages are read in format of 'old' and written in format of 't'. */
+	old := Tree{Pager: t.Pager, Meta: t.Meta}
+	t.Meta.Version = TreeVersion
+	t.Meta.Features = t.Meta.LatestFeatures()
+
+	for _, index := range [...]int64{t.Meta.Root, t.Meta.EndSentinel} {
+		if err := t.upgradePage(&old, index); err != nil {
+			t.Meta = old.Meta
+			return fmt.Errorf("failed to upgrade tree from version %d: %v", old.Meta.Version, err)
+		}
+	}
+	if err := t.upgradeFreeList(&old); err != nil {
+		t.Meta = old.Meta
+		return fmt.Errorf("failed to upgrade tree from version %d: %v", old.Meta.Version, err)
+	}
+
+	if t.Meta.DedupMeta != 0 {
+		dedup, err := t.dedupTree()
+		if err == nil {
+			err = dedup.Upgrade()
+		}
+		if err != nil {
+			t.Meta = old.Meta
+			return fmt.Errorf("failed to upgrade dedup tree: %v", err)
+		}
+	}
+	if t.Meta.IndexCatalog != 0 {
+		if err := t.upgradeIndexes(); err != nil {
+			t.Meta = old.Meta
+			return fmt.Errorf("failed to upgrade indexes: %v", err)
+		}
+	}
+
+	t.MetaDirty = true
+	if err := t.writeMeta(); err != nil {
+		t.Meta = old.Meta
+		return err
+	}
+	return t.sync()
+}
+
+func (t *Tree) upgradePage(old *Tree, index int64) error {
+	page := t.NewPage()
+
+	if _, err := old.ReadPageAt(page, index); err != nil {
+		return fmt.Errorf("failed to read page: %v", err)
+	}
+
+	switch page.Type() {
+	case PageTypeNode:
+		node := page.Node()
+		for i := -1; i < int(node.N); i++ {
+			if err := t.upgradePage(old, node.GetChildAt(i)); err != nil {
+				return err
+			}
+		}
+		if t.Meta.HasFeature(TreeFeaturePrefix) {
+			node.Compact()
+		}
+	case PageTypeLeaf:
+		leaf := page.Leaf()
+		for i := 0; i < int(leaf.N); i++ {
+			if value := leaf.GetValueAt(i); ValueGetType(value) == ValueTypePartial {
+				if err := t.upgradeOverflow(old, ValueGetNext(value)); err != nil {
+					return err
+				}
+			}
+		}
+		if t.Meta.HasFeature(TreeFeaturePrefix) {
+			leaf.Compact()
+		}
+	}
+
+	if _, err := t.WritePageAt(page, index); err != nil {
+		return fmt.Errorf("failed to write upgraded page: %v", err)
+	}
+	return nil
+}
+
+func (t *Tree) upgradeOverflow(old *Tree, next int64) error {
+	page := t.NewPage()
+
+	for next != 0 {
+		if _, err := old.ReadPageAt(page, next); err != nil {
+			return fmt.Errorf("failed to read overflow: %v", err)
+		}
+		index := next
+		next = page.Overflow().Next
+
+		if _, err := t.WritePageAt(page, index); err != nil {
+			return fmt.Errorf("failed to write upgraded overflow: %v", err)
+		}
+	}
+	return nil
+}
+
+func (t *Tree) upgradeFreeList(old *Tree) error {
+	page := t.NewPage()
+
+	next := t.Meta.FreeList
+	for next != 0 {
+		if _, err := old.ReadPageAt(page, next); err != nil {
+			return fmt.Errorf("failed to read free page: %v", err)
+		}
+		index := next
+		next = page.Free().Next
+
+		if _, err := t.WritePageAt(page, index); err != nil {
+			return fmt.Errorf("failed to write upgraded free page: %v", err)
+		}
+	}
+	return nil
+}
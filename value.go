@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/sha256"
 	"encoding/binary"
 	"unsafe"
 )
@@ -11,25 +12,123 @@ const (
 	ValueTypeNone = ValueType(iota)
 	ValueTypeFull
 	ValueTypePartial
+
+	/* ValueTypeLog is a pointer to value stored in 'ValueLog': | type | segment (8 bytes) | offset (8 bytes) | length (8 bytes) |. */
+	ValueTypeLog
+
+	/* ValueTypeExtent is a value stored in run of contiguous pages: | type | first page (8 bytes) | length (8 bytes) |. */
+	ValueTypeExtent
+
+	/* ValueTypeTTL is a value which expires at given time: | type | expiry in nanoseconds since Unix epoch (8 bytes) | value tagged with its own type |. */
+	ValueTypeTTL
+
+	/* ValueTypeShared is a value which pages are shared by all keys with the same value: | type | SHA-256 of value (32 bytes) | value tagged with its own type |. */
+	ValueTypeShared
 )
 
-func FullValue(value []byte) []byte {
-	buffer := make([]byte, len(value)+int(unsafe.Sizeof(ValueTypeFull)))
-	buffer[0] = byte(ValueTypeFull)
-	copy(buffer[unsafe.Sizeof(ValueTypeFull):], value)
+/* EncodedValue is a value tagged with its 'ValueType', which is put into leaf without building tagged copy first: | header | data |. Header holds tag and fixed-size fields of value's type. */
+type EncodedValue struct {
+	Header       [EncodedValueMaxHeaderSize]byte
+	HeaderLength int
+	Data         []byte
+}
+
+/* EncodedValueMaxHeaderSize fits the longest chain of headers: TTL, shared value and extent. */
+const EncodedValueMaxHeaderSize = (1 + 8) + (1 + ValueHashSize) + (1 + 3*8)
+
+const ValueHashSize = sha256.Size
+
+/* EncodeRaw returns 'value', which is already tagged with its 'ValueType'. */
+func EncodeRaw(value []byte) EncodedValue {
+	return EncodedValue{Data: value}
+}
+
+func EncodeFull(value []byte) EncodedValue {
+	var v EncodedValue
+	v.Header[0] = byte(ValueTypeFull)
+	v.HeaderLength = int(unsafe.Sizeof(ValueTypeFull))
+	v.Data = value
+	return v
+}
+
+func EncodePartial(value []byte, next int64) EncodedValue {
+	var v EncodedValue
+	v.Header[0] = byte(ValueTypePartial)
+	binary.LittleEndian.PutUint64(v.Header[unsafe.Sizeof(ValueTypePartial):], uint64(next))
+	v.HeaderLength = int(unsafe.Sizeof(ValueTypePartial)) + int(unsafe.Sizeof(next))
+	v.Data = value
+	return v
+}
+
+func EncodeLog(ptr ValueLogPointer) EncodedValue {
+	var v EncodedValue
+	v.Header[0] = byte(ValueTypeLog)
+	binary.LittleEndian.PutUint64(v.Header[unsafe.Sizeof(ValueTypeLog):], uint64(ptr.Segment))
+	binary.LittleEndian.PutUint64(v.Header[unsafe.Sizeof(ValueTypeLog)+8:], uint64(ptr.Offset))
+	binary.LittleEndian.PutUint64(v.Header[unsafe.Sizeof(ValueTypeLog)+16:], uint64(ptr.Length))
+	v.HeaderLength = int(unsafe.Sizeof(ValueTypeLog)) + int(unsafe.Sizeof(ptr))
+	return v
+}
+
+func EncodeExtent(index int64, length int64) EncodedValue {
+	var v EncodedValue
+	v.Header[0] = byte(ValueTypeExtent)
+	binary.LittleEndian.PutUint64(v.Header[unsafe.Sizeof(ValueTypeExtent):], uint64(index))
+	binary.LittleEndian.PutUint64(v.Header[unsafe.Sizeof(ValueTypeExtent)+8:], uint64(length))
+	v.HeaderLength = int(unsafe.Sizeof(ValueTypeExtent)) + 2*int(unsafe.Sizeof(int64(0)))
+	return v
+}
+
+/* EncodeTTL wraps 'value' into value which expires at 'expiry'. */
+func EncodeTTL(value EncodedValue, expiry int64) EncodedValue {
+	var v EncodedValue
+	v.Header[0] = byte(ValueTypeTTL)
+	binary.LittleEndian.PutUint64(v.Header[unsafe.Sizeof(ValueTypeTTL):], uint64(expiry))
+	v.HeaderLength = int(unsafe.Sizeof(ValueTypeTTL)) + int(unsafe.Sizeof(expiry))
+	v.HeaderLength += copy(v.Header[v.HeaderLength:], value.Header[:value.HeaderLength])
+	v.Data = value.Data
+	return v
+}
+
+/* EncodeShared wraps 'value' into value which pages are shared by all values with 'hash'. */
+func EncodeShared(value EncodedValue, hash [ValueHashSize]byte) EncodedValue {
+	var v EncodedValue
+	v.Header[0] = byte(ValueTypeShared)
+	copy(v.Header[unsafe.Sizeof(ValueTypeShared):], hash[:])
+	v.HeaderLength = SharedValueLen()
+	v.HeaderLength += copy(v.Header[v.HeaderLength:], value.Header[:value.HeaderLength])
+	v.Data = value.Data
+	return v
+}
+
+/* Len returns number of bytes value takes in leaf. */
+func (v *EncodedValue) Len() int {
+	return v.HeaderLength + len(v.Data)
+}
+
+/* Put writes value to the beginning of 'buf'. */
+func (v *EncodedValue) Put(buf []byte) {
+	copy(buf[copy(buf, v.Header[:v.HeaderLength]):], v.Data)
+}
+
+func (v *EncodedValue) Bytes() []byte {
+	buffer := make([]byte, v.Len())
+	v.Put(buffer)
 	return buffer
 }
 
+func FullValue(value []byte) []byte {
+	v := EncodeFull(value)
+	return v.Bytes()
+}
+
 func FullValueLen(value []byte) int {
 	return len(value) + int(unsafe.Sizeof(ValueTypeFull))
 }
 
 func PartialValue(value []byte, next int64) []byte {
-	buffer := make([]byte, len(value)+int(unsafe.Sizeof(ValueTypePartial))+int(unsafe.Sizeof(next)))
-	buffer[0] = byte(ValueTypePartial)
-	binary.LittleEndian.PutUint64(buffer[unsafe.Sizeof(ValueTypePartial):], uint64(next))
-	copy(buffer[unsafe.Sizeof(ValueTypePartial)+unsafe.Sizeof(next):], value)
-	return buffer
+	v := EncodePartial(value, next)
+	return v.Bytes()
 }
 
 func PartialValueLen(value []byte) int {
@@ -52,6 +151,48 @@ func ValueGetPartial(value []byte) ([]byte, int64) {
 	return value[unsafe.Sizeof(ValueTypePartial)+unsafe.Sizeof(int64(0)):], ValueGetNext(value)
 }
 
+func LogValue(ptr ValueLogPointer) []byte {
+	v := EncodeLog(ptr)
+	return v.Bytes()
+}
+
+func ValueGetLog(value []byte) ValueLogPointer {
+	var ptr ValueLogPointer
+	ptr.Segment = int64(binary.LittleEndian.Uint64(value[unsafe.Sizeof(ValueTypeLog):]))
+	ptr.Offset = int64(binary.LittleEndian.Uint64(value[unsafe.Sizeof(ValueTypeLog)+8:]))
+	ptr.Length = int64(binary.LittleEndian.Uint64(value[unsafe.Sizeof(ValueTypeLog)+16:]))
+	return ptr
+}
+
+func ExtentValue(index int64, length int64) []byte {
+	v := EncodeExtent(index, length)
+	return v.Bytes()
+}
+
+func ValueGetExtent(value []byte) (int64, int64) {
+	return int64(binary.LittleEndian.Uint64(value[unsafe.Sizeof(ValueTypeExtent):])), int64(binary.LittleEndian.Uint64(value[unsafe.Sizeof(ValueTypeExtent)+8:]))
+}
+
+func TTLValueLen() int {
+	return int(unsafe.Sizeof(ValueTypeTTL)) + int(unsafe.Sizeof(int64(0)))
+}
+
+/* ValueGetTTL returns expiry of value and value it wraps. */
+func ValueGetTTL(value []byte) (int64, []byte) {
+	return int64(binary.LittleEndian.Uint64(value[unsafe.Sizeof(ValueTypeTTL):])), value[TTLValueLen():]
+}
+
+func SharedValueLen() int {
+	return int(unsafe.Sizeof(ValueTypeShared)) + ValueHashSize
+}
+
+/* ValueGetShared returns hash of value and value it wraps. */
+func ValueGetShared(value []byte) ([ValueHashSize]byte, []byte) {
+	var hash [ValueHashSize]byte
+	copy(hash[:], value[unsafe.Sizeof(ValueTypeShared):])
+	return hash, value[SharedValueLen():]
+}
+
 func ValueSetNext(value []byte, next int64) {
 	binary.LittleEndian.PutUint64(value[unsafe.Sizeof(ValueTypePartial):], uint64(next))
 }
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/anton2920/gofa/errors"
+	"github.com/anton2920/gofa/trace"
+)
+
+/* ValueLog is an append-only log of large values kept outside of tree pages, so that leaves store only small pointers to them. Log is split into segment files, each of them made of records: | key length (4 bytes) | value length (4 bytes) | key | value |. Key is stored to find out whether value is still live when segment is garbage collected. */
+type ValueLog struct {
+	Dir string
+
+	/* SegmentSize is a size after which new segment is started, 0 means 'ValueLogDefaultSegmentSize'. */
+	SegmentSize int64
+
+	Durability Durability
+
+	sync.Mutex
+	Segments map[int64]*os.File
+	Head     int64
+	HeadSize int64
+}
+
+/* ValueLogPointer is a location of value in 'ValueLog'. */
+type ValueLogPointer struct {
+	Segment int64
+	Offset  int64
+	Length  int64
+}
+
+var _ Syncer = new(ValueLog)
+
+const (
+	ValueLogDefaultSegmentSize = 64 * 1024 * 1024
+	ValueLogRecordHeaderSize   = 8
+
+	/* ValueLogMaxValueSize is the longest value which length fits into record header. Longer values are stored in tree. */
+	ValueLogMaxValueSize = math.MaxUint32
+)
+
+func ValueLogSegmentPath(dir string, segment int64) string {
+	return filepath.Join(dir, fmt.Sprintf("%08d.vlog", segment))
+}
+
+/* ValueLogOpen opens all segments of value log in 'dir', creating it if needed. */
+func ValueLogOpen(dir string) (*ValueLog, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create value log directory: %v", err)
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.vlog"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list value log segments: %v", err)
+	}
+
+	l := new(ValueLog)
+	l.Dir = dir
+	l.Segments = make(map[int64]*os.File)
+	for _, path := range paths {
+		var segment int64
+		if _, err := fmt.Sscanf(filepath.Base(path), "%08d.vlog", &segment); err != nil {
+			continue
+		}
+
+		f, err := os.OpenFile(path, os.O_RDWR, 0644)
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("failed to open value log segment: %v", err)
+		}
+		l.Segments[segment] = f
+
+		if segment > l.Head {
+			l.Head = segment
+		}
+	}
+
+	if l.Head == 0 {
+		if err := l.rotate(); err != nil {
+			return nil, err
+		}
+	} else {
+		info, err := l.Segments[l.Head].Stat()
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("failed to get size of value log segment: %v", err)
+		}
+		l.HeadSize = info.Size()
+	}
+
+	return l, nil
+}
+
+func (l *ValueLog) Close() {
+	l.Lock()
+	defer l.Unlock()
+
+	for _, f := range l.Segments {
+		f.Close()
+	}
+	l.Segments = nil
+}
+
+/* SegmentIDs returns IDs of all segments in ascending order. The last one is the one appended to. */
+func (l *ValueLog) SegmentIDs() []int64 {
+	l.Lock()
+	defer l.Unlock()
+
+	segments := make([]int64, 0, len(l.Segments))
+	for segment := range l.Segments {
+		segments = append(segments, segment)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+
+	return segments
+}
+
+/* Rotate starts new segment, so that all existing ones become immutable. */
+func (l *ValueLog) Rotate() error {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.rotate()
+}
+
+func (l *ValueLog) rotate() error {
+	if head, ok := l.Segments[l.Head]; ok {
+		if err := head.Sync(); err != nil {
+			return fmt.Errorf("failed to sync value log segment: %v", err)
+		}
+	}
+
+	f, err := os.OpenFile(ValueLogSegmentPath(l.Dir, l.Head+1), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create value log segment: %v", err)
+	}
+
+	l.Head++
+	l.HeadSize = 0
+	l.Segments[l.Head] = f
+
+	return nil
+}
+
+/* Append writes 'value' stored under 'key' to the end of log. */
+func (l *ValueLog) Append(key []byte, value []byte) (ValueLogPointer, error) {
+	defer trace.End(trace.Begin(""))
+
+	l.Lock()
+	defer l.Unlock()
+
+	segmentSize := l.SegmentSize
+	if segmentSize <= 0 {
+		segmentSize = ValueLogDefaultSegmentSize
+	}
+	if l.HeadSize >= segmentSize {
+		if err := l.rotate(); err != nil {
+			return ValueLogPointer{}, err
+		}
+	}
+
+	if int64(len(value)) > ValueLogMaxValueSize {
+		return ValueLogPointer{}, fmt.Errorf("value of %d bytes is too long for value log", len(value))
+	}
+
+	record := make([]byte, ValueLogRecordHeaderSize+len(key)+len(value))
+	binary.LittleEndian.PutUint32(record, uint32(len(key)))
+	binary.LittleEndian.PutUint32(record[4:], uint32(len(value)))
+	copy(record[ValueLogRecordHeaderSize:], key)
+	copy(record[ValueLogRecordHeaderSize+len(key):], value)
+
+	if _, err := l.Segments[l.Head].WriteAt(record, l.HeadSize); err != nil {
+		return ValueLogPointer{}, fmt.Errorf("failed to write to value log: %v", err)
+	}
+	ptr := ValueLogPointer{Segment: l.Head, Offset: l.HeadSize + ValueLogRecordHeaderSize + int64(len(key)), Length: int64(len(value))}
+	l.HeadSize += int64(len(record))
+
+	return ptr, nil
+}
+
+/* AppendFrom writes 'size' bytes read from 'r' stored under 'key' to the end of log, without keeping the whole value in memory. */
+func (l *ValueLog) AppendFrom(key []byte, r io.Reader, size int64) (ValueLogPointer, error) {
+	defer trace.End(trace.Begin(""))
+
+	l.Lock()
+	defer l.Unlock()
+
+	if size > ValueLogMaxValueSize {
+		return ValueLogPointer{}, fmt.Errorf("value of %d bytes is too long for value log", size)
+	}
+
+	segmentSize := l.SegmentSize
+	if segmentSize <= 0 {
+		segmentSize = ValueLogDefaultSegmentSize
+	}
+	if l.HeadSize >= segmentSize {
+		if err := l.rotate(); err != nil {
+			return ValueLogPointer{}, err
+		}
+	}
+
+	header := make([]byte, ValueLogRecordHeaderSize+len(key))
+	binary.LittleEndian.PutUint32(header, uint32(len(key)))
+	binary.LittleEndian.PutUint32(header[4:], uint32(size))
+	copy(header[ValueLogRecordHeaderSize:], key)
+
+	f := l.Segments[l.Head]
+	if _, err := f.WriteAt(header, l.HeadSize); err != nil {
+		return ValueLogPointer{}, fmt.Errorf("failed to write to value log: %v", err)
+	}
+	offset := l.HeadSize + int64(len(header))
+	if n, err := io.Copy(&offsetWriter{File: f, Offset: offset}, io.LimitReader(r, size)); err != nil {
+		return ValueLogPointer{}, fmt.Errorf("failed to write to value log: %v", err)
+	} else if n != size {
+		return ValueLogPointer{}, fmt.Errorf("failed to write to value log: %v", io.ErrUnexpectedEOF)
+	}
+	/* NOTE(anton2920): head size is updated only after the whole record is written, so failed append is overwritten by the next one. */
+	l.HeadSize = offset + size
+
+	return ValueLogPointer{Segment: l.Head, Offset: offset, Length: size}, nil
+}
+
+/* offsetWriter writes to 'File' one chunk after another, starting at 'Offset'. */
+type offsetWriter struct {
+	File   *os.File
+	Offset int64
+}
+
+func (w *offsetWriter) Write(buf []byte) (int, error) {
+	n, err := w.File.WriteAt(buf, w.Offset)
+	w.Offset += int64(n)
+	return n, err
+}
+
+/* HasSegment returns whether 'segment' exists, i.e. it has not been removed after garbage collection. */
+func (l *ValueLog) HasSegment(segment int64) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	_, ok := l.Segments[segment]
+	return ok
+}
+
+/* AppendValue appends value 'ptr' points to to 'buf'. */
+func (l *ValueLog) AppendValue(buf []byte, ptr ValueLogPointer) ([]byte, error) {
+	defer trace.End(trace.Begin(""))
+
+	l.Lock()
+	f, ok := l.Segments[ptr.Segment]
+	l.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("value log segment %d does not exist", ptr.Segment)
+	}
+
+	n := len(buf)
+	buf = append(buf, make([]byte, ptr.Length)...)
+	if _, err := f.ReadAt(buf[n:], ptr.Offset); err != nil {
+		return nil, fmt.Errorf("failed to read from value log: %v", err)
+	}
+	return buf, nil
+}
+
+/* Scan calls 'fn' for every record in 'segment'. */
+func (l *ValueLog) Scan(segment int64, fn func(key []byte, ptr ValueLogPointer) error) error {
+	var header [ValueLogRecordHeaderSize]byte
+	var offset int64
+
+	l.Lock()
+	f, ok := l.Segments[segment]
+	l.Unlock()
+	if !ok {
+		return fmt.Errorf("value log segment %d does not exist", segment)
+	}
+
+	for {
+		if _, err := f.ReadAt(header[:], offset); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read value log record: %v", err)
+		}
+		keyLength := int64(binary.LittleEndian.Uint32(header[:]))
+		valueLength := int64(binary.LittleEndian.Uint32(header[4:]))
+
+		key := make([]byte, keyLength)
+		if _, err := f.ReadAt(key, offset+ValueLogRecordHeaderSize); err != nil {
+			return fmt.Errorf("failed to read value log record key: %v", err)
+		}
+		if err := fn(key, ValueLogPointer{Segment: segment, Offset: offset + ValueLogRecordHeaderSize + keyLength, Length: valueLength}); err != nil {
+			return err
+		}
+
+		offset += ValueLogRecordHeaderSize + keyLength + valueLength
+	}
+}
+
+/* Remove deletes 'segment', which must not be the one appended to. */
+func (l *ValueLog) Remove(segment int64) error {
+	l.Lock()
+	defer l.Unlock()
+
+	if segment == l.Head {
+		return fmt.Errorf("cannot remove value log segment %d which is appended to", segment)
+	}
+
+	f, ok := l.Segments[segment]
+	if !ok {
+		return fmt.Errorf("value log segment %d does not exist", segment)
+	}
+	f.Close()
+	delete(l.Segments, segment)
+
+	if err := os.Remove(ValueLogSegmentPath(l.Dir, segment)); err != nil {
+		return fmt.Errorf("failed to remove value log segment: %v", err)
+	}
+	return nil
+}
+
+/* Sync makes all previous appends durable according to 'd' or, if it is 'DurabilityDefault', to 'l.Durability'. */
+func (l *ValueLog) Sync(d Durability) error {
+	defer trace.End(trace.Begin(""))
+
+	if d == DurabilityDefault {
+		d = l.Durability
+	}
+
+	switch d {
+	case DurabilityDefault, DurabilityNone:
+		return nil
+	case DurabilitySync, DurabilityGroup:
+		/* NOTE(anton2920): all segments but head are synced before they become immutable. */
+		l.Lock()
+		f := l.Segments[l.Head]
+		l.Unlock()
+
+		if err := f.Sync(); err != nil {
+			return fmt.Errorf("failed to sync value log: %v", err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown durability level %d", d)
+	}
+}
+
+/* CollectValueLog moves values in 'segment' which are still referenced by tree to the head of log and removes 'segment'. It returns number of moved values. */
+func (t *Tree) CollectValueLog(segment int64) (int, error) {
+	defer trace.End(trace.Begin(""))
+
+	t.Lock()
+	defer t.Unlock()
+
+	if t.ValueLog == nil {
+		return 0, errors.New("tree has no value log")
+	}
+
+	t.ValueLog.Lock()
+	head := t.ValueLog.Head
+	t.ValueLog.Unlock()
+	if segment == head {
+		if err := t.ValueLog.Rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	var buffer []byte
+	var moved int
+	err := t.ValueLog.Scan(segment, func(key []byte, ptr ValueLogPointer) error {
+		value, err := t.getRaw(key)
+		if err != nil {
+			return err
+		}
+		if (value == nil) || (ValueGetType(value) != ValueTypeLog) || (ValueGetLog(value) != ptr) {
+			return nil
+		}
+
+		buffer, err = t.ValueLog.AppendValue(buffer[:0], ptr)
+		if err != nil {
+			return err
+		}
+		ptr, err = t.ValueLog.Append(key, buffer)
+		if err != nil {
+			return fmt.Errorf("failed to append value to log: %v", err)
+		}
+		if err := t.update(key, func(leaf *Leaf, old []byte) (EncodedValue, []byte, error) {
+			v := EncodeLog(ptr)
+			if (old != nil) && (ValueGetType(old) == ValueTypeTTL) {
+				expiry, _ := ValueGetTTL(old)
+				v = EncodeTTL(v, expiry)
+			}
+			return v, buffer, nil
+		}); err != nil {
+			return err
+		}
+		moved++
+
+		return nil
+	})
+	if err != nil {
+		return moved, fmt.Errorf("failed to collect value log segment %d: %v", segment, err)
+	}
+
+	if err := t.writeMeta(); err != nil {
+		return moved, err
+	}
+	/* NOTE(anton2920): pointers to new locations must be durable before old values are gone. */
+	if err := t.ValueLog.Sync(DurabilitySync); err != nil {
+		return moved, err
+	}
+	if syncer, ok := t.Pager.(Syncer); ok {
+		if err := syncer.Sync(DurabilitySync); err != nil {
+			return moved, fmt.Errorf("failed to sync tree: %v", err)
+		}
+	}
+
+	return moved, t.ValueLog.Remove(segment)
+}